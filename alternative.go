@@ -0,0 +1,56 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// htmlDropPattern matches elements whose content is not text
+	htmlDropPattern = regexp.MustCompile(`(?is)<(script|style|head|title)\b[^>]*>.*?</(script|style|head|title)\s*>|<!--.*?-->`)
+	// htmlLinkPattern matches links, whose target is kept after the label
+	htmlLinkPattern = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')[^>]*>(.*?)</a\s*>`)
+	// htmlBreakPattern matches tags that start or end a line of text
+	htmlBreakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</?(p|div|ul|ol|li|tr|h[1-6]|blockquote|table)\b[^>]*>`)
+	htmlTagPattern   = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinePattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText renders the text of an HTML body for AUTO_ALTERNATIVE: markup
+// is stripped, block boundaries become line breaks and links keep their
+// target as "label (url)". It is meant as a readable fallback, not a
+// faithful render.
+func htmlToText(value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = htmlDropPattern.ReplaceAllString(value, "")
+	value = htmlLinkPattern.ReplaceAllStringFunc(value, func(match string) string {
+		m := htmlLinkPattern.FindStringSubmatch(match)
+		target := strings.TrimSpace(m[1] + m[2])
+		label := strings.TrimSpace(htmlTagPattern.ReplaceAllString(m[3], ""))
+		if target == "" || strings.HasPrefix(target, "#") || html.UnescapeString(label) == html.UnescapeString(target) {
+			return label
+		}
+		return label + " (" + target + ")"
+	})
+	value = htmlBreakPattern.ReplaceAllString(value, "$0\n")
+	value = htmlTagPattern.ReplaceAllString(value, "")
+	value = html.UnescapeString(value)
+
+	// Source indentation and line breaks mean nothing in HTML
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	value = blankLinePattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(value) + "\n"
+}
+
+// textToHTML wraps a plain text body in minimal HTML for AUTO_ALTERNATIVE,
+// escaping it and keeping its line breaks
+func textToHTML(value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.TrimRight(value, "\n")
+	escaped := strings.ReplaceAll(html.EscapeString(value), "\n", "<br>\n")
+	return "<html><body><div>" + escaped + "</div></body></html>\n"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<p>Hola</p><p>Mundo</p>", "Hola\n\nMundo\n"},
+		{"<html><head><title>Factura</title><style>p{color:red}</style></head><body><p>Total: 100 MXN &amp; IVA</p></body></html>", "Total: 100 MXN & IVA\n"},
+		{`Ver <a href="https://conta-cloud.mx/f/1">la factura</a>`, "Ver la factura (https://conta-cloud.mx/f/1)\n"},
+		{`<a href="https://conta-cloud.mx">https://conta-cloud.mx</a>`, "https://conta-cloud.mx\n"},
+		{`<a href="#top">Arriba</a>`, "Arriba\n"},
+		{"Uno<br>Dos<br/>Tres<!-- oculto -->", "Uno\nDos\nTres\n"},
+		{"<ul>\n  <li>  a  </li>\n  <li>b</li>\n</ul><script>alert(1)</script>", "a\n\nb\n"},
+	}
+	for _, tt := range tests {
+		if got := htmlToText(tt.html); got != tt.want {
+			t.Errorf("htmlToText(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+func TestTextToHTML(t *testing.T) {
+	got := textToHTML("Total <100> & más\r\nGracias\r\n")
+	want := "<html><body><div>Total &lt;100&gt; &amp; más<br>\nGracias</div></body></html>\n"
+	if got != want {
+		t.Errorf("textToHTML = %q, want %q", got, want)
+	}
+}
+
+func TestSendGridAutoAlternative(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		raw      string
+		wantText string
+		wantHTML string
+		noText   bool
+		noHTML   bool
+	}{
+		{"html only", map[string]string{"AUTO_ALTERNATIVE": "true"},
+			"From: app@example.com\nSubject: Hi\nContent-Type: text/html; charset=utf-8\n\n<p>Hola <b>Ana</b></p>\n",
+			"Hola Ana\n", "<p>Hola <b>Ana</b></p>", false, false},
+		{"text only", map[string]string{"AUTO_ALTERNATIVE": "true"},
+			"From: app@example.com\nSubject: Hi\nContent-Type: text/plain; charset=utf-8\n\nHola <Ana>\n",
+			"Hola <Ana>", "<div>Hola &lt;Ana&gt;</div>", false, false},
+		{"multipart html only", map[string]string{"AUTO_ALTERNATIVE": "true"},
+			"From: app@example.com\nSubject: Hi\nMIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+				"--b1\nContent-Type: text/html; charset=utf-8\n\n<p>Adjunto</p>\n--b1--\n",
+			"Adjunto\n", "<p>Adjunto</p>", false, false},
+		{"both present", map[string]string{"AUTO_ALTERNATIVE": "true"},
+			multipartMessage("Texto propio", "<p>HTML propio</p>"),
+			"Texto propio", "<p>HTML propio</p>", false, false},
+		{"disabled", nil,
+			"From: app@example.com\nSubject: Hi\nContent-Type: text/html; charset=utf-8\n\n<p>Hola</p>\n",
+			"", "<p>Hola</p>", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := sendGridPayload(t, tt.env, tt.raw)
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			text, hasText := contentValue(body, "text/plain")
+			html, hasHTML := contentValue(body, "text/html")
+			if hasText == tt.noText || hasHTML == tt.noHTML {
+				t.Fatalf("content = %v, want text %v and html %v", jsonPath(body, "content"), !tt.noText, !tt.noHTML)
+			}
+			if !strings.Contains(text, tt.wantText) || !strings.Contains(html, tt.wantHTML) {
+				t.Errorf("text = %q, html = %q, want %q and %q", text, html, tt.wantText, tt.wantHTML)
+			}
+			// SendGrid requires text/plain first
+			if first, _ := jsonPath(body, "content", 0, "type").(string); hasText && hasHTML && !strings.HasPrefix(first, "text/plain") {
+				t.Errorf("content order = %v", jsonPath(body, "content"))
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// apiSlots caps the concurrent calls to an upstream API, independently of
+// how many SMTP sessions or send workers are running. A nil apiSlots has no
+// cap.
+type apiSlots chan struct{}
+
+// newAPISlots returns nil when max is 0, which disables the cap
+func newAPISlots(max int) apiSlots {
+	if max <= 0 {
+		return nil
+	}
+	return make(apiSlots, max)
+}
+
+// acquire takes a slot, waiting for one to be released or for ctx to end.
+// Calls that had to wait show up in smtp_relay_sendgrid_api_waiting and
+// smtp_relay_sendgrid_api_wait_seconds.
+func (s apiSlots) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	sendGridAPIWaiting.Inc()
+	defer func() {
+		sendGridAPIWaiting.Dec()
+		sendGridAPIWait.Observe(time.Since(start).Seconds())
+	}()
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns a slot taken by acquire
+func (s apiSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitAPIWaiting waits until want more SendGrid calls wait for a slot than
+// before
+func waitAPIWaiting(t *testing.T, before, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(sendGridAPIWaiting)-before != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v calls waiting for a slot, want %v", testutil.ToFloat64(sendGridAPIWaiting)-before, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSendGridMaxConcurrency(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"SENDGRID_MAX_CONCURRENCY": "1"})
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	proceed := make(chan struct{})
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		<-proceed
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	waiting := testutil.ToFloat64(sendGridAPIWaiting)
+	waited, _ := histogramSamples(t, sendGridAPIWait)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org"))
+			errs <- err
+		}()
+	}
+
+	// One call reaches SendGrid, the others queue for its slot
+	waitAPIWaiting(t, waiting, 2)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.Requests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no send reached SendGrid")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		proceed <- struct{}{}
+		if err := <-errs; err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	if maxInFlight != 1 {
+		t.Errorf("%d concurrent SendGrid calls, want 1", maxInFlight)
+	}
+	if got := len(stub.Requests()); got != 3 {
+		t.Errorf("SendGrid got %d requests, want 3", got)
+	}
+	waitAPIWaiting(t, waiting, 0)
+	if got, _ := histogramSamples(t, sendGridAPIWait); got-waited != 2 {
+		t.Errorf("smtp_relay_sendgrid_api_wait_seconds observed %d waits, want 2", got-waited)
+	}
+}
+
+func TestSendGridMaxConcurrencyTimeout(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"SENDGRID_MAX_CONCURRENCY": "1", "SENDGRID_TIMEOUT": "100ms"})
+
+	// The only slot is taken, as by a call in progress
+	if err := relay.slots.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.slots.release()
+	waiting := testutil.ToFloat64(sendGridAPIWaiting)
+
+	// Waiting for the slot counts against SENDGRID_TIMEOUT
+	_, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org"))
+	if smtpCode(err) != 451 || !isTemporary(err) {
+		t.Fatalf("send waiting past the timeout: err = %v, want a temporary 451", err)
+	}
+	if got := len(stub.Requests()); got != 0 {
+		t.Errorf("SendGrid got %d requests from a send without a slot", got)
+	}
+	waitAPIWaiting(t, waiting, 0)
+}
+
+func TestAPISlotsUnlimited(t *testing.T) {
+	slots := newAPISlots(0)
+	if slots != nil {
+		t.Fatalf("newAPISlots(0) = %v, want no cap", slots)
+	}
+	for i := 0; i < 100; i++ {
+		if err := slots.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slots.release()
+
+	if _, err := tryConfig(t, map[string]string{"SENDGRID_MAX_CONCURRENCY": "many"}); err == nil {
+		t.Error("non-numeric SENDGRID_MAX_CONCURRENCY was accepted")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"strings"
+)
+
+// attachment is a MIME part forwarded to SendGrid as an attachment. The
+// content is base64-encoded while the part is read, and once the encoded form
+// grows past ATTACHMENT_SPILL_BYTES it goes to a temp file instead of memory.
+type attachment struct {
+	Filename    string
+	Type        string
+	Disposition string
+	ContentID   string
+
+	spillBytes int
+	buf        bytes.Buffer
+	file       *os.File
+	size       int64 // encoded bytes
+}
+
+// calendarFilename names a text/calendar part that has no filename
+const calendarFilename = "invite.ics"
+
+// readAttachment decodes part's transfer encoding and base64-encodes it on
+// the fly. Quoted-printable parts are already decoded by mime/multipart.
+func readAttachment(part *multipart.Part, spillBytes int) (*attachment, error) {
+	contentType := part.Header.Get("Content-Type")
+	mediaType, params := parseContentType(contentType)
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+
+	a := &attachment{
+		Filename:    part.FileName(),
+		Type:        mediaType,
+		Disposition: "attachment",
+		ContentID:   strings.Trim(part.Header.Get("Content-Id"), "<> "),
+		spillBytes:  spillBytes,
+	}
+	if mediaType == "text/calendar" {
+		// Calendar clients tell an invite from a reply or cancellation by
+		// the method, so it stays on the type
+		if method := params["method"]; method != "" {
+			a.Type += "; method=" + strings.ToUpper(method)
+		}
+		if a.Filename == "" {
+			a.Filename = calendarFilename
+		}
+	}
+	if a.Filename == "" {
+		a.Filename = "attachment"
+	}
+	if disposition == "inline" && a.ContentID != "" {
+		a.Disposition = "inline"
+	}
+
+	var src io.Reader = part
+	if strings.EqualFold(strings.TrimSpace(part.Header.Get("Content-Transfer-Encoding")), "base64") {
+		src = base64.NewDecoder(base64.StdEncoding, part)
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, a)
+	if _, err := io.Copy(enc, src); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to read attachment %q: %w", a.Filename, err)
+	}
+	if err := enc.Close(); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to encode attachment %q: %w", a.Filename, err)
+	}
+	return a, nil
+}
+
+// newAttachment builds an attachment from content already in memory
+func newAttachment(filename, contentType string, content []byte, spillBytes int) (*attachment, error) {
+	a := &attachment{
+		Filename:    filename,
+		Type:        contentType,
+		Disposition: "attachment",
+		spillBytes:  spillBytes,
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, a)
+	if _, err := enc.Write(content); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to encode attachment %q: %w", filename, err)
+	}
+	if err := enc.Close(); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to encode attachment %q: %w", filename, err)
+	}
+	return a, nil
+}
+
+// Write stores encoded content, moving it to a temp file once it exceeds the
+// spill threshold
+func (a *attachment) Write(p []byte) (int, error) {
+	if a.file == nil && a.spillBytes > 0 && a.buf.Len()+len(p) > a.spillBytes {
+		f, err := os.CreateTemp("", "smtp-relay-attachment-*")
+		if err != nil {
+			return 0, err
+		}
+		a.file = f
+		if _, err := f.Write(a.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		a.buf = bytes.Buffer{}
+		logDebug("Spilled attachment %q to %s", a.Filename, f.Name())
+	}
+
+	a.size += int64(len(p))
+	if a.file != nil {
+		return a.file.Write(p)
+	}
+	return a.buf.Write(p)
+}
+
+// content returns a reader over the base64-encoded content
+func (a *attachment) content() (io.Reader, error) {
+	if a.file == nil {
+		return bytes.NewReader(a.buf.Bytes()), nil
+	}
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return a.file, nil
+}
+
+// Close removes the temp file, if any
+func (a *attachment) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	a.file.Close()
+	return os.Remove(a.file.Name())
+}
+
+func closeAttachments(attachments []*attachment) {
+	for _, a := range attachments {
+		if err := a.Close(); err != nil {
+			logWarn("Failed to remove attachment temp file: %v", err)
+		}
+	}
+}
+
+// observeAttachments records the attachment count and sizes of a message
+func observeAttachments(attachments []*attachment) {
+	var total int64
+	for _, a := range attachments {
+		attachmentSize.Observe(float64(a.size))
+		total += a.size
+	}
+	messageAttachments.Observe(float64(len(attachments)))
+	logDebug("Message has %d attachments (%d bytes encoded)", len(attachments), total)
+}
+
+// requestBody serializes message for the SendGrid API. Attachments are
+// streamed into the JSON rather than added to message, so their content is
+// never held in memory as one string.
+func requestBody(message []byte, attachments []*attachment) (io.Reader, int64, error) {
+	if len(attachments) == 0 {
+		return bytes.NewReader(message), int64(len(message)), nil
+	}
+
+	var readers []io.Reader
+	var size int64
+	add := func(r io.Reader, n int64) {
+		readers = append(readers, r)
+		size += n
+	}
+	addBytes := func(b []byte) {
+		add(bytes.NewReader(b), int64(len(b)))
+	}
+
+	// Reopen the serialized message to append the attachments array
+	addBytes(bytes.TrimSuffix(bytes.TrimSpace(message), []byte("}")))
+	addBytes([]byte(`,"attachments":[`))
+	for i, a := range attachments {
+		if i > 0 {
+			addBytes([]byte(","))
+		}
+		meta, err := json.Marshal(struct {
+			Type        string `json:"type"`
+			Filename    string `json:"filename"`
+			Disposition string `json:"disposition"`
+			ContentID   string `json:"content_id,omitempty"`
+		}{a.Type, a.Filename, a.Disposition, a.ContentID})
+		if err != nil {
+			return nil, 0, err
+		}
+		content, err := a.content()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		addBytes([]byte(`{"content":"`))
+		add(content, a.size)
+		addBytes([]byte(`",`))
+		addBytes(meta[1:])
+	}
+	addBytes([]byte("]}"))
+
+	return io.MultiReader(readers...), size, nil
+}
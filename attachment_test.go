@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+// attachmentMessage builds a multipart/mixed message with a text body and
+// content as a base64 attachment named report.bin
+func attachmentMessage(content []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	return "From: app@example.com\nSubject: Report\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain\n\nSee attached\n" +
+		"--b1\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"report.bin\"\nContent-Transfer-Encoding: base64\n\n" +
+		strings.Join(lines, "\n") + "\n" +
+		"--b1--\n"
+}
+
+// readTestPart returns the attachment part of attachmentMessage(content)
+func readTestPart(t *testing.T, content []byte) *multipart.Part {
+	t.Helper()
+	raw := strings.ReplaceAll(attachmentMessage(content), "\n", "\r\n")
+	_, body, _ := strings.Cut(raw, "\r\n\r\n")
+	mr := multipart.NewReader(strings.NewReader(body), "b1")
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return part
+}
+
+// tempFiles lists the entries of dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReadAttachmentSpillsToTempFile(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	content := randomBytes(t, 256*1024)
+
+	a, err := readAttachment(readTestPart(t, content), 16*1024)
+	if err != nil {
+		t.Fatalf("readAttachment: %v", err)
+	}
+	if a.file == nil {
+		t.Fatal("attachment over the threshold was kept in memory")
+	}
+	if a.buf.Len() != 0 {
+		t.Errorf("%d bytes still buffered after the spill", a.buf.Len())
+	}
+	if files := tempFiles(t, tmp); len(files) != 1 || !strings.HasPrefix(files[0], "smtp-relay-attachment-") {
+		t.Errorf("temp files = %v, want one spill file", files)
+	}
+	if a.Filename != "report.bin" || a.Type != "application/octet-stream" {
+		t.Errorf("attachment = %q %q", a.Filename, a.Type)
+	}
+
+	r, err := a.content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString(content); string(encoded) != want || a.size != int64(len(want)) {
+		t.Errorf("spilled content does not round-trip (%d bytes, size %d, want %d)", len(encoded), a.size, len(want))
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := tempFiles(t, tmp); len(files) != 0 {
+		t.Errorf("temp files after Close = %v", files)
+	}
+}
+
+func TestReadAttachmentBelowThresholdStaysInMemory(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	content := []byte("small attachment")
+	a, err := readAttachment(readTestPart(t, content), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.file != nil {
+		t.Error("small attachment was spilled")
+	}
+	if a.buf.String() != base64.StdEncoding.EncodeToString(content) {
+		t.Errorf("content = %q", a.buf.String())
+	}
+}
+
+func TestSendGridLargeAttachment(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	content := randomBytes(t, 512*1024)
+
+	body, err := sendGridPayload(t, map[string]string{"ATTACHMENT_SPILL_BYTES": "4096"}, attachmentMessage(content))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if jsonLen(body, "attachments") != 1 {
+		t.Fatalf("attachments = %v, want one", jsonLen(body, "attachments"))
+	}
+	got, _ := jsonPath(body, "attachments", 0, "content").(string)
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	if err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("attachment content does not match the original (%d bytes, err %v)", len(decoded), err)
+	}
+	if jsonPath(body, "attachments", 0, "filename") != "report.bin" {
+		t.Errorf("attachment = %v", jsonPath(body, "attachments", 0))
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "See attached") {
+		t.Errorf("text = %q", text)
+	}
+	if files := tempFiles(t, tmp); len(files) != 0 {
+		t.Errorf("spill files left after the send: %v", files)
+	}
+}
+
+func TestRequestBodyStreamsAttachments(t *testing.T) {
+	a, err := newAttachment("a.txt", "text/plain", []byte("hello"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	r, size, err := requestBody([]byte(`{"subject":"Hi"}`), []*attachment{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"subject":"Hi","attachments":[{"content":"aGVsbG8=","type":"text/plain","filename":"a.txt","disposition":"attachment"}]}`
+	if string(got) != want || size != int64(len(want)) {
+		t.Errorf("body = %s (size %d), want %s", got, size, want)
+	}
+}
+
+// attachmentsMessage builds a multipart/mixed message with one
+// file<i>.bin attachment of each given size, before base64 encoding
+func attachmentsMessage(sizes ...int) string {
+	var b strings.Builder
+	b.WriteString("From: app@example.com\nSubject: Files\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain\n\nSee attached\n")
+	for i, size := range sizes {
+		fmt.Fprintf(&b, "--b1\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"file%d.bin\"\nContent-Transfer-Encoding: base64\n\n", i)
+		encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i)}, size))
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\n")
+	}
+	b.WriteString("--b1--\n")
+	return b.String()
+}
+
+// attachmentNames returns the filenames of the attachments in a SendGrid
+// request body
+func attachmentNames(body map[string]any) string {
+	var names []string
+	for i := 0; i < jsonLen(body, "attachments"); i++ {
+		name, _ := jsonPath(body, "attachments", i, "filename").(string)
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	// 3000 bytes are 4000 once encoded
+	tests := []struct {
+		name  string
+		env   map[string]string
+		sizes []int
+		want  string // attachments sent, or the error
+	}{
+		{"within limits", map[string]string{"MAX_ATTACHMENTS": "3", "MAX_TOTAL_ATTACHMENT_BYTES": "12000"}, []int{3000, 3000, 3000}, "file0.bin,file1.bin,file2.bin"},
+		{"count truncated", map[string]string{"MAX_ATTACHMENTS": "2"}, []int{3000, 3000, 3000}, "file0.bin,file1.bin"},
+		{"count rejected", map[string]string{"MAX_ATTACHMENTS": "2", "OVERSIZE_POLICY": "reject"}, []int{3000, 3000, 3000}, errTooManyAttachments.Error()},
+		{"size truncated", map[string]string{"MAX_TOTAL_ATTACHMENT_BYTES": "10000"}, []int{3000, 3000, 300, 3000}, "file0.bin,file1.bin,file2.bin"},
+		{"size rejected", map[string]string{"MAX_TOTAL_ATTACHMENT_BYTES": "10000", "OVERSIZE_POLICY": "reject"}, []int{3000, 3000, 3000}, errAttachmentsTooLarge.Error()},
+		{"size disabled", map[string]string{"MAX_TOTAL_ATTACHMENT_BYTES": "0"}, []int{3000, 3000, 3000}, "file0.bin,file1.bin,file2.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			env := map[string]string{"ATTACHMENT_SPILL_BYTES": "1024", "OVERSIZE_POLICY": "", "MAX_ATTACHMENTS": "", "MAX_TOTAL_ATTACHMENT_BYTES": ""}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			body, err := sendGridPayload(t, env, attachmentsMessage(tt.sizes...))
+			got := ""
+			if err != nil {
+				got = err.Error()
+			} else {
+				got = attachmentNames(body)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if err != nil && smtpCode(err) != 552 {
+				t.Errorf("err = %v, want a 552", err)
+			}
+			if files := tempFiles(t, tmp); len(files) != 0 {
+				t.Errorf("spill files left: %v", files)
+			}
+		})
+	}
+}
+
+func TestAttachmentLimitDefault(t *testing.T) {
+	if config := testConfig(t, map[string]string{"MAX_TOTAL_ATTACHMENT_BYTES": ""}); config.MaxAttachmentBytes != 30*1024*1024 || config.MaxAttachments != 0 {
+		t.Errorf("limits = %d attachments, %d bytes, want unlimited and SendGrid's 30 MB", config.MaxAttachments, config.MaxAttachmentBytes)
+	}
+}
+
+const calendarInvite = "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nBEGIN:VEVENT\r\nSUMMARY:Cierre mensual\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+func TestSendGridCalendarInvite(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Invitation\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: multipart/alternative; boundary=\"b2\"\n\n" +
+		"--b2\nContent-Type: text/plain; charset=utf-8\n\nYou are invited\n" +
+		"--b2\nContent-Type: text/html; charset=utf-8\n\n<p>You are invited</p>\n" +
+		"--b2\nContent-Type: text/calendar; charset=utf-8; method=request\n\n" + calendarInvite +
+		"--b2--\n" +
+		"--b1\nContent-Type: text/calendar; method=CANCEL\nContent-Disposition: attachment; filename=\"old.ics\"\n\n" +
+		strings.Replace(calendarInvite, "REQUEST", "CANCEL", 1) +
+		"--b1--\n"
+	body, err := sendGridPayload(t, nil, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "You are invited") {
+		t.Errorf("text = %q", text)
+	}
+	if got := attachmentNames(body); got != "invite.ics,old.ics" {
+		t.Fatalf("attachments = %s, want both calendar parts", got)
+	}
+	for i, want := range []string{"text/calendar; method=REQUEST", "text/calendar; method=CANCEL"} {
+		if got := jsonPath(body, "attachments", i, "type"); got != want {
+			t.Errorf("attachments[%d].type = %v, want %s", i, got, want)
+		}
+	}
+	content, _ := jsonPath(body, "attachments", 0, "content").(string)
+	decoded, err := base64.StdEncoding.DecodeString(content)
+	if err != nil || !strings.Contains(string(decoded), "SUMMARY:Cierre mensual") {
+		t.Errorf("invite content = %q, %v", decoded, err)
+	}
+}
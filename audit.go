@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Stable reason codes for rejected transactions, so alerts can match on them
+const (
+	reasonTooBusy              = "TOO_BUSY"
+	reasonConnectionLimit      = "CONNECTION_LIMIT"
+	reasonAuthFailed           = "AUTH_FAILED"
+	reasonAuthRequired         = "AUTH_REQUIRED"
+	reasonClientCertRequired   = "CLIENT_CERT_REQUIRED"
+	reasonSenderNotAllowed     = "SENDER_NOT_ALLOWED"
+	reasonQuotaExceeded        = "QUOTA_EXCEEDED"
+	reasonRecipientLimit       = "RECIPIENT_LIMIT"
+	reasonGreylisted           = "GREYLISTED"
+	reasonRecipientNotAllowed  = "RECIPIENT_NOT_ALLOWED"
+	reasonSuppressed           = "SUPPRESSED"
+	reasonNoRecipients         = "NO_RECIPIENTS"
+	reasonDataTimeout          = "DATA_TIMEOUT"
+	reasonReadFailed           = "READ_FAILED"
+	reasonClientDisconnected   = "CLIENT_DISCONNECTED"
+	reasonHeaderTooLarge       = "HEADER_TOO_LARGE"
+	reasonTooManyHeaders       = "TOO_MANY_HEADERS"
+	reasonParseFailed          = "PARSE_FAILED"
+	reasonHeaderFromNotAllowed = "HEADER_FROM_NOT_ALLOWED"
+	reasonSenderNotAligned     = "SENDER_NOT_ALIGNED"
+	reasonDuplicateMessage     = "DUPLICATE_MESSAGE"
+	reasonSignFailed           = "SIGN_FAILED"
+	reasonInvalidMessage       = "INVALID_MESSAGE"
+	reasonMessageTooLarge      = "MESSAGE_TOO_LARGE"
+	reasonQueueFull            = "QUEUE_FULL"
+	reasonInflightLimit        = "INFLIGHT_LIMIT"
+	reasonUpstreamTimeout      = "UPSTREAM_TIMEOUT"
+	reasonSendFailed           = "SEND_FAILED"
+	reasonRecipientRejected    = "RECIPIENT_REJECTED"
+)
+
+// auditRejection logs a rejected command in one parseable format
+func auditRejection(phase, reason, remoteAddr, from string, to []string, detail string) {
+	logWarn("Rejected phase=%s reason=%s remote=%s from=%s to=%v detail=%q",
+		phase, reason, remoteAddr, from, to, detail)
+}
+
+// audit logs a rejection for the current transaction
+func (s *Session) audit(phase, reason, detail string) {
+	auditRejection(phase, reason, s.remoteAddr, s.from, s.to, detail)
+}
+
+// sendFailureReason classifies an error returned while handing a message to
+// the backend
+func sendFailureReason(err error) string {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return reasonSendFailed
+	}
+	switch smtpErr.EnhancedCode {
+	case smtp.EnhancedCode{5, 6, 0}:
+		return reasonInvalidMessage
+	case smtp.EnhancedCode{5, 3, 4}:
+		return reasonMessageTooLarge
+	case smtp.EnhancedCode{4, 3, 1}:
+		return reasonQueueFull
+	case smtp.EnhancedCode{4, 4, 1}:
+		return reasonUpstreamTimeout
+	default:
+		return reasonSendFailed
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestAuditRejectionReasons(t *testing.T) {
+	valid := "From: app@example.com\nTo: user@example.org\nSubject: Hi\nMessage-ID: <audit@example.com>\n\nHello\n"
+	tests := []struct {
+		name     string
+		env      map[string]string
+		from     string
+		to       []string
+		raw      string
+		relayErr error
+		want     string
+	}{
+		{"sender", map[string]string{"ALLOWED_SENDERS": "example.com"}, "app@example.net", nil, valid, nil, "phase=MAIL reason=SENDER_NOT_ALLOWED remote=192.0.2.1:1234 from=app@example.net"},
+		{"recipient", map[string]string{"DENIED_RECIPIENTS": "example.org"}, "app@example.com", []string{"user@example.org"}, valid, nil, "phase=RCPT reason=RECIPIENT_NOT_ALLOWED remote=192.0.2.1:1234 from=app@example.com"},
+		{"session recipients", map[string]string{"MAX_SESSION_RECIPIENTS": "1"}, "app@example.com", []string{"a@example.org", "b@example.org"}, valid, nil, "phase=RCPT reason=RECIPIENT_LIMIT"},
+		{"parse", nil, "app@example.com", []string{"user@example.org"}, "not a header\n\nHello\n", nil, "phase=DATA reason=PARSE_FAILED"},
+		{"header from", map[string]string{"ALLOWED_SENDERS": "example.com", "VALIDATE_HEADER_FROM": "true"}, "app@example.com", []string{"user@example.org"}, "From: app@example.net\n\nHello\n", nil, "phase=DATA reason=HEADER_FROM_NOT_ALLOWED"},
+		{"header limit", map[string]string{"MAX_HEADER_COUNT": "2"}, "app@example.com", []string{"user@example.org"}, valid, nil, "phase=DATA reason=TOO_MANY_HEADERS"},
+		{"invalid message", nil, "app@example.com", []string{"user@example.org"}, valid, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Bad"}, "phase=DATA reason=INVALID_MESSAGE"},
+		{"send failed", nil, "app@example.com", []string{"user@example.org"}, valid, errors.New("connection reset"), "phase=DATA reason=SEND_FAILED remote=192.0.2.1:1234 from=app@example.com to=[user@example.org]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			be := newTestBackend(t, testConfig(t, tt.env), &fakeRelay{err: tt.relayErr})
+			if err := sendTestMessage(newTestSession(be), tt.from, tt.to, tt.raw); err == nil {
+				t.Fatal("transaction was not rejected")
+			}
+			if !strings.Contains(logs.String(), "[WARN] Rejected "+tt.want) {
+				t.Errorf("log does not contain %q:\n%s", tt.want, logs)
+			}
+		})
+	}
+}
+
+func TestAuditQuotaExceeded(t *testing.T) {
+	logs := captureLog(t)
+	be := newTestBackend(t, testConfig(t, map[string]string{"SENDER_DAILY_QUOTA": "1"}), &fakeRelay{})
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage); err == nil {
+		t.Fatal("message over the quota was accepted")
+	}
+	if !strings.Contains(logs.String(), "Rejected phase=MAIL reason=QUOTA_EXCEEDED remote=192.0.2.1:1234 from=app@example.com") {
+		t.Errorf("log = %s", logs)
+	}
+}
+
+func TestAuditNoRecipients(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestSession(newTestBackend(t, testConfig(t, nil), &fakeRelay{}))
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Data(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")); err != errNoRecipients {
+		t.Errorf("DATA without recipients: err = %v", err)
+	}
+	if !strings.Contains(logs.String(), `Rejected phase=DATA reason=NO_RECIPIENTS remote=192.0.2.1:1234 from=app@example.com to=[] detail="no accepted recipients"`) {
+		t.Errorf("log = %s", logs)
+	}
+}
+
+func TestSendFailureReason(t *testing.T) {
+	for err, want := range map[error]string{
+		errors.New("boom"): reasonSendFailed,
+		errQueueFull:       reasonQueueFull,
+		&smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}}: reasonMessageTooLarge,
+		&smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}}: reasonUpstreamTimeout,
+		&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}}: reasonSendFailed,
+	} {
+		if got := sendFailureReason(err); got != want {
+			t.Errorf("sendFailureReason(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
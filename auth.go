@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errAuthRequired is the RFC 4954 reply to MAIL before AUTH; go-smtp's own
+// ErrAuthRequired uses 502
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// credentials maps SMTP usernames to their password, stored either as is or
+// as a bcrypt hash ($2a$, $2b$ or $2y$)
+type credentials map[string]string
+
+// parseCredentials parses SMTP_USERS, user:password entries separated by
+// commas or newlines (the latter suits SMTP_USERS_FILE)
+func parseCredentials(value string) (credentials, error) {
+	users := make(credentials)
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		username, password, ok := strings.Cut(entry, ":")
+		if !ok || username == "" || password == "" {
+			// The entry holds a password, so keep it out of the error
+			return nil, fmt.Errorf("invalid SMTP_USERS entry for %q (expected user:password)", username)
+		}
+		users[username] = password
+	}
+	return users, nil
+}
+
+// verify reports whether password is correct for username
+func (c credentials) verify(username, password string) bool {
+	stored, ok := c[username]
+	if !ok {
+		return false
+	}
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// AuthMechanisms advertises PLAIN and LOGIN when SMTP_USERS is set. Without
+// users AUTH is not offered, the relay trusts its network.
+func (s *Session) AuthMechanisms() []string {
+	if len(s.config.SMTPUsers) == 0 {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+// Auth checks both mechanisms against the same SMTP_USERS store
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	s.countCommand("AUTH")
+	if len(s.config.SMTPUsers) == 0 {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				s.audit("AUTH", reasonAuthFailed, fmt.Sprintf("%s may not act as %s", username, identity))
+				return smtp.ErrAuthFailed
+			}
+			return s.authenticate(mech, username, password)
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(func(username, password string) error {
+			return s.authenticate(mech, username, password)
+		}), nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+func (s *Session) authenticate(mech, username, password string) error {
+	if !s.config.SMTPUsers.verify(username, password) {
+		s.audit("AUTH", reasonAuthFailed, fmt.Sprintf("invalid credentials for %q (%s)", username, mech))
+		return smtp.ErrAuthFailed
+	}
+	s.authUser = username
+	logDebug("AUTH %s succeeded for %s from %s", mech, username, s.remoteAddr)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// startAuthServer serves a relay requiring SMTP_USERS=users
+func startAuthServer(t *testing.T, users string) string {
+	t.Helper()
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_USERS": users}), &fakeRelay{})
+	return startTestServer(t, be, nil)
+}
+
+// authLogin runs AUTH LOGIN on c and returns the final reply code
+func authLogin(c *smtpConn, username, password string) int {
+	c.t.Helper()
+	if code, msg := c.cmd("AUTH LOGIN"); code != 334 || msg != base64.StdEncoding.EncodeToString([]byte("Username:")) {
+		c.t.Fatalf("AUTH LOGIN got %d %s, want the username prompt", code, msg)
+	}
+	if code, msg := c.cmd("%s", base64.StdEncoding.EncodeToString([]byte(username))); code != 334 || msg != base64.StdEncoding.EncodeToString([]byte("Password:")) {
+		c.t.Fatalf("username got %d %s, want the password prompt", code, msg)
+	}
+	code, _ := c.cmd("%s", base64.StdEncoding.EncodeToString([]byte(password)))
+	return code
+}
+
+func TestAuthMechanismsAdvertised(t *testing.T) {
+	c := dialSMTP(t, startAuthServer(t, "relay:secret"))
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); !strings.Contains(ehlo, "AUTH PLAIN LOGIN") {
+		t.Errorf("EHLO = %q, want AUTH PLAIN LOGIN", ehlo)
+	}
+
+	// Without SMTP_USERS there is no AUTH
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_USERS": ""}), &fakeRelay{})
+	c = dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); strings.Contains(ehlo, "AUTH") {
+		t.Errorf("EHLO = %q, want no AUTH", ehlo)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	addr := startAuthServer(t, "relay:secret,legacy:s3cret")
+
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	if code := authLogin(c, "legacy", "s3cret"); code != 235 {
+		t.Fatalf("AUTH LOGIN with valid credentials got %d, want 235", code)
+	}
+	c.expect(250, "MAIL FROM:<app@example.com>")
+
+	for _, creds := range [][2]string{{"legacy", "wrong"}, {"nobody", "s3cret"}, {"relay", "s3cret"}} {
+		c := dialSMTP(t, addr)
+		c.reply()
+		c.expect(250, "EHLO client.test")
+		if code := authLogin(c, creds[0], creds[1]); code != 535 {
+			t.Errorf("AUTH LOGIN as %s:%s got %d, want 535", creds[0], creds[1], code)
+		}
+		c.expect(530, "MAIL FROM:<app@example.com>")
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startAuthServer(t, "relay:"+string(hash))
+
+	c := dialClient(t, addr)
+	if err := c.Auth(sasl.NewPlainClient("", "relay", "secret")); err != nil {
+		t.Fatalf("AUTH PLAIN with a bcrypt password: %v", err)
+	}
+	if err := c.Mail("app@example.com", nil); err != nil {
+		t.Errorf("MAIL after AUTH: %v", err)
+	}
+
+	c = dialClient(t, addr)
+	if err := c.Auth(sasl.NewPlainClient("", "relay", "wrong")); err == nil {
+		t.Error("AUTH PLAIN with a wrong password succeeded")
+	}
+	c = dialClient(t, addr)
+	if err := c.Auth(sasl.NewPlainClient("admin", "relay", "secret")); err == nil {
+		t.Error("AUTH PLAIN acting as another identity succeeded")
+	}
+}
+
+func TestAuthRequiresSTARTTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"SMTP_USERS": "relay:secret", "TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, &fakeRelay{}), tlsConfig))
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); strings.Contains(ehlo, "AUTH") {
+		t.Errorf("EHLO before STARTTLS = %q, want no AUTH", ehlo)
+	}
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00relay\x00secret"))
+	c.expect(523, "AUTH PLAIN %s", plain)
+	c.expect(523, "AUTH LOGIN")
+	c.expect(220, "STARTTLS")
+
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &smtpConn{t: t, conn: tlsConn, text: textproto.NewConn(tlsConn)}
+	if ehlo := tc.expect(250, "EHLO client.test"); !strings.Contains(ehlo, "AUTH PLAIN LOGIN") {
+		t.Errorf("EHLO after STARTTLS = %q, want AUTH PLAIN LOGIN", ehlo)
+	}
+	tc.expect(235, "AUTH PLAIN %s", plain)
+	tc.expect(250, "MAIL FROM:<app@example.com>")
+}
+
+func TestParseCredentials(t *testing.T) {
+	users, err := parseCredentials("relay:secret, app:pa:ss\nlegacy:old\n")
+	if err != nil {
+		t.Fatalf("parseCredentials: %v", err)
+	}
+	if len(users) != 3 || !users.verify("app", "pa:ss") || !users.verify("legacy", "old") || users.verify("relay", "") {
+		t.Errorf("users = %v", users)
+	}
+	for _, value := range []string{"relay", "relay:", ":secret"} {
+		_, err := parseCredentials(value)
+		if err == nil {
+			t.Errorf("parseCredentials(%q) succeeded", value)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("error %q leaks the password", err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// bodyRedactMargin is how far past LOG_BODY_MAX_BYTES bodies are scanned
+// for LOG_BODY_REDACT matches
+const bodyRedactMargin = 256
+
+// bodyRedactions are the patterns LOG_BODY_REDACT can mask in logged bodies
+var bodyRedactions = map[string]*regexp.Regexp{
+	"email":  regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+`),
+	"number": regexp.MustCompile(`[0-9][0-9 .\-]{2,}[0-9]`),
+}
+
+// parseBodyRedactions checks LOG_BODY_REDACT names; "none" masks nothing
+func parseBodyRedactions(names []string) ([]string, error) {
+	var redact []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == "none" {
+			continue
+		}
+		if _, ok := bodyRedactions[name]; !ok {
+			return nil, fmt.Errorf("invalid LOG_BODY_REDACT %q (expected email, number or none)", name)
+		}
+		redact = append(redact, name)
+	}
+	return redact, nil
+}
+
+// logBody logs the start of a message body at debug level when LOG_BODIES
+// is enabled, with the LOG_BODY_REDACT patterns masked
+func (c *Config) logBody(id string, body []byte) {
+	if !c.LogBodies || currentLogLevel > LogDebug {
+		return
+	}
+	// Mask before truncating, so a match cut at the limit is not half
+	// shown. Only a margin past the limit is scanned.
+	text := truncateUTF8(string(body), c.LogBodyMaxBytes+bodyRedactMargin)
+	for _, name := range c.LogBodyRedact {
+		text = bodyRedactions[name].ReplaceAllString(text, "***")
+	}
+	truncated := len(body) > c.LogBodyMaxBytes
+	text = truncateUTF8(text, c.LogBodyMaxBytes)
+	if truncated {
+		logDebug("Message body: id=%s (truncated, %d bytes) %q", id, len(body), text)
+	} else {
+		logDebug("Message body: id=%s %q", id, text)
+	}
+}
+
+// logStreamedBody notes, where logBody would log, that a message streamed to
+// the backend left no body to log
+func (c *Config) logStreamedBody(id string) {
+	if !c.LogBodies || currentLogLevel > LogDebug {
+		return
+	}
+	logDebug("Message body: id=%s not logged, streamed to the backend", id)
+}
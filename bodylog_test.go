@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const bodyLogMessage = "From: app@example.com\nSubject: Invoice\n\nDear ana.perez@example.org, your card 4111 1111 1111 1111 was charged.\n"
+
+func TestLogBodies(t *testing.T) {
+	currentLogLevel = LogDebug
+	t.Cleanup(func() { currentLogLevel = LogInfo })
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		want   []string
+		absent []string
+	}{
+		{"disabled", nil, nil, []string{"Message body"}},
+		{"redacted by default", map[string]string{"LOG_BODIES": "true"},
+			[]string{"Message body: id=", "Dear ***, your card *** was charged."},
+			[]string{"ana.perez", "4111"}},
+		{"emails only", map[string]string{"LOG_BODIES": "true", "LOG_BODY_REDACT": "email"},
+			[]string{"Dear ***, your card 4111 1111 1111 1111 was charged."}, nil},
+		{"unredacted", map[string]string{"LOG_BODIES": "true", "LOG_BODY_REDACT": "none"},
+			[]string{"Dear ana.perez@example.org,"}, nil},
+		{"truncated", map[string]string{"LOG_BODIES": "true", "LOG_BODY_MAX_BYTES": "10"},
+			[]string{`(truncated, 72 bytes) "Dear ***, "`}, []string{"card"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			be := newTestBackend(t, testConfig(t, tt.env), &fakeRelay{})
+			if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, bodyLogMessage); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			out := logs.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("log lacks %q:\n%s", want, out)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(out, absent) {
+					t.Errorf("log contains %q:\n%s", absent, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLogBodiesOnlyAtDebug(t *testing.T) {
+	logs := captureLog(t)
+	be := newTestBackend(t, testConfig(t, map[string]string{"LOG_BODIES": "true"}), &fakeRelay{})
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, bodyLogMessage); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if strings.Contains(logs.String(), "Message body") {
+		t.Errorf("body logged at info level:\n%s", logs)
+	}
+}
+
+func TestLogBodiesStreamed(t *testing.T) {
+	currentLogLevel = LogDebug
+	t.Cleanup(func() { currentLogLevel = LogInfo })
+	logs := captureLog(t)
+	sink := newSMTPSink(t)
+	config := testConfig(t, map[string]string{
+		"BACKEND": "smtp", "SMTP_RELAY_ADDR": sink.addr, "SMTP_RELAY_TLS": "none", "LOG_BODIES": "true",
+	})
+	relay, err := newRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(newTestBackend(t, config, relay))
+	if !s.streamRelay() {
+		t.Fatal("SMTP backend does not stream")
+	}
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, bodyLogMessage); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if out := logs.String(); !strings.Contains(out, "not logged, streamed to the backend") {
+		t.Errorf("log does not say the streamed body was not logged:\n%s", out)
+	}
+}
+
+func TestLogBodyConfigValidated(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"LOG_BODY_REDACT": "email,ssn"},
+		{"LOG_BODY_MAX_BYTES": "0"},
+		{"LOG_BODIES": "maybe"},
+	} {
+		if _, err := tryConfig(t, env); err == nil {
+			t.Errorf("config %v was accepted", env)
+		}
+	}
+}
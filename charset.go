@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// contentCharset is the charset of every SendGrid content block, since
+// decodeText converts text to it
+const contentCharset = "utf-8"
+
+// decodeText returns a text body as UTF-8 for SendGrid content. It undoes a
+// base64 or quoted-printable transfer encoding and converts the declared
+// charset, or DEFAULT_CHARSET when none is declared. 8-bit bytes that are
+// not valid in an undeclared UTF-8 or in us-ascii are read as
+// FALLBACK_CHARSET, since JSON encoding would replace them with U+FFFD.
+func (c *Config) decodeText(data []byte, contentType, transferEncoding string) string {
+	fallback := c.FallbackCharset
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "base64":
+		if decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data))); err == nil {
+			data = decoded
+		} else {
+			logWarn("Failed to decode base64 text, sending it as is: %v", err)
+		}
+	case "quoted-printable":
+		if decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data))); err == nil {
+			data = decoded
+		} else {
+			logWarn("Failed to decode quoted-printable text, sending it as is: %v", err)
+		}
+	}
+
+	_, params := parseContentType(contentType)
+	charset := strings.ToLower(params["charset"])
+	declared := charset != ""
+	if !declared {
+		charset = c.DefaultCharset
+	}
+	switch charset {
+	case "utf-8", "utf8":
+		if declared || utf8.Valid(data) {
+			return string(data)
+		}
+		charset = fallback
+	case "us-ascii":
+		if utf8.Valid(data) {
+			return string(data)
+		}
+		charset = fallback
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		if utf8.Valid(data) {
+			return string(data)
+		}
+		logWarn("Unknown charset %q, reading text as %s", charset, fallback)
+		if enc, err = htmlindex.Get(fallback); err != nil {
+			return string(data)
+		}
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		logWarn("Failed to decode %s text, sending it as is: %v", charset, err)
+		return string(data)
+	}
+	return string(decoded)
+}
+
+// has8Bit reports whether data contains bytes outside 7-bit ASCII
+func has8Bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestDecodeText(t *testing.T) {
+	config := testConfig(t, map[string]string{"DEFAULT_CHARSET": "", "FALLBACK_CHARSET": ""})
+	tests := []struct {
+		name                  string
+		data                  string
+		contentType, encoding string
+		want                  string
+	}{
+		{"8-bit utf-8", "Olá, año", "text/plain; charset=utf-8", "8bit", "Olá, año"},
+		{"8-bit latin-1", "Ol\xe1, a\xf1o", "text/plain; charset=ISO-8859-1", "8bit", "Olá, año"},
+		{"undeclared utf-8", "Olá", "text/plain", "", "Olá"},
+		{"undeclared 8-bit", "Ol\xe1", "text/plain", "", "Olá"},
+		{"us-ascii with 8-bit bytes", "caf\xe9", "text/plain; charset=us-ascii", "", "café"},
+		{"quoted-printable latin-1", "Ol=E1=\r\n mundo", "text/plain; charset=iso-8859-1", "quoted-printable", "Olá mundo"},
+		{"base64 utf-8", "T2zDoQ==", "text/plain; charset=utf-8", "base64", "Olá"},
+		{"windows-1252", "\x93quoted\x94", "text/plain; charset=windows-1252", "", "“quoted”"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := config.decodeText([]byte(tt.data), tt.contentType, tt.encoding); got != tt.want {
+				t.Errorf("decodeText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHas8Bit(t *testing.T) {
+	if has8Bit([]byte("plain ASCII\r\n")) {
+		t.Error("ASCII reported as 8-bit")
+	}
+	if !has8Bit([]byte("Ol\xe1")) {
+		t.Error("latin-1 byte not reported as 8-bit")
+	}
+}
+
+func Test8BitMIMERelayedAsUTF8(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, nil)
+	be := newTestBackend(t, relay.config, relay)
+	addr := startTestServer(t, be, nil)
+
+	c := dialClient(t, addr)
+	if ok, _ := c.Extension("8BITMIME"); !ok {
+		t.Fatal("8BITMIME not advertised")
+	}
+	if err := c.Mail("app@example.com", &smtp.MailOptions{Body: smtp.Body8BitMIME}); err != nil {
+		t.Fatalf("MAIL BODY=8BITMIME: %v", err)
+	}
+	if err := c.Rcpt("user@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: app@example.com\r\nSubject: Hola\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" +
+		"Ma\xf1ana lleg\xf3 el caf\xe9\r\n"
+	if _, err := w.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+
+	if text, _ := contentValue(stub.Last(t), "text/plain"); !strings.Contains(text, "Mañana llegó el café") {
+		t.Errorf("text = %q, want the latin-1 body as UTF-8", text)
+	}
+}
+
+func TestSendGridContentCharset(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Hi\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain; charset=iso-8859-1\nContent-Transfer-Encoding: 8bit\n\nCaf\xe9\n" +
+		"--b1\nContent-Type: text/html; charset=windows-1252\n\n<p>\x93Caf\xe9\x94</p>\n" +
+		"--b1--\n"
+	body, err := sendGridPayload(t, nil, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := map[string]string{"text/plain; charset=utf-8": "Café\n", "text/html; charset=utf-8": "<p>“Café”</p>\n"}
+	for i := 0; i < jsonLen(body, "content"); i++ {
+		typ, _ := jsonPath(body, "content", i, "type").(string)
+		value, _ := jsonPath(body, "content", i, "value").(string)
+		if wantValue, ok := want[typ]; !ok || !strings.HasPrefix(value, strings.TrimSuffix(wantValue, "\n")) {
+			t.Errorf("content %q = %q, want one of %v", typ, value, want)
+		}
+		delete(want, typ)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing content blocks %v in %v", want, body["content"])
+	}
+}
+
+func TestDefaultCharset(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Hi\n\nMa\xf1ana\n"
+	body, err := sendGridPayload(t, map[string]string{"DEFAULT_CHARSET": "ISO-8859-15"}, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if text, ok := contentValue(body, "text/plain; charset=utf-8"); !ok || !strings.HasPrefix(text, "Mañana") {
+		t.Errorf("text = %q, want the undeclared body read as ISO-8859-15", text)
+	}
+}
+
+func TestCharsetConfigValidated(t *testing.T) {
+	for _, key := range []string{"DEFAULT_CHARSET", "FALLBACK_CHARSET"} {
+		t.Run(key, func(t *testing.T) {
+			if _, err := tryConfig(t, map[string]string{key: "klingon-8"}); err == nil || !strings.Contains(err.Error(), "invalid "+key) {
+				t.Errorf("%s=klingon-8: err = %v", key, err)
+			}
+		})
+	}
+}
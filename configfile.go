@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// fileSettings holds the values read from CONFIG_FILE, keyed by the
+// environment variable they stand in for
+var fileSettings map[string]string
+
+// readSettings records every key getenv was asked for, so file keys that no
+// setting uses can be reported
+var readSettings = map[string]bool{}
+
+// getenv returns the environment variable key, falling back to CONFIG_FILE
+// when it is unset or empty. Environment variables always take precedence.
+func getenv(key string) string {
+	readSettings[key] = true
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileSettings[key]
+}
+
+// loadConfigFile reads a JSON object whose keys are the environment variable
+// names (case-insensitive). Values may be strings, numbers, booleans or, for
+// list settings such as ALLOWED_SENDERS, arrays of strings, and for
+// key=value lists such as SENDER_DAILY_QUOTA, objects.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid CONFIG_FILE %s: %w", path, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := settingValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONFIG_FILE key %q: %w", key, err)
+		}
+		settings[strings.ToUpper(key)] = s
+	}
+	return settings, nil
+}
+
+// settingValue converts a JSON value to the string form the environment
+// variable would have
+func settingValue(value json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("arrays may only contain strings")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		// Objects become "key=value" lists, e.g. SENDGRID_KEY_ROUTES
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, 0, len(v))
+		for _, key := range keys {
+			var s string
+			switch item := v[key].(type) {
+			case string:
+				s = item
+			case json.Number:
+				s = item.String()
+			default:
+				return "", fmt.Errorf("object values may only be strings or numbers")
+			}
+			items = append(items, key+"="+s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %s", value)
+	}
+}
+
+// warnUnknownSettings logs CONFIG_FILE keys that no setting read
+func warnUnknownSettings() {
+	var unknown []string
+	for key := range fileSettings {
+		if !readSettings[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		logWarn("Ignoring unknown CONFIG_FILE key %s", key)
+	}
+}
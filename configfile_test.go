@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a CONFIG_FILE with the given JSON content
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfigFile = `{
+	"smtp_domain": "file.example.com",
+	"MAX_MESSAGE_BYTES": 1048576,
+	"DRY_RUN": true,
+	"ALLOWED_SENDERS": ["example.com", "example.org"],
+	"SENDER_DAILY_QUOTA": {"app@example.com": 10, "*": "100"}
+}`
+
+func TestConfigFileOnly(t *testing.T) {
+	config := testConfig(t, map[string]string{"CONFIG_FILE": writeConfigFile(t, testConfigFile)})
+	if config.Domain != "file.example.com" {
+		t.Errorf("Domain = %q, want the lower-case key from the file", config.Domain)
+	}
+	if config.MaxMessageBytes != 1048576 || !config.DryRun {
+		t.Errorf("MaxMessageBytes = %d, DryRun = %v", config.MaxMessageBytes, config.DryRun)
+	}
+	if strings.Join(config.AllowedSenders, ",") != "example.com,example.org" {
+		t.Errorf("AllowedSenders = %v", config.AllowedSenders)
+	}
+	if config.SenderDailyQuota != "*=100,app@example.com=10" {
+		t.Errorf("SenderDailyQuota = %q", config.SenderDailyQuota)
+	}
+}
+
+func TestConfigEnvOnly(t *testing.T) {
+	config := testConfig(t, map[string]string{"SMTP_DOMAIN": "env.example.com", "MAX_MESSAGE_BYTES": "2048"})
+	if config.Domain != "env.example.com" || config.MaxMessageBytes != 2048 {
+		t.Errorf("Domain = %q, MaxMessageBytes = %d", config.Domain, config.MaxMessageBytes)
+	}
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"CONFIG_FILE":       writeConfigFile(t, testConfigFile),
+		"SMTP_DOMAIN":       "env.example.com",
+		"MAX_MESSAGE_BYTES": "", // empty falls back to the file
+	})
+	if config.Domain != "env.example.com" {
+		t.Errorf("Domain = %q, want the environment value", config.Domain)
+	}
+	if config.MaxMessageBytes != 1048576 {
+		t.Errorf("MaxMessageBytes = %d, want the file value", config.MaxMessageBytes)
+	}
+}
+
+func TestConfigFileUnknownKeyWarns(t *testing.T) {
+	logs := captureLog(t)
+	testConfig(t, map[string]string{"CONFIG_FILE": writeConfigFile(t, `{"SMTP_DOMAIN": "a.example.com", "SMTP_DOMIAN": "typo"}`)})
+	warnUnknownSettings()
+	if !strings.Contains(logs.String(), "[WARN] Ignoring unknown CONFIG_FILE key SMTP_DOMIAN") {
+		t.Errorf("log = %s, want a warning for the unknown key", logs)
+	}
+	if strings.Contains(logs.String(), "key SMTP_DOMAIN\n") {
+		t.Error("a known key was reported as unknown")
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"not an object": `["SMTP_DOMAIN"]`,
+		"nested array":  `{"ALLOWED_SENDERS": [1, 2]}`,
+		"nested object": `{"SENDER_DAILY_QUOTA": {"a@example.com": {"n": 1}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tryConfig(t, map[string]string{"CONFIG_FILE": writeConfigFile(t, content)}); err == nil || !strings.Contains(err.Error(), "CONFIG_FILE") {
+				t.Errorf("err = %v, want a CONFIG_FILE error", err)
+			}
+		})
+	}
+	if _, err := tryConfig(t, map[string]string{"CONFIG_FILE": filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("a missing CONFIG_FILE was accepted")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// deadLetter is the JSON sidecar written next to a dead-lettered message
+type deadLetter struct {
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Bcc        []string  `json:"bcc,omitempty"`
+	Subject    string    `json:"subject"`
+	Backend    string    `json:"backend"`
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	ReceivedAt time.Time `json:"received_at"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// writeDeadLetter stores a message that could not be delivered in dir as
+// <id>.eml (the raw message as it would have been relayed) and <id>.json
+// (envelope and failure details), so it can be inspected and replayed
+func writeDeadLetter(dir, backend string, job *sendJob, sendErr error, attempts int) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	failedAt := time.Now().UTC()
+	id := failedAt.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	sidecar, err := json.MarshalIndent(deadLetter{
+		From:       job.msg.From,
+		To:         job.msg.To,
+		Bcc:        job.msg.Bcc,
+		Subject:    job.subject,
+		Backend:    backend,
+		Error:      sendErr.Error(),
+		Attempts:   attempts,
+		ReceivedAt: job.start.UTC(),
+		FailedAt:   failedAt,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// Write the message first so a sidecar never points at a missing file
+	if err := os.WriteFile(filepath.Join(dir, id+".eml"), job.msg.Raw, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+".json"), append(sidecar, '\n'), 0o600); err != nil {
+		return "", fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// readDeadLetters returns the raw messages and sidecars written to dir
+func readDeadLetters(t *testing.T, dir string) ([]string, []deadLetter) {
+	t.Helper()
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raws []string
+	var letters []deadLetter
+	for _, path := range sidecars {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var letter deadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			t.Fatalf("sidecar %s: %v", path, err)
+		}
+		raw, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".eml")
+		if err != nil {
+			t.Fatalf("sidecar without a message: %v", err)
+		}
+		raws = append(raws, string(raw))
+		letters = append(letters, letter)
+	}
+	return raws, letters
+}
+
+func TestDeadLetterAfterRetries(t *testing.T) {
+	dir := t.TempDir()
+	relay := &fakeRelay{err: &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Upstream unavailable"}}
+	config := testConfig(t, map[string]string{"DEAD_LETTER_DIR": dir, "SEND_RETRIES": "2", "SEND_RETRY_DELAY": "1ms"})
+	be := newTestBackend(t, config, relay)
+
+	raw := "From: app@example.com\nTo: user@example.org\nSubject: Invoice 42\n\nTotal: 10\n"
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, raw); smtpCode(err) != 451 {
+		t.Fatalf("DATA: err = %v, want the 451", err)
+	}
+	if n := len(relay.Messages()); n != 3 {
+		t.Errorf("relay got %d attempts, want 3", n)
+	}
+
+	raws, letters := readDeadLetters(t, dir)
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	letter := letters[0]
+	if letter.From != "app@example.com" || strings.Join(letter.To, ",") != "user@example.org" || letter.Subject != "Invoice 42" {
+		t.Errorf("sidecar envelope = %+v", letter)
+	}
+	if letter.Backend != "fake" || letter.Attempts != 3 || !strings.Contains(letter.Error, "Upstream unavailable") {
+		t.Errorf("sidecar failure = %+v", letter)
+	}
+	if letter.ReceivedAt.IsZero() || letter.FailedAt.Before(letter.ReceivedAt) {
+		t.Errorf("sidecar times: received %v, failed %v", letter.ReceivedAt, letter.FailedAt)
+	}
+	if !strings.Contains(raws[0], "Subject: Invoice 42\r\n") || !strings.HasSuffix(raws[0], "Total: 10\r\n") {
+		t.Errorf("dead letter message = %q", raws[0])
+	}
+}
+
+func TestDeadLetterPermanentFailure(t *testing.T) {
+	dir := t.TempDir()
+	relay := &fakeRelay{err: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender not verified"}}
+	config := testConfig(t, map[string]string{"DEAD_LETTER_DIR": dir, "SEND_RETRIES": "2", "SEND_RETRY_DELAY": "1ms"})
+	be := newTestBackend(t, config, relay)
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage); err == nil {
+		t.Fatal("failed send was accepted")
+	}
+	if _, letters := readDeadLetters(t, dir); len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Errorf("dead letters = %+v, want one after a single attempt", letters)
+	}
+
+	// Delivered messages leave nothing behind
+	relay.err = nil
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage); err != nil {
+		t.Fatal(err)
+	}
+	if _, letters := readDeadLetters(t, dir); len(letters) != 1 {
+		t.Errorf("got %d dead letters after a successful send, want still 1", len(letters))
+	}
+}
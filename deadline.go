@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errDataTimeout is returned when the body is not received within
+// DATA_MAX_DURATION. The connection is closed, the rest of the body would
+// otherwise be read as commands.
+var errDataTimeout = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "DATA not completed in time, closing connection",
+}
+
+// deadlineReader fails with errDataTimeout once the deadline passes. The
+// SMTP ReadTimeout only bounds each read, so a client trickling a byte at a
+// time could otherwise hold DATA open indefinitely. A read already blocked
+// when the deadline passes is interrupted by abort.
+type deadlineReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// newDeadlineReader calls abort, if not nil, when d elapses. Stop must be
+// called once reading is done.
+func newDeadlineReader(r io.Reader, d time.Duration, abort func()) *deadlineReader {
+	dr := &deadlineReader{r: r}
+	dr.timer = time.AfterFunc(d, func() {
+		dr.expired.Store(true)
+		if abort != nil {
+			abort()
+		}
+	})
+	return dr
+}
+
+func (dr *deadlineReader) Read(b []byte) (int, error) {
+	if dr.expired.Load() {
+		return 0, errDataTimeout
+	}
+	n, err := dr.r.Read(b)
+	if err != nil && dr.expired.Load() {
+		return n, errDataTimeout
+	}
+	return n, err
+}
+
+// Stop cancels the deadline
+func (dr *deadlineReader) Stop() {
+	dr.timer.Stop()
+}
+
+// replyAndClose writes reply and closes the SMTP connection. It is a no-op
+// for HTTP ingest sessions.
+func (s *Session) replyAndClose(reply *smtp.SMTPError) {
+	if s.conn != nil {
+		closeConn(s.conn, reply)
+	}
+}
+
+// closeConn writes reply and closes c, as go-smtp does on an idle timeout.
+// The reply go-smtp writes itself afterwards then fails silently.
+func closeConn(c *smtp.Conn, reply *smtp.SMTPError) {
+	code := reply.EnhancedCode
+	fmt.Fprintf(c.Conn(), "%d %d.%d.%d %s\r\n", reply.Code, code[0], code[1], code[2], reply.Message)
+	c.Close()
+}
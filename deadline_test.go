@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader yields one byte of an endless header every interval
+type slowReader struct {
+	interval time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.interval)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestDataMaxDurationSlowReader(t *testing.T) {
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, testConfig(t, map[string]string{"DATA_MAX_DURATION": "100ms"}), relay))
+	if err := s.Mail("app@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := s.Data(&slowReader{interval: 10 * time.Millisecond})
+	if !errors.Is(err, errDataTimeout) {
+		t.Errorf("Data = %v, want errDataTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Data returned after %v, want about 100ms", elapsed)
+	}
+	if len(relay.Messages()) != 0 {
+		t.Error("partial message relayed")
+	}
+}
+
+func TestDataMaxDurationOverSMTP(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"DATA_MAX_DURATION": "200ms"}), &fakeRelay{})
+	addr := startTestServer(t, be, nil)
+
+	for name, trickle := range map[string]bool{"trickling client": true, "silent client": false} {
+		t.Run(name, func(t *testing.T) {
+			c := dialSMTP(t, addr)
+			c.reply()
+			c.expect(250, "EHLO client.test")
+			c.expect(250, "MAIL FROM:<app@example.com>")
+			c.expect(250, "RCPT TO:<user@example.org>")
+			c.expect(354, "DATA")
+
+			start := time.Now()
+			stop := make(chan struct{})
+			defer close(stop)
+			if trickle {
+				go func() {
+					for {
+						select {
+						case <-stop:
+							return
+						case <-time.After(20 * time.Millisecond):
+							if _, err := io.WriteString(c.conn, "x"); err != nil {
+								return
+							}
+						}
+					}
+				}()
+			}
+
+			// The 30s ReadTimeout never gets a chance
+			code, msg := c.reply()
+			if code != 421 || !strings.Contains(msg, "DATA not completed in time") {
+				t.Errorf("got %d %s, want the 421", code, msg)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("aborted after %v, want about 200ms", elapsed)
+			}
+			if _, err := c.text.ReadLine(); err == nil {
+				t.Error("connection still open after the abort")
+			}
+		})
+	}
+
+	// A client sending promptly is unaffected
+	c := dialClient(t, addr)
+	if err := c.SendMail("app@example.com", []string{"user@example.org"}, strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")); err != nil {
+		t.Errorf("prompt DATA: %v", err)
+	}
+}
+
+func TestDeadlineReaderStop(t *testing.T) {
+	dr := newDeadlineReader(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n"), 20*time.Millisecond, func() { t.Error("abort called after Stop") })
+	if _, err := io.ReadAll(dr); err != nil {
+		t.Fatal(err)
+	}
+	dr.Stop()
+	time.Sleep(50 * time.Millisecond)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageSummary is the metadata kept about a relayed message. Bodies are
+// never stored.
+type messageSummary struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	Status    string    `json:"status"` // sent or failed
+	MessageID string    `json:"message_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// messageLog is a ring buffer of the last DEBUG_MESSAGE_LOG_SIZE summaries
+type messageLog struct {
+	mu      sync.Mutex
+	entries []messageSummary
+	next    int
+	full    bool
+}
+
+// newMessageLog returns nil when size is 0, which disables the log
+func newMessageLog(size int) *messageLog {
+	if size <= 0 {
+		return nil
+	}
+	return &messageLog{entries: make([]messageSummary, size)}
+}
+
+// Record stores a summary, overwriting the oldest once the log is full. It
+// is a no-op on a nil log.
+func (l *messageLog) Record(summary messageSummary) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = summary
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns the stored summaries, oldest first
+func (l *messageLog) Recent() []messageSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]messageSummary(nil), l.entries[:l.next]...)
+	}
+	return append(append([]messageSummary(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// debugMessagesHandler renders the message log as JSON to requests bearing
+// DEBUG_TOKEN
+func debugMessagesHandler(log *messageLog, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			logWarn("Rejected debug request from %s: invalid bearer token", r.RemoteAddr)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Messages []messageSummary `json:"messages"`
+		}{log.Recent()})
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getDebugMessages requests /debug/messages with token
+func getDebugMessages(t *testing.T, messages *messageLog, token string) (int, []messageSummary, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/debug/messages", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	debugMessagesHandler(messages, "d3bug").ServeHTTP(rec, req)
+	var reply struct {
+		Messages []messageSummary `json:"messages"`
+	}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("reply: %v", err)
+		}
+	}
+	return rec.Code, reply.Messages, rec.Body.String()
+}
+
+func TestDebugMessages(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{"DEBUG_MESSAGE_LOG_SIZE": "3", "DEBUG_TOKEN": "d3bug"})
+	be := newTestBackend(t, config, relay)
+	s := newTestSession(be)
+	for i := 1; i <= 4; i++ {
+		relay.mu.Lock()
+		relay.err = nil
+		if i == 3 {
+			relay.err = errors.New("upstream down")
+		}
+		relay.mu.Unlock()
+		raw := fmt.Sprintf("From: app@example.com\nSubject: Message %d\n\nSecret body %d\n", i, i)
+		sendTestMessage(s, "app@example.com", []string{fmt.Sprintf("user%d@example.org", i)}, raw)
+	}
+
+	code, messages, body := getDebugMessages(t, be.messages, "d3bug")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	// The first message was pushed out of the 3 kept
+	var got []string
+	for _, m := range messages {
+		got = append(got, fmt.Sprintf("%s %s %s %s", m.Subject, strings.Join(m.To, ","), m.Status, m.MessageID+m.Error))
+	}
+	want := []string{
+		"Message 2 user2@example.org sent fake-id",
+		"Message 3 user3@example.org failed upstream down",
+		"Message 4 user4@example.org sent fake-id",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("messages =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, m := range messages {
+		if m.From != "app@example.com" || m.ID == "" || m.Time.IsZero() {
+			t.Errorf("summary = %+v", m)
+		}
+	}
+	if strings.Contains(body, "Secret body") {
+		t.Errorf("message bodies served: %s", body)
+	}
+}
+
+func TestDebugMessagesToken(t *testing.T) {
+	messages := newMessageLog(2)
+	messages.Record(messageSummary{Subject: "Hi"})
+	for _, token := range []string{"", "wrong"} {
+		if code, _, _ := getDebugMessages(t, messages, token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: status = %d, want 401", token, code)
+		}
+	}
+}
+
+func TestMessageLog(t *testing.T) {
+	if newMessageLog(0) != nil {
+		t.Error("DEBUG_MESSAGE_LOG_SIZE=0 returned a log")
+	}
+	var disabled *messageLog
+	disabled.Record(messageSummary{}) // no-op
+
+	l := newMessageLog(2)
+	if got := l.Recent(); len(got) != 0 {
+		t.Errorf("empty log = %v", got)
+	}
+	for _, subject := range []string{"a", "b", "c", "d", "e"} {
+		l.Record(messageSummary{Subject: subject})
+	}
+	if got := l.Recent(); len(got) != 2 || got[0].Subject != "d" || got[1].Subject != "e" {
+		t.Errorf("log = %+v, want d then e", got)
+	}
+}
+
+func TestDebugMessagesRequiresToken(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"DEBUG_MESSAGE_LOG_SIZE": "10"}); err == nil || !strings.Contains(err.Error(), "DEBUG_TOKEN") {
+		t.Errorf("err = %v, want one requiring DEBUG_TOKEN", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupSweepInterval bounds how often expired entries are pruned
+const dedupSweepInterval = time.Minute
+
+// dedupCache remembers the messages relayed within ttl, so a client that
+// resubmits the same message is caught. Entries are keyed by dedupKey.
+type dedupCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newDedupCache returns nil when ttl is 0, which disables deduplication
+func newDedupCache(ttl time.Duration) *dedupCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &dedupCache{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+// dedupKey identifies a message by its Message-ID, envelope sender and
+// recipients, so the same Message-ID sent to other recipients is not a
+// duplicate. It is empty for messages without a Message-ID, which are never
+// duplicates.
+func dedupKey(messageID, from string, to []string) string {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return ""
+	}
+	recipients := make([]string, len(to))
+	for i, addr := range to {
+		recipients[i] = strings.ToLower(strings.Trim(addr, "<>"))
+	}
+	sort.Strings(recipients)
+	return messageID + "\x00" + strings.ToLower(from) + "\x00" + strings.Join(recipients, ",")
+}
+
+// Seen reports whether key was recorded within ttl. Nothing is on a nil
+// cache or for an empty key.
+func (d *dedupCache) Seen(key string) bool {
+	if d == nil || key == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.sweep(now)
+
+	at, ok := d.seen[key]
+	return ok && now.Sub(at) <= d.ttl
+}
+
+// Add records key once its message was sent, so a failed send is never
+// recorded and the client's retry goes through
+func (d *dedupCache) Add(key string) {
+	if d == nil || key == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen[key] = d.now()
+}
+
+// sweep drops entries older than ttl. Callers hold d.mu.
+func (d *dedupCache) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < dedupSweepInterval {
+		return
+	}
+	d.lastSweep = now
+	for key, at := range d.seen {
+		if now.Sub(at) > d.ttl {
+			delete(d.seen, key)
+		}
+	}
+}
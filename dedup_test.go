@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dedupTestMessage = "From: app@example.com\nSubject: Invoice\nMessage-Id: <invoice-1@example.com>\n\nHi\n"
+
+func TestDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantCode int
+	}{
+		{"drop", 0},
+		{"reject", 550},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			logs := captureLog(t)
+			relay := &fakeRelay{}
+			be := newTestBackend(t, testConfig(t, map[string]string{"DUPLICATE_TTL": "1h", "DUPLICATE_POLICY": tt.policy}), relay)
+			s := newTestSession(be)
+			to := []string{"user@example.org"}
+			if err := sendTestMessage(s, "app@example.com", to, dedupTestMessage); err != nil {
+				t.Fatalf("first send: %v", err)
+			}
+			err := sendTestMessage(s, "app@example.com", to, dedupTestMessage)
+			if smtpCode(err) != tt.wantCode || (tt.wantCode == 0 && err != nil) {
+				t.Errorf("duplicate: err = %v, want code %d", err, tt.wantCode)
+			}
+			if n := len(relay.Messages()); n != 1 {
+				t.Errorf("relayed %d messages, want the duplicate caught", n)
+			}
+			if tt.policy == "drop" && !strings.Contains(logs.String(), "Dropped duplicate message") {
+				t.Errorf("drop not logged:\n%s", logs)
+			}
+
+			// The same Message-ID to other recipients is another message
+			if err := sendTestMessage(s, "app@example.com", []string{"other@example.org"}, dedupTestMessage); err != nil {
+				t.Errorf("send to other recipients: %v", err)
+			}
+			if n := len(relay.Messages()); n != 2 {
+				t.Errorf("relayed %d messages, want 2", n)
+			}
+		})
+	}
+}
+
+func TestDuplicateRecordedOnlyOnSuccess(t *testing.T) {
+	relay := &fakeRelay{err: errors.New("upstream down")}
+	be := newTestBackend(t, testConfig(t, map[string]string{"DUPLICATE_TTL": "1h", "DUPLICATE_POLICY": "reject"}), relay)
+	s := newTestSession(be)
+	to := []string{"user@example.org"}
+	if err := sendTestMessage(s, "app@example.com", to, dedupTestMessage); err == nil {
+		t.Fatal("send with a failing relay succeeded")
+	}
+
+	// The client's retry after the failure is not a duplicate
+	relay.err = nil
+	if err := sendTestMessage(s, "app@example.com", to, dedupTestMessage); err != nil {
+		t.Fatalf("retry after a failure: %v", err)
+	}
+	if n := len(relay.Messages()); n != 2 {
+		t.Errorf("relay got %d attempts, want 2", n)
+	}
+}
+
+func TestDuplicateWithoutMessageID(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"DUPLICATE_TTL": "1h", "DUPLICATE_POLICY": "reject"}), relay)
+	s := newTestSession(be)
+	for i := 0; i < 2; i++ {
+		if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "Subject: Hi\n\nHi\n"); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if n := len(relay.Messages()); n != 2 {
+		t.Errorf("relayed %d messages without a Message-ID, want 2", n)
+	}
+}
+
+func TestDedupCacheExpires(t *testing.T) {
+	d := newDedupCache(time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	key := dedupKey("<1@example.com>", "App@Example.com", []string{"<B@example.org>", "a@example.org"})
+	if key != dedupKey("<1@example.com>", "app@example.com", []string{"a@example.org", "b@example.org"}) {
+		t.Error("dedupKey depends on case or recipient order")
+	}
+	d.Add(key)
+	now = now.Add(59 * time.Minute)
+	if !d.Seen(key) {
+		t.Error("message not seen within the TTL")
+	}
+	now = now.Add(2 * time.Minute)
+	if d.Seen(key) {
+		t.Error("message still seen after the TTL")
+	}
+	if len(d.seen) != 0 {
+		t.Errorf("%d expired entries kept", len(d.seen))
+	}
+
+	if newDedupCache(0) != nil {
+		t.Error("DUPLICATE_TTL=0 did not disable deduplication")
+	}
+	if _, err := tryConfig(t, map[string]string{"DUPLICATE_POLICY": "ignore"}); err == nil {
+		t.Error("unknown DUPLICATE_POLICY was accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimHeaderKeys are the header fields covered by the signature
+// (RFC 6376 section 5.4.1)
+var dkimHeaderKeys = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "List-Id", "List-Help",
+	"List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner",
+	"List-Archive", "Message-Id", "Content-Type", "Content-Transfer-Encoding",
+	"Content-Id", "Content-Description", "Mime-Version",
+}
+
+// loadDKIMOptions builds the DKIM signing options from config.
+// It returns nil when DKIM signing is not configured.
+func loadDKIMOptions(config *Config) (*dkim.SignOptions, error) {
+	if config.DKIMPrivateKeyFile == "" {
+		return nil, nil
+	}
+	if config.DKIMDomain == "" || config.DKIMSelector == "" {
+		return nil, fmt.Errorf("DKIM_DOMAIN and DKIM_SELECTOR are required when DKIM_PRIVATE_KEY_FILE is set")
+	}
+
+	pemData, err := os.ReadFile(config.DKIMPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM private key: %w", err)
+	}
+
+	signer, err := parseDKIMPrivateKey(pemData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM private key: %w", err)
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 config.DKIMDomain,
+		Selector:               config.DKIMSelector,
+		Signer:                 signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaderKeys,
+	}, nil
+}
+
+func parseDKIMPrivateKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// signMessage returns raw with a DKIM-Signature header prepended
+func signMessage(options *dkim.SignOptions, raw []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(raw), options); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const dkimTestMessage = "From: app@example.com\r\n" +
+	"To: user@example.org\r\n" +
+	"Subject: Invoice\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"\r\n" +
+	"Your invoice is attached.\r\n"
+
+// writePEM writes a PEM block to a file in a test directory
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// verifyDKIM checks the signatures of signed against the public key
+// published for example.com
+func verifyDKIM(t *testing.T, signed []byte, keyType string, publicKey []byte) {
+	t.Helper()
+	record := "v=DKIM1; k=" + keyType + "; p=" + base64.StdEncoding.EncodeToString(publicKey)
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "s1._domainkey.example.com" {
+				t.Errorf("looked up %q", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("got %d signatures, want 1", len(verifications))
+	}
+	if v := verifications[0]; v.Err != nil || v.Domain != "example.com" {
+		t.Fatalf("verification = %+v", v)
+	}
+}
+
+func TestSignMessageRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t, map[string]string{
+		"DKIM_PRIVATE_KEY_FILE": writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		"DKIM_DOMAIN":           "example.com",
+		"DKIM_SELECTOR":         "s1",
+	})
+	options, err := loadDKIMOptions(config)
+	if err != nil {
+		t.Fatalf("loadDKIMOptions: %v", err)
+	}
+
+	signed, err := signMessage(options, []byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("signMessage: %v", err)
+	}
+	if !bytes.HasPrefix(signed, []byte("DKIM-Signature:")) || !bytes.HasSuffix(signed, []byte(dkimTestMessage)) {
+		t.Fatalf("signed message does not start with the signature followed by the original:\n%s", signed)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyDKIM(t, signed, "rsa", publicKey)
+
+	// A message changed after signing no longer verifies
+	tampered := bytes.Replace(signed, []byte("Subject: Invoice"), []byte("Subject: Refund"), 1)
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(tampered), &dkim.VerifyOptions{
+		LookupTXT: func(string) ([]string, error) {
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(publicKey)}, nil
+		},
+	})
+	if err != nil || len(verifications) != 1 || verifications[0].Err == nil {
+		t.Errorf("tampered message verified: %v %+v", err, verifications)
+	}
+}
+
+func TestSignMessagePKCS8Ed25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := loadDKIMOptions(&Config{
+		DKIMPrivateKeyFile: writePEM(t, "PRIVATE KEY", der),
+		DKIMDomain:         "example.com",
+		DKIMSelector:       "s1",
+	})
+	if err != nil {
+		t.Fatalf("loadDKIMOptions: %v", err)
+	}
+	signed, err := signMessage(options, []byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("signMessage: %v", err)
+	}
+	verifyDKIM(t, signed, "ed25519", publicKey)
+}
+
+func TestLoadDKIMOptionsDisabled(t *testing.T) {
+	options, err := loadDKIMOptions(&Config{})
+	if options != nil || err != nil {
+		t.Errorf("loadDKIMOptions without a key = %v, %v, want nil, nil", options, err)
+	}
+}
+
+func TestLoadDKIMOptionsErrors(t *testing.T) {
+	key := writePEM(t, "CERTIFICATE", []byte("not a key"))
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"missing selector", Config{DKIMPrivateKeyFile: key, DKIMDomain: "example.com"}, "DKIM_SELECTOR"},
+		{"missing file", Config{DKIMPrivateKeyFile: filepath.Join(t.TempDir(), "none.pem"), DKIMDomain: "example.com", DKIMSelector: "s1"}, "read"},
+		{"wrong block", Config{DKIMPrivateKeyFile: key, DKIMDomain: "example.com", DKIMSelector: "s1"}, "unsupported PEM block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadDKIMOptions(&tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Custom args carrying the DSN parameters SendGrid has no equivalent for,
+// echoed back in event webhooks so senders can correlate them
+const (
+	dsnEnvelopeIDArg = "dsn_envid"
+	dsnReturnArg     = "dsn_ret"
+)
+
+// dsnRequest holds the DSN (RFC 3461) parameters of a transaction. They are
+// only accepted when ENABLE_DSN advertises the extension.
+type dsnRequest struct {
+	EnvelopeID string                      // ENVID from MAIL FROM
+	Return     smtp.DSNReturn              // RET from MAIL FROM: FULL or HDRS
+	Notify     map[string][]smtp.DSNNotify // NOTIFY from RCPT TO, by recipient
+}
+
+// empty reports whether the client requested nothing
+func (d *dsnRequest) empty() bool {
+	return d == nil || (d.EnvelopeID == "" && d.Return == "" && len(d.Notify) == 0)
+}
+
+// setMail records the MAIL FROM parameters, dropping earlier ones
+func (d *dsnRequest) setMail(opts *smtp.MailOptions) {
+	*d = dsnRequest{}
+	if opts != nil {
+		d.EnvelopeID = opts.EnvelopeID
+		d.Return = opts.Return
+	}
+}
+
+// addRcpt records the NOTIFY parameter of an accepted recipient
+func (d *dsnRequest) addRcpt(to string, opts *smtp.RcptOptions) {
+	if opts == nil || len(opts.Notify) == 0 {
+		return
+	}
+	if d.Notify == nil {
+		d.Notify = make(map[string][]smtp.DSNNotify)
+	}
+	d.Notify[to] = opts.Notify
+}
+
+// clone returns a copy the session can keep changing, or nil when empty
+func (d *dsnRequest) clone() *dsnRequest {
+	if d.empty() {
+		return nil
+	}
+	c := *d
+	if d.Notify != nil {
+		c.Notify = make(map[string][]smtp.DSNNotify, len(d.Notify))
+		for to, notify := range d.Notify {
+			c.Notify[to] = notify
+		}
+	}
+	return &c
+}
+
+// notifyString renders a NOTIFY list as sent on the wire, e.g. SUCCESS,FAILURE
+func notifyString(notify []smtp.DSNNotify) string {
+	values := make([]string, len(notify))
+	for i, n := range notify {
+		values[i] = string(n)
+	}
+	return strings.Join(values, ",")
+}
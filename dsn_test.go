@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// dsnTransaction sends a message over SMTP with DSN parameters
+func dsnTransaction(t *testing.T, addr string) {
+	t.Helper()
+	c := dialSMTP(t, addr)
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); !strings.Contains(ehlo, "DSN") {
+		t.Fatalf("EHLO = %q, want DSN", ehlo)
+	}
+	c.expect(250, "MAIL FROM:<app@example.com> RET=HDRS ENVID=order+2B42")
+	c.expect(250, "RCPT TO:<user@example.org> NOTIFY=SUCCESS,FAILURE")
+	c.expect(250, "RCPT TO:<other@example.org>")
+	c.expect(354, "DATA")
+	c.expect(250, "From: app@example.com\r\nSubject: Hi\r\n\r\nHello\r\n.")
+}
+
+func TestDSNParametersRecorded(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"ENABLE_DSN": "true"}), relay)
+	dsnTransaction(t, startTestServer(t, be, nil))
+
+	messages := relay.Messages()
+	if len(messages) != 1 || messages[0].DSN == nil {
+		t.Fatalf("relay got %+v, want one message with DSN parameters", messages)
+	}
+	dsn := messages[0].DSN
+	if dsn.EnvelopeID != "order+42" || dsn.Return != smtp.DSNReturnHeaders {
+		t.Errorf("ENVID, RET = %q, %q", dsn.EnvelopeID, dsn.Return)
+	}
+	if len(dsn.Notify) != 1 || notifyString(dsn.Notify["user@example.org"]) != "SUCCESS,FAILURE" {
+		t.Errorf("NOTIFY = %v, want SUCCESS,FAILURE for user@example.org only", dsn.Notify)
+	}
+}
+
+func TestDSNDisabled(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"ENABLE_DSN": ""}), relay)
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); strings.Contains(ehlo, "DSN") {
+		t.Errorf("EHLO = %q, want no DSN", ehlo)
+	}
+	if code, msg := c.cmd("MAIL FROM:<app@example.com> RET=FULL"); code/100 != 5 {
+		t.Errorf("MAIL with RET got %d %s, want a 5xx", code, msg)
+	}
+
+	// Without parameters the message carries no DSN request
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, "Subject: Hi\n\nHello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := relay.Messages(); len(got) != 1 || got[0].DSN != nil {
+		t.Errorf("DSN = %+v, want nil", got[0].DSN)
+	}
+}
+
+func TestDSNPassedToSMTPUpstream(t *testing.T) {
+	sink := newSMTPSink(t)
+	config := testConfig(t, map[string]string{"ENABLE_DSN": "true", "BACKEND": "smtp", "SMTP_RELAY_ADDR": sink.addr, "SMTP_RELAY_TLS": "none"})
+	relay, err := newRelay(config)
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	dsnTransaction(t, startTestServer(t, newTestBackend(t, config, relay), nil))
+
+	got := sink.Messages()
+	if len(got) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(got))
+	}
+	if got[0].Mail.EnvelopeID != "order+42" || got[0].Mail.Return != smtp.DSNReturnHeaders {
+		t.Errorf("upstream MAIL options = %+v", got[0].Mail)
+	}
+	if notifyString(got[0].Rcpt[0].Notify) != "SUCCESS,FAILURE" || got[0].Rcpt[1].Notify != nil {
+		t.Errorf("upstream RCPT options = %+v", got[0].Rcpt)
+	}
+}
+
+func TestSendGridDSNCustomArgs(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, nil)
+	msg := testMessage(t, "From: app@example.com\nSubject: Hi\n\nHello\n", "app@example.com", "user@example.org")
+	msg.DSN = &dsnRequest{
+		EnvelopeID: "order+42",
+		Return:     smtp.DSNReturnFull,
+		Notify:     map[string][]smtp.DSNNotify{"user@example.org": {smtp.DSNNotifyNever}},
+	}
+	if _, err := relay.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if jsonPath(body, "custom_args", dsnEnvelopeIDArg) != "order+42" || jsonPath(body, "custom_args", dsnReturnArg) != "FULL" {
+		t.Errorf("custom_args = %v", body["custom_args"])
+	}
+}
+
+func TestDSNRequestClone(t *testing.T) {
+	var d dsnRequest
+	if d.clone() != nil {
+		t.Error("clone of an empty request is not nil")
+	}
+	d.setMail(&smtp.MailOptions{EnvelopeID: "id1"})
+	d.addRcpt("user@example.org", &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyDelayed}})
+	d.addRcpt("other@example.org", nil)
+	c := d.clone()
+
+	// The session moving on does not change what was queued
+	d.setMail(nil)
+	if c.EnvelopeID != "id1" || len(c.Notify) != 1 || !d.empty() {
+		t.Errorf("clone = %+v, session = %+v", c, d)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// eventQueueSize bounds the events waiting to be posted; further events are
+// dropped so a slow webhook never holds up sends
+const eventQueueSize = 1000
+
+// sendEvent is the JSON payload posted to EVENT_WEBHOOK_URL after each send
+type sendEvent struct {
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Subject    string    `json:"subject"`
+	Status     string    `json:"status"` // sent or failed
+	MessageID  string    `json:"message_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// eventWebhook posts send events to EVENT_WEBHOOK_URL from a background
+// goroutine, one at a time and without retries
+type eventWebhook struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+	events  chan sendEvent
+}
+
+// newEventWebhook returns nil when url is empty, which disables events
+func newEventWebhook(url string, timeout time.Duration) *eventWebhook {
+	if url == "" {
+		return nil
+	}
+	w := &eventWebhook{
+		url:     url,
+		client:  &http.Client{},
+		timeout: timeout,
+		events:  make(chan sendEvent, eventQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues an event without blocking. It is a no-op on a nil webhook.
+func (w *eventWebhook) Notify(event sendEvent) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		eventWebhookFailures.WithLabelValues("dropped").Inc()
+		logWarn("Event webhook queue full, dropping event: id=%s", event.ID)
+	}
+}
+
+func (w *eventWebhook) run() {
+	for event := range w.events {
+		if err := w.post(event); err != nil {
+			eventWebhookFailures.WithLabelValues("error").Inc()
+			logWarn("Failed to post event to webhook: id=%s: %v", event.ID, err)
+		}
+	}
+}
+
+func (w *eventWebhook) post(event sendEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
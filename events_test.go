@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startEventReceiver serves an event webhook that sends each event it
+// receives on the returned channel, after waiting for release when set
+func startEventReceiver(t *testing.T, release chan struct{}) (string, chan sendEvent) {
+	t.Helper()
+	received := make(chan sendEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var event sendEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		if release != nil {
+			<-release
+		}
+		received <- event
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, received
+}
+
+func waitEvent(t *testing.T, received chan sendEvent) sendEvent {
+	t.Helper()
+	select {
+	case event := <-received:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event posted to the webhook")
+		return sendEvent{}
+	}
+}
+
+func TestEventWebhookPostsSendResults(t *testing.T) {
+	url, received := startEventReceiver(t, nil)
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"EVENT_WEBHOOK_URL": url}), relay)
+	s := newTestSession(be)
+
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Invoice\n\nHi\n"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	event := waitEvent(t, received)
+	if event.Status != "sent" || event.From != "app@example.com" || len(event.To) != 1 || event.To[0] != "user@example.org" ||
+		event.Subject != "Invoice" || event.MessageID != "fake-id" || event.ID == "" || event.Time.IsZero() {
+		t.Errorf("sent event = %+v", event)
+	}
+
+	relay.err = errors.New("upstream down")
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Invoice\n\nHi\n"); err == nil {
+		t.Fatal("send with a failing relay succeeded")
+	}
+	event = waitEvent(t, received)
+	if event.Status != "failed" || event.Error != "upstream down" || event.MessageID != "" {
+		t.Errorf("failed event = %+v", event)
+	}
+}
+
+func TestEventWebhookDoesNotBlockSends(t *testing.T) {
+	release := make(chan struct{})
+	url, received := startEventReceiver(t, release)
+	be := newTestBackend(t, testConfig(t, map[string]string{"EVENT_WEBHOOK_URL": url}), &fakeRelay{})
+
+	// The webhook holds every request, the SMTP reply must not wait for it
+	done := make(chan error, 1)
+	go func() {
+		done <- sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, "Subject: Hi\n\nHi\n")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("send waited for the event webhook")
+	}
+	close(release)
+	waitEvent(t, received)
+}
+
+func TestEventWebhookDropsWhenFull(t *testing.T) {
+	w := &eventWebhook{events: make(chan sendEvent, 1)}
+	dropped := eventWebhookFailures.WithLabelValues("dropped")
+	before := testutil.ToFloat64(dropped)
+	w.Notify(sendEvent{ID: "1"})
+	w.Notify(sendEvent{ID: "2"})
+	if got := testutil.ToFloat64(dropped) - before; got != 1 {
+		t.Errorf("dropped %v events, want 1", got)
+	}
+
+	// A nil webhook is disabled
+	var disabled *eventWebhook
+	disabled.Notify(sendEvent{ID: "3"})
+	if newEventWebhook("", time.Second) != nil {
+		t.Error("newEventWebhook without a URL is not nil")
+	}
+}
+
+func TestEventWebhookErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	w := &eventWebhook{url: srv.URL, client: srv.Client(), timeout: time.Second}
+	if err := w.post(sendEvent{ID: "1"}); err == nil {
+		t.Error("post to a failing webhook succeeded")
+	}
+
+	if _, err := tryConfig(t, map[string]string{"EVENT_WEBHOOK_URL": "ftp://events.example.com"}); err == nil {
+		t.Error("non-HTTP EVENT_WEBHOOK_URL was accepted")
+	}
+}
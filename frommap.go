@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// fromMapping rewrites the From of mail from an address or domain to a
+// verified sender
+type fromMapping struct {
+	source string // lowercase address, domain or "*"
+	from   *mail.Address
+}
+
+// parseFromMap parses FROM_MAP, a comma-separated list of source=from
+// entries where source is an address, a domain or "*" for every other
+// sender, e.g. "app1@internal=no-reply@brand1.com,*=no-reply@brand.com"
+func parseFromMap(value string) ([]fromMapping, error) {
+	var mappings []fromMapping
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		source, from, ok := strings.Cut(entry, "=")
+		source = strings.ToLower(strings.TrimSpace(source))
+		if !ok || source == "" {
+			return nil, fmt.Errorf("invalid FROM_MAP entry %q (expected source=from)", entry)
+		}
+		addr, err := parseAddress(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid FROM_MAP address for %s: %w", source, err)
+		}
+		mappings = append(mappings, fromMapping{source: source, from: addr})
+	}
+	return mappings, nil
+}
+
+// mapFrom returns the verified sender for addr. An exact address wins over
+// its domain, a domain also covers its subdomains with the closest one
+// winning, and "*" applies when nothing else matches. A mapped address
+// without a display name keeps the original one.
+func (c *Config) mapFrom(addr *mail.Address) (*mail.Address, bool) {
+	address := strings.ToLower(addr.Address)
+	domain := addressDomain(address)
+
+	var exact, parent, wildcard *fromMapping
+	for i := range c.FromMap {
+		mapping := &c.FromMap[i]
+		switch {
+		case mapping.source == address:
+			exact = mapping
+		case mapping.source == "*":
+			wildcard = mapping
+		case domain == mapping.source || strings.HasSuffix(domain, "."+mapping.source):
+			if parent == nil || len(mapping.source) > len(parent.source) {
+				parent = mapping
+			}
+		}
+	}
+	best := exact
+	if best == nil {
+		best = parent
+	}
+	if best == nil {
+		best = wildcard
+	}
+	if best == nil {
+		return addr, false
+	}
+
+	mapped := *best.from
+	if mapped.Name == "" {
+		mapped.Name = addr.Name
+	}
+	return &mapped, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMapFrom(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"FROM_MAP": "app1@internal=no-reply@brand1.com, app2@internal=Brand 2 <no-reply@brand2.com>, internal=ops@brand.com, eu.internal=ops@brand.eu, *=no-reply@brand.com",
+	})
+	tests := []struct {
+		from string
+		want string
+	}{
+		{"App One <app1@internal>", `"App One" <no-reply@brand1.com>`},
+		{"APP2@Internal", `"Brand 2" <no-reply@brand2.com>`},
+		{"cron@internal", "<ops@brand.com>"},
+		{"cron@mx.eu.internal", "<ops@brand.eu>"},
+		{"someone@elsewhere.com", "<no-reply@brand.com>"},
+	}
+	for _, tt := range tests {
+		addr, err := mail.ParseAddress(tt.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := config.mapFrom(addr)
+		if !ok || got.String() != tt.want {
+			t.Errorf("mapFrom(%s) = %s, %v, want %s", tt.from, got, ok, tt.want)
+		}
+	}
+
+	// Without "*" other senders are left alone
+	config = testConfig(t, map[string]string{"FROM_MAP": "app1@internal=no-reply@brand1.com"})
+	addr := &mail.Address{Address: "someone@elsewhere.com"}
+	if got, ok := config.mapFrom(addr); ok || got != addr {
+		t.Errorf("unmapped sender = %s, %v, want it unchanged", got, ok)
+	}
+}
+
+func TestParseFromMapErrors(t *testing.T) {
+	for _, value := range []string{"app1@internal", "=no-reply@brand.com", "app1@internal=not an address"} {
+		if _, err := parseFromMap(value); err == nil || !strings.Contains(err.Error(), "FROM_MAP") {
+			t.Errorf("parseFromMap(%q) err = %v, want a FROM_MAP error", value, err)
+		}
+	}
+}
+
+func TestFromMapFromConfigFile(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"CONFIG_FILE": writeConfigFile(t, `{"FROM_MAP": {"app1@internal": "no-reply@brand1.com", "*": "no-reply@brand.com"}}`),
+	})
+	if got, _ := config.mapFrom(&mail.Address{Address: "app1@internal"}); got.Address != "no-reply@brand1.com" {
+		t.Errorf("app1@internal mapped to %s", got.Address)
+	}
+	if got, _ := config.mapFrom(&mail.Address{Address: "app2@internal"}); got.Address != "no-reply@brand.com" {
+		t.Errorf("app2@internal mapped to %s, want the default", got.Address)
+	}
+}
+
+func TestSendGridFromMap(t *testing.T) {
+	env := map[string]string{"FROM_MAP": "app1@internal=no-reply@brand1.com,*=no-reply@brand.com"}
+	body, err := sendGridPayload(t, env, "From: App <app1@internal>\nSubject: Hi\n\nHello\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := jsonPath(body, "from", "email"); got != "no-reply@brand1.com" {
+		t.Errorf("from.email = %v, want the mapped sender", got)
+	}
+	if got := jsonPath(body, "from", "name"); got != "App" {
+		t.Errorf("from.name = %v, want the original name", got)
+	}
+	// The envelope sender no longer matches the From, so it is kept
+	if got := jsonPath(body, "custom_args", envelopeFromArg); got != "app@example.com" {
+		t.Errorf("custom_args.%s = %v", envelopeFromArg, got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// greylistSweepInterval bounds how often expired entries are pruned
+const greylistSweepInterval = time.Minute
+
+// greylist defers the first delivery attempt of each (sender, recipient,
+// client IP) triple. A triple is accepted once it is retried after delay,
+// and forgotten when it has not been seen for ttl.
+type greylist struct {
+	mu        sync.Mutex
+	delay     time.Duration
+	ttl       time.Duration
+	entries   map[greylistKey]*greylistEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type greylistKey struct {
+	sender, recipient, ip string
+}
+
+type greylistEntry struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// newGreylist returns nil when delay is 0, which disables greylisting
+func newGreylist(delay, ttl time.Duration) *greylist {
+	if delay <= 0 {
+		return nil
+	}
+	return &greylist{
+		delay:   delay,
+		ttl:     ttl,
+		entries: make(map[greylistKey]*greylistEntry),
+		now:     time.Now,
+	}
+}
+
+// Allow records the triple and reports whether it has waited out the delay
+func (g *greylist) Allow(sender, recipient, remoteAddr string) bool {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	key := greylistKey{strings.ToLower(sender), strings.ToLower(recipient), ip}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.sweep(now)
+
+	entry, ok := g.entries[key]
+	if !ok || now.Sub(entry.lastSeen) > g.ttl {
+		g.entries[key] = &greylistEntry{firstSeen: now, lastSeen: now}
+		return false
+	}
+	entry.lastSeen = now
+	return now.Sub(entry.firstSeen) >= g.delay
+}
+
+// sweep drops entries not seen within ttl. Callers hold g.mu.
+func (g *greylist) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < greylistSweepInterval {
+		return
+	}
+	g.lastSweep = now
+	for key, entry := range g.entries {
+		if now.Sub(entry.lastSeen) > g.ttl {
+			delete(g.entries, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// fakeClock is a settable time source
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestGreylist(delay, ttl time.Duration) (*greylist, *fakeClock) {
+	g := newGreylist(delay, ttl)
+	clock := &fakeClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	g.now = clock.now
+	return g, clock
+}
+
+func TestGreylistDefersThenAccepts(t *testing.T) {
+	g, clock := newTestGreylist(5*time.Minute, time.Hour)
+	if g.Allow("app@example.com", "user@example.org", "192.0.2.1:1234") {
+		t.Fatal("first attempt was accepted")
+	}
+	clock.t = clock.t.Add(time.Minute)
+	if g.Allow("app@example.com", "user@example.org", "192.0.2.1:5678") {
+		t.Error("retry within the delay was accepted")
+	}
+	clock.t = clock.t.Add(4 * time.Minute)
+	// The source port and the case of the addresses do not matter
+	if !g.Allow("App@Example.com", "USER@example.org", "192.0.2.1:9999") {
+		t.Error("retry after the delay was deferred")
+	}
+	if !g.Allow("app@example.com", "user@example.org", "192.0.2.1:1") {
+		t.Error("accepted triple was deferred again")
+	}
+
+	// Any element of the triple changing starts over
+	for _, triple := range [][3]string{
+		{"other@example.com", "user@example.org", "192.0.2.1:1"},
+		{"app@example.com", "other@example.org", "192.0.2.1:1"},
+		{"app@example.com", "user@example.org", "192.0.2.2:1"},
+	} {
+		if g.Allow(triple[0], triple[1], triple[2]) {
+			t.Errorf("new triple %v was accepted", triple)
+		}
+	}
+}
+
+func TestGreylistForgetsAfterTTL(t *testing.T) {
+	g, clock := newTestGreylist(time.Minute, time.Hour)
+	g.Allow("app@example.com", "user@example.org", "192.0.2.1:1")
+	clock.t = clock.t.Add(2 * time.Hour)
+	if g.Allow("app@example.com", "user@example.org", "192.0.2.1:1") {
+		t.Error("triple not seen within the TTL was accepted")
+	}
+	if len(g.entries) != 1 {
+		t.Errorf("%d entries after the sweep, want only the new one", len(g.entries))
+	}
+}
+
+func TestGreylistDisabled(t *testing.T) {
+	if g := newGreylist(0, time.Hour); g != nil {
+		t.Errorf("newGreylist(0) = %v, want nil", g)
+	}
+}
+
+func TestGreylistRcpt(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"GREYLIST_DELAY": "5m"}), &fakeRelay{})
+	clock := &fakeClock{t: time.Now()}
+	be.grey.now = clock.now
+
+	s := newTestSession(be)
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.org", &smtp.RcptOptions{}); smtpCode(err) != 451 {
+		t.Errorf("first RCPT: err = %v, want a 451", err)
+	}
+
+	clock.t = clock.t.Add(6 * time.Minute)
+	s = newTestSession(be)
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.org", &smtp.RcptOptions{}); err != nil {
+		t.Errorf("RCPT after the delay: %v", err)
+	}
+}
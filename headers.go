@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net"
+	"strings"
+	"time"
+)
+
+// splitHeader splits a raw message into its header block (including the
+// terminating blank line) and body
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			return raw, nil
+		}
+		line := raw[i : i+end+1]
+		i += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:i], raw[i:]
+		}
+	}
+	return raw, nil
+}
+
+// countHeaderFields returns the number of fields in a header block, not
+// counting folded continuation lines
+func countHeaderFields(header []byte) int {
+	count := 0
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			count++
+		}
+	}
+	return count
+}
+
+// stripHeaders removes the named header fields, including their folded
+// continuation lines, from the header block of a raw message
+func stripHeaders(raw []byte, names ...string) []byte {
+	header, body := splitHeader(raw)
+
+	var out bytes.Buffer
+	out.Grow(len(raw))
+
+	skipping := false
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n')
+		var line []byte
+		if end < 0 {
+			line, header = header, nil
+		} else {
+			line, header = header[:end+1], header[end+1:]
+		}
+
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// Continuation of the previous field
+			if !skipping {
+				out.Write(line)
+			}
+			continue
+		}
+
+		skipping = false
+		if key, _, ok := bytes.Cut(line, []byte(":")); ok {
+			for _, name := range names {
+				if strings.EqualFold(strings.TrimSpace(string(key)), name) {
+					skipping = true
+					break
+				}
+			}
+		}
+		if !skipping {
+			out.Write(line)
+		}
+	}
+
+	out.Write(body)
+	return out.Bytes()
+}
+
+// headerAddresses returns the addresses of an address-list header such as
+// To, Cc or Bcc. Unparseable headers yield no addresses.
+func headerAddresses(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	list, err := parseAddressList(value)
+	if err != nil {
+		logDebug("Failed to parse address list %q: %v", value, err)
+		return nil
+	}
+
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+// headerField is one unfolded field of a raw header block
+type headerField struct {
+	Name  string // as written in the message, case preserved
+	Value string
+}
+
+// headerFields returns the fields of a raw header block in order, with
+// folded continuation lines joined
+func headerFields(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				fields[len(fields)-1].Value += " " + strings.TrimSpace(string(line))
+			}
+			continue
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{
+			Name:  strings.TrimSpace(string(name)),
+			Value: strings.TrimSpace(string(value)),
+		})
+	}
+	return fields
+}
+
+// parseContentType returns the lowercase media type and parameters of a
+// Content-Type value. mime.ParseMediaType rejects some values clients send,
+// such as unquoted boundaries containing '=' or stray semicolons, and those
+// are split leniently instead. Parameter names are lowercased either way.
+func parseContentType(value string) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err == nil {
+		return mediaType, params
+	}
+
+	fields := strings.Split(value, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(fields[0]))
+	params = make(map[string]string)
+	for _, field := range fields[1:] {
+		name, val, ok := strings.Cut(field, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = val[1 : len(val)-1]
+		}
+		if _, seen := params[name]; !seen {
+			params[name] = val
+		}
+	}
+	return mediaType, params
+}
+
+// receivedHeader renders the RFC 5321 trace field this relay prepends under
+// ADD_RECEIVED_HEADER, e.g.
+//
+//	Received: from billing ([10.0.0.7])
+//		by relay.example.com with ESMTPS
+//		for <cliente@ejemplo.com>; Tue, 01 Oct 2024 12:00:00 +0000
+//
+// The protocol follows the RFC 3848 and RFC 6531 "with" keywords. The
+// recipient is only recorded for single-recipient messages, so blind
+// recipients do not show up in each other's copies.
+func (s *Session) receivedHeader(now time.Time) string {
+	host := s.config.Domain
+
+	helo, protocol := "", "HTTP"
+	if s.conn != nil {
+		helo = s.conn.Hostname()
+		protocol = "ESMTP"
+		if s.config.Protocol == "lmtp" {
+			protocol = "LMTP"
+		}
+		if s.utf8 {
+			protocol = "UTF8" + strings.TrimPrefix(protocol, "E")
+		}
+		if _, isTLS := s.conn.TLSConnectionState(); isTLS {
+			protocol += "S"
+		}
+		if s.authUser != "" {
+			protocol += "A"
+		}
+	}
+
+	// Unix socket clients have no IP to record
+	client := "localhost"
+	if ip, _, err := net.SplitHostPort(s.remoteAddr); err == nil {
+		client = "[" + ip + "]"
+	}
+
+	var b strings.Builder
+	if helo != "" {
+		b.WriteString("Received: from " + helo + " (" + client + ")")
+	} else {
+		b.WriteString("Received: from " + client)
+	}
+	b.WriteString("\r\n\tby " + host + " with " + protocol)
+	if len(s.to) == 1 {
+		b.WriteString("\r\n\tfor <" + strings.Trim(s.to[0], "<>") + ">")
+	}
+	b.WriteString("; " + now.Format(time.RFC1123Z) + "\r\n")
+	return b.String()
+}
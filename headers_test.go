@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripHeaders(t *testing.T) {
+	raw := "From: app@example.com\r\n" +
+		"Bcc: secret@example.org,\r\n" +
+		"\tother-secret@example.org\r\n" +
+		"To: user@example.org\r\n" +
+		"BCC: shouting@example.org\r\n" +
+		"\r\n" +
+		"Bcc: this line is body text\r\n"
+	want := "From: app@example.com\r\n" +
+		"To: user@example.org\r\n" +
+		"\r\n" +
+		"Bcc: this line is body text\r\n"
+	if got := string(stripHeaders([]byte(raw), "Bcc")); got != want {
+		t.Errorf("stripHeaders =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestHeaderAddresses(t *testing.T) {
+	got := headerAddresses(`"Doe, Jane" <jane@example.org>, bob@example.org`)
+	if len(got) != 2 || got[0] != "jane@example.org" || got[1] != "bob@example.org" {
+		t.Errorf("headerAddresses = %v", got)
+	}
+	if got := headerAddresses("not an address list <"); got != nil {
+		t.Errorf("headerAddresses of garbage = %v, want nil", got)
+	}
+}
+
+func TestParseContentType(t *testing.T) {
+	tests := []struct {
+		value, mediaType, boundary, charset string
+	}{
+		{"multipart/mixed; boundary=b1", "multipart/mixed", "b1", ""},
+		{"Multipart/Mixed; BOUNDARY=\"b1\"", "multipart/mixed", "b1", ""},
+		{"  multipart/ALTERNATIVE ;\r\n\tboundary = \"=_Part 1; x\"", "multipart/alternative", "=_Part 1; x", ""},
+		{"multipart/mixed; boundary==_abc=", "multipart/mixed", "=_abc=", ""},
+		{"multipart/related;; boundary=b1;", "multipart/related", "b1", ""},
+		{"TEXT/HTML; Charset=\"UTF-8\"", "text/html", "", "UTF-8"},
+		{"text/plain; charset=utf-8; charset=latin1", "text/plain", "", "utf-8"},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		mediaType, params := parseContentType(tt.value)
+		if mediaType != tt.mediaType || params["boundary"] != tt.boundary || params["charset"] != tt.charset {
+			t.Errorf("parseContentType(%q) = %q, %v, want %q boundary=%q charset=%q", tt.value, mediaType, params, tt.mediaType, tt.boundary, tt.charset)
+		}
+	}
+}
+
+// relayedReceived returns the last message relay got and its Received
+// header
+func relayedReceived(t *testing.T, relay *fakeRelay) (string, string) {
+	t.Helper()
+	messages := relay.Messages()
+	if len(messages) == 0 {
+		t.Fatal("no message relayed")
+	}
+	raw := string(messages[len(messages)-1].Raw)
+	parsed, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("relayed message does not parse: %v", err)
+	}
+	return raw, parsed.Header.Get("Received")
+}
+
+func TestReceivedHeaderOverSMTP(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"ADD_RECEIVED_HEADER": "true", "SMTP_DOMAIN": "relay.example.com"}), relay)
+	c := dialClient(t, startTestServer(t, be, nil))
+	before := time.Now().Truncate(time.Second)
+	if err := c.SendMail("app@example.com", []string{"user@example.org"}, strings.NewReader("From: app@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, received := relayedReceived(t, relay)
+	prefix := "Received: from client.test ([127.0.0.1])\r\n\tby relay.example.com with ESMTP\r\n\tfor <user@example.org>; "
+	if !strings.HasPrefix(raw, prefix) {
+		t.Fatalf("relayed message starts with\n%q\nwant\n%q", raw[:min(len(raw), len(prefix)+40)], prefix)
+	}
+	_, date, _ := strings.Cut(received, "; ")
+	stamp, err := time.Parse(time.RFC1123Z, date)
+	if err != nil || stamp.Before(before) || stamp.After(time.Now()) {
+		t.Errorf("Received date %q = %v, %v, want the time of the transaction", date, stamp, err)
+	}
+	if !strings.Contains(raw, "\r\nFrom: app@example.com\r\n") {
+		t.Errorf("original header lost:\n%s", raw)
+	}
+}
+
+func TestReceivedHeaderSession(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	config := testConfig(t, map[string]string{"SMTP_DOMAIN": "mx.example.com"})
+	s := newTestSession(newTestBackend(t, config, &fakeRelay{}))
+
+	// HTTP ingest sessions have no HELO, and several recipients are not listed
+	s.to = []string{"a@example.org", "b@example.org"}
+	want := "Received: from [192.0.2.1]\r\n\tby mx.example.com with HTTP; Tue, 01 Oct 2024 12:00:00 +0000\r\n"
+	if got := s.receivedHeader(now); got != want {
+		t.Errorf("receivedHeader =\n%q\nwant\n%q", got, want)
+	}
+
+	s.remoteAddr = "@"
+	s.to = []string{"<a@example.org>"}
+	want = "Received: from localhost\r\n\tby mx.example.com with HTTP\r\n\tfor <a@example.org>; Tue, 01 Oct 2024 12:00:00 +0000\r\n"
+	if got := s.receivedHeader(now); got != want {
+		t.Errorf("receivedHeader over a Unix socket =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestReceivedHeaderDisabled(t *testing.T) {
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, testConfig(t, map[string]string{"ADD_RECEIVED_HEADER": ""}), relay))
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Hi\n\nHello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if raw, received := relayedReceived(t, relay); received != "" {
+		t.Errorf("Received header added by default:\n%s", raw)
+	}
+}
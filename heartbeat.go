@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// startHeartbeat logs relay activity every interval, for deployments without
+// Prometheus. The returned function stops it.
+func startHeartbeat(interval time.Duration, bkd *Backend) (stop func()) {
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				logInfo("Heartbeat: %s", bkd.heartbeatStats(time.Since(start)))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// heartbeatStats formats the counters logged by the heartbeat
+func (bkd *Backend) heartbeatStats(uptime time.Duration) string {
+	bkd.mu.Lock()
+	active := len(bkd.connRecipients)
+	bkd.mu.Unlock()
+
+	stats := fmt.Sprintf("uptime=%s active_sessions=%d relayed=%d failed=%d",
+		uptime.Round(time.Second), active, sentTotal.Load(), failedTotal.Load())
+	if bkd.pool != nil {
+		stats += fmt.Sprintf(" queued=%d", len(bkd.pool.jobs))
+	}
+	if b := bkd.inflight; b != nil {
+		b.mu.Lock()
+		stats += fmt.Sprintf(" inflight_bytes=%d", b.used)
+		b.mu.Unlock()
+	}
+	return stats
+}
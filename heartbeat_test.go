@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatStats(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"MAX_INFLIGHT_BYTES": "1048576"}), &fakeRelay{})
+	addr := startTestServer(t, be, nil)
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+
+	relayed, failed := sentTotal.Load(), failedTotal.Load()
+	recordSend("app@example.com", &SendResult{StatusCode: 250}, nil)
+	recordSend("app@example.com", nil, errors.New("boom"))
+
+	stats := be.heartbeatStats(90 * time.Second)
+	for _, want := range []string{
+		"uptime=1m30s",
+		"active_sessions=1",
+		"relayed=" + strconv.FormatInt(relayed+1, 10),
+		"failed=" + strconv.FormatInt(failed+1, 10),
+		"inflight_bytes=0",
+	} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("stats = %q, want %q", stats, want)
+		}
+	}
+	if strings.Contains(stats, "queued=") {
+		t.Errorf("stats = %q, want no queue without SEND_WORKERS", stats)
+	}
+}
+
+func TestHeartbeatLogsEveryInterval(t *testing.T) {
+	logs := captureLog(t)
+	be := newTestBackend(t, testConfig(t, map[string]string{"SEND_WORKERS": "1"}), &fakeRelay{})
+	stop := startHeartbeat(20*time.Millisecond, be)
+
+	pattern := regexp.MustCompile(`Heartbeat: uptime=\S+ active_sessions=0 relayed=\d+ failed=\d+ queued=0`)
+	deadline := time.Now().Add(2 * time.Second)
+	for !pattern.MatchString(logs.String()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no heartbeat logged:\n%s", logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing more is logged once stopped
+	stop()
+	before := strings.Count(logs.String(), "Heartbeat:")
+	time.Sleep(60 * time.Millisecond)
+	if after := strings.Count(logs.String(), "Heartbeat:"); after != before {
+		t.Errorf("%d heartbeats logged after stop", after-before)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Timeouts of the HTTP servers taking client requests, so a slow or stalled
+// client cannot hold a connection open. The write timeout also covers the
+// send itself, since HTTP ingest answers only once the message is relayed.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = time.Minute
+	httpWriteTimeout      = 2 * time.Minute
+)
+
+// newHTTPServer returns a server for handler on addr with the client
+// timeouts set
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+	}
+}
+
+// listenAndServe runs srv until it is shut down
+func listenAndServe(srv *http.Server) error {
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveHTTP runs the operational HTTP server (metrics, delivery status and,
+// when enabled, the recent message log)
+func serveHTTP(addr, backend string, messages *messageLog, debugToken string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/status", statusHandler(backend))
+	if messages != nil {
+		mux.Handle("/debug/messages", debugMessagesHandler(messages, debugToken))
+	}
+
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// defaultInflightReserve is reserved for messages whose MAIL FROM declared
+// no SIZE; the reservation grows to the real size once the message is read
+const defaultInflightReserve = 1 << 20
+
+// errInflightFull is returned when MAX_INFLIGHT_BYTES is used up
+var errInflightFull = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Too much mail in flight, try again later",
+}
+
+// byteBudget bounds the message bytes held in memory across sessions and
+// the send queue
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+	wait bool // block until bytes are released instead of rejecting
+
+	timeout time.Duration // how long a wait may last
+	closed  bool          // shutting down, waiters give up
+}
+
+// newByteBudget returns nil when max is 0, which disables the limit
+func newByteBudget(max int64, wait bool, timeout time.Duration) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	b := &byteBudget{max: max, wait: wait, timeout: timeout}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// reservation is a share of the budget held by one message. Its methods are
+// no-ops on a nil reservation, which is what a nil budget hands out.
+type reservation struct {
+	budget *byteBudget
+	n      int64
+	once   sync.Once
+}
+
+// Reserve takes n bytes from the budget, waiting up to INFLIGHT_WAIT_TIMEOUT
+// for them in wait mode. It reports false when the budget is exhausted in
+// reject mode, the wait timed out or the budget was closed. Requests larger
+// than the whole budget are capped to it so they can eventually proceed.
+func (b *byteBudget) Reserve(n int64) (*reservation, bool) {
+	if b == nil {
+		return nil, true
+	}
+	n = min(n, b.max)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var deadline time.Time
+	for b.used+n > b.max {
+		if !b.wait || b.closed {
+			return nil, false
+		}
+		if deadline.IsZero() {
+			// A sync.Cond cannot time out, wake the waiters at the deadline
+			deadline = time.Now().Add(b.timeout)
+			timer := time.AfterFunc(b.timeout, b.wake)
+			defer timer.Stop()
+		} else if !time.Now().Before(deadline) {
+			return nil, false
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	inflightBytes.Set(float64(b.used))
+	return &reservation{budget: b, n: n}, true
+}
+
+// Grow raises the reservation to n bytes without waiting, so a message
+// larger than its declared size is still accounted for
+func (r *reservation) Grow(n int64) {
+	if r == nil || n <= r.n {
+		return
+	}
+	b := r.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used += n - r.n
+	r.n = n
+	inflightBytes.Set(float64(b.used))
+}
+
+// Release returns the reserved bytes. It is safe to call more than once.
+func (r *reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		b := r.budget
+		b.mu.Lock()
+		b.used -= r.n
+		inflightBytes.Set(float64(b.used))
+		b.mu.Unlock()
+		b.cond.Broadcast()
+	})
+}
+
+// Close makes waiting and later waits in Reserve give up, so shutdown is not
+// held up by sessions waiting for bytes
+func (b *byteBudget) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// wake wakes the waiters so they check their deadline. It takes b.mu, so it
+// cannot fire between a waiter's checks and its Wait.
+func (b *byteBudget) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestByteBudgetReject(t *testing.T) {
+	b := newByteBudget(100, false, time.Second)
+	r1, ok := b.Reserve(60)
+	if !ok {
+		t.Fatal("first reservation refused")
+	}
+	if _, ok := b.Reserve(50); ok {
+		t.Error("reservation over the budget was granted")
+	}
+	r2, ok := b.Reserve(40)
+	if !ok {
+		t.Fatal("reservation within the budget refused")
+	}
+	r1.Release()
+	r1.Release() // releasing twice returns the bytes once
+	if b.used != 40 {
+		t.Errorf("used = %d after releasing 60 twice, want 40", b.used)
+	}
+	r2.Release()
+
+	// Oversized requests are capped to the budget
+	r, ok := b.Reserve(1000)
+	if !ok || r.n != 100 {
+		t.Errorf("oversized reservation = %v %v, want capped to 100", r, ok)
+	}
+	r.Release()
+}
+
+func TestByteBudgetDisabled(t *testing.T) {
+	b := newByteBudget(0, false, time.Second)
+	if b != nil {
+		t.Fatalf("newByteBudget(0) = %v, want nil", b)
+	}
+	r, ok := b.Reserve(1 << 40)
+	if !ok || r != nil {
+		t.Errorf("Reserve on a nil budget = %v %v", r, ok)
+	}
+	r.Grow(10)
+	r.Release()
+	b.Close()
+}
+
+func TestByteBudgetGrow(t *testing.T) {
+	b := newByteBudget(100, false, time.Second)
+	r, _ := b.Reserve(10)
+	r.Grow(80)
+	r.Grow(20) // never shrinks
+	if b.used != 80 {
+		t.Errorf("used = %d, want 80", b.used)
+	}
+	if got := testutil.ToFloat64(inflightBytes); got != 80 {
+		t.Errorf("inflight gauge = %v, want 80", got)
+	}
+	r.Release()
+	if b.used != 0 || testutil.ToFloat64(inflightBytes) != 0 {
+		t.Errorf("used = %d after release", b.used)
+	}
+}
+
+// reserveAsync reserves n bytes from b in a goroutine
+func reserveAsync(b *byteBudget, n int64) <-chan bool {
+	done := make(chan bool, 1)
+	go func() {
+		r, ok := b.Reserve(n)
+		if ok {
+			defer r.Release()
+		}
+		done <- ok
+	}()
+	return done
+}
+
+func TestByteBudgetWait(t *testing.T) {
+	b := newByteBudget(100, true, 5*time.Second)
+	r, _ := b.Reserve(100)
+	done := reserveAsync(b, 50)
+	select {
+	case <-done:
+		t.Fatal("reservation did not wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.Release()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("waiting reservation refused after the release")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting reservation not woken by the release")
+	}
+}
+
+func TestByteBudgetWaitTimeout(t *testing.T) {
+	b := newByteBudget(100, true, 50*time.Millisecond)
+	r, _ := b.Reserve(100)
+	defer r.Release()
+	start := time.Now()
+	select {
+	case ok := <-reserveAsync(b, 50):
+		if ok {
+			t.Error("reservation granted with the budget still used")
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("gave up after %v, before INFLIGHT_WAIT_TIMEOUT", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not bounded by the timeout")
+	}
+}
+
+func TestByteBudgetCloseWakesWaiters(t *testing.T) {
+	b := newByteBudget(100, true, time.Minute)
+	r, _ := b.Reserve(100)
+	defer r.Release()
+	done := reserveAsync(b, 50)
+	time.Sleep(20 * time.Millisecond)
+	b.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("reservation granted after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake the waiter")
+	}
+	if _, ok := b.Reserve(50); ok {
+		t.Error("reservation over the budget granted after Close")
+	}
+}
+
+func TestInflightLimitConcurrentSends(t *testing.T) {
+	relay := newBlockingRelay()
+	config := testConfig(t, map[string]string{"MAX_INFLIGHT_BYTES": "2097152"})
+	be := newTestBackend(t, config, relay)
+	to := []string{"user@example.org"}
+
+	// Without a declared SIZE each message reserves 1 MiB while it is sent
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage) }()
+	}
+	relay.waitStarted(t)
+	relay.waitStarted(t)
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != errInflightFull {
+		t.Errorf("third concurrent message: err = %v, want %v", err, errInflightFull)
+	}
+
+	close(relay.release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("send %d: %v", i, err)
+		}
+	}
+	if be.inflight.used != 0 {
+		t.Errorf("%d bytes still reserved after the sends", be.inflight.used)
+	}
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+		t.Errorf("message after the budget freed up: %v", err)
+	}
+}
+
+func TestLoadConfigInflightWaitTimeout(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"INFLIGHT_WAIT_TIMEOUT": "0s"}); err == nil {
+		t.Error("INFLIGHT_WAIT_TIMEOUT=0 was accepted")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ingestRequest is the JSON body accepted by the HTTP ingestion endpoint
+type ingestRequest struct {
+	From        string             `json:"from"`
+	To          []string           `json:"to"`
+	Subject     string             `json:"subject"`
+	Text        string             `json:"text"`
+	HTML        string             `json:"html"`
+	Attachments []ingestAttachment `json:"attachments"`
+}
+
+type ingestAttachment struct {
+	Filename    string `json:"filename"`
+	Type        string `json:"type"`
+	Content     string `json:"content"` // base64
+	ContentID   string `json:"content_id"`
+	Disposition string `json:"disposition"` // attachment (default) or inline
+}
+
+// newIngestServer returns the HTTP ingestion endpoint, an alternative to
+// SMTP for clients that would rather POST JSON
+func newIngestServer(addr string, bkd *Backend) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/messages", ingestHandler(bkd))
+
+	return newHTTPServer(addr, mux)
+}
+
+// ingestHandler accepts POST /messages. The message is rendered as MIME and
+// goes through the same MAIL/RCPT/DATA handling as an SMTP client, so
+// allowlists, quotas, DKIM and the backend behave identically.
+func ingestHandler(bkd *Backend) http.Handler {
+	token := []byte(bkd.config.HTTPIngestToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeIngestError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), token) != 1 {
+			logWarn("Rejected HTTP ingest request from %s: invalid bearer token", r.RemoteAddr)
+			writeIngestError(w, http.StatusUnauthorized, "invalid bearer token")
+			return
+		}
+
+		// Base64 attachments make the JSON larger than the message itself
+		r.Body = http.MaxBytesReader(w, r.Body, int64(bkd.config.MaxMessageBytes)*2)
+		var req ingestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeIngestError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+			return
+		}
+
+		raw, err := req.message(r.Header.Get("Traceparent"))
+		if err != nil {
+			writeIngestError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(raw) > bkd.config.MaxMessageBytes {
+			writeIngestError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("message is %d bytes (max %d)", len(raw), bkd.config.MaxMessageBytes))
+			return
+		}
+
+		if err := bkd.ingest(r.RemoteAddr, req.envelopeFrom(), req.envelopeTo(), raw); err != nil {
+			writeIngestError(w, ingestStatus(err), err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"accepted"}` + "\n"))
+	})
+}
+
+// ingest relays a message received over HTTP through a Session
+func (bkd *Backend) ingest(remoteAddr, from string, to []string, raw []byte) error {
+	logDebug("New HTTP ingest request from %s", remoteAddr)
+	s := &Session{
+		backend:    bkd,
+		config:     bkd.config,
+		remoteAddr: remoteAddr,
+		recipients: new(int),
+	}
+	if err := s.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := s.Rcpt(addr, nil); err != nil {
+			return err
+		}
+	}
+	return s.Data(bytes.NewReader(raw))
+}
+
+// ingestStatus maps a relay error to an HTTP status: temporary SMTP
+// failures are 503, permanent ones 422, anything else 502
+func ingestStatus(err error) int {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		if smtpErr.Temporary() {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+func writeIngestError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// envelopeFrom is the bare address of From, used as MAIL FROM
+func (req *ingestRequest) envelopeFrom() string {
+	if addr, err := parseAddress(req.From); err == nil {
+		return addr.Address
+	}
+	return req.From
+}
+
+// envelopeTo is the bare addresses of To, used as RCPT TO
+func (req *ingestRequest) envelopeTo() []string {
+	to := make([]string, 0, len(req.To))
+	for _, value := range req.To {
+		if addr, err := parseAddress(value); err == nil {
+			value = addr.Address
+		}
+		to = append(to, value)
+	}
+	return to
+}
+
+// message renders the request as an RFC 5322 message: a single text or HTML
+// part, multipart/alternative when both are set, wrapped in multipart/mixed
+// when there are attachments
+func (req *ingestRequest) message(traceparent string) ([]byte, error) {
+	from, err := parseAddress(req.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from %q: %v", req.From, err)
+	}
+	if len(req.To) == 0 {
+		return nil, fmt.Errorf("at least one to address is required")
+	}
+	to := make([]string, 0, len(req.To))
+	for _, value := range req.To {
+		addr, err := parseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to %q: %v", value, err)
+		}
+		to = append(to, addr.String())
+	}
+	if req.Text == "" && req.HTML == "" {
+		return nil, fmt.Errorf("text or html is required")
+	}
+	header, body, err := req.body()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", req.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if traceparent != "" {
+		fmt.Fprintf(&buf, "Traceparent: %s\r\n", traceparent)
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(req.Attachments) == 0 {
+		writePartHeader(&buf, header)
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	var mixed bytes.Buffer
+	mw := multipart.NewWriter(&mixed)
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	pw.Write(body)
+	for i, a := range req.Attachments {
+		if err := a.write(mw); err != nil {
+			return nil, fmt.Errorf("attachment %d: %v", i+1, err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	buf.Write(mixed.Bytes())
+	return buf.Bytes(), nil
+}
+
+// body renders the text content as a single part, or multipart/alternative
+// when both text and HTML are set
+func (req *ingestRequest) body() (textproto.MIMEHeader, []byte, error) {
+	if req.Text == "" || req.HTML == "" {
+		if req.HTML != "" {
+			return textPart("text/html", req.HTML)
+		}
+		return textPart("text/plain", req.Text)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, value string }{
+		{"text/plain", req.Text},
+		{"text/html", req.HTML},
+	} {
+		header, value, err := textPart(part.contentType, part.value)
+		if err != nil {
+			return nil, nil, err
+		}
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		pw.Write(value)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	return header, body.Bytes(), nil
+}
+
+// textPart encodes a UTF-8 text part as quoted-printable
+func textPart(contentType, value string) (textproto.MIMEHeader, []byte, error) {
+	var body bytes.Buffer
+	qw := quotedprintable.NewWriter(&body)
+	if _, err := qw.Write([]byte(value)); err != nil {
+		return nil, nil, err
+	}
+	if err := qw.Close(); err != nil {
+		return nil, nil, err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return header, body.Bytes(), nil
+}
+
+// writePartHeader writes a part header followed by the blank line
+func writePartHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func (a ingestAttachment) write(mw *multipart.Writer) error {
+	content, err := base64.StdEncoding.DecodeString(a.Content)
+	if err != nil {
+		return fmt.Errorf("invalid base64 content: %v", err)
+	}
+	contentType := a.Type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	filename := a.Filename
+	if filename == "" {
+		filename = "attachment"
+	}
+	disposition := "attachment"
+	if strings.EqualFold(a.Disposition, "inline") {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+	if a.ContentID != "" {
+		header.Set("Content-Id", "<"+strings.Trim(a.ContentID, "<>")+">")
+	}
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	// Base64 lines are limited to 76 characters
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		fmt.Fprintf(pw, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(pw, "%s\r\n", encoded)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// postIngest POSTs body to the ingest handler of be with token, returning
+// the status and decoded reply
+func postIngest(t *testing.T, be *Backend, token, body string) (int, map[string]string) {
+	t.Helper()
+	srv := httptest.NewServer(ingestHandler(be))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/messages", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	return resp.StatusCode, reply
+}
+
+var ingestEnv = map[string]string{"HTTP_INGEST_ADDR": "127.0.0.1:0", "HTTP_INGEST_TOKEN": "s3cret"}
+
+func TestIngestRelaysThroughSendGrid(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, ingestEnv)
+	be := newTestBackend(t, relay.config, relay)
+
+	payload, _ := json.Marshal(ingestRequest{
+		From:    "Billing <billing@example.com>",
+		To:      []string{"Ann <ann@example.org>"},
+		Subject: "Factura número 42",
+		Text:    "Your invoice",
+		HTML:    "<p>Your invoice</p>",
+		Attachments: []ingestAttachment{
+			{Filename: "invoice.pdf", Type: "application/pdf", Content: base64.StdEncoding.EncodeToString([]byte("%PDF-1.4"))},
+		},
+	})
+	status, reply := postIngest(t, be, "s3cret", string(payload))
+	if status != http.StatusAccepted || reply["status"] != "accepted" {
+		t.Fatalf("POST = %d %v, want 202 accepted", status, reply)
+	}
+
+	body := stub.Last(t)
+	if jsonPath(body, "from", "email") != "billing@example.com" || jsonPath(body, "from", "name") != "Billing" {
+		t.Errorf("from = %v", body["from"])
+	}
+	if got := personalizationEmails(body, 0, "to"); len(got) != 1 || got[0] != "<ann@example.org>" {
+		t.Errorf("to = %v, want the bare address as the envelope recipient", got)
+	}
+	if body["subject"] != "Factura número 42" {
+		t.Errorf("subject = %v", body["subject"])
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "Your invoice") {
+		t.Errorf("text = %q", text)
+	}
+	if html, _ := contentValue(body, "text/html"); !strings.Contains(html, "<p>Your invoice</p>") {
+		t.Errorf("html = %q", html)
+	}
+	if jsonPath(body, "attachments", 0, "filename") != "invoice.pdf" ||
+		jsonPath(body, "attachments", 0, "content") != base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")) {
+		t.Errorf("attachments = %v", body["attachments"])
+	}
+}
+
+func TestIngestErrors(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{"HTTP_INGEST_ADDR": "127.0.0.1:0", "HTTP_INGEST_TOKEN": "s3cret", "ALLOWED_SENDERS": "example.com", "DENIED_RECIPIENTS": "blocked.example"})
+	be := newTestBackend(t, config, relay)
+	valid := `{"from": "app@example.com", "to": ["user@example.org"], "subject": "Hi", "text": "Hello"}`
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"wrong token", "guess", valid, http.StatusUnauthorized},
+		{"invalid JSON", "s3cret", `{"from":`, http.StatusBadRequest},
+		{"no recipients", "s3cret", `{"from": "app@example.com", "text": "Hello"}`, http.StatusBadRequest},
+		{"no content", "s3cret", `{"from": "app@example.com", "to": ["user@example.org"]}`, http.StatusBadRequest},
+		{"bad attachment", "s3cret", `{"from": "app@example.com", "to": ["user@example.org"], "text": "Hi", "attachments": [{"filename": "a", "content": "***"}]}`, http.StatusBadRequest},
+		{"sender not allowed", "s3cret", `{"from": "app@example.net", "to": ["user@example.org"], "text": "Hello"}`, http.StatusUnprocessableEntity},
+		{"recipient denied", "s3cret", `{"from": "app@example.com", "to": ["Eve <eve@blocked.example>"], "text": "Hello"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := postIngest(t, be, tt.token, tt.body)
+			if status != tt.status || reply["error"] == "" {
+				t.Errorf("POST = %d %v, want %d with an error", status, reply, tt.status)
+			}
+		})
+	}
+	if n := len(relay.Messages()); n != 0 {
+		t.Errorf("relayed %d rejected messages", n)
+	}
+
+	srv := httptest.NewServer(ingestHandler(be))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET = %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestIngestServerTimeouts(t *testing.T) {
+	srv := newIngestServer("127.0.0.1:0", newTestBackend(t, testConfig(t, nil), &fakeRelay{}))
+	if srv.ReadHeaderTimeout <= 0 || srv.ReadTimeout <= 0 || srv.WriteTimeout <= 0 {
+		t.Errorf("ingest server timeouts: header %v, read %v, write %v, want all set",
+			srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout)
+	}
+}
+
+func TestIngestStatus(t *testing.T) {
+	for err, want := range map[error]int{
+		&smtp.SMTPError{Code: 451}: http.StatusServiceUnavailable,
+		&smtp.SMTPError{Code: 550}: http.StatusUnprocessableEntity,
+		errors.New("boom"):         http.StatusBadGateway,
+	} {
+		if got := ingestStatus(err); got != want {
+			t.Errorf("ingestStatus(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
+
+func TestLoadConfigIngestRequiresToken(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"HTTP_INGEST_ADDR": ":8025"}); err == nil || !strings.Contains(err.Error(), "HTTP_INGEST_TOKEN") {
+		t.Errorf("err = %v, want the missing token refused", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyRoute selects a SendGrid API key for mail from or to a domain
+type keyRoute struct {
+	domain string
+	key    string
+}
+
+// parseKeyRoutes parses SENDGRID_KEY_ROUTES, a comma-separated list of
+// domain=key entries, e.g. "tenant-a.com=SG.aaa.bbb,tenant-b.com=SG.ccc.ddd"
+func parseKeyRoutes(value string) ([]keyRoute, error) {
+	var routes []keyRoute
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		domain, key, ok := strings.Cut(entry, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		key = strings.TrimSpace(key)
+		if !ok || domain == "" || key == "" {
+			// The entry holds a key, so keep it out of the error
+			return nil, fmt.Errorf("invalid SENDGRID_KEY_ROUTES entry for %q (expected domain=key)", domain)
+		}
+		routes = append(routes, keyRoute{domain: domain, key: key})
+	}
+	return routes, nil
+}
+
+// matchKeyRoute returns the route for domain or its closest parent domain
+func matchKeyRoute(routes []keyRoute, domain string) (keyRoute, bool) {
+	var best keyRoute
+	found := false
+	for _, route := range routes {
+		if domain != route.domain && !strings.HasSuffix(domain, "."+route.domain) {
+			continue
+		}
+		if !found || len(route.domain) > len(best.domain) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// sendGridKey returns the API key for msg and the domain whose route chose
+// it. The sender domain is matched first, then each recipient in envelope
+// order; without a match the default SENDGRID_API_KEY is used.
+func (c *Config) sendGridKey(msg *Message) (key, routed string) {
+	if len(c.SendGridKeyRoutes) > 0 {
+		if route, ok := matchKeyRoute(c.SendGridKeyRoutes, addressDomain(msg.From)); ok {
+			return route.key, route.domain
+		}
+		for _, recipient := range msg.To {
+			if route, ok := matchKeyRoute(c.SendGridKeyRoutes, addressDomain(recipient)); ok {
+				return route.key, route.domain
+			}
+		}
+	}
+	return c.SendGridAPIKey, ""
+}
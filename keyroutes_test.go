@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyRoutes(t *testing.T) {
+	routes, err := parseKeyRoutes(" Tenant-A.example.com = SG.aaa , tenant-b.example.com=SG.bbb,")
+	if err != nil {
+		t.Fatalf("parseKeyRoutes: %v", err)
+	}
+	want := []keyRoute{{"tenant-a.example.com", "SG.aaa"}, {"tenant-b.example.com", "SG.bbb"}}
+	if len(routes) != len(want) || routes[0] != want[0] || routes[1] != want[1] {
+		t.Errorf("routes = %+v, want %+v", routes, want)
+	}
+
+	for _, value := range []string{"tenant-a.example.com", "=SG.secret", "tenant-a.example.com="} {
+		_, err := parseKeyRoutes(value)
+		if err == nil {
+			t.Errorf("parseKeyRoutes(%q) succeeded", value)
+		} else if strings.Contains(err.Error(), "SG.secret") {
+			t.Errorf("error %q leaks the key", err)
+		}
+	}
+}
+
+func TestSendGridKeyRouting(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"SENDGRID_KEY_ROUTES": "tenant-a.example.com=SG.a,example.net=SG.net,eu.example.net=SG.eu",
+	})
+	tests := []struct {
+		name       string
+		from       string
+		to         []string
+		key, route string
+	}{
+		{"sender domain", "app@tenant-a.example.com", []string{"user@example.org"}, "SG.a", "tenant-a.example.com"},
+		{"sender case", "App@Tenant-A.Example.com", []string{"user@example.org"}, "SG.a", "tenant-a.example.com"},
+		{"parent domain", "app@mail.example.net", []string{"user@example.org"}, "SG.net", "example.net"},
+		{"closest parent", "app@mail.eu.example.net", []string{"user@example.org"}, "SG.eu", "eu.example.net"},
+		{"sender before recipients", "app@example.net", []string{"user@tenant-a.example.com"}, "SG.net", "example.net"},
+		{"first routed recipient", "app@example.com", []string{"user@example.org", "user@tenant-a.example.com", "user@example.net"}, "SG.a", "tenant-a.example.com"},
+		{"no suffix match", "app@notexample.net", []string{"user@example.org"}, "SG.test", ""},
+		{"fallback", "app@example.com", []string{"user@example.org"}, "SG.test", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, route := config.sendGridKey(&Message{From: tt.from, To: tt.to})
+			if key != tt.key || route != tt.route {
+				t.Errorf("sendGridKey = %q, %q, want %q, %q", key, route, tt.key, tt.route)
+			}
+		})
+	}
+}
+
+func TestSendGridUsesRoutedKey(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"SENDGRID_KEY_ROUTES": "tenant-b.example.com=SG.b"})
+	raw := "From: app@tenant-b.example.com\nSubject: Hi\n\nHello\n"
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@tenant-b.example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	raw = "From: app@example.com\nSubject: Hi\n\nHello\n"
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	requests := stub.Requests()
+	if len(requests) != 2 || requests[0].APIKey != "SG.b" || requests[1].APIKey != "SG.test" {
+		t.Errorf("requests = %+v, want SG.b then the default key", requests)
+	}
+}
+
+func TestKeyRoutesFromConfigFile(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"CONFIG_FILE": writeConfigFile(t, `{"SENDGRID_KEY_ROUTES": {"tenant-b.example.com": "SG.b", "tenant-a.example.com": "SG.a"}}`),
+	})
+	if len(config.SendGridKeyRoutes) != 2 || config.SendGridKeyRoutes[0] != (keyRoute{"tenant-a.example.com", "SG.a"}) {
+		t.Errorf("routes = %+v, want both tenants from the file", config.SendGridKeyRoutes)
+	}
+}
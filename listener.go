@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// listen opens the SMTP listener. addr is a TCP address or "unix:/path/to/sock".
+func listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous process.
+// A socket somebody is still listening on, or a non-socket file, is an error.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	logInfo("Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// busyListener counts open SMTP connections and, above MAX_ACTIVE_SESSIONS,
+// answers new ones with a 421 and closes them before go-smtp sees them, so
+// load is shed before any work is done for the client
+type busyListener struct {
+	net.Listener
+	max    int    // high-water mark, 0 for no limit
+	host   string // hostname in the 421 reply
+	active atomic.Int64
+}
+
+func newBusyListener(l net.Listener, max int, host string) *busyListener {
+	return &busyListener{Listener: l, max: max, host: host}
+}
+
+func (l *busyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if active := l.active.Load(); l.max > 0 && active >= int64(l.max) {
+			go l.shed(c, active)
+			continue
+		}
+		activeSessions.Set(float64(l.active.Add(1)))
+		return &countedConn{Conn: c, listener: l}, nil
+	}
+}
+
+// shed refuses c without blocking Accept on a slow client
+func (l *busyListener) shed(c net.Conn, active int64) {
+	auditRejection("CONNECT", reasonTooBusy, c.RemoteAddr().String(), "", nil,
+		fmt.Sprintf("%d active sessions (max %d)", active, l.max))
+	sessionsShed.Inc()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(c, "421 4.3.2 %s Too busy, try again later\r\n", l.host)
+	c.Close()
+}
+
+// countedConn releases its busyListener slot once closed
+type countedConn struct {
+	net.Conn
+	listener *busyListener
+	once     sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		activeSessions.Set(float64(c.listener.active.Add(-1)))
+	})
+	return c.Conn.Close()
+}
+
+// closeListener calls onClose once for each accepted connection when it is
+// closed, with the connection it returned from Accept. It must be the
+// outermost listener, so go-smtp closes its connections itself.
+type closeListener struct {
+	net.Listener
+	onClose func(net.Conn)
+}
+
+func newCloseListener(l net.Listener, onClose func(net.Conn)) net.Listener {
+	return &closeListener{Listener: l, onClose: onClose}
+}
+
+func (l *closeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &notifyConn{Conn: c, onClose: l.onClose}, nil
+}
+
+// notifyConn calls its closeListener's onClose once closed
+type notifyConn struct {
+	net.Conn
+	onClose func(net.Conn)
+	once    sync.Once
+}
+
+func (c *notifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.onClose(c) })
+	return err
+}
+
+// idleListener closes connections that send nothing for timeout. go-smtp
+// only sets its ReadTimeout deadline once per command line, so this bounds
+// each read separately and keeps the earlier of the two deadlines.
+type idleListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func newIdleListener(l net.Listener, timeout time.Duration) net.Listener {
+	if timeout <= 0 {
+		return l
+	}
+	return &idleListener{Listener: l, timeout: timeout}
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &idleConn{Conn: c, timeout: l.timeout}, nil
+}
+
+// idleConn restarts the idle deadline on every read, so a client streaming
+// a large DATA body is not cut off while one sitting between commands is
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline set by go-smtp, zero for none
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.mu.Unlock()
+
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *idleConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// greetingListener rewrites the 220 banner go-smtp writes, which is
+// otherwise derived from Server.Domain. go-smtp has no hook for it.
+type greetingListener struct {
+	net.Listener
+	banner string // full text after "220 ", empty to keep the default
+}
+
+func newGreetingListener(l net.Listener, banner string) net.Listener {
+	if banner == "" {
+		return l
+	}
+	return &greetingListener{Listener: l, banner: banner}
+}
+
+func (l *greetingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetingConn{Conn: c, listener: l}, nil
+}
+
+// greetingConn rewrites the first write on the connection, the greeting.
+// Later replies, encrypted or not after STARTTLS, are passed through.
+type greetingConn struct {
+	net.Conn
+	listener *greetingListener
+
+	mu      sync.Mutex
+	greeted bool
+}
+
+func (c *greetingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	first := !c.greeted
+	c.greeted = true
+	c.mu.Unlock()
+
+	end := bytes.Index(b, []byte("\r\n"))
+	if !first || !bytes.HasPrefix(b, []byte("220 ")) || end < 0 {
+		return c.Conn.Write(b)
+	}
+	if _, err := c.Conn.Write(append([]byte("220 "+c.listener.banner), b[end:]...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// parseBanner normalizes SMTP_BANNER, which may include the 220 code
+func parseBanner(banner string) string {
+	banner = strings.TrimSpace(banner)
+	banner = strings.TrimPrefix(banner, "220 ")
+	return strings.TrimSpace(banner)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The greeting of go-smtp v0.21 that the docs describe, pinned so that a
+// go-smtp upgrade that changes it is noticed
+const goSMTPGreeting = "220 %s ESMTP Service Ready"
+
+func TestVrfyReply(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, &fakeRelay{}), tlsConfig))
+	c.reply()
+
+	// VRFY never tells whether a mailbox exists, in the clear or not
+	check := func(c *smtpConn) {
+		t.Helper()
+		c.expect(250, "EHLO client.test")
+		if code, msg := c.cmd("VRFY user@example.org"); code != 252 || msg != "2.5.0 Cannot VRFY user, but will accept message" {
+			t.Errorf("VRFY = %d %s, want 252 2.5.0", code, msg)
+		}
+		if code, msg := c.cmd("EXPN staff"); code != 502 {
+			t.Errorf("EXPN = %d %s, want 502", code, msg)
+		}
+	}
+	check(c)
+	c.expect(220, "STARTTLS")
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &smtpConn{t: t, conn: tlsConn, text: textproto.NewConn(tlsConn)}
+	check(tc)
+	// The session carries on
+	tc.expect(250, "MAIL FROM:<app@example.com>")
+}
+
+func TestQuitReply(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_BANNER": "mx.contacloud.mx ESMTP"}), &fakeRelay{})
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	if code, msg := c.cmd("QUIT"); code != 221 || msg != "2.0.0 Bye" {
+		t.Errorf("QUIT = %d %s, want 221 2.0.0 Bye", code, msg)
+	}
+	if _, err := c.text.ReadLine(); err == nil {
+		t.Error("connection left open after QUIT")
+	}
+	waitConnsForgotten(t, be)
+}
+
+func TestDefaultGreeting(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_DOMAIN": "relay.example.com"}), &fakeRelay{})
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	if code, msg := c.reply(); code != 220 || "220 "+msg != strings.Replace(goSMTPGreeting, "%s", "relay.example.com", 1) {
+		t.Errorf("greeting = %d %s", code, msg)
+	}
+}
+
+func TestCustomBanner(t *testing.T) {
+	config := testConfig(t, map[string]string{"SMTP_BANNER": "220 mx.contacloud.mx ESMTP ready for compliance"})
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, &fakeRelay{}), nil))
+	if code, msg := c.reply(); code != 220 || msg != "mx.contacloud.mx ESMTP ready for compliance" {
+		t.Errorf("greeting = %d %s, want the custom banner", code, msg)
+	}
+
+	// The extensions still follow the EHLO line
+	ehlo := c.expect(250, "EHLO client.test")
+	lines := strings.Split(ehlo, "\n")
+	if lines[0] != "Hello client.test" || !strings.Contains(ehlo, "\nPIPELINING") || !strings.Contains(ehlo, "\n8BITMIME") {
+		t.Errorf("EHLO reply =\n%s", ehlo)
+	}
+}
+
+func TestBannerWithSTARTTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{
+		"SMTP_BANNER":   "mx.contacloud.mx ESMTP",
+		"TLS_CERT_FILE": certFile,
+		"TLS_KEY_FILE":  keyFile,
+	})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &fakeRelay{}
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, relay), tlsConfig))
+	if code, msg := c.reply(); code != 220 || msg != "mx.contacloud.mx ESMTP" {
+		t.Errorf("greeting = %d %s, want the custom banner", code, msg)
+	}
+	if ehlo := c.expect(250, "EHLO client.test"); !strings.HasPrefix(ehlo, "Hello client.test\n") || !strings.Contains(ehlo, "\nSTARTTLS") {
+		t.Errorf("EHLO reply =\n%s", ehlo)
+	}
+	c.expect(220, "STARTTLS")
+
+	// The encrypted session answers EHLO the same way, without STARTTLS
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &smtpConn{t: t, conn: tlsConn, text: textproto.NewConn(tlsConn)}
+	ehlo := tc.expect(250, "EHLO client.test")
+	if !strings.HasPrefix(ehlo, "Hello client.test\n") || !strings.Contains(ehlo, "\nPIPELINING") || strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("EHLO reply after STARTTLS =\n%s", ehlo)
+	}
+	tc.expect(250, "MAIL FROM:<app@example.com>")
+	tc.expect(250, "RCPT TO:<user@example.org>")
+	tc.expect(354, "DATA")
+	tc.expect(250, "Subject: Hi\r\n\r\nHello\r\n.")
+	if len(relay.Messages()) != 1 {
+		t.Error("message sent after STARTTLS was not relayed")
+	}
+}
+
+func TestParseBanner(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                        "",
+		"  mx.example.com ESMTP ": "mx.example.com ESMTP",
+		"220 mx.example.com":      "mx.example.com",
+	} {
+		if got := parseBanner(in); got != want {
+			t.Errorf("parseBanner(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+
+	// A socket file left behind by a previous process is removed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_LISTEN_ADDR": "unix:" + path}), relay)
+	s := newSMTPServer(be.config, be, nil)
+	go s.Serve(wrapListener(l, be.config, be))
+	defer s.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := smtp.NewClient(conn)
+	defer c.Close()
+	if err := c.SendMail("app@example.com", []string{"user@example.org"}, strings.NewReader("Subject: Hi\r\n\r\nOver a socket\r\n")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if messages := relay.Messages(); len(messages) != 1 || !strings.Contains(string(messages[0].Raw), "Over a socket") {
+		t.Errorf("relayed %d messages, want the one sent over the socket", len(messages))
+	}
+
+	// A socket still in use is not taken over
+	if _, err := listen("unix:" + path); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("listen on a socket in use: err = %v", err)
+	}
+}
+
+func TestListenRefusesNonSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:" + path); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listen over a regular file: err = %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("regular file was modified")
+	}
+}
+
+func TestIdleTimeoutClosesSession(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"SMTP_IDLE_TIMEOUT": "150ms"}), &fakeRelay{})
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+
+	// Commands sent more often than the timeout keep the session open
+	for i := 0; i < 4; i++ {
+		time.Sleep(75 * time.Millisecond)
+		c.expect(250, "NOOP")
+	}
+
+	start := time.Now()
+	if code, msg := c.reply(); code != 421 {
+		t.Errorf("idle session got %d %s, want a 421", code, msg)
+	}
+	if _, err := c.text.ReadLine(); err == nil {
+		t.Error("connection still open after the idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle session closed after %v, want about 150ms", elapsed)
+	}
+}
+
+func TestIdleConnKeepsEarlierDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &idleConn{Conn: server, timeout: time.Hour}
+
+	// A deadline set by go-smtp that is earlier than the idle one wins
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := c.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Read err = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Read returned after %v, want the 50ms deadline", elapsed)
+	}
+
+	// Without one the idle timeout applies
+	c.SetReadDeadline(time.Time{})
+	c.timeout = 50 * time.Millisecond
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("Read with no data did not time out")
+	}
+}
+
+func TestIdleListenerDisabled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := newIdleListener(l, 0); got != l {
+		t.Errorf("newIdleListener(l, 0) = %T, want l unchanged", got)
+	}
+}
+
+// waitActive waits until l counts want open connections
+func waitActive(t *testing.T, l *busyListener, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.active.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active sessions, want %d", l.active.Load(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBusyListenerShedsAboveMax(t *testing.T) {
+	logs := captureLog(t)
+	be := newTestBackend(t, testConfig(t, map[string]string{"MAX_ACTIVE_SESSIONS": "2"}), &fakeRelay{})
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newBusyListener(inner, be.config.MaxActiveSessions, "relay.test")
+	s := newSMTPServer(be.config, be, nil)
+	go s.Serve(newCloseListener(l, be.forgetConn))
+	t.Cleanup(func() { s.Close() })
+	addr := inner.Addr().String()
+
+	var conns []*smtpConn
+	for i := 0; i < 2; i++ {
+		c := dialSMTP(t, addr)
+		if code, _ := c.reply(); code != 220 {
+			t.Fatalf("connection %d greeted with %d", i, code)
+		}
+		conns = append(conns, c)
+	}
+	if got := testutil.ToFloat64(activeSessions); got != 2 {
+		t.Errorf("smtp_relay_active_sessions = %v, want 2", got)
+	}
+
+	shed := testutil.ToFloat64(sessionsShed)
+	for i := 0; i < 2; i++ {
+		c := dialSMTP(t, addr)
+		if code, msg := c.reply(); code != 421 || msg != "4.3.2 relay.test Too busy, try again later" {
+			t.Errorf("connection above the mark got %d %s, want 421", code, msg)
+		}
+		if _, err := c.text.ReadLine(); err == nil {
+			t.Error("shed connection was left open")
+		}
+	}
+	if got := testutil.ToFloat64(sessionsShed) - shed; got != 2 {
+		t.Errorf("smtp_relay_sessions_shed_total grew by %v, want 2", got)
+	}
+	if !strings.Contains(logs.String(), reasonTooBusy) {
+		t.Errorf("shedding not audited:\n%s", logs)
+	}
+
+	// Closing a session makes room for a new one
+	conns[0].expect(221, "QUIT")
+	conns[0].conn.Close()
+	waitActive(t, l, 1)
+	c := dialSMTP(t, addr)
+	if code, _ := c.reply(); code != 220 {
+		t.Errorf("connection after one closed greeted with %d, want 220", code)
+	}
+	c.expect(250, "EHLO client.test")
+	waitActive(t, l, 2)
+
+	// Every closed connection releases its slot
+	c.conn.Close()
+	conns[1].conn.Close()
+	waitActive(t, l, 0)
+}
+
+func TestBusyListenerUnlimited(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, nil), &fakeRelay{})
+	addr := startTestServer(t, be, nil)
+	for i := 0; i < 5; i++ {
+		c := dialSMTP(t, addr)
+		if code, _ := c.reply(); code != 220 {
+			t.Fatalf("connection %d greeted with %d without MAX_ACTIVE_SESSIONS", i, code)
+		}
+	}
+}
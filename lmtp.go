@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errRecipientRejected is the LMTP reply for a recipient the backend did not
+// accept while sending the message to the others
+var errRecipientRejected = smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient rejected by backend",
+}
+
+// LMTPData handles DATA in LMTP mode (PROTOCOL=lmtp). The message is
+// delivered once, as with SMTP, then each recipient gets its own reply: the
+// ones the backend reported as not accepted get a 550, the rest the overall
+// result. In async queue mode every recipient gets the queueing result.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		reason, ok := s.rejected[strings.ToLower(strings.Trim(to, "<>"))]
+		if !ok {
+			status.SetStatus(to, nil)
+			continue
+		}
+		reply := errRecipientRejected
+		if reason != "" {
+			reply.Message += ": " + reason
+		}
+		s.audit("DATA", reasonRecipientRejected, to+": "+reason)
+		status.SetStatus(to, &reply)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// lmtpTransaction sends a message to two recipients over LMTP and returns
+// the reply for each
+func lmtpTransaction(t *testing.T, addr string) [2]string {
+	t.Helper()
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "LHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<a@example.org>")
+	c.expect(250, "RCPT TO:<b@example.org>")
+	c.expect(354, "DATA")
+	if err := c.text.PrintfLine("From: app@example.com\r\nTo: a@example.org, b@example.org\r\nSubject: Hi\r\n\r\nHi\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	var replies [2]string
+	for i := range replies {
+		code, msg := c.reply()
+		replies[i] = fmt.Sprintf("%d %s", code, msg)
+	}
+	return replies
+}
+
+func TestLMTPPerRecipientReplies(t *testing.T) {
+	logs := captureLog(t)
+	relay, stub := newTestSendGridRelay(t, map[string]string{"PROTOCOL": "lmtp"})
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"errors":[{"message":"Recipient is suppressed","field":"personalizations.0.to.1.email"}]}`)
+	}
+	be := newTestBackend(t, relay.config, relay)
+	replies := lmtpTransaction(t, startTestServer(t, be, nil))
+
+	if !strings.HasPrefix(replies[0], "250 ") {
+		t.Errorf("a@example.org got %q, want 250", replies[0])
+	}
+	if replies[1] != "550 5.1.1 <b@example.org> Recipient rejected by backend: Recipient is suppressed" {
+		t.Errorf("b@example.org got %q, want the SendGrid rejection", replies[1])
+	}
+	if !strings.Contains(logs.String(), reasonRecipientRejected) {
+		t.Errorf("rejected recipient not audited:\n%s", logs)
+	}
+}
+
+func TestLMTPFailureRepliesForEveryRecipient(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"PROTOCOL": "lmtp"})
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	be := newTestBackend(t, relay.config, relay)
+	for i, reply := range lmtpTransaction(t, startTestServer(t, be, nil)) {
+		if !strings.HasPrefix(reply, "451 4.4.0 ") {
+			t.Errorf("recipient %d got %q, want the temporary failure", i, reply)
+		}
+	}
+}
+
+func TestLMTPReceivedHeader(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"PROTOCOL": "lmtp", "ADD_RECEIVED_HEADER": "true"}), relay)
+	for i, reply := range lmtpTransaction(t, startTestServer(t, be, nil)) {
+		if !strings.HasPrefix(reply, "250 ") {
+			t.Errorf("recipient %d got %q, want 250", i, reply)
+		}
+	}
+	if messages := relay.Messages(); len(messages) != 1 || !strings.Contains(string(messages[0].Raw), " with LMTP") {
+		t.Errorf("relayed %d messages, want one received with LMTP", len(messages))
+	}
+
+	if _, err := tryConfig(t, map[string]string{"PROTOCOL": "http"}); err == nil {
+		t.Error("unknown PROTOCOL was accepted")
+	}
+}
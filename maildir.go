@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MaildirRelay writes messages to a local Maildir instead of delivering
+// them, so the relay can be run and inspected without an upstream account
+type MaildirRelay struct {
+	path       string
+	hostname   string
+	deliveries atomic.Uint64
+}
+
+// newMaildirRelay creates the tmp, new and cur directories under path if
+// they do not exist yet
+func newMaildirRelay(path string) (*MaildirRelay, error) {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create maildir: %w", err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// "/" and ":" would break the file name, Maildir escapes them as octal
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return &MaildirRelay{path: path, hostname: hostname}, nil
+}
+
+func (r *MaildirRelay) Name() string {
+	return "maildir"
+}
+
+func (r *MaildirRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	_, span := tracer.Start(ctx, "maildir.deliver", trace.WithSpanKind(trace.SpanKindInternal))
+	defer span.End()
+
+	result, err := r.deliver(msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+// deliver writes the message to tmp and then renames it into new, so
+// readers never see a partial file
+func (r *MaildirRelay) deliver(msg *Message) (*SendResult, error) {
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), r.deliveries.Add(1), r.hostname)
+
+	// The envelope is recorded the way a local MDA would, since Bcc
+	// recipients appear nowhere else in the message
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", strings.Trim(msg.From, "<>"))
+	for _, recipient := range msg.To {
+		fmt.Fprintf(&buf, "Delivered-To: %s\r\n", strings.Trim(recipient, "<>"))
+	}
+	buf.Write(msg.Raw)
+
+	tmp := filepath.Join(r.path, "tmp", name)
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return nil, fmt.Errorf("maildir write error: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(r.path, "new", name)); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("maildir write error: %w", err)
+	}
+	logDebug("Maildir delivery: %s", name)
+	return &SendResult{MessageID: name, StatusCode: 250}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirRelaySend(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	relay, err := newRelay(testConfig(t, map[string]string{"BACKEND": "maildir", "MAILDIR_PATH": dir}))
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	if relay.Name() != "maildir" {
+		t.Fatalf("relay = %s, want maildir", relay.Name())
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			t.Errorf("%s directory not created: %v", sub, err)
+		}
+	}
+
+	raw := "From: app@example.com\r\nTo: user@example.org\r\nSubject: Hi\r\n\r\nHello\r\n"
+	var names []string
+	for i := 0; i < 2; i++ {
+		result, err := relay.Send(context.Background(), &Message{
+			From: "<app@example.com>",
+			To:   []string{"<user@example.org>", "hidden@example.org"},
+			Raw:  []byte(raw),
+		})
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if result.StatusCode != 250 || result.MessageID == "" {
+			t.Errorf("result = %+v", result)
+		}
+		names = append(names, result.MessageID)
+	}
+	if names[0] == names[1] {
+		t.Errorf("both deliveries are named %s", names[0])
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("new holds %d files (%v), want 2", len(entries), err)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp still holds %d files", len(tmp))
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "new", names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <app@example.com>\r\nDelivered-To: user@example.org\r\nDelivered-To: hidden@example.org\r\n" + raw
+	if string(got) != want {
+		t.Errorf("delivered file =\n%q\nwant\n%q", got, want)
+	}
+	if strings.ContainsAny(names[0], "/:") {
+		t.Errorf("file name %q is not Maildir-safe", names[0])
+	}
+}
+
+func TestMaildirRequiresPath(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"BACKEND": "maildir"}); err == nil || !strings.Contains(err.Error(), "MAILDIR_PATH") {
+		t.Errorf("err = %v, want one requiring MAILDIR_PATH", err)
+	}
+}
+
+func TestMaildirWriteError(t *testing.T) {
+	dir := t.TempDir()
+	relay, err := newMaildirRelay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = relay.Send(context.Background(), &Message{From: "app@example.com", To: []string{"user@example.org"}, Raw: []byte("Subject: Hi\r\n\r\nHi\r\n")})
+	if err == nil || !strings.Contains(err.Error(), "maildir write error") {
+		t.Errorf("err = %v, want a maildir write error", err)
+	}
+}
@@ -1,44 +1,318 @@
 // ContaCloud SMTP-to-SendGrid Relay
 //
 // Receives SMTP emails on port 25 (internal) and forwards them
-// to SendGrid via HTTP API (port 443).
+// to SendGrid via HTTP API (port 443), or to a downstream SMTP server.
 //
 // Designed for Kubernetes environments where outbound SMTP ports
 // (25, 465, 587) are blocked (e.g., DigitalOcean, GKE).
 //
-// Environment variables:
-//   - SENDGRID_API_KEY: SendGrid API key (required)
-//   - SMTP_LISTEN_ADDR: Address to listen on (default: ":25")
+// ALLOWED_SENDERS, ALLOWED_RECIPIENTS, DENIED_RECIPIENTS, SENDGRID_IP_POOLS and
+// SENDGRID_BYPASS_SENDERS are reloaded on SIGHUP.
+//
+// Environment variables (any of them may instead be set in CONFIG_FILE):
+//   - CONFIG_FILE: JSON file with settings keyed by variable name, e.g.
+//     {"SENDGRID_API_KEY": "SG.x", "ALLOWED_SENDERS": ["example.com"]} (optional)
+//   - BACKEND: Delivery backend: sendgrid, smtp, ses, maildir (default: "sendgrid")
+//   - SENDGRID_API_KEY: SendGrid API key (required for the sendgrid backend)
+//   - SENDGRID_API_KEY_FILE: File holding the API key, used when SENDGRID_API_KEY is empty
+//   - SENDGRID_HOST: SendGrid API base URL, e.g. https://api.eu.sendgrid.com (default: "https://api.sendgrid.com")
+//   - SENDGRID_TIMEOUT: Timeout for each SendGrid API call, 0 to disable (default: 20s)
+//   - SENDGRID_MAX_CONCURRENCY: Maximum concurrent SendGrid API calls, 0 for no limit (default: 0)
+//   - SENDGRID_KEY_ROUTES: Per-domain API keys as "domain=key,...", matched on the sender domain
+//     and then the recipient domains; SENDGRID_API_KEY is used otherwise (optional)
+//   - SENDGRID_PROXY_URL: HTTP proxy for SendGrid API calls, may include user:pass (default: HTTPS_PROXY/NO_PROXY)
+//   - SENDGRID_IP_POOL: Default SendGrid IP pool name (optional)
+//   - SENDGRID_IP_POOLS: Comma-separated IP pool names messages may select (optional)
+//   - SENDGRID_CLICK_TRACKING: Default click tracking: on, off (default: account setting)
+//   - SENDGRID_OPEN_TRACKING: Default open tracking: on, off (default: account setting)
+//   - SENDGRID_FOOTER: Default footer: on, off (default: on with SENDGRID_FOOTER_TEXT/HTML,
+//     otherwise account setting)
+//   - SENDGRID_FOOTER_TEXT, SENDGRID_FOOTER_HTML: Footer content, empty for the account footer (optional)
+//   - SENDGRID_BYPASS_SENDERS: Senders (addresses or domains) allowed to bypass list management (optional)
+//   - DEFAULT_FROM: From used when a message has no usable From header; unset rejects
+//     such messages (optional)
+//   - FROM_MAP: Verified From per original sender as "source=from,...", where source is
+//     an address, a domain or * for any other sender (optional)
+//   - ARCHIVE_BCC: Address that gets one Bcc copy of every SendGrid message, for an
+//     archive of all mail (optional)
+//   - SMTP_RELAY_ADDR: Upstream SMTP server host:port (required for the smtp backend)
+//   - SMTP_RELAY_USERNAME: Upstream SMTP username (optional)
+//   - SMTP_RELAY_PASSWORD: Upstream SMTP password (optional)
+//   - SMTP_RELAY_PASSWORD_FILE: File holding the upstream password, used when SMTP_RELAY_PASSWORD is empty
+//   - SMTP_RELAY_TLS: Upstream TLS mode: starttls, tls, none (default: "starttls")
+//   - SMTP_RELAY_POOL_SIZE: Idle upstream connections kept open for reuse, 0 dials per message (default: 0)
+//   - SMTP_RELAY_POOL_IDLE_TIMEOUT: Close pooled connections idle for longer than this (default: 30s)
+//   - AWS_REGION: SES region, or AWS_DEFAULT_REGION (required for the ses backend)
+//   - AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY: SES credentials (required for the ses backend)
+//   - AWS_SESSION_TOKEN: Session token for temporary SES credentials (optional)
+//   - SES_ENDPOINT: SES API base URL (default: "https://email.<AWS_REGION>.amazonaws.com")
+//   - SES_CONFIGURATION_SET: SES configuration set applied to every message (optional)
+//   - SES_TIMEOUT: Timeout for each SES API call, 0 to disable (default: 20s)
+//   - MAILDIR_PATH: Maildir messages are written to (required for the maildir backend)
+//   - SMTP_LISTEN_ADDR: Address to listen on, or unix:/path/to/sock (default: ":25")
+//   - PROTOCOL: smtp, or lmtp to answer LHLO and reply to DATA per recipient (default: "smtp")
 //   - SMTP_DOMAIN: Domain for SMTP server (default: "localhost")
+//   - SMTP_BANNER: Full 220 greeting text (default: "<SMTP_DOMAIN> ESMTP Service Ready")
+//   - SMTP_IDLE_TIMEOUT: Close sessions that send nothing for this long, 0 to only use the
+//     30s read timeout (default: 0)
+//   - ADD_RECEIVED_HEADER: Prepend a Received header recording the client and protocol
+//     to the relayed message (default: false)
+//   - DATA_MAX_DURATION: Close sessions that take longer than this to send a message body,
+//     0 for no limit (default: 0)
+//   - TLS_CERT_FILE: PEM certificate for STARTTLS (optional)
+//   - TLS_KEY_FILE: PEM private key for STARTTLS, required with TLS_CERT_FILE
+//   - ENABLE_DSN: Advertise DSN and accept NOTIFY/RET/ENVID; SendGrid receives ENVID and RET
+//     as custom args, the SMTP backend forwards them (default: false)
+//   - SMTP_USERS: Credentials clients must AUTH (PLAIN or LOGIN) with, as "user:password,...";
+//     passwords may be bcrypt hashes. Also SMTP_USERS_FILE, one per line (optional)
+//   - TLS_MIN_VERSION: Oldest TLS version accepted for STARTTLS: 1.0, 1.1, 1.2 or 1.3
+//     (default: 1.2)
+//   - TLS_CIPHERS: Comma-separated TLS 1.0-1.2 cipher suites offered, e.g.
+//     TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; empty for Go's defaults (optional)
+//   - TLS_CLIENT_CA_FILE: PEM CA bundle; clients must STARTTLS with a certificate it verifies (optional)
+//   - TLS_CLIENT_ALLOWED_CNS: Comma-separated client certificate CNs accepted, empty for any
+//     verified certificate (optional)
 //   - LOG_LEVEL: Logging level: debug, info, warn, error (default: "info")
+//   - LOG_BODIES: Log the start of each message body at debug level, for deep debugging
+//     only (default: false)
+//   - LOG_BODY_MAX_BYTES: Body bytes logged with LOG_BODIES (default: 1024)
+//   - LOG_BODY_REDACT: Patterns masked in logged bodies: email, number or none (default: "email,number")
 //   - ALLOWED_SENDERS: Comma-separated list of allowed sender domains (optional)
+//   - ALLOWED_RECIPIENTS: Comma-separated recipient domains mail may be delivered to,
+//     "*.example.com" for subdomains (optional)
+//   - DENIED_RECIPIENTS: Comma-separated recipient domains always refused, same syntax (optional)
+//   - VALIDATE_HEADER_FROM: Also check the From header against ALLOWED_SENDERS (default: false)
+//   - REQUIRE_SENDER_ALIGNMENT: Reject messages whose MAIL FROM domain does not align with the
+//     From header domain (default: false)
+//   - MAX_MESSAGE_BYTES: Maximum message size, advertised via SIZE (default: 26214400)
+//   - MAX_HEADER_BYTES: Maximum size of the message header block, 0 to disable (default: 131072)
+//   - MAX_HEADER_COUNT: Maximum number of header fields, 0 to disable (default: 1000)
+//   - MAX_TEXT_BYTES: Maximum text/plain content size, 0 to disable (default: 0)
+//   - MAX_HTML_BYTES: Maximum text/html content size, 0 to disable (default: 0)
+//   - DEFAULT_CHARSET: Charset of text parts that declare none (default: "utf-8")
+//   - FALLBACK_CHARSET: Charset assumed for 8-bit text that is not valid in an undeclared
+//     UTF-8 or in us-ascii (default: "windows-1252")
+//   - LINK_REWRITE_BASE: Click-tracking URL HTML links are rewritten through, with {url} or
+//     appended as the escaped original, e.g. "https://click.example.com/r?u=" (optional)
+//   - NORMALIZE_LINE_ENDINGS: Convert bare LF/CR in text and HTML content to CRLF (default: false)
+//   - WRAP_LONG_LINES: Wrap content lines longer than 998 octets (default: false)
+//   - AUTO_ALTERNATIVE: Generate the missing text or HTML content from the other, so
+//     SendGrid messages always carry both (default: false)
+//   - ATTACHMENT_SPILL_BYTES: Encoded attachment size above which it is buffered in a
+//     temp file instead of memory, 0 to always use memory (default: 1048576)
+//   - MAX_ATTACHMENTS: Maximum attachments per message, 0 to disable (default: 0)
+//   - MAX_TOTAL_ATTACHMENT_BYTES: Maximum encoded size of all attachments, 0 to disable
+//     (default: 31457280, SendGrid's 30 MB limit)
+//   - OVERSIZE_POLICY: What to do with oversized content or attachments over the limits:
+//     truncate (drop for attachments), reject (default: "truncate")
+//   - EMPTY_BODY_POLICY: What to do with SendGrid messages without a body: placeholder or
+//     reject (default: "placeholder")
+//   - EMPTY_BODY_PLACEHOLDER: Text sent as the body of empty messages (default: " ")
+//   - SUBJECT_PREFIX: Text prepended to every subject, e.g. "[Staging] " (optional)
+//   - SUBJECT_REWRITE: Regex subject rewrite as "pattern=>replacement" (optional)
+//   - SENDER_STRIP_HEADERS: Headers removed from the mail of a sender (address or domain) as
+//     "sender=Header Header,..." (optional)
+//   - MAX_INFLIGHT_BYTES: Message bytes held in memory across sessions and the send queue,
+//     0 to disable (default: 0)
+//   - INFLIGHT_MODE: When MAX_INFLIGHT_BYTES is used up: reject (451) or wait (default: "reject")
+//   - INFLIGHT_WAIT_TIMEOUT: How long wait mode waits for bytes before answering 451 (default: 30s)
+//   - SEND_WORKERS: Number of send workers, 0 sends inline from each SMTP session (default: 0)
+//   - SEND_QUEUE_SIZE: Messages that may wait for a worker before clients get 451 (default: 100)
+//   - SEND_QUEUE_MODE: wait (reply after the send) or async (reply once queued) (default: "wait")
+//   - SEND_RETRIES: Retries of temporary send failures (default: 0)
+//   - SEND_RETRY_DELAY: Delay before the first retry, doubled on each retry (default: 1s)
+//   - DEAD_LETTER_DIR: Directory where messages that still fail are written (optional)
+//   - DRY_RUN: Build SendGrid/SES requests but never call the API (default: false)
+//   - GREYLIST_DELAY: Defer first-seen (sender, recipient, IP) triples for this long, 0 to disable (default: 0)
+//   - GREYLIST_TTL: Forget greylist triples not seen for this long (default: 24h)
+//   - DUPLICATE_TTL: Catch messages resent with the same Message-ID, sender and recipients
+//     within this long of a successful send, 0 to disable (default: 0)
+//   - DUPLICATE_POLICY: What to do with a duplicate: drop (accept and discard) or reject (default: "drop")
+//   - MAX_SESSION_RECIPIENTS: Maximum recipients per connection across RSET and STARTTLS,
+//     0 to disable (default: 0)
+//   - MAX_CONNECTIONS_PER_IP: Maximum open SMTP connections per client IP, 0 to disable (default: 0)
+//   - MAX_ACTIVE_SESSIONS: Open SMTP connections above which new ones get 421, 0 to disable (default: 0)
+//   - PARSE_HEADER_TO: Use To header display names for envelope recipients (default: false)
+//   - ONE_PERSONALIZATION_PER_RECIPIENT: Send each recipient a private copy (default: false)
+//   - SENDER_DAILY_QUOTA: Daily send limit per sender domain, e.g. "500,example.com=5000" (optional)
+//   - REJECT_MSG_SENDER, REJECT_MSG_RECIPIENT, REJECT_MSG_RATE, REJECT_MSG_RECIPIENTS,
+//     REJECT_MSG_GREYLIST, REJECT_MSG_HEADER_FROM, REJECT_MSG_ALIGNMENT, REJECT_MSG_SUPPRESSED,
+//     REJECT_MSG_DUPLICATE: Reply for each policy rejection as "[code] [enhanced-code] text"
+//     (optional)
+//   - HEARTBEAT_INTERVAL: Log session and send counts this often, 0 to disable (default: 0)
+//   - SHUTDOWN_TIMEOUT: Time open sessions get to finish on SIGTERM/SIGINT before they are
+//     force-closed, and then the send queue to drain before it is dead-lettered (default: 30s)
+//   - HTTP_ADDR: Address for the HTTP server exposing /metrics and /status (optional)
+//   - DEBUG_MESSAGE_LOG_SIZE: Summaries of the last N relayed messages served on HTTP_ADDR
+//     at /debug/messages, 0 to disable (default: 0)
+//   - DEBUG_TOKEN: Bearer token required by /debug/messages (or DEBUG_TOKEN_FILE)
+//   - EVENT_WEBHOOK_URL: URL each send result is POSTed to as JSON, best-effort (optional)
+//   - EVENT_WEBHOOK_TIMEOUT: Timeout of each event webhook request (default: 5s)
+//   - HTTP_INGEST_ADDR: Address for the HTTP endpoint accepting messages as JSON (optional)
+//   - HTTP_INGEST_TOKEN: Bearer token required by HTTP_INGEST_ADDR (or HTTP_INGEST_TOKEN_FILE)
+//   - SENDGRID_WEBHOOK_ADDR: Address for the SendGrid event webhook feeding the suppression list (optional)
+//   - SENDGRID_WEBHOOK_PUBLIC_KEY: Signed Event Webhook verification key, required with
+//     SENDGRID_WEBHOOK_ADDR
+//   - SUPPRESSION_FILE: JSON file the suppression list is persisted to (optional, in memory otherwise)
+//   - OTEL_EXPORTER_OTLP_ENDPOINT: Enables OpenTelemetry tracing over OTLP/HTTP (optional,
+//     standard OTEL_* variables apply)
+//   - DKIM_PRIVATE_KEY_FILE: PEM private key used to DKIM-sign messages (optional)
+//   - DKIM_DOMAIN: DKIM signing domain (d=), required with DKIM_PRIVATE_KEY_FILE
+//   - DKIM_SELECTOR: DKIM selector (s=), required with DKIM_PRIVATE_KEY_FILE
 
 package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"mime"
-	"mime/multipart"
+	"net"
+	"net/http"
 	"net/mail"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
-	"github.com/sendgrid/sendgrid-go"
-	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 // Config holds the relay configuration
 type Config struct {
-	SendGridAPIKey string
-	ListenAddr     string
-	Domain         string
-	LogLevel       string
-	AllowedSenders []string
+	Backend                        string
+	SendGridAPIKey                 string
+	SendGridKeyRoutes              []keyRoute
+	SendGridHost                   string
+	SendGridProxyURL               string
+	SendGridTimeout                time.Duration
+	SendGridMaxConcurrency         int
+	SendGridIPPool                 string
+	SendGridIPPools                []string
+	ClickTracking                  string
+	OpenTracking                   string
+	Footer                         string
+	FooterText                     string
+	FooterHTML                     string
+	BypassListSenders              []string
+	SenderStripHeaders             []headerStripRule
+	DefaultFrom                    *mail.Address
+	ArchiveBcc                     string
+	FromMap                        []fromMapping
+	SMTPRelayAddr                  string
+	SMTPRelayUsername              string
+	SMTPRelayPassword              string
+	SMTPRelayTLS                   string
+	SMTPRelayPoolSize              int
+	SMTPRelayPoolIdleTimeout       time.Duration
+	SESRegion                      string
+	SESEndpoint                    string
+	SESAccessKeyID                 string
+	SESSecretAccessKey             string
+	SESSessionToken                string
+	SESConfigurationSet            string
+	SESTimeout                     time.Duration
+	MaildirPath                    string
+	ListenAddr                     string
+	Protocol                       string
+	Domain                         string
+	Banner                         string
+	AddReceivedHeader              bool
+	TLSCertFile                    string
+	TLSKeyFile                     string
+	TLSClientCAFile                string
+	TLSMinVersion                  uint16
+	TLSCipherSuites                []uint16
+	TLSClientCNs                   []string
+	SMTPUsers                      credentials
+	LogLevel                       string
+	LogBodies                      bool
+	LogBodyMaxBytes                int
+	LogBodyRedact                  []string
+	AllowedSenders                 []string
+	AllowedRecipients              []string
+	DeniedRecipients               []string
+	ValidateHeaderFrom             bool
+	RequireSenderAlignment         bool
+	MaxMessageBytes                int
+	MaxHeaderBytes                 int
+	MaxHeaderCount                 int
+	MaxSessionRecipients           int
+	MaxConnectionsPerIP            int
+	MaxActiveSessions              int
+	MaxTextBytes                   int
+	MaxHTMLBytes                   int
+	DefaultCharset                 string
+	FallbackCharset                string
+	LinkRewriteBase                string
+	NormalizeLineEndings           bool
+	WrapLongLines                  bool
+	AutoAlternative                bool
+	AttachmentSpillBytes           int
+	MaxAttachments                 int
+	MaxAttachmentBytes             int
+	OversizePolicy                 string
+	EmptyBodyPolicy                string
+	EmptyBodyPlaceholder           string
+	SubjectPrefix                  string
+	SubjectRewrite                 *regexp.Regexp
+	SubjectReplacement             string
+	ParseHeaderTo                  bool
+	OnePersonalizationPerRecipient bool
+	DryRun                         bool
+	SenderDailyQuota               string
+	GreylistDelay                  time.Duration
+	GreylistTTL                    time.Duration
+	DuplicateTTL                   time.Duration
+	DuplicatePolicy                string
+	Rejections                     map[string]smtp.SMTPError
+	SendWorkers                    int
+	SendQueueSize                  int
+	SendQueueMode                  string
+	MaxInflightBytes               int
+	InflightMode                   string
+	InflightWaitTimeout            time.Duration
+	SendRetries                    int
+	SendRetryDelay                 time.Duration
+	DeadLetterDir                  string
+	HTTPAddr                       string
+	HTTPIngestAddr                 string
+	HTTPIngestToken                string
+	DebugMessageLogSize            int
+	DebugToken                     string
+	EventWebhookURL                string
+	EventWebhookTimeout            time.Duration
+	EnableDSN                      bool
+	SendGridWebhookAddr            string
+	SendGridWebhookPublicKey       string
+	SuppressionFile                string
+	HeartbeatInterval              time.Duration
+	IdleTimeout                    time.Duration
+	DataMaxDuration                time.Duration
+	ShutdownTimeout                time.Duration
+	DKIMPrivateKeyFile             string
+	DKIMDomain                     string
+	DKIMSelector                   string
 }
 
 // Logger levels
@@ -92,80 +366,546 @@ func logError(format string, v ...interface{}) {
 	}
 }
 
+// senderAllowed reports whether from matches ALLOWED_SENDERS.
+// All senders are allowed when the list is empty.
+func (c *Config) senderAllowed(from string) bool {
+	allowlistMu.RLock()
+	defer allowlistMu.RUnlock()
+
+	if len(c.AllowedSenders) == 0 {
+		return true
+	}
+
+	fromLower := strings.ToLower(from)
+	for _, domain := range c.AllowedSenders {
+		if strings.HasSuffix(fromLower, "@"+strings.ToLower(domain)) ||
+			strings.HasSuffix(fromLower, "."+strings.ToLower(domain)+">") {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientAllowed reports whether to may receive mail under
+// DENIED_RECIPIENTS and ALLOWED_RECIPIENTS. A denied domain always wins; all
+// other recipients are allowed when ALLOWED_RECIPIENTS is empty.
+func (c *Config) recipientAllowed(to string) bool {
+	allowlistMu.RLock()
+	defer allowlistMu.RUnlock()
+
+	domain := addressDomain(to)
+	for _, pattern := range c.DeniedRecipients {
+		if domainMatches(domain, pattern) {
+			return false
+		}
+	}
+	if len(c.AllowedRecipients) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedRecipients {
+		if domainMatches(domain, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatches reports whether domain matches pattern, a domain or
+// "*.domain" for any of its subdomains
+func domainMatches(domain, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if parent, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(domain, "."+parent)
+	}
+	return domain == pattern
+}
+
+// hasAllowedSenders reports whether ALLOWED_SENDERS restricts senders
+func (c *Config) hasAllowedSenders() bool {
+	allowlistMu.RLock()
+	defer allowlistMu.RUnlock()
+	return len(c.AllowedSenders) > 0
+}
+
+// ipPoolAllowed reports whether pool may be used. Any pool is allowed when
+// SENDGRID_IP_POOLS is empty.
+func (c *Config) ipPoolAllowed(pool string) bool {
+	allowlistMu.RLock()
+	defer allowlistMu.RUnlock()
+
+	if len(c.SendGridIPPools) == 0 {
+		return true
+	}
+	for _, allowed := range c.SendGridIPPools {
+		if strings.EqualFold(pool, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCNAllowed reports whether cn is listed in TLS_CLIENT_ALLOWED_CNS.
+// Any verified certificate is allowed when the list is empty.
+func (c *Config) clientCNAllowed(cn string) bool {
+	if len(c.TLSClientCNs) == 0 {
+		return true
+	}
+	for _, allowed := range c.TLSClientCNs {
+		if cn == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassAllowed reports whether from is listed in SENDGRID_BYPASS_SENDERS,
+// as an address or a domain. An empty list allows nobody.
+func (c *Config) bypassAllowed(from string) bool {
+	allowlistMu.RLock()
+	defer allowlistMu.RUnlock()
+
+	from = strings.ToLower(strings.Trim(from, "<>"))
+	for _, allowed := range c.BypassListSenders {
+		allowed = strings.ToLower(allowed)
+		if from == allowed || addressDomain(from) == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteSubject applies SUBJECT_REWRITE and then SUBJECT_PREFIX to a
+// decoded subject
+func (c *Config) rewriteSubject(subject string) string {
+	if c.SubjectRewrite != nil {
+		subject = c.SubjectRewrite.ReplaceAllString(subject, c.SubjectReplacement)
+	}
+	if c.SubjectPrefix != "" && !strings.HasPrefix(subject, c.SubjectPrefix) {
+		subject = c.SubjectPrefix + subject
+	}
+	return subject
+}
+
 // Backend implements smtp.Backend
 type Backend struct {
 	config *Config
+	relay  Relay
+	dkim   *dkim.SignOptions
+	quota  *senderQuota
+	grey   *greylist
+	dedup  *dedupCache
+
+	// suppressions holds recipients that bounced or complained, nil when
+	// neither SENDGRID_WEBHOOK_ADDR nor SUPPRESSION_FILE is set
+	suppressions *suppressionList
+
+	// messages keeps the last DEBUG_MESSAGE_LOG_SIZE summaries, nil when
+	// disabled
+	messages *messageLog
+
+	// events posts each send result to EVENT_WEBHOOK_URL, nil when disabled
+	events *eventWebhook
+
+	// inflight bounds the message bytes held by sessions and the send queue
+	inflight *byteBudget
+	pool     *sendPool
+
+	// connRecipients counts recipients per connection across RSET, repeated
+	// EHLO and STARTTLS, which each start a new Session. It is keyed by the
+	// accepted net.Conn, which outlives them, and an entry is only dropped
+	// once the connection closes. ipConns counts the connections in it per
+	// client IP for MAX_CONNECTIONS_PER_IP.
+	mu             sync.Mutex
+	connRecipients map[net.Conn]*int
+	ipConns        map[string]int
 }
 
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	remoteAddr := c.Conn().RemoteAddr().String()
 	logDebug("New SMTP session from %s", remoteAddr)
+	// After STARTTLS go-smtp starts a new session, which sees the handshake.
+	// The CA verified the chain, so the leaf's CN identifies the client.
+	var clientCN string
+	if state, ok := c.TLSConnectionState(); ok {
+		if len(state.VerifiedChains) > 0 {
+			clientCN = state.PeerCertificates[0].Subject.CommonName
+		}
+		logTLSConnection(remoteAddr, state)
+	}
+	recipients, ok := bkd.admitConn(c)
+	if !ok {
+		auditRejection("EHLO", reasonConnectionLimit, remoteAddr, "", nil,
+			fmt.Sprintf("over MAX_CONNECTIONS_PER_IP of %d", bkd.config.MaxConnectionsPerIP))
+		closeConn(c, errTooManyConnections)
+		return nil, errTooManyConnections
+	}
 	return &Session{
+		backend:    bkd,
 		config:     bkd.config,
+		conn:       c,
 		remoteAddr: remoteAddr,
+		clientCN:   clientCN,
+		recipients: recipients,
+		start:      time.Now(),
 	}, nil
 }
 
+// errTooManyConnections refuses clients over MAX_CONNECTIONS_PER_IP
+var errTooManyConnections = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many connections from your IP, closing connection",
+}
+
+// admitConn returns the recipient counter shared by all sessions of a
+// connection. A connection seen for the first time is counted against
+// MAX_CONNECTIONS_PER_IP, and refused when its IP is already at the limit.
+func (bkd *Backend) admitConn(c *smtp.Conn) (*int, bool) {
+	conn := acceptedConn(c)
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	if count, ok := bkd.connRecipients[conn]; ok {
+		return count, true
+	}
+
+	if ip := connIP(conn); ip != "" {
+		if max := bkd.config.MaxConnectionsPerIP; max > 0 && bkd.ipConns[ip] >= max {
+			return nil, false
+		}
+		if bkd.ipConns == nil {
+			bkd.ipConns = make(map[string]int)
+		}
+		bkd.ipConns[ip]++
+	}
+	if bkd.connRecipients == nil {
+		bkd.connRecipients = make(map[net.Conn]*int)
+	}
+	count := new(int)
+	bkd.connRecipients[conn] = count
+	return count, true
+}
+
+// forgetConn releases a connection admitted by admitConn. It is called by
+// the closeListener once the connection closes, not on Logout, which
+// STARTTLS triggers too.
+func (bkd *Backend) forgetConn(conn net.Conn) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	if _, ok := bkd.connRecipients[conn]; !ok {
+		return
+	}
+	delete(bkd.connRecipients, conn)
+	if ip := connIP(conn); ip != "" {
+		if bkd.ipConns[ip]--; bkd.ipConns[ip] <= 0 {
+			delete(bkd.ipConns, ip)
+		}
+	}
+}
+
+// acceptedConn returns the connection the listener accepted for c, which
+// STARTTLS wraps in a tls.Conn
+func acceptedConn(c *smtp.Conn) net.Conn {
+	conn := c.Conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.NetConn()
+	}
+	return conn
+}
+
+// connIP returns the client IP of conn, with IPv4-mapped IPv6 addresses in
+// their IPv4 form so both count as the same client. Unix socket clients
+// have none and are not limited.
+func connIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+// closeConns force-closes the open SMTP sessions and returns their remote
+// addresses, sorted. go-smtp's Server.Close does nothing once Shutdown has
+// begun, so shutdown closes the connections through here instead.
+func (bkd *Backend) closeConns() []string {
+	bkd.mu.Lock()
+	conns := make([]net.Conn, 0, len(bkd.connRecipients))
+	for conn := range bkd.connRecipients {
+		conns = append(conns, conn)
+	}
+	bkd.mu.Unlock()
+
+	// Closing calls forgetConn, which takes bkd.mu
+	remotes := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		remotes = append(remotes, conn.RemoteAddr().String())
+		conn.Close()
+	}
+	sort.Strings(remotes)
+	return remotes
+}
+
 // Session implements smtp.Session
 type Session struct {
+	backend    *Backend
 	config     *Config
+	conn       *smtp.Conn
 	remoteAddr string
+	clientCN   string        // CN of the verified TLS client certificate, if any
+	authUser   string        // SMTP_USERS user the client authenticated as, if any
+	recipients *int          // recipients accepted on this connection so far
+	size       int64         // SIZE declared in MAIL FROM, 0 if none
+	body       smtp.BodyType // BODY declared in MAIL FROM, empty if none
 	from       string
 	to         []string
+	utf8       bool
+	dsn        dsnRequest // DSN parameters of the transaction
+
+	// recipients the backend did not accept in the last delivered message,
+	// reported one by one in LMTP mode
+	rejected map[string]string
+
+	start    time.Time // when the session started, for smtp_relay_session_duration_seconds
+	dataDone bool      // set by Data, go-smtp resets the session after DATA without an RSET
 }
 
-func (s *Session) AuthPlain(username, password string) error {
-	// No authentication required for internal relay
-	logDebug("Auth attempt from %s (ignored - internal relay)", s.remoteAddr)
-	return nil
+// countCommand counts an SMTP command in smtp_relay_smtp_commands_total.
+// HTTP ingest sessions go through the same methods and are not counted.
+func (s *Session) countCommand(command string) {
+	if s.conn != nil {
+		smtpCommands.WithLabelValues(command).Inc()
+	}
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	// Validate sender if allowed list is configured
-	if len(s.config.AllowedSenders) > 0 {
-		allowed := false
-		fromLower := strings.ToLower(from)
-		for _, domain := range s.config.AllowedSenders {
-			if strings.HasSuffix(fromLower, "@"+strings.ToLower(domain)) ||
-				strings.HasSuffix(fromLower, "."+strings.ToLower(domain)+">") {
-				allowed = true
-				break
-			}
+	s.countCommand("MAIL")
+
+	// With SMTP_USERS, SMTP clients must authenticate first
+	if s.conn != nil && len(s.config.SMTPUsers) > 0 && s.authUser == "" {
+		auditRejection("MAIL", reasonAuthRequired, s.remoteAddr, from, nil, "not authenticated")
+		return errAuthRequired
+	}
+
+	// With TLS_CLIENT_CA_FILE, SMTP clients must present an allowed
+	// certificate. HTTP ingest sessions have no conn and their own token.
+	if s.conn != nil && s.config.TLSClientCAFile != "" {
+		if s.clientCN == "" {
+			auditRejection("MAIL", reasonClientCertRequired, s.remoteAddr, from, nil, "no verified client certificate")
+			return errClientCertRequired
 		}
-		if !allowed {
-			logWarn("Rejected sender %s (not in allowed list)", from)
-			return fmt.Errorf("sender domain not allowed")
+		if !s.config.clientCNAllowed(s.clientCN) {
+			auditRejection("MAIL", reasonClientCertRequired, s.remoteAddr, from, nil, fmt.Sprintf("client certificate CN %q not in TLS_CLIENT_ALLOWED_CNS", s.clientCN))
+			return errClientCertNotAllowed
 		}
 	}
 
+	// Validate sender if allowed list is configured
+	if !s.config.senderAllowed(from) {
+		auditRejection("MAIL", reasonSenderNotAllowed, s.remoteAddr, from, nil, "not in ALLOWED_SENDERS")
+		return s.config.rejection(rejectSender)
+	}
+
+	// Enforce the per-sender-domain daily quota
+	if s.backend.quota != nil && s.backend.quota.Exceeded(addressDomain(from)) {
+		auditRejection("MAIL", reasonQuotaExceeded, s.remoteAddr, from, nil, "daily quota exceeded")
+		return s.config.rejection(rejectRate)
+	}
+
 	s.from = from
-	logDebug("MAIL FROM: %s", from)
+	s.utf8 = opts != nil && opts.UTF8
+	s.size = 0
+	s.body = ""
+	if opts != nil {
+		s.size = opts.Size
+		s.body = opts.Body
+	}
+	s.dsn.setMail(opts)
+	if s.dsn.EnvelopeID != "" || s.dsn.Return != "" {
+		logDebug("DSN requested for %s: envid=%q ret=%s", from, s.dsn.EnvelopeID, s.dsn.Return)
+	}
+	if opts != nil && opts.Size > 0 {
+		logDebug("MAIL FROM: %s (declared size %d)", from, opts.Size)
+	} else {
+		logDebug("MAIL FROM: %s", from)
+	}
 	return nil
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.countCommand("RCPT")
+
+	// Cap recipients per connection, MaxRecipients only caps a transaction
+	if max := s.config.MaxSessionRecipients; max > 0 && *s.recipients >= max {
+		s.audit("RCPT", reasonRecipientLimit, fmt.Sprintf("recipient %s over session limit of %d", to, max))
+		return s.config.rejection(rejectRecipients)
+	}
+
+	// SES takes one call per message, see errSESTooManyRecipients
+	if s.config.Backend == "ses" && len(s.to) >= sesMaxRecipients {
+		s.audit("RCPT", reasonRecipientLimit, fmt.Sprintf("recipient %s over the SES limit of %d", to, sesMaxRecipients))
+		return errSESTooManyRecipients
+	}
+
+	// Keep recipients within ALLOWED_RECIPIENTS/DENIED_RECIPIENTS
+	if !s.config.recipientAllowed(to) {
+		s.audit("RCPT", reasonRecipientNotAllowed, fmt.Sprintf("recipient %s not allowed by ALLOWED_RECIPIENTS/DENIED_RECIPIENTS", to))
+		return s.config.rejection(rejectRecipient)
+	}
+
+	// Known-bad recipients would only bounce or complain again
+	if s.backend.suppressions != nil {
+		if entry, ok := s.backend.suppressions.Lookup(to); ok {
+			s.audit("RCPT", reasonSuppressed, fmt.Sprintf("recipient %s suppressed after %s", to, entry.Event))
+			reply := s.config.rejection(rejectSuppressed)
+			reply.Message += " (" + entry.Event + ")"
+			return reply
+		}
+	}
+
+	// Defer first-seen (sender, recipient, IP) triples
+	if s.backend.grey != nil && !s.backend.grey.Allow(s.from, to, s.remoteAddr) {
+		s.audit("RCPT", reasonGreylisted, fmt.Sprintf("recipient %s greylisted", to))
+		return s.config.rejection(rejectGreylist)
+	}
+	*s.recipients++
+
 	s.to = append(s.to, to)
-	logDebug("RCPT TO: %s", to)
+	s.dsn.addRcpt(to, opts)
+	if opts != nil && len(opts.Notify) > 0 {
+		logDebug("RCPT TO: %s (notify %s)", to, notifyString(opts.Notify))
+	} else {
+		logDebug("RCPT TO: %s", to)
+	}
 	return nil
 }
 
-func (s *Session) Data(r io.Reader) error {
+// errClientCertRequired and errClientCertNotAllowed reject MAIL FROM from
+// clients without an acceptable certificate under TLS_CLIENT_CA_FILE
+var (
+	errClientCertRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Client certificate required, issue STARTTLS first",
+	}
+	errClientCertNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Client certificate not allowed",
+	}
+)
+
+// errNoRecipients rejects DATA when no recipient was accepted
+var errNoRecipients = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "No valid recipients",
+}
+
+// Replies for messages that fail before reaching the backend, with the
+// RFC 3463 code of each cause
+var (
+	errReadFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Failed to read message data, try again",
+	}
+	errParseFailed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Malformed message",
+	}
+	errSignFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to sign message, try again later",
+	}
+)
+
+func (s *Session) Data(r io.Reader) (err error) {
 	startTime := time.Now()
+	s.countCommand("DATA")
+	defer func() { s.dataDone = true }()
+
+	// go-smtp answers DATA without an accepted RCPT itself, this guards the
+	// other callers (HTTP ingest) so no backend sees an empty envelope
+	if len(s.to) == 0 {
+		s.audit("DATA", reasonNoRecipients, "no accepted recipients")
+		return errNoRecipients
+	}
 
-	// Read the entire message
-	data, err := io.ReadAll(r)
+	// Reserve the declared size against MAX_INFLIGHT_BYTES before buffering
+	// the message
+	reserve := s.size
+	if reserve <= 0 {
+		reserve = defaultInflightReserve
+	}
+	res, ok := s.backend.inflight.Reserve(reserve)
+	if !ok {
+		s.audit("DATA", reasonInflightLimit, fmt.Sprintf("%d bytes over MAX_INFLIGHT_BYTES", reserve))
+		return errInflightFull
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			res.Release()
+		}
+	}()
+
+	// Bound the whole DATA phase with DATA_MAX_DURATION. Unblocking a
+	// pending read needs the connection, HTTP ingest bodies are in memory.
+	if d := s.config.DataMaxDuration; d > 0 {
+		var abort func()
+		if s.conn != nil {
+			abort = func() { s.conn.Conn().SetReadDeadline(time.Now()) }
+		}
+		dr := newDeadlineReader(r, d, abort)
+		defer dr.Stop()
+		r = dr
+	}
+
+	// Read the entire message, or only its header when the backend takes
+	// the body as a stream. With CHUNKING, r streams the concatenated BDAT
+	// chunks and fails with ErrDataReset if the client aborts.
+	var data []byte
+	var stream *countingReader
+	if s.streamRelay() {
+		var rest io.Reader
+		data, rest, err = readHeaderBlock(r, s.config.MaxHeaderBytes)
+		if rest != nil {
+			stream = &countingReader{r: rest}
+		}
+	} else {
+		data, err = io.ReadAll(r)
+	}
 	if err != nil {
-		logError("Failed to read email data: %v", err)
-		return fmt.Errorf("failed to read email data: %w", err)
+		return s.readFailed(err, int64(len(data)))
 	}
 
-	logDebug("Received email data: %d bytes", len(data))
+	if stream != nil {
+		logDebug("Received email header: %d bytes, streaming the body", len(data))
+	} else {
+		logDebug("Received email data: %d bytes", len(data))
+	}
+	res.Grow(int64(len(data)))
+	if s.body != smtp.Body8BitMIME && has8Bit(data) {
+		// Accepted anyway, decodeText reads the bytes by their charset
+		logDebug("8-bit content from %s without BODY=8BITMIME", s.remoteAddr)
+	}
+
+	// Bound the header block before handing it to the parser
+	if err := s.checkHeaderLimits(data); err != nil {
+		return err
+	}
 
 	// Parse the email
+	parseStart := time.Now()
 	msg, err := mail.ReadMessage(bytes.NewReader(data))
 	if err != nil {
-		logError("Failed to parse email: %v", err)
-		return fmt.Errorf("failed to parse email: %w", err)
+		s.audit("DATA", reasonParseFailed, err.Error())
+		return errParseFailed
 	}
 
 	// Extract headers
@@ -177,160 +917,525 @@ func (s *Session) Data(r io.Reader) error {
 	logDebug("From header: %s", from)
 	logDebug("Content-Type: %s", contentType)
 
+	// Optionally hold the From header to the same allowlist as MAIL FROM
+	if s.config.ValidateHeaderFrom && s.config.hasAllowedSenders() {
+		headerFrom, err := parseAddress(from)
+		if err != nil || !s.config.senderAllowed(headerFrom.Address) {
+			s.audit("DATA", reasonHeaderFromNotAllowed, fmt.Sprintf("From header %q not in ALLOWED_SENDERS", from))
+			return s.config.rejection(rejectHeaderFrom)
+		}
+	}
+
+	// Optionally require the MAIL FROM and From header domains to align,
+	// relaxed as in DMARC: equal, or one a subdomain of the other. Bounces
+	// (null MAIL FROM) have no envelope domain to align.
+	if s.config.RequireSenderAlignment && s.from != "" {
+		envelope := addressDomain(s.from)
+		headerDomain := ""
+		if headerFrom, err := parseAddress(from); err == nil {
+			headerDomain = addressDomain(headerFrom.Address)
+		}
+		if !domainsAligned(envelope, headerDomain) {
+			s.audit("DATA", reasonSenderNotAligned, fmt.Sprintf("MAIL FROM domain %q does not align with From header %q", envelope, from))
+			return s.config.rejection(rejectAlignment)
+		}
+	}
+
+	// Catch a client resubmitting a message already sent within
+	// DUPLICATE_TTL. Messages are only recorded once sent, so a retry after a
+	// failure goes through.
+	messageID := msg.Header.Get("Message-Id")
+	dedupID := dedupKey(messageID, s.from, s.to)
+	if s.backend.dedup.Seen(dedupID) {
+		if s.config.DuplicatePolicy == "reject" {
+			s.audit("DATA", reasonDuplicateMessage, fmt.Sprintf("Message-ID %s already sent", messageID))
+			return s.config.rejection(rejectDuplicate)
+		}
+		logWarn("Dropped duplicate message: from=%s to=%v message_id=%s", s.from, s.to, messageID)
+		return nil
+	}
+
 	// Read and parse body
 	body, err := io.ReadAll(msg.Body)
 	if err != nil {
-		logError("Failed to read email body: %v", err)
-		return fmt.Errorf("failed to read email body: %w", err)
+		s.audit("DATA", reasonReadFailed, err.Error())
+		return errReadFailed
 	}
 
-	// Send via SendGrid
-	err = s.sendViaSendGrid(from, s.to, subject, body, contentType)
-	if err != nil {
-		logError("Failed to send via SendGrid: %v", err)
-		return err
+	// Start the message span now that the traceparent header (if any) is
+	// known, backdated so it covers the whole DATA phase
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(msg.Header))
+	ctx, span := tracer.Start(ctx, "smtp.data",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(startTime),
+		trace.WithAttributes(
+			attribute.Int("smtp.recipients", len(s.to)),
+			attribute.Int("smtp.message.size", len(data)),
+		))
+	defer span.End()
+	_, parseSpan := tracer.Start(ctx, "smtp.parse", trace.WithTimestamp(parseStart))
+	parseSpan.End()
+
+	// Never forward the Bcc header, blind recipients are delivered through
+	// the envelope only
+	bcc := headerAddresses(msg.Header.Get("Bcc"))
+	delete(msg.Header, "Bcc")
+	raw := stripHeaders(data, "Bcc")
+
+	// Drop the headers SENDER_STRIP_HEADERS keeps from this sender's mail,
+	// e.g. tracking or list headers it must not send
+	if names := s.config.strippedHeaders(s.from); len(names) > 0 {
+		for _, name := range names {
+			delete(msg.Header, name)
+		}
+		raw = stripHeaders(raw, names...)
+		logDebug("Stripped headers for %s: %s", s.from, strings.Join(names, ", "))
 	}
 
-	duration := time.Since(startTime)
-	logInfo("Email sent successfully: from=%s to=%v subject=%q duration=%v",
-		s.from, s.to, truncate(subject, 50), duration)
-
-	return nil
-}
-
-func (s *Session) sendViaSendGrid(from string, to []string, subject string, body []byte, contentType string) error {
-	// Parse from address
-	fromAddr, err := mail.ParseAddress(from)
-	if err != nil {
-		// Use raw address if parsing fails
-		fromAddr = &mail.Address{Address: strings.Trim(from, "<>")}
+	// Apply SUBJECT_REWRITE/SUBJECT_PREFIX to the decoded subject, before
+	// signing so the signature covers the subject recipients see
+	if newSubject := s.config.rewriteSubject(subject); newSubject != subject {
+		encoded := mime.QEncoding.Encode("utf-8", newSubject)
+		msg.Header["Subject"] = []string{encoded}
+		raw = append([]byte("Subject: "+encoded+"\r\n"), stripHeaders(raw, "Subject")...)
+		logDebug("Rewrote subject %q to %q", subject, newSubject)
+		subject = newSubject
 	}
 
-	// Create SendGrid message
-	message := sgmail.NewV3Mail()
-	message.SetFrom(sgmail.NewEmail(fromAddr.Name, fromAddr.Address))
-	message.Subject = subject
+	// Record this hop for backends that relay the raw message
+	if s.config.AddReceivedHeader {
+		raw = append([]byte(s.receivedHeader(time.Now())), raw...)
+	}
 
-	// Add recipients
-	p := sgmail.NewPersonalization()
-	for _, recipient := range to {
-		toAddr, err := mail.ParseAddress(recipient)
+	// DKIM-sign the outgoing message if configured
+	if s.backend.dkim != nil {
+		raw, err = signMessage(s.backend.dkim, raw)
 		if err != nil {
-			toAddr = &mail.Address{Address: strings.Trim(recipient, "<>")}
+			s.audit("DATA", reasonSignFailed, err.Error())
+			logError("Failed to sign email: %v", err)
+			return errSignFailed
 		}
-		p.AddTos(sgmail.NewEmail(toAddr.Name, toAddr.Address))
+		logDebug("DKIM-signed email: d=%s s=%s", s.backend.dkim.Domain, s.backend.dkim.Selector)
 	}
-	message.AddPersonalizations(p)
 
-	// Handle content based on type
-	if strings.Contains(contentType, "multipart/") {
-		// Parse multipart message
-		err := s.handleMultipart(message, body, contentType)
-		if err != nil {
-			logWarn("Failed to parse multipart, sending as plain text: %v", err)
-			message.AddContent(sgmail.NewContent("text/plain", string(body)))
+	// A streamed message's size is only known once it has been relayed
+	if stream == nil {
+		messageSize.Observe(float64(len(raw)))
+		logDebug("Message size: %d bytes", len(raw))
+	} else {
+		defer func() {
+			size := int64(len(raw)) + stream.n
+			messageSize.Observe(float64(size))
+			logDebug("Message size: %d bytes", size)
+		}()
+	}
+
+	// Count the message against the sender domain's quota before sending.
+	// The check at MAIL FROM is only an early answer, sessions still racing
+	// for the last messages of the day are sorted out here.
+	var hold *quotaHold
+	if s.backend.quota != nil {
+		var ok bool
+		if hold, ok = s.backend.quota.Reserve(addressDomain(s.from)); !ok {
+			s.audit("DATA", reasonQuotaExceeded, "daily quota exceeded")
+			return s.config.rejection(rejectRate)
 		}
-	} else if strings.Contains(contentType, "text/html") {
-		message.AddContent(sgmail.NewContent("text/html", string(body)))
+	}
+
+	// Every log line about the message from here on carries its ID
+	id := uuid.NewString()
+	span.SetAttributes(attribute.String("relay.id", id))
+	if stream == nil {
+		logInfo("Accepted message: id=%s from=%s to=%v subject=%q size=%d", id, s.from, s.to, truncate(subject, 50), len(raw))
 	} else {
-		// Default to plain text
-		message.AddContent(sgmail.NewContent("text/plain", string(body)))
+		logInfo("Accepted message: id=%s from=%s to=%v subject=%q size=streamed", id, s.from, s.to, truncate(subject, 50))
+	}
+	if stream == nil {
+		s.config.logBody(id, body)
+	} else {
+		s.config.logStreamedBody(id)
 	}
 
-	// Send via SendGrid API
-	client := sendgrid.NewSendClient(s.config.SendGridAPIKey)
-	response, err := client.Send(message)
+	// Hand off to the configured backend, through the send queue if enabled
+	job := &sendJob{
+		ctx: ctx,
+		msg: &Message{
+			ID:     id,
+			From:   s.from,
+			To:     append([]string(nil), s.to...),
+			Bcc:    bcc,
+			Header: msg.Header,
+			Body:   body,
+			Raw:    raw,
+			UTF8:   s.utf8,
+			DSN:    s.dsn.clone(),
+		},
+		subject:     subject,
+		start:       startTime,
+		dedupKey:    dedupID,
+		reservation: res,
+		quota:       hold,
+	}
+	if stream != nil {
+		job.body = stream
+	}
+	if s.backend.pool != nil {
+		err = s.backend.pool.Submit(job)
+		queued = err == nil && !s.backend.pool.wait
+	} else {
+		err = s.backend.deliver(job)
+	}
+	if err == nil && !queued {
+		s.rejected = job.rejected
+	}
 	if err != nil {
-		return fmt.Errorf("sendgrid API error: %w", err)
+		// Not queued or not sent, e.g. a full queue
+		s.backend.releaseQuota(job)
 	}
-
-	if response.StatusCode >= 400 {
-		logError("SendGrid returned error: status=%d body=%s", response.StatusCode, response.Body)
-		return fmt.Errorf("sendgrid returned status %d: %s", response.StatusCode, response.Body)
+	if err != nil && stream != nil && stream.err != nil {
+		// The client failed mid-stream, not the backend
+		return s.readFailed(stream.err, int64(len(raw))+stream.n)
 	}
+	if err != nil {
+		s.audit("DATA", sendFailureReason(err), err.Error())
+		// HTTP ingest answers backend errors with a 502 of its own
+		if s.conn != nil {
+			return backendReply(err)
+		}
+	}
+	return err
+}
 
-	logDebug("SendGrid response: status=%d", response.StatusCode)
-	return nil
+// readFailed reports a failure reading the message from the client after
+// received bytes
+func (s *Session) readFailed(err error, received int64) error {
+	if errors.Is(err, smtp.ErrDataReset) {
+		logWarn("Message transfer aborted by %s", s.remoteAddr)
+		return err
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		logWarn("Client %s disconnected during DATA after %d bytes", s.remoteAddr, received)
+		s.audit("DATA", reasonClientDisconnected, fmt.Sprintf("%d bytes received", received))
+		return err
+	}
+	if errors.Is(err, errDataTimeout) {
+		s.audit("DATA", reasonDataTimeout, fmt.Sprintf("%d bytes received in %v", received, s.config.DataMaxDuration))
+		s.replyAndClose(errDataTimeout)
+		return errDataTimeout
+	}
+	// go-smtp's own errors, such as 552 5.3.4 past MAX_MESSAGE_BYTES, are
+	// replies already and must not be wrapped
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		s.audit("DATA", sendFailureReason(smtpErr), err.Error())
+		return smtpErr
+	}
+	s.audit("DATA", reasonReadFailed, err.Error())
+	return errReadFailed
 }
 
-func (s *Session) handleMultipart(message *sgmail.SGMailV3, body []byte, contentType string) error {
-	mediaType, params, err := mime.ParseMediaType(contentType)
+// deliver sends a message through the relay and records the outcome
+func (bkd *Backend) deliver(job *sendJob) error {
+	span := trace.SpanFromContext(job.ctx)
+	msg := job.msg
+
+	result, attempts, err := bkd.sendWithRetry(job)
 	if err != nil {
+		bkd.releaseQuota(job)
+		if bkd.config.DeadLetterDir != "" {
+			id, dlErr := writeDeadLetter(bkd.config.DeadLetterDir, bkd.relay.Name(), job, err, attempts)
+			if dlErr != nil {
+				logError("Failed to dead-letter message: id=%s from=%s: %v", msg.ID, msg.From, dlErr)
+			} else {
+				logWarn("Dead-lettered message: id=%s from=%s as %s", msg.ID, msg.From, id)
+			}
+		}
+		recordSend(msg.From, nil, err)
+		relayStatus.RecordError(err)
+		bkd.messages.Record(messageSummary{
+			Time: time.Now().UTC(), ID: msg.ID, From: msg.From, To: msg.To, Subject: job.subject,
+			Status: "failed", Error: err.Error(),
+		})
+		bkd.events.Notify(sendEvent{
+			Time: time.Now().UTC(), ID: msg.ID, From: msg.From, To: msg.To, Subject: job.subject,
+			Status: "failed", Error: err.Error(), DurationMS: time.Since(job.start).Milliseconds(),
+		})
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logError("Failed to send via %s: id=%s: %v", bkd.relay.Name(), msg.ID, err)
 		return err
 	}
+	span.SetAttributes(attribute.String("relay.message_id", result.MessageID))
+	job.rejected = result.Rejected
+
+	recordSend(msg.From, result, nil)
+	relayStatus.RecordSuccess(result.MessageID)
+	bkd.messages.Record(messageSummary{
+		Time: time.Now().UTC(), ID: msg.ID, From: msg.From, To: msg.To, Subject: job.subject,
+		Status: "sent", MessageID: result.MessageID,
+	})
+	bkd.dedup.Add(job.dedupKey)
+
+	duration := time.Since(job.start)
+	bkd.events.Notify(sendEvent{
+		Time: time.Now().UTC(), ID: msg.ID, From: msg.From, To: msg.To, Subject: job.subject,
+		Status: "sent", MessageID: result.MessageID, DurationMS: duration.Milliseconds(),
+	})
+	logInfo("Email sent successfully: id=%s from=%s to=%v subject=%q message_id=%s duration=%v",
+		msg.ID, msg.From, msg.To, truncate(job.subject, 50), result.MessageID, duration)
 
-	if !strings.HasPrefix(mediaType, "multipart/") {
-		return fmt.Errorf("not a multipart message")
-	}
+	return nil
+}
 
-	boundary := params["boundary"]
-	if boundary == "" {
-		return fmt.Errorf("no boundary found")
+// abandon records a queued message that shutdown left unsent, dead-lettering
+// it when DEAD_LETTER_DIR is set
+func (bkd *Backend) abandon(job *sendJob) {
+	msg := job.msg
+	bkd.releaseQuota(job)
+	if bkd.config.DeadLetterDir == "" {
+		logError("Message lost at shutdown, set DEAD_LETTER_DIR to keep it: id=%s from=%s to=%v", msg.ID, msg.From, msg.To)
+		return
 	}
+	id, err := writeDeadLetter(bkd.config.DeadLetterDir, bkd.relay.Name(), job, errShuttingDown, 0)
+	if err != nil {
+		logError("Failed to dead-letter message at shutdown: id=%s from=%s: %v", msg.ID, msg.From, err)
+		return
+	}
+	logWarn("Dead-lettered unsent message at shutdown: id=%s from=%s as %s", msg.ID, msg.From, id)
+}
 
-	mr := multipart.NewReader(bytes.NewReader(body), boundary)
-
-	var textContent, htmlContent string
+// releaseQuota gives back the SENDER_DAILY_QUOTA hold of a message that was
+// not sent. It is safe to call more than once.
+func (bkd *Backend) releaseQuota(job *sendJob) {
+	if bkd.quota != nil {
+		bkd.quota.Release(job.quota)
+	}
+	job.quota = nil
+}
 
-	for {
-		part, err := mr.NextPart()
-		if err == io.EOF {
-			break
+// sendWithRetry sends a message, retrying temporary failures up to
+// SEND_RETRIES times with exponential backoff from SEND_RETRY_DELAY. It
+// returns the number of attempts made.
+func (bkd *Backend) sendWithRetry(job *sendJob) (*SendResult, int, error) {
+	delay := bkd.config.SendRetryDelay
+	for attempt := 1; ; attempt++ {
+		// A streamed body can be read once, streamRelay only allows it
+		// without retries
+		if job.body != nil {
+			result, err := bkd.relay.(StreamRelay).SendStream(job.ctx, job.msg, job.body)
+			return result, attempt, err
 		}
-		if err != nil {
-			return err
+		result, err := bkd.relay.Send(job.ctx, job.msg)
+		if err == nil || !isTemporary(err) {
+			return result, attempt, err
 		}
-
-		partContentType := part.Header.Get("Content-Type")
-		partBody, err := io.ReadAll(part)
-		if err != nil {
-			continue
+		if attempt > bkd.config.SendRetries {
+			if bkd.config.SendRetries > 0 {
+				sendRetriesExhausted.Inc()
+			}
+			return result, attempt, err
 		}
 
-		if strings.Contains(partContentType, "text/plain") {
-			textContent = string(partBody)
-		} else if strings.Contains(partContentType, "text/html") {
-			htmlContent = string(partBody)
-		}
+		logWarn("Send attempt %d via %s failed, retrying in %v: id=%s: %v", attempt, bkd.relay.Name(), delay, job.msg.ID, err)
+		sendRetries.Inc()
+		sendBackoffs.Inc()
+		time.Sleep(delay)
+		sendBackoffs.Dec()
+		sendRetrySleep.Add(delay.Seconds())
+		delay *= 2
 	}
+}
 
-	// Add content - SendGrid requires text/plain BEFORE text/html
-	if textContent != "" {
-		message.AddContent(sgmail.NewContent("text/plain", textContent))
-	}
-	if htmlContent != "" {
-		message.AddContent(sgmail.NewContent("text/html", htmlContent))
+// checkHeaderLimits rejects messages whose header block exceeds
+// MAX_HEADER_BYTES or MAX_HEADER_COUNT
+func (s *Session) checkHeaderLimits(data []byte) error {
+	header, _ := splitHeader(data)
+
+	if max := s.config.MaxHeaderBytes; max > 0 && len(header) > max {
+		s.audit("DATA", reasonHeaderTooLarge, fmt.Sprintf("header block is %d bytes (max %d)", len(header), max))
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message header too large",
+		}
 	}
 
-	if textContent == "" && htmlContent == "" {
-		return fmt.Errorf("no text or html content found")
+	if max := s.config.MaxHeaderCount; max > 0 {
+		if count := countHeaderFields(header); count > max {
+			s.audit("DATA", reasonTooManyHeaders, fmt.Sprintf("%d header fields (max %d)", count, max))
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      "Too many message header fields",
+			}
+		}
 	}
 
 	return nil
 }
 
 func (s *Session) Reset() {
+	if s.dataDone {
+		s.dataDone = false
+	} else {
+		s.countCommand("RSET")
+	}
 	s.from = ""
 	s.to = nil
+	s.rejected = nil
+	s.utf8 = false
+	s.dsn = dsnRequest{}
+	s.size = 0
+	s.body = ""
 	logDebug("Session reset")
 }
 
+// Logout is called by go-smtp when the connection closes, after QUIT or
+// an abrupt disconnect alike, and before STARTTLS starts a new session. A
+// DATA in progress has already returned by then and released its
+// MAX_INFLIGHT_BYTES reservation.
 func (s *Session) Logout() error {
+	if s.conn != nil {
+		sessionDuration.Observe(time.Since(s.start).Seconds())
+	}
 	logDebug("Session logout from %s", s.remoteAddr)
 	return nil
 }
 
 // Helper functions
 
+// wordDecoder decodes RFC 2047 encoded-words in any charset known to the
+// WHATWG encoding index, not only the UTF-8/ASCII/Latin-1 mime supports
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// addressParser parses address headers with wordDecoder
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
 func decodeHeader(header string) string {
-	dec := new(mime.WordDecoder)
-	decoded, err := dec.DecodeHeader(header)
+	decoded, err := wordDecoder.DecodeHeader(header)
 	if err != nil {
 		return header
 	}
 	return decoded
 }
 
+// parseAddress parses a single address, also decoding encoded-words that
+// clients put inside a quoted display name, which net/mail leaves as is
+func parseAddress(value string) (*mail.Address, error) {
+	addr, err := addressParser.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	addr.Name = decodeHeader(addr.Name)
+	return addr, nil
+}
+
+// parseAddressList is parseAddress for address lists
+func parseAddressList(value string) ([]*mail.Address, error) {
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range list {
+		addr.Name = decodeHeader(addr.Name)
+	}
+	return list, nil
+}
+
+// domainsAligned reports whether two domains are equal or one is a
+// subdomain of the other. An empty domain never aligns.
+func domainsAligned(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+// addressDomain returns the lowercase domain part of an email address
+func addressDomain(addr string) string {
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+// truncateUTF8 cuts s to at most maxLen bytes without splitting a rune
+func truncateUTF8(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
+	}
+	return s[:maxLen]
+}
+
+// maxLineLength is the RFC 5322 limit on a line, excluding the CRLF
+const maxLineLength = 998
+
+// normalizeLineEndings converts bare LF and bare CR to CRLF
+func normalizeLineEndings(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s) + len(s)/32)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\r':
+			b.WriteString("\r\n")
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			b.WriteString("\r\n")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// wrapLongLines breaks lines longer than maxLen octets, preferably at the
+// last space or tab, otherwise at a UTF-8 rune boundary. Inserted breaks are
+// CRLF; existing line endings are kept as they are.
+func wrapLongLines(s string, maxLen int) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		end := strings.IndexByte(s, '\n')
+		line := s
+		if end >= 0 {
+			line, s = s[:end+1], s[end+1:]
+		} else {
+			s = ""
+		}
+
+		for len(strings.TrimRight(line, "\r\n")) > maxLen {
+			cut := strings.LastIndexAny(line[:maxLen+1], " \t")
+			if cut <= 0 {
+				cut = len(truncateUTF8(line, maxLen))
+				if cut == 0 {
+					cut = maxLen
+				}
+			}
+			b.WriteString(line[:cut])
+			b.WriteString("\r\n")
+			line = strings.TrimLeft(line[cut:], " \t")
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -339,15 +1444,155 @@ func truncate(s string, maxLen int) string {
 }
 
 func loadConfig() (*Config, error) {
+	// Settings not present in the environment may come from a JSON file
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		settings, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileSettings = settings
+	}
+
 	config := &Config{
-		SendGridAPIKey: os.Getenv("SENDGRID_API_KEY"),
-		ListenAddr:     os.Getenv("SMTP_LISTEN_ADDR"),
-		Domain:         os.Getenv("SMTP_DOMAIN"),
-		LogLevel:       os.Getenv("LOG_LEVEL"),
+		Backend:              strings.ToLower(getenv("BACKEND")),
+		SendGridHost:         strings.TrimRight(getenv("SENDGRID_HOST"), "/"),
+		SendGridProxyURL:     getenv("SENDGRID_PROXY_URL"),
+		SendGridIPPool:       strings.TrimSpace(getenv("SENDGRID_IP_POOL")),
+		ClickTracking:        strings.TrimSpace(getenv("SENDGRID_CLICK_TRACKING")),
+		Footer:               strings.TrimSpace(getenv("SENDGRID_FOOTER")),
+		FooterText:           getenv("SENDGRID_FOOTER_TEXT"),
+		FooterHTML:           getenv("SENDGRID_FOOTER_HTML"),
+		OpenTracking:         strings.TrimSpace(getenv("SENDGRID_OPEN_TRACKING")),
+		SMTPRelayAddr:        getenv("SMTP_RELAY_ADDR"),
+		SMTPRelayUsername:    getenv("SMTP_RELAY_USERNAME"),
+		SMTPRelayTLS:         strings.ToLower(getenv("SMTP_RELAY_TLS")),
+		ListenAddr:           getenv("SMTP_LISTEN_ADDR"),
+		Domain:               getenv("SMTP_DOMAIN"),
+		Banner:               parseBanner(getenv("SMTP_BANNER")),
+		Protocol:             strings.ToLower(getenv("PROTOCOL")),
+		TLSCertFile:          getenv("TLS_CERT_FILE"),
+		TLSKeyFile:           getenv("TLS_KEY_FILE"),
+		TLSClientCAFile:      getenv("TLS_CLIENT_CA_FILE"),
+		LogLevel:             getenv("LOG_LEVEL"),
+		DKIMPrivateKeyFile:   getenv("DKIM_PRIVATE_KEY_FILE"),
+		DKIMDomain:           getenv("DKIM_DOMAIN"),
+		DKIMSelector:         getenv("DKIM_SELECTOR"),
+		SenderDailyQuota:     getenv("SENDER_DAILY_QUOTA"),
+		OversizePolicy:       strings.ToLower(getenv("OVERSIZE_POLICY")),
+		EmptyBodyPolicy:      strings.ToLower(getenv("EMPTY_BODY_POLICY")),
+		EmptyBodyPlaceholder: getenv("EMPTY_BODY_PLACEHOLDER"),
+		DefaultCharset:       strings.ToLower(getenv("DEFAULT_CHARSET")),
+		FallbackCharset:      strings.ToLower(getenv("FALLBACK_CHARSET")),
+		LinkRewriteBase:      getenv("LINK_REWRITE_BASE"),
+		EventWebhookURL:      getenv("EVENT_WEBHOOK_URL"),
+		HTTPAddr:             getenv("HTTP_ADDR"),
+		HTTPIngestAddr:       getenv("HTTP_INGEST_ADDR"),
+		SendGridWebhookAddr:  getenv("SENDGRID_WEBHOOK_ADDR"),
+		SuppressionFile:      getenv("SUPPRESSION_FILE"),
+		SESRegion:            getenv("AWS_REGION"),
+		SESEndpoint:          getenv("SES_ENDPOINT"),
+		MaildirPath:          getenv("MAILDIR_PATH"),
+		SESAccessKeyID:       getenv("AWS_ACCESS_KEY_ID"),
+		SESSessionToken:      getenv("AWS_SESSION_TOKEN"),
+		SESConfigurationSet:  getenv("SES_CONFIGURATION_SET"),
+		SubjectPrefix:        getenv("SUBJECT_PREFIX"),
+		SendQueueMode:        strings.ToLower(getenv("SEND_QUEUE_MODE")),
+		InflightMode:         strings.ToLower(getenv("INFLIGHT_MODE")),
+		DuplicatePolicy:      strings.ToLower(getenv("DUPLICATE_POLICY")),
+		DeadLetterDir:        getenv("DEAD_LETTER_DIR"),
 	}
 
-	if config.SendGridAPIKey == "" {
-		return nil, fmt.Errorf("SENDGRID_API_KEY environment variable is required")
+	var err error
+	if config.SendGridAPIKey, err = secretSetting("SENDGRID_API_KEY"); err != nil {
+		return nil, err
+	}
+	if config.SMTPRelayPassword, err = secretSetting("SMTP_RELAY_PASSWORD"); err != nil {
+		return nil, err
+	}
+	if config.HTTPIngestToken, err = secretSetting("HTTP_INGEST_TOKEN"); err != nil {
+		return nil, err
+	}
+	if config.DebugToken, err = secretSetting("DEBUG_TOKEN"); err != nil {
+		return nil, err
+	}
+	if config.SESSecretAccessKey, err = secretSetting("AWS_SECRET_ACCESS_KEY"); err != nil {
+		return nil, err
+	}
+	if config.SESRegion == "" {
+		config.SESRegion = getenv("AWS_DEFAULT_REGION")
+	}
+	users, err := secretSetting("SMTP_USERS")
+	if err != nil {
+		return nil, err
+	}
+	if config.SMTPUsers, err = parseCredentials(users); err != nil {
+		return nil, err
+	}
+	if config.SendGridKeyRoutes, err = parseKeyRoutes(getenv("SENDGRID_KEY_ROUTES")); err != nil {
+		return nil, err
+	}
+	if config.Rejections, err = loadRejections(); err != nil {
+		return nil, err
+	}
+	if config.HTTPIngestAddr != "" && config.HTTPIngestToken == "" {
+		return nil, fmt.Errorf("HTTP_INGEST_TOKEN or HTTP_INGEST_TOKEN_FILE is required with HTTP_INGEST_ADDR")
+	}
+	config.SendGridWebhookPublicKey = getenv("SENDGRID_WEBHOOK_PUBLIC_KEY")
+	if config.SendGridWebhookAddr != "" && config.SendGridWebhookPublicKey == "" {
+		return nil, fmt.Errorf("SENDGRID_WEBHOOK_PUBLIC_KEY is required with SENDGRID_WEBHOOK_ADDR")
+	}
+
+	if config.Backend == "" {
+		config.Backend = "sendgrid"
+	}
+
+	switch config.Backend {
+	case "sendgrid":
+		if config.SendGridAPIKey == "" {
+			return nil, fmt.Errorf("SENDGRID_API_KEY or SENDGRID_API_KEY_FILE is required")
+		}
+		if config.SendGridHost != "" {
+			u, err := url.Parse(config.SendGridHost)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid SENDGRID_HOST %q (expected an http(s) base URL)", config.SendGridHost)
+			}
+		}
+		if config.SendGridProxyURL != "" {
+			u, err := url.Parse(config.SendGridProxyURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid SENDGRID_PROXY_URL %q (expected an http(s) proxy URL)", config.SendGridProxyURL)
+			}
+		}
+	case "smtp":
+		if config.SMTPRelayAddr == "" {
+			return nil, fmt.Errorf("SMTP_RELAY_ADDR environment variable is required for the smtp backend")
+		}
+		switch config.SMTPRelayTLS {
+		case "":
+			config.SMTPRelayTLS = "starttls"
+		case "starttls", "tls", "none":
+		default:
+			return nil, fmt.Errorf("invalid SMTP_RELAY_TLS %q (expected starttls, tls or none)", config.SMTPRelayTLS)
+		}
+	case "ses":
+		if config.SESRegion == "" {
+			return nil, fmt.Errorf("AWS_REGION or AWS_DEFAULT_REGION is required for the ses backend")
+		}
+		if config.SESAccessKeyID == "" || config.SESSecretAccessKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the ses backend")
+		}
+		if config.SESEndpoint != "" {
+			u, err := url.Parse(config.SESEndpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid SES_ENDPOINT %q (expected an http(s) base URL)", config.SESEndpoint)
+			}
+		}
+	case "maildir":
+		if config.MaildirPath == "" {
+			return nil, fmt.Errorf("MAILDIR_PATH is required for the maildir backend")
+		}
+	default:
+		return nil, fmt.Errorf("invalid BACKEND %q (expected sendgrid, smtp, ses or maildir)", config.Backend)
 	}
 
 	if config.ListenAddr == "" {
@@ -362,21 +1607,411 @@ func loadConfig() (*Config, error) {
 		config.LogLevel = "info"
 	}
 
+	if config.ParseHeaderTo, err = envBool("PARSE_HEADER_TO", false); err != nil {
+		return nil, err
+	}
+	if config.ValidateHeaderFrom, err = envBool("VALIDATE_HEADER_FROM", false); err != nil {
+		return nil, err
+	}
+	if config.RequireSenderAlignment, err = envBool("REQUIRE_SENDER_ALIGNMENT", false); err != nil {
+		return nil, err
+	}
+	if config.MaxMessageBytes, err = envInt("MAX_MESSAGE_BYTES", 25*1024*1024); err != nil {
+		return nil, err
+	}
+	if config.MaxMessageBytes == 0 {
+		return nil, fmt.Errorf("MAX_MESSAGE_BYTES must be greater than 0")
+	}
+	if config.MaxHeaderBytes, err = envInt("MAX_HEADER_BYTES", 128*1024); err != nil {
+		return nil, err
+	}
+	if config.MaxHeaderCount, err = envInt("MAX_HEADER_COUNT", 1000); err != nil {
+		return nil, err
+	}
+	if config.EnableDSN, err = envBool("ENABLE_DSN", false); err != nil {
+		return nil, err
+	}
+	if config.DryRun, err = envBool("DRY_RUN", false); err != nil {
+		return nil, err
+	}
+	if config.MaxSessionRecipients, err = envInt("MAX_SESSION_RECIPIENTS", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxConnectionsPerIP, err = envInt("MAX_CONNECTIONS_PER_IP", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxActiveSessions, err = envInt("MAX_ACTIVE_SESSIONS", 0); err != nil {
+		return nil, err
+	}
+	if config.OnePersonalizationPerRecipient, err = envBool("ONE_PERSONALIZATION_PER_RECIPIENT", false); err != nil {
+		return nil, err
+	}
+	if config.SMTPRelayPoolSize, err = envInt("SMTP_RELAY_POOL_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if config.SMTPRelayPoolIdleTimeout, err = envDuration("SMTP_RELAY_POOL_IDLE_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.EventWebhookTimeout, err = envDuration("EVENT_WEBHOOK_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if config.SendGridTimeout, err = envDuration("SENDGRID_TIMEOUT", 20*time.Second); err != nil {
+		return nil, err
+	}
+	if config.SendGridMaxConcurrency, err = envInt("SENDGRID_MAX_CONCURRENCY", 0); err != nil {
+		return nil, err
+	}
+	if config.SESTimeout, err = envDuration("SES_TIMEOUT", 20*time.Second); err != nil {
+		return nil, err
+	}
+	if config.IdleTimeout, err = envDuration("SMTP_IDLE_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if config.AddReceivedHeader, err = envBool("ADD_RECEIVED_HEADER", false); err != nil {
+		return nil, err
+	}
+	if config.DataMaxDuration, err = envDuration("DATA_MAX_DURATION", 0); err != nil {
+		return nil, err
+	}
+	if config.HeartbeatInterval, err = envDuration("HEARTBEAT_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if config.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.GreylistDelay, err = envDuration("GREYLIST_DELAY", 0); err != nil {
+		return nil, err
+	}
+	if config.GreylistTTL, err = envDuration("GREYLIST_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if config.LogBodies, err = envBool("LOG_BODIES", false); err != nil {
+		return nil, err
+	}
+	if config.LogBodyMaxBytes, err = envInt("LOG_BODY_MAX_BYTES", 1024); err != nil {
+		return nil, err
+	}
+	if config.LogBodyMaxBytes <= 0 {
+		return nil, fmt.Errorf("invalid LOG_BODY_MAX_BYTES %d (expected a positive number)", config.LogBodyMaxBytes)
+	}
+	redact := getenv("LOG_BODY_REDACT")
+	if redact == "" {
+		redact = "email,number"
+	}
+	if config.LogBodyRedact, err = parseBodyRedactions(splitList(redact)); err != nil {
+		return nil, err
+	}
+	if config.DuplicateTTL, err = envDuration("DUPLICATE_TTL", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxTextBytes, err = envInt("MAX_TEXT_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxHTMLBytes, err = envInt("MAX_HTML_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if config.NormalizeLineEndings, err = envBool("NORMALIZE_LINE_ENDINGS", false); err != nil {
+		return nil, err
+	}
+	if config.WrapLongLines, err = envBool("WRAP_LONG_LINES", false); err != nil {
+		return nil, err
+	}
+	if config.AutoAlternative, err = envBool("AUTO_ALTERNATIVE", false); err != nil {
+		return nil, err
+	}
+	if config.DebugMessageLogSize, err = envInt("DEBUG_MESSAGE_LOG_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if config.DebugMessageLogSize > 0 && config.DebugToken == "" {
+		return nil, fmt.Errorf("DEBUG_TOKEN or DEBUG_TOKEN_FILE is required with DEBUG_MESSAGE_LOG_SIZE")
+	}
+	if config.AttachmentSpillBytes, err = envInt("ATTACHMENT_SPILL_BYTES", 1024*1024); err != nil {
+		return nil, err
+	}
+	if config.MaxAttachments, err = envInt("MAX_ATTACHMENTS", 0); err != nil {
+		return nil, err
+	}
+	if config.MaxAttachmentBytes, err = envInt("MAX_TOTAL_ATTACHMENT_BYTES", 30*1024*1024); err != nil {
+		return nil, err
+	}
+	if rewrite := getenv("SUBJECT_REWRITE"); rewrite != "" {
+		pattern, replacement, ok := strings.Cut(rewrite, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid SUBJECT_REWRITE %q: expected pattern=>replacement", rewrite)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SUBJECT_REWRITE pattern: %w", err)
+		}
+		config.SubjectRewrite, config.SubjectReplacement = re, strings.TrimSpace(replacement)
+	}
+	if config.SendWorkers, err = envInt("SEND_WORKERS", 0); err != nil {
+		return nil, err
+	}
+	if config.SendQueueSize, err = envInt("SEND_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if config.SendWorkers > 0 && config.SendQueueSize == 0 {
+		return nil, fmt.Errorf("SEND_QUEUE_SIZE must be at least 1 when SEND_WORKERS is set")
+	}
+	if config.SendRetries, err = envInt("SEND_RETRIES", 0); err != nil {
+		return nil, err
+	}
+	if config.SendRetryDelay, err = envDuration("SEND_RETRY_DELAY", time.Second); err != nil {
+		return nil, err
+	}
+	if config.MaxInflightBytes, err = envInt("MAX_INFLIGHT_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if config.InflightWaitTimeout, err = envDuration("INFLIGHT_WAIT_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.InflightWaitTimeout <= 0 {
+		return nil, fmt.Errorf("invalid INFLIGHT_WAIT_TIMEOUT %v (expected a positive duration)", config.InflightWaitTimeout)
+	}
+	switch config.Protocol {
+	case "":
+		config.Protocol = "smtp"
+	case "smtp", "lmtp":
+	default:
+		return nil, fmt.Errorf("invalid PROTOCOL %q (expected smtp or lmtp)", config.Protocol)
+	}
+	switch config.DuplicatePolicy {
+	case "":
+		config.DuplicatePolicy = "drop"
+	case "drop", "reject":
+	default:
+		return nil, fmt.Errorf("invalid DUPLICATE_POLICY %q (expected drop or reject)", config.DuplicatePolicy)
+	}
+	switch config.InflightMode {
+	case "":
+		config.InflightMode = "reject"
+	case "reject", "wait":
+	default:
+		return nil, fmt.Errorf("invalid INFLIGHT_MODE %q (expected reject or wait)", config.InflightMode)
+	}
+	switch config.SendQueueMode {
+	case "":
+		config.SendQueueMode = "wait"
+	case "wait", "async":
+	default:
+		return nil, fmt.Errorf("invalid SEND_QUEUE_MODE %q (expected wait or async)", config.SendQueueMode)
+	}
+	if config.EventWebhookURL != "" {
+		u, err := url.Parse(config.EventWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid EVENT_WEBHOOK_URL %q (expected an http(s) URL)", config.EventWebhookURL)
+		}
+	}
+	if config.LinkRewriteBase != "" {
+		u, err := url.Parse(strings.ReplaceAll(config.LinkRewriteBase, linkPlaceholder, ""))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid LINK_REWRITE_BASE %q (expected an http(s) URL)", config.LinkRewriteBase)
+		}
+	}
+	if config.DefaultCharset == "" {
+		config.DefaultCharset = "utf-8"
+	}
+	if config.FallbackCharset == "" {
+		config.FallbackCharset = "windows-1252"
+	}
+	for _, charset := range []struct{ key, value string }{
+		{"DEFAULT_CHARSET", config.DefaultCharset},
+		{"FALLBACK_CHARSET", config.FallbackCharset},
+	} {
+		if _, err := htmlindex.Get(charset.value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", charset.key, charset.value, err)
+		}
+	}
+
+	switch config.OversizePolicy {
+	case "":
+		config.OversizePolicy = "truncate"
+	case "truncate", "reject":
+	default:
+		return nil, fmt.Errorf("invalid OVERSIZE_POLICY %q (expected truncate or reject)", config.OversizePolicy)
+	}
+	switch config.EmptyBodyPolicy {
+	case "":
+		config.EmptyBodyPolicy = "placeholder"
+	case "placeholder", "reject":
+	default:
+		return nil, fmt.Errorf("invalid EMPTY_BODY_POLICY %q (expected placeholder or reject)", config.EmptyBodyPolicy)
+	}
+	// SendGrid rejects empty content but accepts a single space
+	if config.EmptyBodyPlaceholder == "" {
+		config.EmptyBodyPlaceholder = " "
+	}
+
+	for key, value := range map[string]string{
+		"SENDGRID_CLICK_TRACKING": config.ClickTracking,
+		"SENDGRID_OPEN_TRACKING":  config.OpenTracking,
+		"SENDGRID_FOOTER":         config.Footer,
+	} {
+		if _, err := parseToggle(value); value != "" && err != nil {
+			return nil, fmt.Errorf("invalid %s %q (expected on or off)", key, value)
+		}
+	}
+
+	if config.FromMap, err = parseFromMap(getenv("FROM_MAP")); err != nil {
+		return nil, err
+	}
+	if defaultFrom := getenv("DEFAULT_FROM"); defaultFrom != "" {
+		addr, err := parseAddress(defaultFrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DEFAULT_FROM %q: %w", defaultFrom, err)
+		}
+		config.DefaultFrom = addr
+	}
+	if archiveBcc := getenv("ARCHIVE_BCC"); archiveBcc != "" {
+		addr, err := parseAddress(archiveBcc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ARCHIVE_BCC %q: %w", archiveBcc, err)
+		}
+		config.ArchiveBcc = addr.Address
+	}
+
 	// Parse allowed senders
-	allowedSenders := os.Getenv("ALLOWED_SENDERS")
-	if allowedSenders != "" {
-		for _, sender := range strings.Split(allowedSenders, ",") {
-			sender = strings.TrimSpace(sender)
-			if sender != "" {
-				config.AllowedSenders = append(config.AllowedSenders, sender)
-			}
+	config.AllowedSenders = splitList(getenv("ALLOWED_SENDERS"))
+	config.AllowedRecipients = splitList(getenv("ALLOWED_RECIPIENTS"))
+	config.DeniedRecipients = splitList(getenv("DENIED_RECIPIENTS"))
+
+	// Parse the TLS protocol versions and cipher suites offered
+	config.TLSMinVersion = tls.VersionTLS12
+	if value := getenv("TLS_MIN_VERSION"); value != "" {
+		if config.TLSMinVersion, err = parseTLSVersion(value); err != nil {
+			return nil, err
 		}
 	}
+	if config.TLSCipherSuites, err = parseCipherSuites(splitList(getenv("TLS_CIPHERS"))); err != nil {
+		return nil, err
+	}
+
+	// Parse client certificate names allowed with TLS_CLIENT_CA_FILE
+	config.TLSClientCNs = splitList(getenv("TLS_CLIENT_ALLOWED_CNS"))
+
+	// Parse senders allowed to bypass list management
+	config.BypassListSenders = splitList(getenv("SENDGRID_BYPASS_SENDERS"))
+	if config.SenderStripHeaders, err = parseHeaderStripRules(getenv("SENDER_STRIP_HEADERS")); err != nil {
+		return nil, err
+	}
+
+	// Parse IP pools
+	config.SendGridIPPools = splitList(getenv("SENDGRID_IP_POOLS"))
+	if config.SendGridIPPool != "" && !config.ipPoolAllowed(config.SendGridIPPool) {
+		return nil, fmt.Errorf("SENDGRID_IP_POOL %q is not listed in SENDGRID_IP_POOLS", config.SendGridIPPool)
+	}
 
 	return config, nil
 }
 
+// splitList parses a comma-separated setting, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// secretSetting reads a secret from key, or from the file named by key_FILE
+// (e.g. a mounted Kubernetes secret) when key is empty
+func secretSetting(key string) (string, error) {
+	if value := getenv(key); value != "" {
+		return value, nil
+	}
+	path := getenv(key + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// envBool reads a boolean setting, returning def when unset
+func envBool(key string, def bool) (bool, error) {
+	value := getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: expected true or false", key, value)
+	}
+	return b, nil
+}
+
+// envInt reads a non-negative integer setting, returning def when unset
+func envInt(key string, def int) (int, error) {
+	value := getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a non-negative integer", key, value)
+	}
+	return n, nil
+}
+
+// envDuration reads a non-negative duration setting such as "20s",
+// returning def when unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	value := getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a non-negative duration such as 20s", key, value)
+	}
+	return d, nil
+}
+
+// newSMTPServer creates the SMTP server for be
+func newSMTPServer(config *Config, be *Backend, tlsConfig *tls.Config) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Addr = config.ListenAddr
+	s.Domain = config.Domain
+	s.LMTP = config.Protocol == "lmtp"
+	// With STARTTLS on offer, AUTH waits for it so passwords never go in the clear
+	s.AllowInsecureAuth = tlsConfig == nil
+	s.EnableDSN = config.EnableDSN
+	s.EnableSMTPUTF8 = true
+	s.TLSConfig = tlsConfig
+	s.MaxMessageBytes = int64(config.MaxMessageBytes) // advertised as SIZE, oversized MAIL FROM SIZE= gets 552
+	s.MaxRecipients = 50
+	s.ReadTimeout = 30 * time.Second
+	s.WriteTimeout = 30 * time.Second
+	return s
+}
+
+// wrapListener layers the connection handling of the relay over the SMTP
+// listener l
+func wrapListener(l net.Listener, config *Config, be *Backend) net.Listener {
+	l = newBusyListener(l, config.MaxActiveSessions, config.Domain)
+	l = newIdleListener(l, config.IdleTimeout)
+	l = newGreetingListener(l, config.Banner)
+	return newCloseListener(l, be.forgetConn)
+}
+
 func main() {
+	validate := flag.Bool("validate", false, "check the configuration and exit without starting the relay")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration, with secrets redacted, and exit")
+	flag.Parse()
+	if *validate {
+		os.Exit(runValidate(os.Stderr))
+	}
+	if *printConfig {
+		os.Exit(runPrintConfig(os.Stdout))
+	}
+
 	// Load configuration
 	config, err := loadConfig()
 	if err != nil {
@@ -385,44 +2020,312 @@ func main() {
 
 	// Set log level
 	currentLogLevel = parseLogLevel(config.LogLevel)
+	warnUnknownSettings()
+	for _, line := range effectiveSettings() {
+		logDebug("Config: %s", line)
+	}
+
+	// Set up tracing
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Tracing error: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Create delivery backend
+	relay, err := newRelay(config)
+	if err != nil {
+		log.Fatalf("Backend error: %v", err)
+	}
+
+	// Load DKIM signing key
+	dkimOptions, err := loadDKIMOptions(config)
+	if err != nil {
+		log.Fatalf("DKIM error: %v", err)
+	}
+
+	// Load STARTTLS certificate
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		log.Fatalf("TLS error: %v", err)
+	}
+
+	// Parse sender quotas
+	quota, err := parseSenderQuota(config.SenderDailyQuota)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	// Load the suppression list fed by the SendGrid event webhook
+	var webhookKey *ecdsa.PublicKey
+	var suppressions *suppressionList
+	if config.SendGridWebhookAddr != "" || config.SuppressionFile != "" {
+		if config.SendGridWebhookAddr != "" {
+			if webhookKey, err = parseWebhookKey(config.SendGridWebhookPublicKey); err != nil {
+				log.Fatalf("Configuration error: %v", err)
+			}
+		}
+		if suppressions, err = newSuppressionList(config.SuppressionFile); err != nil {
+			log.Fatalf("Suppression list error: %v", err)
+		}
+	}
+
+	// Prepare the dead-letter directory
+	if config.DeadLetterDir != "" {
+		if err := os.MkdirAll(config.DeadLetterDir, 0o700); err != nil {
+			log.Fatalf("Dead-letter directory error: %v", err)
+		}
+	}
 
 	// Create backend
-	be := &Backend{config: config}
+	be := &Backend{
+		config: config,
+		relay:  relay,
+		dkim:   dkimOptions,
+		quota:  quota,
+		grey:   newGreylist(config.GreylistDelay, config.GreylistTTL),
+		dedup:  newDedupCache(config.DuplicateTTL),
+
+		suppressions: suppressions,
+		messages:     newMessageLog(config.DebugMessageLogSize),
+		events:       newEventWebhook(config.EventWebhookURL, config.EventWebhookTimeout),
+
+		inflight: newByteBudget(int64(config.MaxInflightBytes), config.InflightMode == "wait", config.InflightWaitTimeout),
+	}
+	if config.SendWorkers > 0 {
+		be.pool = newSendPool(be, config.SendWorkers, config.SendQueueSize, config.SendQueueMode == "wait")
+	}
 
 	// Create SMTP server
-	s := smtp.NewServer(be)
-	s.Addr = config.ListenAddr
-	s.Domain = config.Domain
-	s.AllowInsecureAuth = true
-	s.MaxMessageBytes = 25 * 1024 * 1024 // 25 MB
-	s.MaxRecipients = 50
-	s.ReadTimeout = 30 * time.Second
-	s.WriteTimeout = 30 * time.Second
+	s := newSMTPServer(config, be, tlsConfig)
 
 	// Print startup info
 	logInfo("===========================================")
 	logInfo("ContaCloud SMTP-to-SendGrid Relay")
 	logInfo("===========================================")
+	logInfo("Backend: %s", relay.Name())
+	if config.Protocol == "lmtp" {
+		logInfo("Protocol: LMTP")
+	}
+	if config.Backend == "sendgrid" && config.SendGridHost != "" {
+		logInfo("SendGrid host: %s", config.SendGridHost)
+	}
+	if config.Backend == "sendgrid" && config.SendGridMaxConcurrency > 0 {
+		logInfo("SendGrid max concurrency: %d", config.SendGridMaxConcurrency)
+	}
+	if config.Backend == "sendgrid" && config.SendGridIPPool != "" {
+		logInfo("SendGrid IP pool: %s", config.SendGridIPPool)
+	}
+	if config.Backend == "sendgrid" && len(config.SendGridKeyRoutes) > 0 {
+		domains := make([]string, 0, len(config.SendGridKeyRoutes))
+		for _, route := range config.SendGridKeyRoutes {
+			domains = append(domains, route.domain)
+		}
+		logInfo("SendGrid API key routes: %s", strings.Join(domains, ", "))
+	}
+	if config.Backend == "sendgrid" && config.LinkRewriteBase != "" {
+		logInfo("Link rewrite base: %s", config.LinkRewriteBase)
+	}
+	if config.Backend == "sendgrid" && config.DefaultFrom != nil {
+		logInfo("Default From: %s", config.DefaultFrom)
+	}
+	if config.Backend == "sendgrid" && config.ArchiveBcc != "" {
+		logInfo("Archive Bcc: %s", config.ArchiveBcc)
+	}
+	if config.Backend == "sendgrid" && len(config.FromMap) > 0 {
+		sources := make([]string, 0, len(config.FromMap))
+		for _, mapping := range config.FromMap {
+			sources = append(sources, mapping.source)
+		}
+		logInfo("From map: %s", strings.Join(sources, ", "))
+	}
+	if config.Backend == "sendgrid" && config.SendGridProxyURL != "" {
+		proxyURL, _ := url.Parse(config.SendGridProxyURL)
+		logInfo("SendGrid proxy: %s", proxyURL.Redacted())
+	}
+	if config.Backend == "smtp" {
+		logInfo("Upstream SMTP: %s (tls=%s)", config.SMTPRelayAddr, config.SMTPRelayTLS)
+		if config.SMTPRelayPoolSize > 0 {
+			logInfo("Upstream connection pool: size=%d idle_timeout=%v", config.SMTPRelayPoolSize, config.SMTPRelayPoolIdleTimeout)
+		}
+	}
+	if config.Backend == "ses" {
+		logInfo("SES region: %s", config.SESRegion)
+		if config.SESConfigurationSet != "" {
+			logInfo("SES configuration set: %s", config.SESConfigurationSet)
+		}
+	}
+	if config.Backend == "maildir" {
+		logInfo("Maildir: %s", config.MaildirPath)
+	}
 	logInfo("Listen address: %s", config.ListenAddr)
 	logInfo("Domain: %s", config.Domain)
+	if config.Banner != "" {
+		logInfo("Banner: %s", config.Banner)
+	}
+	if config.IdleTimeout > 0 {
+		logInfo("Idle timeout: %v", config.IdleTimeout)
+	}
+	if config.DataMaxDuration > 0 {
+		logInfo("DATA max duration: %v", config.DataMaxDuration)
+	}
+	if config.MaxConnectionsPerIP > 0 {
+		logInfo("Max connections per IP: %d", config.MaxConnectionsPerIP)
+	}
 	logInfo("Log level: %s", config.LogLevel)
+	if config.LogBodies {
+		logWarn("Body logging: enabled at debug level (first %d bytes, redacting: %s)", config.LogBodyMaxBytes, strings.Join(config.LogBodyRedact, ", "))
+	}
+	if config.DryRun {
+		logInfo("Dry run: enabled (messages are not sent)")
+	}
+	if config.OnePersonalizationPerRecipient {
+		logInfo("One personalization per recipient: enabled")
+	}
+	if config.SubjectPrefix != "" {
+		logInfo("Subject prefix: %q", config.SubjectPrefix)
+	}
+	if config.SubjectRewrite != nil {
+		logInfo("Subject rewrite: %s => %s", config.SubjectRewrite, config.SubjectReplacement)
+	}
 	if len(config.AllowedSenders) > 0 {
 		logInfo("Allowed senders: %v", config.AllowedSenders)
 	} else {
 		logInfo("Allowed senders: all")
 	}
-	logInfo("Max message size: 25 MB")
+	if len(config.AllowedRecipients) > 0 {
+		logInfo("Allowed recipient domains: %v", config.AllowedRecipients)
+	}
+	if len(config.DeniedRecipients) > 0 {
+		logInfo("Denied recipient domains: %v", config.DeniedRecipients)
+	}
+	if be.messages != nil {
+		if config.HTTPAddr == "" {
+			logWarn("DEBUG_MESSAGE_LOG_SIZE is set but HTTP_ADDR is not, /debug/messages is not served")
+		}
+		logInfo("Debug message log: last %d messages", config.DebugMessageLogSize)
+	}
+	if config.EnableDSN {
+		logInfo("DSN: enabled")
+	}
+	if len(config.SMTPUsers) > 0 {
+		logInfo("SMTP AUTH: required (PLAIN, LOGIN; %d users)", len(config.SMTPUsers))
+	}
+	if tlsConfig != nil {
+		logInfo("STARTTLS: enabled (min version %s)", tls.VersionName(config.TLSMinVersion))
+		if config.TLSClientCAFile != "" {
+			logInfo("Client certificates: required (CA %s, allowed CNs: %s)", config.TLSClientCAFile, strings.Join(config.TLSClientCNs, ", "))
+		}
+	} else {
+		logInfo("STARTTLS: disabled")
+	}
+	if dkimOptions != nil {
+		logInfo("DKIM signing: d=%s s=%s", dkimOptions.Domain, dkimOptions.Selector)
+	} else {
+		logInfo("DKIM signing: disabled")
+	}
+	if be.pool != nil {
+		logInfo("Send queue: workers=%d size=%d mode=%s", config.SendWorkers, config.SendQueueSize, config.SendQueueMode)
+	}
+	if config.SendRetries > 0 {
+		logInfo("Send retries: %d (first after %v)", config.SendRetries, config.SendRetryDelay)
+	}
+	if config.DeadLetterDir != "" {
+		logInfo("Dead-letter directory: %s", config.DeadLetterDir)
+	}
+	if quota != nil {
+		logInfo("Sender daily quota: %s", config.SenderDailyQuota)
+	}
+	if be.inflight != nil {
+		logInfo("Max in-flight bytes: %d (mode=%s wait_timeout=%v)", config.MaxInflightBytes, config.InflightMode, config.InflightWaitTimeout)
+	}
+	if be.grey != nil {
+		logInfo("Greylisting: delay=%v ttl=%v", config.GreylistDelay, config.GreylistTTL)
+	}
+	if config.MaxActiveSessions > 0 {
+		logInfo("Max active sessions: %d", config.MaxActiveSessions)
+	}
+	if be.dedup != nil {
+		logInfo("Duplicate detection: ttl=%v policy=%s", config.DuplicateTTL, config.DuplicatePolicy)
+	}
+	if be.events != nil {
+		logInfo("Event webhook: %s (timeout %v)", config.EventWebhookURL, config.EventWebhookTimeout)
+	}
+	if config.HTTPAddr != "" {
+		logInfo("HTTP address: %s", config.HTTPAddr)
+	}
+	if config.HTTPIngestAddr != "" {
+		logInfo("HTTP ingest address: %s", config.HTTPIngestAddr)
+	}
+	if config.SendGridWebhookAddr != "" {
+		logInfo("SendGrid webhook address: %s", config.SendGridWebhookAddr)
+	}
+	if suppressions != nil {
+		logInfo("Suppressed addresses: %d", suppressions.Len())
+	}
+	if tracingEnabled() {
+		logInfo("Tracing: OTLP export enabled")
+	}
+	logInfo("Max message size: %d bytes", config.MaxMessageBytes)
 	logInfo("===========================================")
-	logInfo("Ready to relay emails to SendGrid API")
+	logInfo("Ready to relay emails via %s", relay.Name())
 	logInfo("===========================================")
 
+	// Reload allowlists on SIGHUP
+	watchReload(config)
+
+	// Log activity periodically
+	if config.HeartbeatInterval > 0 {
+		stopHeartbeat := startHeartbeat(config.HeartbeatInterval, be)
+		defer stopHeartbeat()
+	}
+
+	// Start HTTP server
+	if config.HTTPAddr != "" {
+		go func() {
+			if err := serveHTTP(config.HTTPAddr, relay.Name(), be.messages, config.DebugToken); err != nil {
+				log.Fatalf("HTTP server error: %v", err)
+			}
+		}()
+	}
+	// Client-facing HTTP servers stop together with the SMTP server
+	var httpServers []*http.Server
+	if config.HTTPIngestAddr != "" {
+		ingest := newIngestServer(config.HTTPIngestAddr, be)
+		httpServers = append(httpServers, ingest)
+		go func() {
+			if err := listenAndServe(ingest); err != nil {
+				log.Fatalf("HTTP ingest server error: %v", err)
+			}
+		}()
+	}
+	if config.SendGridWebhookAddr != "" {
+		webhook := newWebhookServer(config.SendGridWebhookAddr, webhookKey, suppressions)
+		httpServers = append(httpServers, webhook)
+		go func() {
+			if err := listenAndServe(webhook); err != nil {
+				log.Fatalf("SendGrid webhook server error: %v", err)
+			}
+		}()
+	}
+
 	// Start server
-	if err := s.ListenAndServe(); err != nil {
+	l, err := listen(config.ListenAddr)
+	if err != nil {
+		log.Fatalf("SMTP listen error: %v", err)
+	}
+	l = wrapListener(l, config, be)
+
+	stopped := watchShutdown(s, be, config.ShutdownTimeout, httpServers...)
+	if err := s.Serve(l); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
 		log.Fatalf("SMTP server error: %v", err)
 	}
+	<-stopped
+	if be.pool != nil {
+		be.pool.Close(config.ShutdownTimeout)
+	}
+	if r, ok := relay.(*SMTPRelay); ok && r.pool != nil {
+		r.pool.Close()
+	}
+	logInfo("Shutdown complete")
 }
-
-// Health check endpoint could be added here if needed
-// For now, Kubernetes can use TCP probe on port 25
-
-// Metrics could be added with prometheus client if needed
@@ -0,0 +1,1234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// logBuffer collects log output, which may be written by server goroutines
+// while the test reads it
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the log output of the test
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return buf
+}
+
+// testMessage parses raw, with LF line endings allowed, into the Message a
+// session would hand to a Relay
+func testMessage(t *testing.T, raw, from string, to ...string) *Message {
+	t.Helper()
+	raw = strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\n", "\r\n")
+	parsed, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	body, err := io.ReadAll(parsed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{
+		ID:     "test-id",
+		From:   from,
+		To:     to,
+		Header: parsed.Header,
+		Body:   body,
+		Raw:    []byte(raw),
+	}
+}
+
+// testConfig loads the configuration from env, on top of a SendGrid API key
+// so the default backend is valid
+func testConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	config, err := tryConfig(t, env)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return config
+}
+
+// tryConfig is testConfig for configurations expected to fail
+func tryConfig(t *testing.T, env map[string]string) (*Config, error) {
+	t.Helper()
+	fileSettings = nil
+	t.Cleanup(func() { fileSettings = nil })
+	t.Setenv("SENDGRID_API_KEY", "SG.test")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	return loadConfig()
+}
+
+// fakeRelay is a Relay recording the messages it is sent. Send fails with
+// err when set.
+type fakeRelay struct {
+	mu       sync.Mutex
+	err      error
+	result   *SendResult
+	messages []*Message
+}
+
+func (r *fakeRelay) Name() string {
+	return "fake"
+}
+
+func (r *fakeRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.result != nil {
+		return r.result, nil
+	}
+	return &SendResult{MessageID: "fake-id", StatusCode: 250}, nil
+}
+
+// Messages returns the messages sent so far
+func (r *fakeRelay) Messages() []*Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Message(nil), r.messages...)
+}
+
+// newTestBackend builds the Backend main would for config and relay
+func newTestBackend(t *testing.T, config *Config, relay Relay) *Backend {
+	t.Helper()
+	quota, err := parseSenderQuota(config.SenderDailyQuota)
+	if err != nil {
+		t.Fatalf("parseSenderQuota: %v", err)
+	}
+	be := &Backend{
+		config:   config,
+		relay:    relay,
+		quota:    quota,
+		grey:     newGreylist(config.GreylistDelay, config.GreylistTTL),
+		dedup:    newDedupCache(config.DuplicateTTL),
+		messages: newMessageLog(config.DebugMessageLogSize),
+		events:   newEventWebhook(config.EventWebhookURL, config.EventWebhookTimeout),
+		inflight: newByteBudget(int64(config.MaxInflightBytes), config.InflightMode == "wait", config.InflightWaitTimeout),
+	}
+	if config.SendWorkers > 0 {
+		be.pool = newSendPool(be, config.SendWorkers, config.SendQueueSize, config.SendQueueMode == "wait")
+		t.Cleanup(func() { be.pool.Close(time.Second) })
+	}
+	return be
+}
+
+// newTestSession returns a session as the HTTP ingest endpoint opens them,
+// without an SMTP connection
+func newTestSession(be *Backend) *Session {
+	return &Session{backend: be, config: be.config, remoteAddr: "192.0.2.1:1234", recipients: new(int), start: time.Now()}
+}
+
+// sendTestMessage runs a transaction on s, returning the first error
+func sendTestMessage(s *Session, from string, to []string, raw string) error {
+	s.Reset()
+	if err := s.Mail(from, &smtp.MailOptions{}); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := s.Rcpt(addr, &smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	raw = strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\n", "\r\n")
+	return s.Data(strings.NewReader(raw))
+}
+
+// smtpCode returns the reply code of an SMTP error, 0 for other errors
+func smtpCode(err error) int {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+// startTestServer serves be over SMTP on a local port, with the server and
+// listeners main sets up, and returns its address
+func startTestServer(t *testing.T, be *Backend, tlsConfig *tls.Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := newSMTPServer(be.config, be, tlsConfig)
+	go s.Serve(wrapListener(l, be.config, be))
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// smtpConn is a raw SMTP client, for tests that check exact replies
+type smtpConn struct {
+	t    *testing.T
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialSMTP connects to addr without reading the greeting
+func dialSMTP(t *testing.T, addr string) *smtpConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &smtpConn{t: t, conn: conn, text: textproto.NewConn(conn)}
+}
+
+// reply reads a reply, with the lines of a multiline one joined by "\n"
+func (c *smtpConn) reply() (int, string) {
+	c.t.Helper()
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	return code, msg
+}
+
+// cmd sends a command line and reads its reply
+func (c *smtpConn) cmd(format string, args ...any) (int, string) {
+	c.t.Helper()
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+	return c.reply()
+}
+
+// expect sends a command and fails the test unless the reply has code
+func (c *smtpConn) expect(code int, format string, args ...any) string {
+	c.t.Helper()
+	got, msg := c.cmd(format, args...)
+	if got != code {
+		c.t.Fatalf("%s: got %d %s, want %d", fmt.Sprintf(format, args...), got, msg, code)
+	}
+	return msg
+}
+
+// dialClient connects to addr with go-smtp's client and greets it
+func dialClient(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	return c
+}
+
+// testCA is a throwaway certificate authority for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for cn signed by ca, valid for localhost and
+// 127.0.0.1 as a server and for client authentication
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCertFiles writes cert as PEM files, returning their paths
+func writeCertFiles(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// sinkMessage is a message received by an smtpSink
+type sinkMessage struct {
+	From     string
+	To       []string
+	Data     []byte
+	Mail     smtp.MailOptions
+	Rcpt     []smtp.RcptOptions
+	AuthUser string
+}
+
+// smtpSink is an in-process SMTP server recording what it is sent, standing
+// in for an upstream relay
+type smtpSink struct {
+	addr string
+
+	// username and password, when set, are required with AUTH PLAIN
+	username string
+	password string
+	// rejectRcpt, when set, is refused at RCPT TO
+	rejectRcpt string
+
+	mu       sync.Mutex
+	sessions int
+	conns    []net.Conn
+	messages []sinkMessage
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	sink := &smtpSink{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := smtp.NewServer(sink)
+	s.Domain = "sink.test"
+	s.AllowInsecureAuth = true
+	s.EnableSMTPUTF8 = true
+	s.EnableDSN = true
+	sink.addr = l.Addr().String()
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return sink
+}
+
+func (sink *smtpSink) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	sink.mu.Lock()
+	sink.sessions++
+	sink.conns = append(sink.conns, c.Conn())
+	sink.mu.Unlock()
+	return &sinkSession{sink: sink}, nil
+}
+
+// CloseConns drops every connection from the server side, as an upstream
+// restart would
+func (sink *smtpSink) CloseConns() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, c := range sink.conns {
+		c.Close()
+	}
+	sink.conns = nil
+}
+
+// Messages returns the messages received so far
+func (sink *smtpSink) Messages() []sinkMessage {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]sinkMessage(nil), sink.messages...)
+}
+
+// Sessions returns the number of sessions opened so far
+func (sink *smtpSink) Sessions() int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.sessions
+}
+
+type sinkSession struct {
+	sink *smtpSink
+	msg  sinkMessage
+}
+
+func (s *sinkSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *sinkSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != s.sink.username || password != s.sink.password {
+			return errors.New("invalid credentials")
+		}
+		s.msg.AuthUser = username
+		return nil
+	}), nil
+}
+
+func (s *sinkSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.sink.username != "" && s.msg.AuthUser == "" {
+		return smtp.ErrAuthRequired
+	}
+	s.msg.From = from
+	if opts != nil {
+		s.msg.Mail = *opts
+	}
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if to == s.sink.rejectRcpt {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	s.msg.To = append(s.msg.To, to)
+	var rcpt smtp.RcptOptions
+	if opts != nil {
+		rcpt = *opts
+	}
+	s.msg.Rcpt = append(s.msg.Rcpt, rcpt)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = data
+	s.sink.mu.Lock()
+	s.sink.messages = append(s.sink.messages, s.msg)
+	s.sink.mu.Unlock()
+	s.msg = sinkMessage{AuthUser: s.msg.AuthUser}
+	return nil
+}
+
+func (s *sinkSession) Reset() {
+	s.msg = sinkMessage{AuthUser: s.msg.AuthUser}
+}
+
+func (s *sinkSession) Logout() error {
+	return nil
+}
+
+func TestDataStripsBcc(t *testing.T) {
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, testConfig(t, nil), relay))
+	raw := "From: app@example.com\nTo: user@example.org\nBcc: Hidden <hidden@example.org>\nSubject: Hi\n\nHello\n"
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org", "hidden@example.org"}, raw); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	messages := relay.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("relayed %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	if strings.Contains(strings.ToLower(string(msg.Raw)), "bcc") || msg.Header.Get("Bcc") != "" {
+		t.Errorf("relayed message still carries the Bcc header:\n%s", msg.Raw)
+	}
+	if len(msg.Bcc) != 1 || msg.Bcc[0] != "hidden@example.org" {
+		t.Errorf("Bcc = %v, want it kept for delivery", msg.Bcc)
+	}
+	if len(msg.To) != 2 {
+		t.Errorf("To = %v, want both envelope recipients", msg.To)
+	}
+}
+
+func TestDataValidatesHeaderFrom(t *testing.T) {
+	tests := []struct {
+		name       string
+		validate   string
+		headerFrom string
+		wantCode   int
+	}{
+		{"matching", "true", "App <app@example.com>", 0},
+		{"spoofed", "true", "Bank <security@bank.example>", 550},
+		{"missing", "true", "", 550},
+		{"spoofed without the check", "false", "Bank <security@bank.example>", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, map[string]string{"ALLOWED_SENDERS": "example.com", "VALIDATE_HEADER_FROM": tt.validate})
+			relay := &fakeRelay{}
+			s := newTestSession(newTestBackend(t, config, relay))
+			raw := "To: user@example.org\nSubject: Hi\n\nHello\n"
+			if tt.headerFrom != "" {
+				raw = "From: " + tt.headerFrom + "\n" + raw
+			}
+			err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, raw)
+			if code := smtpCode(err); code != tt.wantCode || (tt.wantCode == 0 && err != nil) {
+				t.Fatalf("err = %v, want code %d", err, tt.wantCode)
+			}
+			if sent := len(relay.Messages()); (sent == 1) != (tt.wantCode == 0) {
+				t.Errorf("relayed %d messages", sent)
+			}
+		})
+	}
+}
+
+func TestBDATIsRelayed(t *testing.T) {
+	relay := &fakeRelay{}
+	addr := startTestServer(t, newTestBackend(t, testConfig(t, nil), relay), nil)
+	c := dialSMTP(t, addr)
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); !strings.Contains(ehlo, "CHUNKING") || !strings.Contains(ehlo, "PIPELINING") {
+		t.Fatalf("EHLO does not advertise CHUNKING and PIPELINING:\n%s", ehlo)
+	}
+
+	// Pipeline the envelope and the first chunk, then finish with LAST
+	first := "From: app@example.com\r\nTo: user@example.org\r\n"
+	last := "Subject: Chunked\r\n\r\nHello in two chunks\r\n"
+	fmt.Fprintf(c.conn, "MAIL FROM:<app@example.com>\r\nRCPT TO:<user@example.org>\r\nBDAT %d\r\n%s", len(first), first)
+	for _, step := range []string{"MAIL", "RCPT", "BDAT"} {
+		if code, msg := c.reply(); code != 250 {
+			t.Fatalf("%s: %d %s", step, code, msg)
+		}
+	}
+	fmt.Fprintf(c.conn, "BDAT %d LAST\r\n%s", len(last), last)
+	if code, msg := c.reply(); code != 250 {
+		t.Fatalf("BDAT LAST: %d %s", code, msg)
+	}
+	c.expect(221, "QUIT")
+
+	messages := relay.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("relayed %d messages, want 1", len(messages))
+	}
+	if got := string(messages[0].Raw); got != first+last {
+		t.Errorf("relayed %q, want %q", got, first+last)
+	}
+	if got := messages[0].Header.Get("Subject"); got != "Chunked" {
+		t.Errorf("Subject = %q", got)
+	}
+}
+
+func TestDataHeaderLimits(t *testing.T) {
+	config := testConfig(t, map[string]string{"MAX_HEADER_BYTES": "1024", "MAX_HEADER_COUNT": "10"})
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, config, relay))
+	to := []string{"user@example.org"}
+
+	large := "From: app@example.com\nX-Padding: " + strings.Repeat("x", 2000) + "\n\nHello\n"
+	if err := sendTestMessage(s, "app@example.com", to, large); smtpCode(err) != 552 || !strings.Contains(err.Error(), "header too large") {
+		t.Errorf("oversized header block: err = %v, want 552", err)
+	}
+
+	many := "From: app@example.com\n" + strings.Repeat("X-Field: value\n", 10) + "\nHello\n"
+	if err := sendTestMessage(s, "app@example.com", to, many); smtpCode(err) != 552 || !strings.Contains(err.Error(), "Too many") {
+		t.Errorf("11 header fields: err = %v, want 552", err)
+	}
+
+	// A folded field counts once, and a large body is not a large header
+	folded := "From: app@example.com\nX-Folded: one\n two\n three\nSubject: Hi\n\n" + strings.Repeat("body ", 1000) + "\n"
+	if err := sendTestMessage(s, "app@example.com", to, folded); err != nil {
+		t.Errorf("message within limits: %v", err)
+	}
+	if got := len(relay.Messages()); got != 1 {
+		t.Errorf("relayed %d messages, want only the one within limits", got)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"añb", 2, "a"}, // ñ is two bytes
+		{"añb", 3, "añ"},
+	} {
+		if got := truncateUTF8(tt.in, tt.max); got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestSMTPUTF8Recipient(t *testing.T) {
+	relay := &fakeRelay{}
+	c := dialClient(t, startTestServer(t, newTestBackend(t, testConfig(t, nil), relay), nil))
+	if ok, _ := c.Extension("SMTPUTF8"); !ok {
+		t.Fatal("SMTPUTF8 not advertised")
+	}
+	if err := c.Mail("remitente@contacloud.mx", &smtp.MailOptions{UTF8: true}); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("用户@例え.jp", nil); err != nil {
+		t.Fatalf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "From: remitente@contacloud.mx\r\nTo: 用户@例え.jp\r\nSubject: Hola\r\n\r\nHola\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+
+	messages := relay.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("relayed %d messages", len(messages))
+	}
+	if msg := messages[0]; len(msg.To) != 1 || msg.To[0] != "用户@例え.jp" || !msg.UTF8 {
+		t.Errorf("relayed To=%q UTF8=%v, want the address intact with SMTPUTF8", msg.To, msg.UTF8)
+	}
+}
+
+func TestRewriteSubject(t *testing.T) {
+	config := testConfig(t, map[string]string{"SUBJECT_PREFIX": "[Staging] ", "SUBJECT_REWRITE": `(?i)^(re|fwd):\s*=>`})
+	for in, want := range map[string]string{
+		"Invoice":             "[Staging] Invoice",
+		"RE: Invoice":         "[Staging] Invoice",
+		"[Staging] Invoice":   "[Staging] Invoice",
+		"Fwd: Factura de año": "[Staging] Factura de año",
+	} {
+		if got := config.rewriteSubject(in); got != want {
+			t.Errorf("rewriteSubject(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if _, err := tryConfig(t, map[string]string{"SUBJECT_REWRITE": "(unclosed=>x"}); err == nil {
+		t.Error("invalid SUBJECT_REWRITE regex was accepted")
+	}
+}
+
+func TestDataRewritesEncodedSubject(t *testing.T) {
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, testConfig(t, map[string]string{"SUBJECT_PREFIX": "[Staging] "}), relay))
+	raw := "From: app@example.com\nSubject: =?utf-8?q?Factura_de_a=C3=B1o?=\n\nHola\n"
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	msg := relay.Messages()[0]
+	encoded := msg.Header.Get("Subject")
+	if got := decodeHeader(encoded); got != "[Staging] Factura de año" {
+		t.Errorf("Subject decodes to %q", got)
+	}
+	if !strings.HasPrefix(encoded, "=?utf-8?") {
+		t.Errorf("non-ASCII subject %q was not re-encoded", encoded)
+	}
+	if strings.Count(string(msg.Raw), "Subject:") != 1 || !strings.Contains(string(msg.Raw), "Subject: "+encoded+"\r\n") {
+		t.Errorf("raw message does not carry only the rewritten subject:\n%s", msg.Raw)
+	}
+}
+
+func TestMaxSessionRecipients(t *testing.T) {
+	config := testConfig(t, map[string]string{"MAX_SESSION_RECIPIENTS": "3"})
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, &fakeRelay{}), nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+
+	// Each transaction stays under the cap, the connection does not
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<a@example.org>")
+	c.expect(250, "RCPT TO:<b@example.org>")
+	c.expect(250, "RSET")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<c@example.org>")
+	if code, msg := c.cmd("RCPT TO:<d@example.org>"); code != 452 || !strings.Contains(msg, "Too many recipients for this session") {
+		t.Errorf("recipient over the cap: %d %s, want 452", code, msg)
+	}
+	c.expect(250, "RSET")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(452, "RCPT TO:<e@example.org>")
+
+	// A new connection starts from zero
+	c2 := dialSMTP(t, c.conn.RemoteAddr().String())
+	c2.reply()
+	c2.expect(250, "EHLO client.test")
+	c2.expect(250, "MAIL FROM:<app@example.com>")
+	c2.expect(250, "RCPT TO:<a@example.org>")
+}
+
+func TestMaxSessionRecipientsAcrossSTARTTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"MAX_SESSION_RECIPIENTS": "2", "TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := newTestBackend(t, config, &fakeRelay{})
+	c := dialSMTP(t, startTestServer(t, be, tlsConfig))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<a@example.org>")
+	c.expect(250, "RCPT TO:<b@example.org>")
+	c.expect(250, "RSET")
+	c.expect(220, "STARTTLS")
+
+	// go-smtp starts a new session after the handshake, which must not
+	// reset the count
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &smtpConn{t: t, conn: tlsConn, text: textproto.NewConn(tlsConn)}
+	tc.expect(250, "EHLO client.test")
+	tc.expect(250, "MAIL FROM:<app@example.com>")
+	tc.expect(452, "RCPT TO:<c@example.org>")
+
+	be.mu.Lock()
+	tracked := len(be.connRecipients)
+	be.mu.Unlock()
+	if tracked != 1 {
+		t.Errorf("tracking %d connections after STARTTLS, want 1", tracked)
+	}
+}
+
+func TestConnectionForgottenOnClose(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"MAX_SESSION_RECIPIENTS": "5"}), &fakeRelay{})
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(221, "QUIT")
+	c.conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		be.mu.Lock()
+		tracked, ips := len(be.connRecipients), len(be.ipConns)
+		be.mu.Unlock()
+		if tracked == 0 && ips == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still tracking %d connections and %d IPs after close", tracked, ips)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitIPConns waits until the backend counts want connections from ip
+func waitIPConns(t *testing.T, be *Backend, ip string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		be.mu.Lock()
+		got, tracked := be.ipConns[ip]
+		be.mu.Unlock()
+		if got == want && (want > 0 || !tracked) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counting %d connections from %s, want %d", got, ip, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, map[string]string{"MAX_CONNECTIONS_PER_IP": "2"}), &fakeRelay{})
+	addr := startTestServer(t, be, nil)
+	// go-smtp creates the session, and so counts the connection, at EHLO
+	var conns []*smtpConn
+	for i := 0; i < 2; i++ {
+		c := dialSMTP(t, addr)
+		c.reply()
+		c.expect(250, "EHLO client.test")
+		conns = append(conns, c)
+	}
+
+	// The third connection from the same IP is refused and closed
+	third := dialSMTP(t, addr)
+	third.reply()
+	if code, msg := third.cmd("EHLO client.test"); code != 421 || !strings.Contains(msg, "Too many connections") {
+		t.Fatalf("third connection got %d %s, want 421", code, msg)
+	}
+	if _, err := third.text.ReadLine(); err == nil {
+		t.Error("refused connection was left open")
+	}
+	waitIPConns(t, be, "127.0.0.1", 2)
+
+	// Closing one connection frees its slot
+	conns[0].expect(221, "QUIT")
+	conns[0].conn.Close()
+	waitIPConns(t, be, "127.0.0.1", 1)
+	fourth := dialSMTP(t, addr)
+	fourth.reply()
+	fourth.expect(250, "EHLO client.test")
+
+	conns[1].conn.Close()
+	fourth.conn.Close()
+	waitIPConns(t, be, "127.0.0.1", 0)
+}
+
+func TestMaxConnectionsPerIPAcrossSTARTTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"MAX_CONNECTIONS_PER_IP": "1", "TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := newTestBackend(t, config, &fakeRelay{})
+	addr := startTestServer(t, be, tlsConfig)
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(220, "STARTTLS")
+
+	// The session go-smtp starts after the handshake keeps the connection's
+	// slot instead of taking a second one
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc := &smtpConn{t: t, conn: tlsConn, text: textproto.NewConn(tlsConn)}
+	tc.expect(250, "EHLO client.test")
+	waitIPConns(t, be, "127.0.0.1", 1)
+
+	other := dialSMTP(t, addr)
+	other.reply()
+	other.expect(421, "EHLO client.test")
+
+	tc.expect(221, "QUIT")
+	tlsConn.Close()
+	waitIPConns(t, be, "127.0.0.1", 0)
+}
+
+func TestConnIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 25}, "192.0.2.1"},
+		{&net.UnixAddr{Name: "/run/smtp-relay.sock", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := connIP(addrConn{remote: tt.addr}); got != tt.want {
+			t.Errorf("connIP(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// addrConn is a net.Conn that only has a remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestSendGridAPIKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sendgrid_api_key")
+	if err := os.WriteFile(path, []byte("  SG.from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(t, map[string]string{"SENDGRID_API_KEY": "", "SENDGRID_API_KEY_FILE": path})
+	if config.SendGridAPIKey != "SG.from-file" {
+		t.Errorf("SendGridAPIKey = %q, want the trimmed file content", config.SendGridAPIKey)
+	}
+
+	// The variable itself takes precedence over the file
+	config = testConfig(t, map[string]string{"SENDGRID_API_KEY": "SG.from-env", "SENDGRID_API_KEY_FILE": path})
+	if config.SendGridAPIKey != "SG.from-env" {
+		t.Errorf("SendGridAPIKey = %q, want SENDGRID_API_KEY", config.SendGridAPIKey)
+	}
+
+	_, err := tryConfig(t, map[string]string{"SENDGRID_API_KEY": "", "SENDGRID_API_KEY_FILE": filepath.Join(t.TempDir(), "missing")})
+	if err == nil || !strings.Contains(err.Error(), "SENDGRID_API_KEY_FILE") {
+		t.Errorf("missing key file: err = %v", err)
+	}
+	if _, err := tryConfig(t, map[string]string{"SENDGRID_API_KEY": "", "SENDGRID_API_KEY_FILE": ""}); err == nil {
+		t.Error("config without an API key was accepted")
+	}
+}
+
+func TestSizeAdvertisedAndEnforcedAtMail(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{"MAX_MESSAGE_BYTES": "1000"})
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, relay), nil))
+	c.reply()
+	if ehlo := c.expect(250, "EHLO client.test"); !strings.Contains(ehlo, "\nSIZE 1000") {
+		t.Errorf("EHLO reply does not advertise SIZE 1000:\n%s", ehlo)
+	}
+
+	// An oversized declaration is refused before any data is sent
+	if code, msg := c.cmd("MAIL FROM:<app@example.com> SIZE=5000"); code != 552 {
+		t.Errorf("MAIL FROM with SIZE=5000: %d %s, want 552", code, msg)
+	}
+	c.expect(250, "MAIL FROM:<app@example.com> SIZE=500")
+	c.expect(250, "RCPT TO:<user@example.org>")
+	c.expect(354, "DATA")
+	if code, msg := c.cmd("Subject: Hi\r\n\r\n%s.", strings.Repeat(strings.Repeat("x", 70)+"\r\n", 30)); code != 552 {
+		t.Errorf("body over MAX_MESSAGE_BYTES: %d %s, want 552", code, msg)
+	}
+	if len(relay.Messages()) != 0 {
+		t.Error("oversized message was relayed")
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                   "",
+		"no breaks":          "no breaks",
+		"a\nb\n":             "a\r\nb\r\n",
+		"a\r\nb\r\n":         "a\r\nb\r\n",
+		"a\rb\r":             "a\r\nb\r\n",
+		"mixed\n\r\n\r\nend": "mixed\r\n\r\n\r\nend",
+	} {
+		if got := normalizeLineEndings(in); got != want {
+			t.Errorf("normalizeLineEndings(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWrapLongLines(t *testing.T) {
+	// Lines break at the last space within the limit
+	if got := wrapLongLines("aaaa bbbb cccc\r\nshort\n", 10); got != "aaaa bbbb\r\ncccc\r\nshort\n" {
+		t.Errorf("wrap at space = %q", got)
+	}
+	// Without spaces the line is cut, never inside a UTF-8 sequence
+	got := wrapLongLines(strings.Repeat("ñ", 6), 5)
+	if got != "ññ\r\nññ\r\nññ" {
+		t.Errorf("wrap without spaces = %q", got)
+	}
+	long := strings.Repeat("x", 2500)
+	for _, line := range strings.Split(wrapLongLines(long, maxLineLength), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("line of %d octets after wrapping", len(line))
+		}
+	}
+	if got := wrapLongLines("fits\r\n", 10); got != "fits\r\n" {
+		t.Errorf("short line changed: %q", got)
+	}
+}
+
+// failingReader fails the test if the message body is read
+type failingReader struct{ t *testing.T }
+
+func (r failingReader) Read([]byte) (int, error) {
+	r.t.Error("message body read without recipients")
+	return 0, io.EOF
+}
+
+func TestDataWithoutRecipients(t *testing.T) {
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"ALLOWED_RECIPIENTS": "example.org"}), relay)
+	s := newTestSession(be)
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.net", &smtp.RcptOptions{}); err == nil {
+		t.Fatal("recipient outside ALLOWED_RECIPIENTS accepted")
+	}
+	err := s.Data(failingReader{t})
+	if smtpCode(err) != 554 || !strings.Contains(err.Error(), "No valid recipients") {
+		t.Errorf("Data = %v, want a 554 no valid recipients", err)
+	}
+	if len(relay.Messages()) != 0 {
+		t.Errorf("relay got %d messages", len(relay.Messages()))
+	}
+
+	// Over SMTP go-smtp refuses DATA itself
+	c := dialSMTP(t, startTestServer(t, be, nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.cmd("RCPT TO:<user@example.net>")
+	if code, msg := c.cmd("DATA"); code/100 != 5 {
+		t.Errorf("DATA without recipients got %d %s, want a 5xx", code, msg)
+	}
+	c.expect(250, "NOOP")
+}
+
+func TestMessageIDCorrelatesLogLines(t *testing.T) {
+	logs := captureLog(t)
+	relay := &flakyRelay{failures: 1}
+	config := testConfig(t, map[string]string{"SEND_RETRIES": "1", "SEND_RETRY_DELAY": "1ms", "SEND_WORKERS": "2", "SEND_QUEUE_MODE": "wait"})
+	s := newTestSession(newTestBackend(t, config, relay))
+	for i := 0; i < 2; i++ {
+		if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Hi\n\nHello\n"); err != nil {
+			t.Fatalf("DATA: %v", err)
+		}
+	}
+
+	messages := relay.Messages()
+	if len(messages) != 2 || messages[0].ID == messages[1].ID {
+		t.Fatalf("relayed %d messages with IDs %v, want 2 distinct", len(messages), messages)
+	}
+	for _, msg := range messages {
+		if _, err := uuid.Parse(msg.ID); err != nil {
+			t.Errorf("ID %q is not a UUID", msg.ID)
+		}
+	}
+	// The first message was retried once, each line names it
+	for _, want := range []string{
+		"Accepted message: id=" + messages[0].ID + " from=app@example.com",
+		"failed, retrying in 1ms: id=" + messages[0].ID + ":",
+		"Email sent successfully: id=" + messages[0].ID + " from=app@example.com",
+		"Accepted message: id=" + messages[1].ID + " from=app@example.com",
+		"Email sent successfully: id=" + messages[1].ID + " from=app@example.com",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestRecipientAllowed(t *testing.T) {
+	tests := []struct {
+		allowed, denied string
+		to              string
+		want            bool
+	}{
+		{"", "", "anyone@example.net", true},
+		{"example.com, *.example.org", "", "user@example.com", true},
+		{"example.com, *.example.org", "", "User@EXAMPLE.COM", true},
+		{"example.com, *.example.org", "", "user@mail.example.org", true},
+		{"example.com, *.example.org", "", "user@example.org", false},
+		{"example.com, *.example.org", "", "user@sub.example.com", false},
+		{"example.com, *.example.org", "", "user@notexample.com", false},
+		{"", "blocked.example.com", "user@blocked.example.com", false},
+		{"", "blocked.example.com", "user@open.example.com", true},
+		{"*.example.com", "*.qa.example.com", "user@app.example.com", true},
+		{"*.example.com", "*.qa.example.com", "user@x.qa.example.com", false},
+	}
+	for _, tt := range tests {
+		config := &Config{AllowedRecipients: splitList(tt.allowed), DeniedRecipients: splitList(tt.denied)}
+		if got := config.recipientAllowed(tt.to); got != tt.want {
+			t.Errorf("allowed=%q denied=%q: recipientAllowed(%s) = %v, want %v", tt.allowed, tt.denied, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRcptRecipientPolicy(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{"ALLOWED_RECIPIENTS": "*.example.org,example.org", "DENIED_RECIPIENTS": "qa.example.org"})
+	s := newTestSession(newTestBackend(t, config, relay))
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for to, want := range map[string]int{
+		"user@example.org":      0,
+		"<user@mx.example.org>": 0,
+		"tester@qa.example.org": 550,
+		"someone@example.net":   550,
+	} {
+		err := s.Rcpt(to, &smtp.RcptOptions{})
+		if smtpCode(err) != want {
+			t.Errorf("Rcpt(%s) = %v, want code %d", to, err, want)
+		}
+		if want != 0 && !strings.Contains(err.Error(), "Recipient domain not allowed") {
+			t.Errorf("Rcpt(%s) = %v, want a clear reason", to, err)
+		}
+	}
+	if err := s.Data(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := relay.Messages(); len(got) != 1 || len(got[0].To) != 2 {
+		t.Errorf("relayed %+v, want one message to the 2 allowed recipients", got)
+	}
+}
+
+func TestDomainsAligned(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"conta-cloud.mx", "conta-cloud.mx", true},
+		{"bounces.conta-cloud.mx", "conta-cloud.mx", true},
+		{"conta-cloud.mx", "mail.conta-cloud.mx", true},
+		{"evil-conta-cloud.mx", "conta-cloud.mx", false},
+		{"example.com", "example.org", false},
+		{"", "example.com", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := domainsAligned(tt.a, tt.b); got != tt.want {
+			t.Errorf("domainsAligned(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRequireSenderAlignment(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		header   string
+		wantCode int
+	}{
+		{"same domain", "app@conta-cloud.mx", "From: App <app@conta-cloud.mx>\n", 0},
+		{"envelope subdomain", "bounces@bounces.conta-cloud.mx", "From: app@conta-cloud.mx\n", 0},
+		{"case differs", "App@Conta-Cloud.MX", "From: app@conta-cloud.mx\n", 0},
+		{"bounce", "", "From: mailer-daemon@example.org\n", 0},
+		{"other domain", "app@conta-cloud.mx", "From: ceo@example.com\n", 550},
+		{"lookalike domain", "app@evil-conta-cloud.mx", "From: app@conta-cloud.mx\n", 550},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			relay := &fakeRelay{}
+			be := newTestBackend(t, testConfig(t, map[string]string{"REQUIRE_SENDER_ALIGNMENT": "true"}), relay)
+			err := sendTestMessage(newTestSession(be), tt.from, []string{"user@example.org"}, tt.header+"Subject: Hi\n\nHi\n")
+			if smtpCode(err) != tt.wantCode || (tt.wantCode == 0 && err != nil) {
+				t.Fatalf("err = %v, want code %d", err, tt.wantCode)
+			}
+			if tt.wantCode == 0 {
+				if len(relay.Messages()) != 1 {
+					t.Error("aligned message was not relayed")
+				}
+				return
+			}
+			if len(relay.Messages()) != 0 || !strings.Contains(logs.String(), reasonSenderNotAligned) {
+				t.Errorf("misaligned message relayed or not audited:\n%s", logs)
+			}
+			if !strings.Contains(err.Error(), "does not align") {
+				t.Errorf("err = %v, want the alignment reply", err)
+			}
+		})
+	}
+
+	// Off by default
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, nil), relay)
+	if err := sendTestMessage(newTestSession(be), "app@conta-cloud.mx", []string{"user@example.org"}, "From: ceo@example.com\nSubject: Hi\n\nHi\n"); err != nil {
+		t.Errorf("misaligned message without REQUIRE_SENDER_ALIGNMENT: %v", err)
+	}
+}
+
+func TestAbruptDisconnectDuringData(t *testing.T) {
+	logs := captureLog(t)
+	relay := &fakeRelay{}
+	be := newTestBackend(t, testConfig(t, map[string]string{"MAX_INFLIGHT_BYTES": "10000000", "MAX_CONNECTIONS_PER_IP": "1"}), relay)
+	addr := startTestServer(t, be, nil)
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com> SIZE=5000")
+	c.expect(250, "RCPT TO:<user@example.org>")
+	c.expect(354, "DATA")
+	if _, err := c.conn.Write([]byte("From: app@example.com\r\nSubject: Half\r\n\r\nThe first half")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Disconnect once DATA holds its reservation
+	waitUsed := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			be.inflight.mu.Lock()
+			used := be.inflight.used
+			be.inflight.mu.Unlock()
+			if used == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d inflight bytes reserved, want %d", used, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitUsed(5000)
+	c.conn.Close()
+	waitUsed(0)
+	waitIPConns(t, be, "127.0.0.1", 0)
+
+	if len(relay.Messages()) != 0 {
+		t.Error("partial message was relayed")
+	}
+	if out := logs.String(); !strings.Contains(out, reasonClientDisconnected) || !strings.Contains(out, "disconnected during DATA") {
+		t.Errorf("disconnect not logged:\n%s", out)
+	}
+
+	// The released slot and budget serve the next client
+	c = dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com> SIZE=5000")
+	c.expect(250, "RCPT TO:<user@example.org>")
+	c.expect(354, "DATA")
+	c.expect(250, "From: app@example.com\r\nSubject: Whole\r\n\r\nAll of it\r\n.")
+	if len(relay.Messages()) != 1 {
+		t.Errorf("relayed %d messages after the reconnect, want 1", len(relay.Messages()))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxSenderDomainLabels caps the distinct sender_domain label values; later
+// domains are counted under "other" to bound the series count
+const maxSenderDomainLabels = 100
+
+var (
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp_relay_messages_sent_total",
+		Help: "Messages successfully handed to the backend.",
+	}, []string{"sender_domain", "status"})
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp_relay_messages_failed_total",
+		Help: "Messages the backend failed to send.",
+	}, []string{"sender_domain", "status"})
+	senderQuotaUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smtp_relay_sender_quota_used",
+		Help: "Messages sent today (UTC) per sender domain, when SENDER_DAILY_QUOTA is set.",
+	}, []string{"domain"})
+	messageSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_relay_message_size_bytes",
+		Help:    "Size of accepted messages as relayed upstream.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1 KiB to 256 MiB
+	})
+	messageAttachments = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_relay_message_attachments",
+		Help:    "Attachments per message sent via SendGrid.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50},
+	})
+	attachmentSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_relay_attachment_size_bytes",
+		Help:    "Size of each attachment sent via SendGrid, base64-encoded.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	sendRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_relay_send_retries_total",
+		Help: "Send attempts retried after a temporary failure.",
+	})
+	sendRetriesExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_relay_send_retries_exhausted_total",
+		Help: "Messages that still failed temporarily after SEND_RETRIES retries.",
+	})
+	sendRetrySleep = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_relay_send_retry_sleep_seconds_total",
+		Help: "Time spent in backoff before retries.",
+	})
+	sendBackoffs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_send_backoffs_in_progress",
+		Help: "Sends currently waiting in backoff before a retry.",
+	})
+	activeSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_active_sessions",
+		Help: "Open SMTP connections.",
+	})
+	sessionsShed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_relay_sessions_shed_total",
+		Help: "SMTP connections refused with 421 above MAX_ACTIVE_SESSIONS.",
+	})
+	sendGridAPIWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_sendgrid_api_waiting",
+		Help: "SendGrid API calls waiting for a slot under SENDGRID_MAX_CONCURRENCY.",
+	})
+	sendGridAPIWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_relay_sendgrid_api_wait_seconds",
+		Help:    "Time SendGrid API calls waited for a slot under SENDGRID_MAX_CONCURRENCY, for those that had to wait.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 8), // 5ms to ~82s
+	})
+	smtpCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp_relay_smtp_commands_total",
+		Help: "SMTP commands handled, whatever their reply.",
+	}, []string{"command"})
+	sessionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_relay_session_duration_seconds",
+		Help:    "Time from EHLO/HELO to the end of an SMTP session.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // 10ms to ~44min
+	})
+	smtpPoolReused = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_relay_upstream_connections_reused_total",
+		Help: "Sends over a pooled upstream connection of the smtp backend.",
+	})
+	sendQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_send_queue_depth",
+		Help: "Messages waiting in the send queue for a worker.",
+	})
+	sendQueueOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_send_queue_oldest_age_seconds",
+		Help: "How long the oldest message in the send queue has been waiting.",
+	})
+	inflightBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp_relay_inflight_bytes",
+		Help: "Message bytes reserved against MAX_INFLIGHT_BYTES.",
+	})
+	recipientsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp_relay_recipients_rejected_total",
+		Help: "Recipients the backend did not accept although the message was sent to the rest.",
+	}, []string{"backend"})
+	eventWebhookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp_relay_event_webhook_failures_total",
+		Help: "Send events not delivered to EVENT_WEBHOOK_URL, by reason (dropped or error).",
+	}, []string{"reason"})
+
+	senderDomainLabels = newLabelSet(maxSenderDomainLabels)
+
+	// Totals since start, for the heartbeat log
+	sentTotal   atomic.Int64
+	failedTotal atomic.Int64
+)
+
+// labelSet admits up to max distinct label values and folds the rest into
+// "other"
+type labelSet struct {
+	mu     sync.Mutex
+	max    int
+	values map[string]bool
+}
+
+func newLabelSet(max int) *labelSet {
+	return &labelSet{max: max, values: make(map[string]bool)}
+}
+
+func (l *labelSet) label(value string) string {
+	value = strings.ToLower(value)
+	if value == "" {
+		return "unknown"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.values[value] {
+		return value
+	}
+	if len(l.values) >= l.max {
+		return "other"
+	}
+	l.values[value] = true
+	return value
+}
+
+// statusLabel is the upstream status for the metrics: the HTTP status or
+// SMTP reply code when known, "dry_run" for dry runs, or "error" for
+// failures without one (network errors, timeouts)
+func statusLabel(result *SendResult, err error) string {
+	if err == nil {
+		if result == nil || result.StatusCode == 0 {
+			return "dry_run"
+		}
+		return strconv.Itoa(result.StatusCode)
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return strconv.Itoa(statusErr.StatusCode)
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return strconv.Itoa(smtpErr.Code)
+	}
+	return "error"
+}
+
+// recordSend counts a send attempt's outcome by sender domain and status
+func recordSend(from string, result *SendResult, err error) {
+	labels := prometheus.Labels{
+		"sender_domain": senderDomainLabels.label(addressDomain(from)),
+		"status":        statusLabel(result, err),
+	}
+	if err != nil {
+		messagesFailed.With(labels).Inc()
+		failedTotal.Add(1)
+	} else {
+		messagesSent.With(labels).Inc()
+		sentTotal.Add(1)
+	}
+}
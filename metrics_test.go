@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestStatusLabel(t *testing.T) {
+	tests := []struct {
+		result *SendResult
+		err    error
+		want   string
+	}{
+		{&SendResult{StatusCode: 202}, nil, "202"},
+		{&SendResult{}, nil, "dry_run"},
+		{nil, nil, "dry_run"},
+		{nil, fmt.Errorf("send: %w", &StatusError{Service: "SendGrid", StatusCode: 429}), "429"},
+		{nil, &smtp.SMTPError{Code: 554}, "554"},
+		{nil, errors.New("connection refused"), "error"},
+	}
+	for _, tt := range tests {
+		if got := statusLabel(tt.result, tt.err); got != tt.want {
+			t.Errorf("statusLabel(%+v, %v) = %s, want %s", tt.result, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSendLabels(t *testing.T) {
+	previous := senderDomainLabels
+	senderDomainLabels = newLabelSet(2)
+	t.Cleanup(func() { senderDomainLabels = previous })
+
+	sent := func(domain, status string) float64 {
+		return testutil.ToFloat64(messagesSent.WithLabelValues(domain, status))
+	}
+	failed := func(domain, status string) float64 {
+		return testutil.ToFloat64(messagesFailed.WithLabelValues(domain, status))
+	}
+	baseA, baseB, baseOther := sent("a.example", "202"), sent("b.example", "202"), sent("other", "202")
+	baseFailed := failed("a.example", "429")
+
+	recordSend("app@A.example", &SendResult{StatusCode: 202}, nil)
+	recordSend("app@a.example", &SendResult{StatusCode: 202}, nil)
+	recordSend("app@a.example", nil, &StatusError{Service: "SendGrid", StatusCode: 429})
+	recordSend("app@b.example", &SendResult{StatusCode: 202}, nil)
+	// Past the cap new domains fold into "other", known ones keep their label
+	recordSend("app@c.example", &SendResult{StatusCode: 202}, nil)
+	recordSend("app@d.example", &SendResult{StatusCode: 202}, nil)
+	recordSend("app@b.example", &SendResult{StatusCode: 202}, nil)
+
+	if got := sent("a.example", "202") - baseA; got != 2 {
+		t.Errorf("a.example sent = %v, want 2", got)
+	}
+	if got := failed("a.example", "429") - baseFailed; got != 1 {
+		t.Errorf("a.example failed with 429 = %v, want 1", got)
+	}
+	if got := sent("b.example", "202") - baseB; got != 2 {
+		t.Errorf("b.example sent = %v, want 2", got)
+	}
+	if got := sent("other", "202") - baseOther; got != 2 {
+		t.Errorf("other sent = %v, want 2", got)
+	}
+	if got := sent("c.example", "202"); got != 0 {
+		t.Errorf("c.example has its own series (%v) past the cap", got)
+	}
+}
+
+func TestLabelSetUnknown(t *testing.T) {
+	l := newLabelSet(1)
+	if got := l.label(""); got != "unknown" {
+		t.Errorf("label of an empty domain = %s", got)
+	}
+	if got := l.label("Example.COM"); got != "example.com" {
+		t.Errorf("label = %s, want it lowercased", got)
+	}
+}
+
+// histogramSamples returns the sample count and sum observed by h so far
+func histogramSamples(t *testing.T, h prometheus.Histogram) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestMessageSizeObserved(t *testing.T) {
+	relay := &fakeRelay{}
+	s := newTestSession(newTestBackend(t, testConfig(t, nil), relay))
+	count, sum := histogramSamples(t, messageSize)
+
+	for _, size := range []int{10, 5000, 100000} {
+		body := strings.Repeat(strings.Repeat("x", 99)+"\n", size/100+1)
+		if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Hi\n\n"+body); err != nil {
+			t.Fatalf("send %d bytes: %v", size, err)
+		}
+	}
+
+	var want float64
+	for _, msg := range relay.Messages() {
+		want += float64(len(msg.Raw))
+	}
+	gotCount, gotSum := histogramSamples(t, messageSize)
+	if gotCount-count != 3 || gotSum-sum != want {
+		t.Errorf("observed %d sizes totalling %v, want 3 totalling %v", gotCount-count, gotSum-sum, want)
+	}
+}
+
+func TestAttachmentsObserved(t *testing.T) {
+	messages, attachments := histogramSamples(t, messageAttachments)
+	_, sizes := histogramSamples(t, attachmentSize)
+
+	if _, err := sendGridPayload(t, nil, attachmentMessage(make([]byte, 3000))); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\n\nHello\n"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	gotMessages, gotAttachments := histogramSamples(t, messageAttachments)
+	if gotMessages-messages != 2 || gotAttachments-attachments != 1 {
+		t.Errorf("observed %d messages with %v attachments, want 2 with 1", gotMessages-messages, gotAttachments-attachments)
+	}
+	// 3000 bytes are 4000 once base64-encoded
+	if _, gotSizes := histogramSamples(t, attachmentSize); gotSizes-sizes != 4000 {
+		t.Errorf("observed %v attachment bytes, want 4000", gotSizes-sizes)
+	}
+}
+
+// flakyRelay fails the first failures sends with a temporary error
+type flakyRelay struct {
+	fakeRelay
+	failures int
+}
+
+func (r *flakyRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	r.mu.Lock()
+	fail := r.failures > 0
+	r.failures--
+	r.mu.Unlock()
+	if fail {
+		return nil, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again"}
+	}
+	return r.fakeRelay.Send(ctx, msg)
+}
+
+func TestRetryMetrics(t *testing.T) {
+	retries, exhausted, sleep := testutil.ToFloat64(sendRetries), testutil.ToFloat64(sendRetriesExhausted), testutil.ToFloat64(sendRetrySleep)
+	config := testConfig(t, map[string]string{"SEND_RETRIES": "3", "SEND_RETRY_DELAY": "10ms"})
+	const raw = "From: app@example.com\nSubject: Hi\n\nHello\n"
+
+	// Succeeds on the third attempt, after 10ms and 20ms of backoff
+	flaky := &flakyRelay{failures: 2}
+	if err := sendTestMessage(newTestSession(newTestBackend(t, config, flaky)), "app@example.com", []string{"user@example.org"}, raw); err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if got := testutil.ToFloat64(sendRetries) - retries; got != 2 {
+		t.Errorf("retries = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sendRetrySleep) - sleep; got < 0.029 || got > 0.031 {
+		t.Errorf("retry sleep = %vs, want 0.03s", got)
+	}
+	if got := testutil.ToFloat64(sendRetriesExhausted) - exhausted; got != 0 {
+		t.Errorf("retries exhausted = %v, want 0", got)
+	}
+
+	// Fails after all 3 retries
+	failing := &flakyRelay{failures: 10}
+	if err := sendTestMessage(newTestSession(newTestBackend(t, config, failing)), "app@example.com", []string{"user@example.org"}, raw); smtpCode(err) != 451 {
+		t.Fatalf("DATA: err = %v, want a 451", err)
+	}
+	if got := testutil.ToFloat64(sendRetries) - retries; got != 5 {
+		t.Errorf("retries = %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(sendRetriesExhausted) - exhausted; got != 1 {
+		t.Errorf("retries exhausted = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(sendBackoffs); got != 0 {
+		t.Errorf("backoffs in progress = %v after the sends, want 0", got)
+	}
+}
+
+func TestBackoffGauge(t *testing.T) {
+	config := testConfig(t, map[string]string{"SEND_RETRIES": "1", "SEND_RETRY_DELAY": "300ms"})
+	s := newTestSession(newTestBackend(t, config, &flakyRelay{failures: 1}))
+	done := make(chan error, 1)
+	go func() {
+		done <- sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "From: app@example.com\nSubject: Hi\n\nHello\n")
+	}()
+
+	deadline := time.Now().Add(250 * time.Millisecond)
+	for testutil.ToFloat64(sendBackoffs) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("backoff gauge did not reach 1 during the retry delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if got := testutil.ToFloat64(sendBackoffs); got != 0 {
+		t.Errorf("backoffs in progress = %v after the retry, want 0", got)
+	}
+}
+
+func TestSMTPCommandCounters(t *testing.T) {
+	c := dialSMTP(t, startAuthServer(t, "relay:secret"))
+	base := map[string]float64{}
+	for _, command := range []string{"AUTH", "MAIL", "RCPT", "DATA", "RSET"} {
+		base[command] = testutil.ToFloat64(smtpCommands.WithLabelValues(command))
+	}
+	sessions, _ := histogramSamples(t, sessionDuration)
+
+	// want checks the count of every command since the session started
+	want := func(step string, counts map[string]float64) {
+		t.Helper()
+		for command, before := range base {
+			if got := testutil.ToFloat64(smtpCommands.WithLabelValues(command)) - before; got != counts[command] {
+				t.Errorf("after %s: %s counted %v times, want %v", step, command, got, counts[command])
+			}
+		}
+	}
+
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	// Rejected commands are counted too
+	c.expect(530, "MAIL FROM:<app@example.com>")
+	want("MAIL without AUTH", map[string]float64{"MAIL": 1})
+	c.expect(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00relay\x00secret")))
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<a@example.org>")
+	c.expect(250, "RCPT TO:<b@example.org>")
+	want("RCPT", map[string]float64{"AUTH": 1, "MAIL": 2, "RCPT": 2})
+	c.expect(354, "DATA")
+	c.expect(250, "Subject: Hi\r\n\r\nHello\r\n.")
+	// go-smtp resets the session after DATA, which is not an RSET
+	want("DATA", map[string]float64{"AUTH": 1, "MAIL": 2, "RCPT": 2, "DATA": 1})
+	c.expect(250, "RSET")
+	want("RSET", map[string]float64{"AUTH": 1, "MAIL": 2, "RCPT": 2, "DATA": 1, "RSET": 1})
+
+	c.expect(221, "QUIT")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := histogramSamples(t, sessionDuration); got == sessions+1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session duration not observed after QUIT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSMTPCommandCountersSkipIngest(t *testing.T) {
+	mail := testutil.ToFloat64(smtpCommands.WithLabelValues("MAIL"))
+	sessions, _ := histogramSamples(t, sessionDuration)
+
+	s := newTestSession(newTestBackend(t, testConfig(t, nil), &fakeRelay{}))
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, "Subject: Hi\n\nHello\n"); err != nil {
+		t.Fatal(err)
+	}
+	s.Logout()
+	if got := testutil.ToFloat64(smtpCommands.WithLabelValues("MAIL")) - mail; got != 0 {
+		t.Errorf("HTTP ingest session counted %v MAIL commands, want none", got)
+	}
+	if got, _ := histogramSamples(t, sessionDuration); got != sessions {
+		t.Error("HTTP ingest session observed a session duration")
+	}
+}
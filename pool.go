@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// sendJob is an accepted message waiting to be delivered
+type sendJob struct {
+	ctx     context.Context
+	msg     *Message
+	body    io.Reader // rest of the message for a StreamRelay, nil when msg.Raw is complete
+	subject string    // decoded subject, for logging
+	start   time.Time // when DATA started
+	done    chan error
+
+	// DUPLICATE_TTL entry recorded once the message is sent
+	dedupKey string
+
+	// recipients the backend did not accept, set once delivered
+	rejected map[string]string
+
+	// bytes reserved against MAX_INFLIGHT_BYTES, released once delivered
+	reservation *reservation
+
+	// message counted against SENDER_DAILY_QUOTA, released if not sent
+	quota *quotaHold
+}
+
+// sendPool delivers messages from a bounded queue with a fixed number of
+// workers, so the number of concurrent upstream calls no longer follows the
+// number of SMTP sessions. A full queue pushes back on clients with a 451.
+type sendPool struct {
+	backend *Backend
+	jobs    chan *sendJob
+	wait    bool // reply to the client only after the send completes
+
+	// queued holds when each job in jobs was queued, for the queue gauges
+	mu     sync.Mutex
+	queued map[*sendJob]time.Time
+	closed bool          // Close was called, Submit refuses new jobs
+	stop   chan struct{} // closed by Close, ends refreshGauges
+
+	workers   sync.WaitGroup
+	abandoned atomic.Bool // Close timed out, queued jobs are dead-lettered unsent
+}
+
+// queueGaugeInterval is how often the oldest queued age is refreshed while
+// no job enters or leaves the queue
+const queueGaugeInterval = 5 * time.Second
+
+// errQueueFull is returned when no queue slot is free
+var errQueueFull = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Relay busy, try again later",
+}
+
+// errShuttingDown is returned by Submit once the pool is closing, and is the
+// recorded failure of jobs still queued when Close gives up on them
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Relay shutting down, try again later",
+}
+
+func newSendPool(backend *Backend, workers, size int, wait bool) *sendPool {
+	p := &sendPool{
+		backend: backend,
+		jobs:    make(chan *sendJob, size),
+		wait:    wait,
+		queued:  make(map[*sendJob]time.Time),
+		stop:    make(chan struct{}),
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.refreshGauges()
+	return p
+}
+
+// refreshGauges keeps the oldest queued age current until Close
+func (p *sendPool) refreshGauges() {
+	ticker := time.NewTicker(queueGaugeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.updateGauges()
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *sendPool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		p.mu.Lock()
+		delete(p.queued, job)
+		p.updateGauges()
+		p.mu.Unlock()
+
+		var err error
+		if p.abandoned.Load() {
+			err = errShuttingDown
+			p.backend.abandon(job)
+		} else {
+			err = p.backend.deliver(job)
+		}
+		job.reservation.Release()
+		if job.done != nil {
+			job.done <- err
+		}
+	}
+}
+
+// Close stops accepting jobs and waits up to timeout for the queued ones to
+// be sent. Jobs still queued after that are written to DEAD_LETTER_DIR (or
+// logged as lost without one) instead of being sent; sends already in
+// progress are left to finish.
+func (p *sendPool) Close(timeout time.Duration) {
+	p.mu.Lock()
+	p.closed = true
+	pending := len(p.jobs)
+	close(p.jobs)
+	close(p.stop)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	if pending > 0 {
+		logInfo("Draining send queue: %d messages", pending)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	p.abandoned.Store(true)
+	logWarn("Send queue not drained after %v, dead-lettering queued messages", timeout)
+	// Take the remaining jobs here too, workers may all be stuck in a send
+	for job := range p.jobs {
+		p.mu.Lock()
+		delete(p.queued, job)
+		p.updateGauges()
+		p.mu.Unlock()
+		p.backend.abandon(job)
+		job.reservation.Release()
+		if job.done != nil {
+			job.done <- errShuttingDown
+		}
+	}
+}
+
+// Submit queues job without blocking. In wait mode it then blocks until the
+// message is sent and returns the send error; in async mode the message is
+// accepted as soon as it is queued and send errors are only logged.
+func (p *sendPool) Submit(job *sendJob) error {
+	if p.wait {
+		job.done = make(chan error, 1)
+	}
+
+	// Queued under the lock, so a worker can only take the job once its
+	// time is recorded
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errShuttingDown
+	}
+	select {
+	case p.jobs <- job:
+		p.queued[job] = time.Now()
+		p.updateGauges()
+		p.mu.Unlock()
+	default:
+		p.mu.Unlock()
+		logWarn("Send queue full (%d messages), deferring message: id=%s from=%s", cap(p.jobs), job.msg.ID, job.msg.From)
+		return errQueueFull
+	}
+
+	if !p.wait {
+		logDebug("Queued message: id=%s from=%s (%d waiting)", job.msg.ID, job.msg.From, len(p.jobs))
+		return nil
+	}
+	return <-job.done
+}
+
+// updateGauges sets the queue depth and the age of the oldest queued
+// message. Callers hold p.mu.
+func (p *sendPool) updateGauges() {
+	sendQueueDepth.Set(float64(len(p.queued)))
+	var oldest time.Time
+	for _, at := range p.queued {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	age := 0.0
+	if !oldest.IsZero() {
+		age = time.Since(oldest).Seconds()
+	}
+	sendQueueOldestAge.Set(age)
+}
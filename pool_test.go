@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingRelay is a fakeRelay whose sends wait for release, announcing
+// each one on started
+type blockingRelay struct {
+	fakeRelay
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingRelay() *blockingRelay {
+	return &blockingRelay{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (r *blockingRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	r.started <- struct{}{}
+	<-r.release
+	return r.fakeRelay.Send(ctx, msg)
+}
+
+// waitStarted waits for the next send to reach the relay
+func (r *blockingRelay) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-r.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no send reached the relay")
+	}
+}
+
+// waitMessages waits until the relay has sent n messages
+func waitMessages(t *testing.T, r *fakeRelay, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Messages()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("relay sent %d messages, want %d", len(r.Messages()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const poolTestMessage = "From: app@example.com\nTo: user@example.org\nSubject: Hi\n\nHello\n"
+
+func TestSendPoolBackpressure(t *testing.T) {
+	relay := newBlockingRelay()
+	config := testConfig(t, map[string]string{"SEND_WORKERS": "1", "SEND_QUEUE_SIZE": "1", "SEND_QUEUE_MODE": "async"})
+	be := newTestBackend(t, config, relay)
+	to := []string{"user@example.org"}
+
+	// The worker takes the first message, the second waits in the queue
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	relay.waitStarted(t)
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+		t.Fatalf("queued message: %v", err)
+	}
+
+	// With the worker busy and the queue full the client is deferred
+	err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage)
+	if err != errQueueFull {
+		t.Errorf("message over the queue size: err = %v, want %v", err, errQueueFull)
+	}
+
+	close(relay.release)
+	waitMessages(t, &relay.fakeRelay, 2)
+}
+
+func TestSendPoolWaitMode(t *testing.T) {
+	relay := newBlockingRelay()
+	config := testConfig(t, map[string]string{"SEND_WORKERS": "2", "SEND_QUEUE_MODE": "wait"})
+	be := newTestBackend(t, config, relay)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage)
+	}()
+	relay.waitStarted(t)
+	select {
+	case err := <-done:
+		t.Fatalf("DATA replied before the send completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(relay.release)
+	if err := <-done; err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+
+	// The send error reaches the client
+	relay.err = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Rejected"}
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, poolTestMessage); smtpCode(err) != 550 {
+		t.Errorf("failed send: err = %v, want the 550", err)
+	}
+}
+
+func TestSendPoolCloseDrains(t *testing.T) {
+	relay := newBlockingRelay()
+	be := newTestBackend(t, testConfig(t, nil), relay)
+	be.pool = newSendPool(be, 1, 5, false)
+	to := []string{"user@example.org"}
+
+	for i := 0; i < 3; i++ {
+		if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	relay.waitStarted(t)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(relay.release)
+	}()
+	be.pool.Close(5 * time.Second)
+	if n := len(relay.Messages()); n != 3 {
+		t.Errorf("sent %d messages before Close returned, want 3", n)
+	}
+
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != errShuttingDown {
+		t.Errorf("message after Close: err = %v, want %v", err, errShuttingDown)
+	}
+}
+
+func TestSendPoolCloseDeadLettersQueued(t *testing.T) {
+	dir := t.TempDir()
+	relay := newBlockingRelay()
+	defer close(relay.release)
+	be := newTestBackend(t, testConfig(t, map[string]string{"DEAD_LETTER_DIR": dir}), relay)
+	be.pool = newSendPool(be, 1, 5, false)
+	to := []string{"user@example.org"}
+
+	for i := 0; i < 3; i++ {
+		if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	relay.waitStarted(t)
+
+	// The worker stays stuck in the first send, the two queued messages
+	// are dead-lettered once the timeout passes
+	start := time.Now()
+	be.pool.Close(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close took %v with a stuck send", elapsed)
+	}
+	letters, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("dead letters = %v, want the 2 queued messages", letters)
+	}
+	if raw, err := os.ReadFile(letters[0]); err != nil || len(raw) == 0 {
+		t.Errorf("dead letter %s: %v", letters[0], err)
+	}
+}
+
+func TestSendQueueGauges(t *testing.T) {
+	relay := newBlockingRelay()
+	config := testConfig(t, map[string]string{"SEND_WORKERS": "1", "SEND_QUEUE_SIZE": "3", "SEND_QUEUE_MODE": "async"})
+	be := newTestBackend(t, config, relay)
+	to := []string{"user@example.org"}
+
+	// The worker holds the first message, the next two wait in the queue
+	if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+		t.Fatal(err)
+	}
+	relay.waitStarted(t)
+	for i := 0; i < 2; i++ {
+		if err := sendTestMessage(newTestSession(be), "app@example.com", to, poolTestMessage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(sendQueueDepth); got != 2 {
+		t.Errorf("smtp_relay_send_queue_depth = %v, want 2", got)
+	}
+
+	// The periodic refresh ages the oldest message while nothing moves
+	time.Sleep(20 * time.Millisecond)
+	be.pool.mu.Lock()
+	be.pool.updateGauges()
+	be.pool.mu.Unlock()
+	if got := testutil.ToFloat64(sendQueueOldestAge); got < 0.02 || got > 5 {
+		t.Errorf("smtp_relay_send_queue_oldest_age_seconds = %v, want about 0.02", got)
+	}
+
+	close(relay.release)
+	waitMessages(t, &relay.fakeRelay, 3)
+	if depth, age := testutil.ToFloat64(sendQueueDepth), testutil.ToFloat64(sendQueueOldestAge); depth != 0 || age != 0 {
+		t.Errorf("drained queue: depth = %v, oldest age = %v, want 0", depth, age)
+	}
+}
+
+func TestSendPoolCloseStopsGaugeRefresh(t *testing.T) {
+	p := newSendPool(newTestBackend(t, testConfig(t, nil), &fakeRelay{}), 1, 1, false)
+	p.Close(time.Second)
+	select {
+	case <-p.stop:
+	default:
+		t.Error("Close left the gauge refresh running")
+	}
+}
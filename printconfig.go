@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// redactedValue replaces secrets in the printed configuration
+const redactedValue = "****"
+
+// secretSettings are the settings whose value is never printed
+var secretSettings = map[string]bool{
+	"SENDGRID_API_KEY":      true,
+	"SMTP_RELAY_PASSWORD":   true,
+	"HTTP_INGEST_TOKEN":     true,
+	"DEBUG_TOKEN":           true,
+	"AWS_SECRET_ACCESS_KEY": true,
+	"AWS_SESSION_TOKEN":     true,
+}
+
+// effectiveSettings returns every setting read by loadConfig that has a
+// value, as sorted "KEY=value (source)" lines with secrets redacted. It must
+// be called after loadConfig.
+func effectiveSettings() []string {
+	keys := make([]string, 0, len(readSettings))
+	for key := range readSettings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		value := getenv(key)
+		if value == "" {
+			continue
+		}
+		source := "env"
+		if os.Getenv(key) == "" {
+			source = "config file"
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s (%s)", key, redactSetting(key, value), source))
+	}
+	return lines
+}
+
+// redactSetting hides the secret parts of a setting's value. SendGrid API
+// keys keep their "SG." prefix so the kind of key is still recognizable.
+func redactSetting(key, value string) string {
+	switch {
+	case secretSettings[key]:
+		return redactSecret(value)
+	case key == "SENDGRID_KEY_ROUTES":
+		return redactPairs(value, ",", "=")
+	case key == "SMTP_USERS":
+		return redactPairs(value, ",\n", ":")
+	case key == "SENDGRID_PROXY_URL":
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+		return redactedValue
+	}
+	return value
+}
+
+func redactSecret(value string) string {
+	if strings.HasPrefix(value, "SG.") {
+		return "SG." + redactedValue
+	}
+	return redactedValue
+}
+
+// redactPairs keeps the names of a "name=secret,..." list and redacts the
+// secrets
+func redactPairs(value, separators, sep string) string {
+	entries := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(separators, r) })
+	for i, entry := range entries {
+		name, secret, ok := strings.Cut(strings.TrimSpace(entry), sep)
+		if !ok {
+			entries[i] = redactedValue
+			continue
+		}
+		entries[i] = name + sep + redactSecret(strings.TrimSpace(secret))
+	}
+	return strings.Join(entries, ",")
+}
+
+// runPrintConfig loads the configuration and writes the effective settings
+// to w, returning the process exit code
+func runPrintConfig(w io.Writer) int {
+	if _, err := loadConfig(); err != nil {
+		fmt.Fprintf(w, "Configuration error: %v\n", err)
+		return 1
+	}
+	for _, line := range effectiveSettings() {
+		fmt.Fprintln(w, line)
+	}
+	return 0
+}
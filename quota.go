@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// senderQuota tracks per-sender-domain daily send counts.
+// Counters reset at midnight UTC.
+type senderQuota struct {
+	mu           sync.Mutex
+	defaultLimit int            // limit for domains without an override (0 = unlimited)
+	limits       map[string]int // per-domain limits
+	day          string         // UTC date the counters belong to
+	counts       map[string]int
+	used         map[string]int // counts summed by gauge label
+	now          func() time.Time
+}
+
+// quotaHold is one message counted against a domain's quota, taken before
+// the send and given back if it fails
+type quotaHold struct {
+	domain string
+	day    string
+}
+
+// parseSenderQuota parses SENDER_DAILY_QUOTA, a comma-separated list of
+// a default limit and/or domain=limit overrides, e.g. "500,conta-cloud.mx=5000".
+// It returns nil when no quota is configured.
+func parseSenderQuota(value string) (*senderQuota, error) {
+	q := &senderQuota{
+		limits: make(map[string]int),
+		counts: make(map[string]int),
+		used:   make(map[string]int),
+		now:    time.Now,
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		domain, limitStr, hasDomain := strings.Cut(entry, "=")
+		if !hasDomain {
+			limitStr = domain
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(limitStr))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid SENDER_DAILY_QUOTA entry %q", entry)
+		}
+
+		if hasDomain {
+			q.limits[strings.ToLower(strings.TrimSpace(domain))] = limit
+		} else {
+			q.defaultLimit = limit
+		}
+	}
+
+	if q.defaultLimit == 0 && len(q.limits) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func (q *senderQuota) limit(domain string) int {
+	if limit, ok := q.limits[domain]; ok {
+		return limit
+	}
+	return q.defaultLimit
+}
+
+// rollover resets the counters when the UTC day changes. Callers hold q.mu.
+func (q *senderQuota) rollover() {
+	today := q.now().UTC().Format("2006-01-02")
+	if q.day != today {
+		q.day = today
+		q.counts = make(map[string]int)
+		q.used = make(map[string]int)
+		senderQuotaUsed.Reset()
+	}
+}
+
+// Exceeded reports whether domain has used up its quota for today
+func (q *senderQuota) Exceeded(domain string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	limit := q.limit(domain)
+	return limit > 0 && q.counts[domain] >= limit
+}
+
+// Reserve counts a message against domain's quota for today, unless that
+// would exceed it. Checking and counting under one lock keeps concurrent
+// sessions from overshooting the limit. Domains without a limit are not
+// counted and get a nil hold.
+func (q *senderQuota) Reserve(domain string) (*quotaHold, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	limit := q.limit(domain)
+	if limit == 0 {
+		return nil, true
+	}
+	if q.counts[domain] >= limit {
+		return nil, false
+	}
+	q.counts[domain]++
+	q.setUsed(domain, 1)
+	return &quotaHold{domain: domain, day: q.day}, true
+}
+
+// Release gives back a hold whose message was not sent. Holds from before
+// the last reset are ignored.
+func (q *senderQuota) Release(h *quotaHold) {
+	if h == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	if h.day != q.day || q.counts[h.domain] == 0 {
+		return
+	}
+	q.counts[h.domain]--
+	q.setUsed(h.domain, -1)
+}
+
+// setUsed moves the gauge for domain by delta. Domains past
+// maxSenderDomainLabels share the "other" series. Callers hold q.mu.
+func (q *senderQuota) setUsed(domain string, delta int) {
+	label := senderDomainLabels.label(domain)
+	q.used[label] += delta
+	senderQuotaUsed.WithLabelValues(label).Set(float64(q.used[label]))
+}
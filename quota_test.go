@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSenderQuota(t *testing.T) {
+	q, err := parseSenderQuota("500, Conta-Cloud.mx=5000 ,bulk.example.com=0")
+	if err != nil {
+		t.Fatalf("parseSenderQuota: %v", err)
+	}
+	for domain, want := range map[string]int{"other.example": 500, "conta-cloud.mx": 5000, "bulk.example.com": 0} {
+		if got := q.limit(domain); got != want {
+			t.Errorf("limit(%s) = %d, want %d", domain, got, want)
+		}
+	}
+
+	if q, err := parseSenderQuota(""); q != nil || err != nil {
+		t.Errorf("empty quota = %v, %v, want nil", q, err)
+	}
+	for _, value := range []string{"abc", "example.com=-1", "example.com=ten"} {
+		if _, err := parseSenderQuota(value); err == nil {
+			t.Errorf("parseSenderQuota(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSenderQuotaResetsAtMidnightUTC(t *testing.T) {
+	q, err := parseSenderQuota("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	q.Reserve("example.com")
+	if q.Exceeded("example.com") {
+		t.Fatal("exceeded after 1 of 2")
+	}
+	q.Reserve("example.com")
+	if !q.Exceeded("example.com") {
+		t.Fatal("not exceeded after 2 of 2")
+	}
+	if _, ok := q.Reserve("example.com"); ok {
+		t.Fatal("reserved a 3rd message of 2")
+	}
+	if q.Exceeded("other.example") {
+		t.Error("quota is shared across domains")
+	}
+	if got := testutil.ToFloat64(senderQuotaUsed.WithLabelValues("example.com")); got != 2 {
+		t.Errorf("smtp_relay_sender_quota_used = %v, want 2", got)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if q.Exceeded("example.com") {
+		t.Error("quota not reset after midnight UTC")
+	}
+}
+
+func TestSenderQuotaReserveIsAtomic(t *testing.T) {
+	q, err := parseSenderQuota("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var reserved atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := q.Reserve("example.com"); ok {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := reserved.Load(); got != 10 {
+		t.Errorf("%d concurrent reservations succeeded, want 10", got)
+	}
+}
+
+func TestSenderQuotaRelease(t *testing.T) {
+	q, err := parseSenderQuota("1,bulk.example.com=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	hold, ok := q.Reserve("example.com")
+	if !ok {
+		t.Fatal("first message refused")
+	}
+	q.Release(hold)
+	if q.Exceeded("example.com") {
+		t.Fatal("released message still counts")
+	}
+
+	// A hold from yesterday does not free a message of today
+	hold, _ = q.Reserve("example.com")
+	now = now.Add(2 * time.Minute)
+	q.Reserve("example.com")
+	q.Release(hold)
+	if !q.Exceeded("example.com") {
+		t.Error("yesterday's hold released today's message")
+	}
+
+	// Unlimited domains are not counted at all
+	hold, ok = q.Reserve("bulk.example.com")
+	if !ok || hold != nil {
+		t.Errorf("Reserve on an unlimited domain = %v, %v, want nil, true", hold, ok)
+	}
+	if _, ok := q.counts["bulk.example.com"]; ok {
+		t.Error("unlimited domain was counted")
+	}
+	q.Release(nil)
+}
+
+func TestSenderQuotaUsedLabelsAreCapped(t *testing.T) {
+	previous := senderDomainLabels
+	senderDomainLabels = newLabelSet(1)
+	t.Cleanup(func() { senderDomainLabels = previous })
+	q, err := parseSenderQuota("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Reserve("first.example")
+	q.Reserve("second.example")
+	hold, _ := q.Reserve("third.example")
+	if got := testutil.ToFloat64(senderQuotaUsed.WithLabelValues("other")); got != 2 {
+		t.Errorf(`smtp_relay_sender_quota_used{domain="other"} = %v, want 2`, got)
+	}
+	q.Release(hold)
+	if got := testutil.ToFloat64(senderQuotaUsed.WithLabelValues("other")); got != 1 {
+		t.Errorf(`smtp_relay_sender_quota_used{domain="other"} after a release = %v, want 1`, got)
+	}
+	if got := testutil.CollectAndCount(senderQuotaUsed); got != 2 {
+		t.Errorf("smtp_relay_sender_quota_used has %d series, want 2", got)
+	}
+}
+
+func TestSessionRejectsSenderOverQuota(t *testing.T) {
+	config := testConfig(t, map[string]string{"SENDER_DAILY_QUOTA": "1"})
+	relay := &fakeRelay{}
+	be := newTestBackend(t, config, relay)
+	be.quota.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	s := newTestSession(be)
+
+	raw := "From: app@example.com\nTo: user@example.org\nSubject: Hi\n\nHello\n"
+	if err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, raw); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	err := sendTestMessage(s, "app@example.com", []string{"user@example.org"}, raw)
+	if code := smtpCode(err); code != 451 {
+		t.Fatalf("second message: err = %v, want a 451", err)
+	}
+	if err := sendTestMessage(s, "app@other.example", []string{"user@example.org"}, raw); err != nil {
+		t.Errorf("other sender domain: %v", err)
+	}
+	if got := len(relay.Messages()); got != 2 {
+		t.Errorf("relayed %d messages, want 2", got)
+	}
+}
+
+func TestSessionQuotaReservedUntilSent(t *testing.T) {
+	config := testConfig(t, map[string]string{"SENDER_DAILY_QUOTA": "1"})
+	relay := &fakeRelay{err: &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "upstream down"}}
+	be := newTestBackend(t, config, relay)
+	raw := "From: app@example.com\nTo: user@example.org\nSubject: Hi\n\nHello\n"
+
+	// A failed send does not use up the quota
+	if err := sendTestMessage(newTestSession(be), "app@example.com", []string{"user@example.org"}, raw); err == nil {
+		t.Fatal("send through a failing relay succeeded")
+	}
+	relay.mu.Lock()
+	relay.err = nil
+	relay.mu.Unlock()
+
+	// Both sessions pass MAIL FROM with one message left, only the first
+	// DATA gets it
+	first, second := newTestSession(be), newTestSession(be)
+	for _, s := range []*Session{first, second} {
+		if err := s.Mail("app@example.com", nil); err != nil {
+			t.Fatalf("MAIL: %v", err)
+		}
+		if err := s.Rcpt("user@example.org", nil); err != nil {
+			t.Fatalf("RCPT: %v", err)
+		}
+	}
+	if err := first.Data(strings.NewReader(raw)); err != nil {
+		t.Fatalf("first DATA: %v", err)
+	}
+	if err := second.Data(strings.NewReader(raw)); smtpCode(err) != 451 {
+		t.Errorf("second DATA: err = %v, want a 451", err)
+	}
+	if got := len(relay.Messages()); got != 2 {
+		t.Errorf("relay got %d messages, want 2", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Policy rejections whose reply can be overridden with REJECT_MSG_<name>
+const (
+	rejectSender     = "SENDER"
+	rejectRecipient  = "RECIPIENT"
+	rejectRate       = "RATE"
+	rejectRecipients = "RECIPIENTS"
+	rejectGreylist   = "GREYLIST"
+	rejectHeaderFrom = "HEADER_FROM"
+	rejectAlignment  = "ALIGNMENT"
+	rejectSuppressed = "SUPPRESSED"
+	rejectDuplicate  = "DUPLICATE"
+)
+
+var defaultRejections = map[string]smtp.SMTPError{
+	rejectSender:     {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "sender domain not allowed"},
+	rejectRecipient:  {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Recipient domain not allowed"},
+	rejectRate:       {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Daily send quota exceeded, try again later"},
+	rejectRecipients: {Code: 452, EnhancedCode: smtp.EnhancedCode{4, 5, 3}, Message: "Too many recipients for this session"},
+	rejectGreylist:   {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Greylisted, try again later"},
+	rejectHeaderFrom: {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "From header domain not allowed"},
+	rejectAlignment:  {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Envelope sender does not align with From header"},
+	rejectSuppressed: {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Recipient suppressed after a bounce or complaint"},
+	rejectDuplicate:  {Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Duplicate message already accepted"},
+}
+
+var (
+	replyCodePattern    = regexp.MustCompile(`^[45][0-9][0-9]$`)
+	enhancedCodePattern = regexp.MustCompile(`^[45]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+)
+
+// loadRejections reads the REJECT_MSG_* overrides
+func loadRejections() (map[string]smtp.SMTPError, error) {
+	rejections := make(map[string]smtp.SMTPError)
+	for name, def := range defaultRejections {
+		key := "REJECT_MSG_" + name
+		value := getenv(key)
+		if value == "" {
+			continue
+		}
+		reply, err := parseRejection(value, def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+		rejections[name] = reply
+	}
+	return rejections, nil
+}
+
+// parseRejection parses "[code] [enhanced-code] text", e.g.
+// "550 5.7.1 Remitente no permitido". Omitted codes keep the default's.
+func parseRejection(value string, def smtp.SMTPError) (smtp.SMTPError, error) {
+	reply := def
+	text := strings.TrimSpace(value)
+
+	if field, rest, _ := strings.Cut(text, " "); replyCodePattern.MatchString(field) {
+		reply.Code, _ = strconv.Atoi(field)
+		reply.EnhancedCode[0] = reply.Code / 100
+		text = strings.TrimSpace(rest)
+	}
+	if field, rest, _ := strings.Cut(text, " "); enhancedCodePattern.MatchString(field) {
+		parts := strings.Split(field, ".")
+		for i, part := range parts {
+			reply.EnhancedCode[i], _ = strconv.Atoi(part)
+		}
+		text = strings.TrimSpace(rest)
+	}
+	if text == "" {
+		return reply, fmt.Errorf("empty message")
+	}
+	if reply.Code/100 != reply.EnhancedCode[0] {
+		return reply, fmt.Errorf("reply code %d does not match enhanced code class %d", reply.Code, reply.EnhancedCode[0])
+	}
+	reply.Message = text
+	return reply, nil
+}
+
+// rejection returns the SMTP reply for a policy rejection
+func (c *Config) rejection(name string) *smtp.SMTPError {
+	reply, ok := c.Rejections[name]
+	if !ok {
+		reply = defaultRejections[name]
+	}
+	return &reply
+}
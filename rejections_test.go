@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestParseRejection(t *testing.T) {
+	def := defaultRejections[rejectRate]
+	tests := []struct {
+		value string
+		want  smtp.SMTPError
+	}{
+		{"550 5.7.1 Remitente no permitido", smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Remitente no permitido"}},
+		{"Remitente no permitido", smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Remitente no permitido"}},
+		{"553 Not here", smtp.SMTPError{Code: 553, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Not here"}},
+		{"4.7.26 Try later", smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 26}, Message: "Try later"}},
+		// Numbers that are not codes are part of the text
+		{"2024 policy", smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "2024 policy"}},
+	}
+	for _, tt := range tests {
+		got, err := parseRejection(tt.value, def)
+		if err != nil || got != tt.want {
+			t.Errorf("parseRejection(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"550", "550 5.7.1", "550 4.7.1 Mismatch"} {
+		if _, err := parseRejection(value, def); err == nil {
+			t.Errorf("parseRejection(%q) succeeded", value)
+		}
+	}
+}
+
+func TestConfiguredRejectionReplies(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"ALLOWED_SENDERS":        "example.com",
+		"DENIED_RECIPIENTS":      "blocked.example",
+		"MAX_SESSION_RECIPIENTS": "1",
+		"REJECT_MSG_SENDER":      "550 5.7.1 Remitente no permitido",
+		"REJECT_MSG_RECIPIENT":   "Destinatario no permitido",
+		"REJECT_MSG_RECIPIENTS":  "452 4.5.3 Demasiados destinatarios",
+	})
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, &fakeRelay{}), nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	if code, msg := c.cmd("MAIL FROM:<app@example.net>"); code != 550 || msg != "5.7.1 Remitente no permitido" {
+		t.Errorf("sender rejection = %d %s", code, msg)
+	}
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	if code, msg := c.cmd("RCPT TO:<eve@blocked.example>"); code != 550 || msg != "5.7.1 Destinatario no permitido" {
+		t.Errorf("recipient rejection = %d %s, want the default codes with the configured text", code, msg)
+	}
+	c.expect(250, "RCPT TO:<user@example.org>")
+	if code, msg := c.cmd("RCPT TO:<other@example.org>"); code != 452 || msg != "4.5.3 Demasiados destinatarios" {
+		t.Errorf("recipient limit rejection = %d %s", code, msg)
+	}
+}
+
+func TestLoadRejectionsInvalid(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"REJECT_MSG_RATE": "451 5.7.1 Mixed"}); err == nil {
+		t.Error("REJECT_MSG_RATE with mismatched codes was accepted")
+	}
+}
+
+func TestDefaultRejectionsHaveEnhancedCodes(t *testing.T) {
+	for name, reply := range defaultRejections {
+		if class := reply.Code / 100; reply.EnhancedCode[0] != class || reply.EnhancedCode == (smtp.EnhancedCode{class, 0, 0}) {
+			t.Errorf("%s: %d %v, want a specific enhanced code of class %d", name, reply.Code, reply.EnhancedCode, class)
+		}
+	}
+}
+
+func TestRejectionPathsEnhancedCodes(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{
+		"ALLOWED_SENDERS":        "example.com",
+		"DENIED_RECIPIENTS":      "blocked.example",
+		"MAX_SESSION_RECIPIENTS": "3",
+		"MAX_MESSAGE_BYTES":      "1000",
+	})
+	c := dialSMTP(t, startTestServer(t, newTestBackend(t, config, relay), nil))
+	c.reply()
+	c.expect(250, "EHLO client.test")
+
+	// rejection sends a command expecting code and the enhanced code
+	rejection := func(code int, enhanced, format string, args ...any) {
+		t.Helper()
+		got, msg := c.cmd(format, args...)
+		if got != code || !strings.HasPrefix(msg, enhanced+" ") {
+			t.Errorf("%s: got %d %s, want %d %s", fmt.Sprintf(format, args...), got, msg, code, enhanced)
+		}
+	}
+	// data sends a message, expecting code and the enhanced code
+	data := func(code int, enhanced, message string) {
+		t.Helper()
+		c.expect(250, "RSET")
+		c.expect(250, "MAIL FROM:<app@example.com>")
+		c.expect(250, "RCPT TO:<user@example.org>")
+		c.expect(354, "DATA")
+		rejection(code, enhanced, "%s\r\n.", message)
+	}
+
+	rejection(550, "5.7.1", "MAIL FROM:<app@example.net>")
+	rejection(552, "5.3.4", "MAIL FROM:<app@example.com> SIZE=5000")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	rejection(550, "5.7.1", "RCPT TO:<eve@blocked.example>")
+
+	data(550, "5.6.0", "Not a header line\r\n\r\nBody")
+	relay.mu.Lock()
+	relay.err = &StatusError{Service: "fake", StatusCode: 400, Body: "bad request"}
+	relay.mu.Unlock()
+	data(554, "5.6.0", "Subject: Hi\r\n\r\nHi")
+	relay.mu.Lock()
+	relay.err = errors.New("connection reset")
+	relay.mu.Unlock()
+	data(451, "4.4.0", "Subject: Hi\r\n\r\nHi")
+
+	// The session recipient limit is reached by now
+	c.expect(250, "RSET")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	rejection(452, "4.5.3", "RCPT TO:<user@example.org>")
+}
+
+func TestReadFailureEnhancedCode(t *testing.T) {
+	s := newTestSession(newTestBackend(t, testConfig(t, nil), &fakeRelay{}))
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.org", &smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var smtpErr *smtp.SMTPError
+	err := s.Data(iotest.ErrReader(errors.New("connection reset")))
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 4, 2}) {
+		t.Errorf("read failure: err = %v, want 451 4.4.2", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Message is an accepted email ready to be handed to a Relay
+type Message struct {
+	ID     string      // internal UUID correlating the log lines of one message
+	From   string      // envelope sender (MAIL FROM)
+	To     []string    // envelope recipients (RCPT TO)
+	Bcc    []string    // addresses from the (already stripped) Bcc header
+	Header mail.Header // parsed message headers
+	Body   []byte      // message body without headers
+	Raw    []byte      // full message as relayed upstream (DKIM-signed if enabled)
+	UTF8   bool        // the client sent MAIL FROM with SMTPUTF8
+	DSN    *dsnRequest // DSN parameters under ENABLE_DSN, nil if none
+}
+
+// SendResult describes how the upstream service accepted a message
+type SendResult struct {
+	MessageID  string // upstream message identifier, if the service returns one
+	StatusCode int    // HTTP status or SMTP reply code, 0 in dry-run mode
+
+	// Rejected maps recipients the service did not accept, although the
+	// message was sent to the others, to the reason given
+	Rejected map[string]string
+}
+
+// StatusError is an error status returned by an upstream HTTP API
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// isTemporary reports whether a failed send may succeed if retried. SMTP
+// replies are judged by their code and HTTP statuses by 429/5xx; anything
+// else (network errors, timeouts) is assumed temporary.
+func isTemporary(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Temporary()
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == 429 || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// backendReply turns a send failure into the SMTP reply for the client.
+// SMTP replies pass through, temporary failures become 451 4.4.0 so the
+// client retries, and permanent HTTP statuses map to the closest RFC 3463
+// code: 5.3.4 for 413, 5.7.0 for 401/403 and 5.6.0 for the rest.
+func backendReply(err error) *smtp.SMTPError {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	if isTemporary(err) {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+			Message:      "Upstream delivery failed, try again later: " + err.Error(),
+		}
+	}
+
+	reply := &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Upstream rejected the message: " + err.Error(),
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestEntityTooLarge:
+			reply.Code, reply.EnhancedCode = 552, smtp.EnhancedCode{5, 3, 4}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			reply.EnhancedCode = smtp.EnhancedCode{5, 7, 0}
+		}
+	}
+	return reply
+}
+
+// Relay delivers accepted messages to an upstream service
+type Relay interface {
+	Name() string
+	Send(ctx context.Context, msg *Message) (*SendResult, error)
+}
+
+// StreamRelay is a Relay that can also take the message body as a stream,
+// so large messages are forwarded without being buffered. msg.Raw then holds
+// only the header block and body the rest of the message, read as the
+// client sends it.
+type StreamRelay interface {
+	Relay
+	SendStream(ctx context.Context, msg *Message, body io.Reader) (*SendResult, error)
+}
+
+// newRelay builds the Relay selected by config.Backend
+func newRelay(config *Config) (Relay, error) {
+	switch config.Backend {
+	case "sendgrid":
+		return &SendGridRelay{
+			config:     config,
+			client:     newSendGridClient(config),
+			transforms: contentTransforms(config),
+			slots:      newAPISlots(config.SendGridMaxConcurrency),
+		}, nil
+	case "smtp":
+		r := &SMTPRelay{
+			addr:     config.SMTPRelayAddr,
+			username: config.SMTPRelayUsername,
+			password: config.SMTPRelayPassword,
+			tlsMode:  config.SMTPRelayTLS,
+			helo:     config.Domain,
+		}
+		r.pool = newSMTPConnPool(config.SMTPRelayPoolSize, config.SMTPRelayPoolIdleTimeout, r.connect)
+		return r, nil
+	case "ses":
+		return newSESRelay(config), nil
+	case "maildir":
+		return newMaildirRelay(config.MaildirPath)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", config.Backend)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBackendReply(t *testing.T) {
+	upstream := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	tests := []struct {
+		name     string
+		err      error
+		code     int
+		enhanced smtp.EnhancedCode
+	}{
+		{"smtp reply", fmt.Errorf("send: %w", upstream), 550, smtp.EnhancedCode{5, 1, 1}},
+		{"network error", errors.New("connection refused"), 451, smtp.EnhancedCode{4, 4, 0}},
+		{"server error", &StatusError{Service: "sendgrid", StatusCode: 503}, 451, smtp.EnhancedCode{4, 4, 0}},
+		{"rate limited", &StatusError{Service: "sendgrid", StatusCode: 429}, 451, smtp.EnhancedCode{4, 4, 0}},
+		{"too large", &StatusError{Service: "sendgrid", StatusCode: 413}, 552, smtp.EnhancedCode{5, 3, 4}},
+		{"unauthorized", &StatusError{Service: "sendgrid", StatusCode: 401}, 554, smtp.EnhancedCode{5, 7, 0}},
+		{"forbidden", &StatusError{Service: "ses", StatusCode: 403}, 554, smtp.EnhancedCode{5, 7, 0}},
+		{"bad request", &StatusError{Service: "sendgrid", StatusCode: 400}, 554, smtp.EnhancedCode{5, 6, 0}},
+	}
+	for _, tt := range tests {
+		got := backendReply(tt.err)
+		if got.Code != tt.code || got.EnhancedCode != tt.enhanced {
+			t.Errorf("%s: reply = %d %v, want %d %v", tt.name, got.Code, got.EnhancedCode, tt.code, tt.enhanced)
+		}
+	}
+}
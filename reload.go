@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// allowlistMu guards the Config allowlists that SIGHUP reloads:
+// AllowedSenders, AllowedRecipients, DeniedRecipients, SendGridIPPools and
+// BypassListSenders
+var allowlistMu sync.RWMutex
+
+// watchReload reloads the allowlists on SIGHUP. The listener and open
+// sessions are left alone.
+func watchReload(config *Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reloadAllowlists(config); err != nil {
+				logError("Reload failed, keeping previous settings: %v", err)
+			}
+		}
+	}()
+}
+
+// reloadAllowlists re-reads the configuration (CONFIG_FILE and environment)
+// and swaps in the new allowlists
+func reloadAllowlists(config *Config) error {
+	fresh, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	allowlistMu.Lock()
+	config.AllowedSenders = fresh.AllowedSenders
+	config.AllowedRecipients = fresh.AllowedRecipients
+	config.DeniedRecipients = fresh.DeniedRecipients
+	config.SendGridIPPools = fresh.SendGridIPPools
+	config.BypassListSenders = fresh.BypassListSenders
+	allowlistMu.Unlock()
+
+	logInfo("Reloaded allowlists: allowed_senders=%v allowed_recipients=%v denied_recipients=%v ip_pools=%v bypass_senders=%v",
+		fresh.AllowedSenders, fresh.AllowedRecipients, fresh.DeniedRecipients, fresh.SendGridIPPools, fresh.BypassListSenders)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestReloadAllowlistsOnSIGHUP(t *testing.T) {
+	logs := captureLog(t)
+	path := writeConfigFile(t, `{"ALLOWED_SENDERS": ["example.com"], "SMTP_DOMAIN": "relay.example.com"}`)
+	config := testConfig(t, map[string]string{"CONFIG_FILE": path})
+	be := newTestBackend(t, config, &fakeRelay{})
+	if err := newTestSession(be).Mail("app@example.net", &smtp.MailOptions{}); err == nil {
+		t.Fatal("sender outside ALLOWED_SENDERS was accepted before the reload")
+	}
+
+	watchReload(config)
+	if err := os.WriteFile(path, []byte(`{"ALLOWED_SENDERS": ["example.com", "example.net"], "DENIED_RECIPIENTS": ["blocked.example"], "SMTP_DOMAIN": "other.example.com"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "Reloaded allowlists") {
+		if time.Now().After(deadline) {
+			t.Fatal("allowlists not reloaded after SIGHUP")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := newTestSession(be).Mail("app@example.net", &smtp.MailOptions{}); err != nil {
+		t.Errorf("newly allowed sender: %v", err)
+	}
+	if config.recipientAllowed("user@blocked.example") {
+		t.Error("newly denied recipient still allowed")
+	}
+	// Only the allowlists are reloaded
+	if config.Domain != "relay.example.com" {
+		t.Errorf("Domain = %q, want it unchanged", config.Domain)
+	}
+}
+
+func TestReloadAllowlistsKeepsSettingsOnError(t *testing.T) {
+	logs := captureLog(t)
+	path := writeConfigFile(t, `{"ALLOWED_SENDERS": ["example.com"]}`)
+	config := testConfig(t, map[string]string{"CONFIG_FILE": path})
+
+	if err := os.WriteFile(path, []byte(`{"ALLOWED_SENDERS": `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadAllowlists(config); err == nil {
+		t.Fatal("reload of an invalid CONFIG_FILE succeeded")
+	}
+	if strings.Join(config.AllowedSenders, ",") != "example.com" {
+		t.Errorf("AllowedSenders = %v, want the previous list", config.AllowedSenders)
+	}
+	if strings.Contains(logs.String(), "Reloaded allowlists") {
+		t.Error("failed reload was logged as done")
+	}
+}
@@ -0,0 +1,1182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/sendgrid/rest"
+	"github.com/sendgrid/sendgrid-go"
+	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers recognized by the SendGrid relay to control SendGrid-specific features
+const (
+	headerTemplateID    = "X-SMTP-Relay-Template-ID"
+	headerTemplateData  = "X-SMTP-Relay-Template-Data"
+	headerASMGroup      = "X-SMTP-Relay-ASM-Group"
+	headerASMDisplay    = "X-SMTP-Relay-ASM-Groups-To-Display"
+	headerIPPool        = "X-SMTP-Relay-IP-Pool"
+	headerArgPrefix     = "X-SMTP-Relay-Arg-"
+	headerPHeaderPrefix = "X-SMTP-Relay-PHeader-"
+	headerClickTrack    = "X-SMTP-Relay-Click-Tracking"
+	headerSubstitutions = "X-SMTP-Relay-Substitutions"
+	headerBatchID       = "X-SMTP-Relay-Batch-ID"
+	headerSendAt        = "X-SMTP-Relay-Send-At"
+	headerOpenTrack     = "X-SMTP-Relay-Open-Tracking"
+	headerFooter        = "X-SMTP-Relay-Footer"
+	headerBypassList    = "X-SMTP-Relay-Bypass-List-Management"
+)
+
+// maxSendAtDelay is how far ahead SendGrid accepts a scheduled send_at
+const maxSendAtDelay = 72 * time.Hour
+
+// maxCustomArgsBytes is SendGrid's limit on the combined size of custom args
+const maxCustomArgsBytes = 10000
+
+// envelopeFromArg is the custom arg carrying MAIL FROM when it differs from
+// the From header
+const envelopeFromArg = "envelope_from"
+
+// SendGridRelay delivers messages through the SendGrid v3 HTTP API
+type SendGridRelay struct {
+	config     *Config
+	client     *rest.Client
+	transforms []contentTransform
+	slots      apiSlots // SENDGRID_MAX_CONCURRENCY
+}
+
+// newSendGridClient builds the HTTP client for the SendGrid API. Requests go
+// through SENDGRID_PROXY_URL when set, otherwise HTTPS_PROXY/NO_PROXY apply.
+// Credentials in the proxy URL are sent as proxy basic auth.
+func newSendGridClient(config *Config) *rest.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if config.SendGridProxyURL != "" {
+		if proxyURL, err := url.Parse(config.SendGridProxyURL); err == nil {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	return &rest.Client{HTTPClient: &http.Client{Transport: transport}}
+}
+
+func (r *SendGridRelay) Name() string {
+	return "sendgrid"
+}
+
+func (r *SendGridRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	ctx, span := tracer.Start(ctx, "sendgrid.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	result, err := r.sendViaSendGrid(ctx, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+func (r *SendGridRelay) sendViaSendGrid(ctx context.Context, msg *Message) (*SendResult, error) {
+	subject := decodeHeader(msg.Header.Get("Subject"))
+	from := msg.Header.Get("From")
+	contentType := msg.Header.Get("Content-Type")
+	body := msg.Body
+
+	// Display names from the To and Cc headers, keyed by lowercase address
+	var headerNames map[string]string
+	if r.config.ParseHeaderTo {
+		headerNames = headerRecipientNames(msg.Header.Get("Cc"))
+		for addr, name := range headerRecipientNames(msg.Header.Get("To")) {
+			if headerNames == nil {
+				headerNames = make(map[string]string)
+			}
+			headerNames[addr] = name
+		}
+	}
+
+	// Parse from address
+	fromAddr, err := parseAddress(from)
+	if err != nil {
+		// Use raw address if parsing fails
+		fromAddr = &mail.Address{Address: strings.TrimSpace(strings.Trim(from, "<>"))}
+	}
+	if !strings.Contains(fromAddr.Address, "@") {
+		// SendGrid rejects an empty or malformed from with a 400
+		if r.config.DefaultFrom == nil {
+			logWarn("Rejected message: id=%s from=%s: no usable From header (%q)", msg.ID, msg.From, from)
+			return nil, &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      "Message has no usable From header",
+			}
+		}
+		logWarn("No usable From header (%q), using DEFAULT_FROM %s: id=%s", from, r.config.DefaultFrom.Address, msg.ID)
+		fromAddr = r.config.DefaultFrom
+	} else if mapped, ok := r.config.mapFrom(fromAddr); ok {
+		logDebug("Mapped From %s to %s: id=%s", fromAddr.Address, mapped.Address, msg.ID)
+		fromAddr = mapped
+	}
+
+	// Create SendGrid message
+	message := sgmail.NewV3Mail()
+	message.SetFrom(sgmail.NewEmail(fromAddr.Name, fromAddr.Address))
+	message.Subject = subject
+
+	// Add recipients - envelope recipients decide who gets the message,
+	// the headers only decide whether each one is a To, Cc or Bcc and
+	// contribute display names for matching addresses
+	tos, ccs, bccs := splitRecipients(msg.To, msg.Header, msg.Bcc)
+	email := func(addr string) *sgmail.Email {
+		return sgmail.NewEmail(headerNames[addr], addr)
+	}
+	p := sgmail.NewPersonalization()
+	for _, addr := range tos {
+		p.AddTos(email(addr))
+	}
+	for _, addr := range ccs {
+		p.AddCCs(email(addr))
+	}
+	for _, addr := range bccs {
+		p.AddBCCs(email(addr))
+	}
+
+	// Per-recipient substitutions need a personalization per recipient
+	substitutions, err := substitutionsFromHeaders(msg.Header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+
+	if len(p.To) > 0 && !r.config.OnePersonalizationPerRecipient && substitutions == nil {
+		message.AddPersonalizations(p)
+	} else {
+		// Every recipient gets a private copy addressed only to them. This is
+		// also needed without To recipients, since SendGrid requires a To in
+		// every personalization.
+		for _, email := range append(append(p.To, p.CC...), p.BCC...) {
+			bp := sgmail.NewPersonalization()
+			bp.AddTos(email)
+			for key, value := range substitutions[strings.ToLower(email.Address)] {
+				bp.SetSubstitution(key, value)
+			}
+			message.AddPersonalizations(bp)
+		}
+	}
+	// The archive gets exactly one copy, as a Bcc of the first
+	// personalization (SendGrid needs a To in each, so it cannot have its
+	// own), unless its address already receives one. It is not an envelope
+	// recipient, so ALLOWED_RECIPIENTS does not apply to it.
+	if archive := r.config.ArchiveBcc; archive != "" && len(message.Personalizations) > 0 {
+		archived := false
+		for _, personalization := range message.Personalizations {
+			archived = archived || personalizationHas(personalization, archive)
+		}
+		if !archived {
+			message.Personalizations[0].AddBCCs(sgmail.NewEmail("", archive))
+		}
+	}
+	for addr := range substitutions {
+		if !containsFold(msg.To, addr) {
+			logDebug("Ignoring %s entry for unknown recipient %s", headerSubstitutions, addr)
+		}
+	}
+
+	// Unsubscribe group
+	asm, err := asmFromHeaders(msg.Header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if asm != nil {
+		message.SetASM(asm)
+	}
+
+	// IP pool
+	pool, err := r.ipPoolFromHeaders(msg.Header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if pool != "" {
+		message.SetIPPoolID(pool)
+	}
+
+	// Click and open tracking
+	tracking, err := r.trackingFromHeaders(msg.Header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if tracking != nil {
+		message.SetTrackingSettings(tracking)
+	}
+
+	// Footer and list management bypass
+	settings, err := r.mailSettingsFromHeaders(msg.Header, msg.From)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if settings != nil {
+		message.SetMailSettings(settings)
+	}
+
+	// Scheduled sends
+	batchID, sendAt, err := scheduleFromHeaders(msg.Header, time.Now())
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if batchID != "" {
+		message.SetBatchID(batchID)
+	}
+	if sendAt != 0 {
+		message.SetSendAt(int(sendAt))
+	}
+
+	// Custom args, echoed back in event webhooks
+	header, _ := splitHeader(msg.Raw)
+	args, err := customArgsFromHeaders(header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	for key, value := range args {
+		message.SetCustomArg(key, value)
+	}
+
+	// Personalization headers, added to every recipient's copy
+	pheaders, err := personalizationHeadersFromHeaders(header)
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	for _, personalization := range message.Personalizations {
+		for key, value := range pheaders {
+			personalization.SetHeader(key, value)
+		}
+	}
+
+	// SendGrid always sets the Return-Path to the bounce domain of the
+	// authenticated sending domain, so a MAIL FROM that differs from the From
+	// header is kept as a custom arg, echoed back in bounce events
+	if envelopeFrom := strings.Trim(msg.From, "<>"); envelopeFrom != "" && !strings.EqualFold(envelopeFrom, fromAddr.Address) {
+		if _, ok := args[envelopeFromArg]; !ok {
+			message.SetCustomArg(envelopeFromArg, envelopeFrom)
+		}
+	}
+
+	// SendGrid sends no DSNs of its own, ENVID and RET travel as custom args
+	// so bounce and delivery events can be matched to the request. NOTIFY
+	// has no equivalent and is dropped.
+	if dsn := msg.DSN; dsn != nil {
+		for key, value := range map[string]string{dsnEnvelopeIDArg: dsn.EnvelopeID, dsnReturnArg: string(dsn.Return)} {
+			if _, ok := args[key]; !ok && value != "" {
+				message.SetCustomArg(key, value)
+			}
+		}
+		if len(dsn.Notify) > 0 {
+			logDebug("DSN NOTIFY not supported by SendGrid, ignored for %d recipients", len(dsn.Notify))
+		}
+	}
+
+	// Handle content based on type
+	var attachments []*attachment
+	templateID, templateData, useTemplate := templateFromHeaders(msg.Header)
+	if useTemplate {
+		// SendGrid renders the dynamic template, the message body is not sent
+		message.SetTemplateID(templateID)
+		for _, p := range message.Personalizations {
+			for key, value := range templateData {
+				p.SetDynamicTemplateData(key, value)
+			}
+		}
+		logDebug("Using SendGrid dynamic template %s", templateID)
+	} else {
+		attachments, err = r.addBodyContent(message, body, contentType, msg.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		defer closeAttachments(attachments)
+		observeAttachments(attachments)
+		if err := r.fillEmptyBody(message, msg.ID, len(attachments)); err != nil {
+			return nil, err
+		}
+	}
+
+	// In dry-run mode stop here, the message is fully built but never sent
+	if r.config.DryRun {
+		logInfo("Dry run: would send via SendGrid: id=%s from=%s to=%v subject=%q contents=%d attachments=%d template=%s",
+			msg.ID, fromAddr.Address, msg.To, truncate(subject, 50), len(message.Content), len(attachments), message.TemplateID)
+		logDebug("Dry run request body: %s", sgmail.GetRequestBody(message))
+		return &SendResult{}, nil
+	}
+
+	// Send via SendGrid API
+	reqBody, size, err := requestBody(sgmail.GetRequestBody(message), attachments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build sendgrid request: %w", err)
+	}
+	apiKey, routed := r.config.sendGridKey(msg)
+	if routed != "" {
+		logDebug("Using SendGrid API key routed for %s: id=%s", routed, msg.ID)
+	}
+	request := sendgrid.GetRequest(apiKey, "/v3/mail/send", r.config.SendGridHost)
+	request.Method = "POST"
+	if r.config.SendGridTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.SendGridTimeout)
+		defer cancel()
+	}
+	// Waiting for a SENDGRID_MAX_CONCURRENCY slot counts against the timeout
+	var response *rest.Response
+	if err = r.slots.acquire(ctx); err == nil {
+		response, err = r.post(ctx, request, reqBody, size)
+		r.slots.release()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		logError("SendGrid API call timed out after %v: id=%s", r.config.SendGridTimeout, msg.ID)
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+			Message:      "SendGrid API timed out, try again later",
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sendgrid API error: %w", err)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("sendgrid.status_code", response.StatusCode))
+
+	if response.StatusCode >= 400 {
+		logError("SendGrid returned error: id=%s status=%d body=%s", msg.ID, response.StatusCode, response.Body)
+		return nil, &StatusError{Service: "sendgrid", StatusCode: response.StatusCode, Body: response.Body}
+	}
+
+	result := &SendResult{StatusCode: response.StatusCode}
+
+	// A 2xx may still carry errors for recipients SendGrid did not accept
+	if rejected := rejectedRecipients(message, response.Body); len(rejected) > 0 {
+		result.Rejected = make(map[string]string, len(rejected))
+		for _, recipient := range rejected {
+			logWarn("SendGrid did not accept recipient: id=%s to=%s: %s", msg.ID, recipient.address, recipient.reason)
+			result.Rejected[strings.ToLower(recipient.address)] = recipient.reason
+		}
+		recipientsRejected.WithLabelValues("sendgrid").Add(float64(len(rejected)))
+	}
+
+	result.MessageID = responseMessageID(response.Headers)
+	logDebug("SendGrid response: id=%s status=%d message_id=%s", msg.ID, response.StatusCode, result.MessageID)
+	return result, nil
+}
+
+// post sends a SendGrid API request with a streamed body
+func (r *SendGridRelay) post(ctx context.Context, request rest.Request, body io.Reader, size int64) (*rest.Response, error) {
+	req, err := rest.BuildRequestObject(request)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(body)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := r.client.MakeRequest(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return rest.BuildResponse(res)
+}
+
+// splitRecipients lowercases and de-duplicates the envelope recipients and
+// sorts them into To, Cc and Bcc. An address listed in several headers goes
+// where it ranks highest (To over Cc over Bcc). Envelope recipients missing
+// from all headers are treated as To, as before.
+func splitRecipients(envelope []string, header mail.Header, bcc []string) (tos, ccs, bccs []string) {
+	inHeader := func(addrs []string) map[string]bool {
+		set := make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			set[strings.ToLower(addr)] = true
+		}
+		return set
+	}
+	toHeader := inHeader(headerAddresses(header.Get("To")))
+	ccHeader := inHeader(headerAddresses(header.Get("Cc")))
+	blind := inHeader(bcc)
+
+	seen := make(map[string]bool, len(envelope))
+	for _, recipient := range envelope {
+		addr := strings.ToLower(strings.Trim(strings.TrimSpace(recipient), "<>"))
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		switch {
+		case toHeader[addr]:
+			tos = append(tos, addr)
+		case ccHeader[addr]:
+			ccs = append(ccs, addr)
+		case blind[addr]:
+			bccs = append(bccs, addr)
+		default:
+			tos = append(tos, addr)
+		}
+	}
+	return tos, ccs, bccs
+}
+
+// templateFromHeaders returns the dynamic template requested via headers.
+// Invalid template data falls back to sending the message content.
+func templateFromHeaders(header mail.Header) (string, map[string]interface{}, bool) {
+	templateID := strings.TrimSpace(header.Get(headerTemplateID))
+	if templateID == "" {
+		return "", nil, false
+	}
+
+	var data map[string]interface{}
+	if raw := header.Get(headerTemplateData); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			logWarn("Invalid %s header, sending message content instead: %v", headerTemplateData, err)
+			return "", nil, false
+		}
+	}
+
+	return templateID, data, true
+}
+
+// substitutionsFromHeaders parses the per-recipient substitutions header, a
+// JSON object mapping each recipient address to its placeholder values:
+// {"ann@example.com": {"%name%": "Ann"}}. Addresses are lowercased.
+func substitutionsFromHeaders(header mail.Header) (map[string]map[string]string, error) {
+	raw := strings.TrimSpace(header.Get(headerSubstitutions))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var parsed map[string]map[string]string
+	if err := json.Unmarshal([]byte(decodeHeader(raw)), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid %s header: expected a JSON object of recipient to string values", headerSubstitutions)
+	}
+
+	substitutions := make(map[string]map[string]string, len(parsed))
+	for addr, values := range parsed {
+		substitutions[strings.ToLower(strings.TrimSpace(addr))] = values
+	}
+	return substitutions, nil
+}
+
+// asmFromHeaders builds the unsubscribe group settings requested via headers
+func asmFromHeaders(header mail.Header) (*sgmail.Asm, error) {
+	value := strings.TrimSpace(header.Get(headerASMGroup))
+	if value == "" {
+		return nil, nil
+	}
+
+	groupID, err := strconv.Atoi(value)
+	if err != nil || groupID <= 0 {
+		return nil, fmt.Errorf("invalid %s header %q: expected a positive integer", headerASMGroup, value)
+	}
+	asm := sgmail.NewASM().SetGroupID(groupID)
+
+	for _, display := range strings.Split(header.Get(headerASMDisplay), ",") {
+		display = strings.TrimSpace(display)
+		if display == "" {
+			continue
+		}
+		id, err := strconv.Atoi(display)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid %s header %q: expected positive integers", headerASMDisplay, display)
+		}
+		asm.AddGroupsToDisplay(id)
+	}
+
+	return asm, nil
+}
+
+// ipPoolFromHeaders returns the IP pool requested via header, or the
+// SENDGRID_IP_POOL default
+func (r *SendGridRelay) ipPoolFromHeaders(header mail.Header) (string, error) {
+	pool := strings.TrimSpace(header.Get(headerIPPool))
+	if pool == "" {
+		return r.config.SendGridIPPool, nil
+	}
+	// SendGrid pool names are 2 to 64 characters
+	if len(pool) < 2 || len(pool) > 64 {
+		return "", fmt.Errorf("invalid %s header %q: expected 2 to 64 characters", headerIPPool, pool)
+	}
+	if !r.config.ipPoolAllowed(pool) {
+		return "", fmt.Errorf("IP pool %q is not allowed", pool)
+	}
+	return pool, nil
+}
+
+// scheduleFromHeaders returns the batch ID and send_at unix timestamp
+// requested via headers. send_at must lie in the future, within the 72 hours
+// SendGrid allows.
+func scheduleFromHeaders(header mail.Header, now time.Time) (string, int64, error) {
+	batchID := strings.TrimSpace(header.Get(headerBatchID))
+
+	value := strings.TrimSpace(header.Get(headerSendAt))
+	if value == "" {
+		return batchID, 0, nil
+	}
+	sendAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid %s header %q: expected a unix timestamp", headerSendAt, value)
+	}
+	at := time.Unix(sendAt, 0)
+	if !at.After(now) {
+		return "", 0, fmt.Errorf("invalid %s header %q: must be in the future", headerSendAt, value)
+	}
+	if at.Sub(now) > maxSendAtDelay {
+		return "", 0, fmt.Errorf("invalid %s header %q: must be within %v", headerSendAt, value, maxSendAtDelay)
+	}
+	return batchID, sendAt, nil
+}
+
+// trackingFromHeaders builds the click/open tracking settings from headers,
+// falling back to SENDGRID_CLICK_TRACKING/SENDGRID_OPEN_TRACKING. It returns
+// nil when neither is set, leaving the SendGrid account settings in effect.
+func (r *SendGridRelay) trackingFromHeaders(header mail.Header) (*sgmail.TrackingSettings, error) {
+	click, err := headerToggle(header, headerClickTrack, r.config.ClickTracking)
+	if err != nil {
+		return nil, err
+	}
+	open, err := headerToggle(header, headerOpenTrack, r.config.OpenTracking)
+	if err != nil {
+		return nil, err
+	}
+	if click == nil && open == nil {
+		return nil, nil
+	}
+
+	tracking := sgmail.NewTrackingSettings()
+	if click != nil {
+		tracking.SetClickTracking(sgmail.NewClickTrackingSetting().SetEnable(*click).SetEnableText(*click))
+	}
+	if open != nil {
+		tracking.SetOpenTracking(sgmail.NewOpenTrackingSetting().SetEnable(*open))
+	}
+	return tracking, nil
+}
+
+// mailSettingsFromHeaders returns the footer and bypass_list_management
+// mail settings requested via headers or configured by default. Only
+// SENDGRID_BYPASS_SENDERS may bypass list management.
+func (r *SendGridRelay) mailSettingsFromHeaders(header mail.Header, sender string) (*sgmail.MailSettings, error) {
+	footerDefault := r.config.Footer
+	if footerDefault == "" && (r.config.FooterText != "" || r.config.FooterHTML != "") {
+		footerDefault = "on"
+	}
+	footer, err := headerToggle(header, headerFooter, footerDefault)
+	if err != nil {
+		return nil, err
+	}
+	bypass, err := headerToggle(header, headerBypassList, "")
+	if err != nil {
+		return nil, err
+	}
+	if bypass != nil && *bypass && !r.config.bypassAllowed(sender) {
+		return nil, fmt.Errorf("sender %s may not bypass list management", sender)
+	}
+	if footer == nil && bypass == nil {
+		return nil, nil
+	}
+
+	settings := sgmail.NewMailSettings()
+	if footer != nil {
+		setting := sgmail.NewFooterSetting().SetEnable(*footer)
+		if *footer && r.config.FooterText != "" {
+			setting.SetText(r.config.FooterText)
+		}
+		if *footer && r.config.FooterHTML != "" {
+			setting.SetHTML(r.config.FooterHTML)
+		}
+		settings.SetFooter(setting)
+	}
+	if bypass != nil {
+		settings.SetBypassListManagement(sgmail.NewSetting(*bypass))
+	}
+	return settings, nil
+}
+
+// containsFold reports whether list holds addr, ignoring case and angle brackets
+func containsFold(list []string, addr string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.Trim(item, "<>"), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerToggle reads an on/off header, falling back to def. It returns nil
+// when neither is set.
+func headerToggle(header mail.Header, name, def string) (*bool, error) {
+	value := strings.TrimSpace(header.Get(name))
+	if value == "" {
+		value = def
+	}
+	if value == "" {
+		return nil, nil
+	}
+	enabled, err := parseToggle(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header %q: expected on or off", name, value)
+	}
+	return &enabled, nil
+}
+
+// parseToggle parses on/off, also accepting the strconv.ParseBool forms
+func parseToggle(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "yes":
+		return true, nil
+	case "off", "no":
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// customArgsFromHeaders collects X-SMTP-Relay-Arg-<Name> headers into custom
+// args. The raw header is used so <Name> keeps its original case.
+func customArgsFromHeaders(header []byte) (map[string]string, error) {
+	var args map[string]string
+	size := 0
+	for _, field := range headerFields(header) {
+		if len(field.Name) <= len(headerArgPrefix) || !strings.EqualFold(field.Name[:len(headerArgPrefix)], headerArgPrefix) {
+			continue
+		}
+		if args == nil {
+			args = make(map[string]string)
+		}
+		key := field.Name[len(headerArgPrefix):]
+		value := decodeHeader(field.Value)
+		args[key] = value
+		size += len(key) + len(value)
+	}
+	if size > maxCustomArgsBytes {
+		return nil, fmt.Errorf("custom args total %d bytes, SendGrid allows %d", size, maxCustomArgsBytes)
+	}
+	return args, nil
+}
+
+// reservedPersonalizationHeaders are headers SendGrid does not accept in a
+// personalization
+var reservedPersonalizationHeaders = []string{
+	"x-sg-id", "x-sg-eid", "received", "dkim-signature", "content-type",
+	"content-transfer-encoding", "to", "from", "subject", "reply-to", "cc", "bcc",
+}
+
+// personalizationHeadersFromHeaders collects X-SMTP-Relay-PHeader-<Name>
+// headers into personalization headers named <Name>. Like custom args, the
+// raw header is used so <Name> keeps its original case.
+func personalizationHeadersFromHeaders(header []byte) (map[string]string, error) {
+	var headers map[string]string
+	for _, field := range headerFields(header) {
+		if len(field.Name) <= len(headerPHeaderPrefix) || !strings.EqualFold(field.Name[:len(headerPHeaderPrefix)], headerPHeaderPrefix) {
+			continue
+		}
+		key := field.Name[len(headerPHeaderPrefix):]
+		for _, reserved := range reservedPersonalizationHeaders {
+			if strings.EqualFold(key, reserved) {
+				return nil, fmt.Errorf("%s%s: %s is reserved by SendGrid", headerPHeaderPrefix, key, key)
+			}
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[key] = decodeHeader(field.Value)
+	}
+	return headers, nil
+}
+
+// headerRecipientNames parses a To or Cc header into a lowercase address -> display
+// name map. Addresses without a display name are skipped.
+func headerRecipientNames(header string) map[string]string {
+	if header == "" {
+		return nil
+	}
+
+	addrs, err := parseAddressList(header)
+	if err != nil {
+		logDebug("Failed to parse recipient header %q: %v", header, err)
+		return nil
+	}
+
+	names := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		if addr.Name != "" {
+			names[strings.ToLower(addr.Address)] = addr.Name
+		}
+	}
+	return names
+}
+
+// responseMessageID extracts the X-Message-Id header SendGrid returns on 202,
+// used to correlate with event webhooks
+func responseMessageID(headers map[string][]string) string {
+	if values := http.Header(headers).Values("X-Message-Id"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// personalizationHas reports whether addr is a To, Cc or Bcc of p
+func personalizationHas(p *sgmail.Personalization, addr string) bool {
+	for _, emails := range [][]*sgmail.Email{p.To, p.CC, p.BCC} {
+		for _, email := range emails {
+			if strings.EqualFold(email.Address, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rejectedRecipient is a recipient SendGrid reported an error for
+type rejectedRecipient struct {
+	address string
+	reason  string
+}
+
+// rejectedRecipients parses the errors SendGrid may include in a successful
+// response, e.g. {"errors":[{"message":"...","field":"personalizations.0.to.1.email"}]},
+// mapping each field back to the recipient it names. Errors without a
+// recipient field are logged at debug level only.
+func rejectedRecipients(message *sgmail.SGMailV3, body string) []rejectedRecipient {
+	if strings.TrimSpace(body) == "" {
+		return nil
+	}
+	var parsed struct {
+		Errors []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		logDebug("Ignoring unparsable SendGrid response body %q: %v", body, err)
+		return nil
+	}
+
+	var rejected []rejectedRecipient
+	for _, e := range parsed.Errors {
+		address := personalizationField(message, e.Field)
+		if address == "" {
+			logDebug("SendGrid response error: field=%s: %s", e.Field, e.Message)
+			continue
+		}
+		rejected = append(rejected, rejectedRecipient{address: address, reason: e.Message})
+	}
+	return rejected
+}
+
+// personalizationField returns the address a field such as
+// "personalizations.0.to.1.email" refers to, or "" if it names none
+func personalizationField(message *sgmail.SGMailV3, field string) string {
+	parts := strings.Split(field, ".")
+	if len(parts) < 4 || parts[0] != "personalizations" {
+		return ""
+	}
+	p, err := strconv.Atoi(parts[1])
+	if err != nil || p < 0 || p >= len(message.Personalizations) {
+		return ""
+	}
+	var emails []*sgmail.Email
+	switch parts[2] {
+	case "to":
+		emails = message.Personalizations[p].To
+	case "cc":
+		emails = message.Personalizations[p].CC
+	case "bcc":
+		emails = message.Personalizations[p].BCC
+	}
+	i, err := strconv.Atoi(parts[3])
+	if err != nil || i < 0 || i >= len(emails) {
+		return ""
+	}
+	return emails[i].Address
+}
+
+// addBodyContent adds the message body as SendGrid content based on its type.
+// It returns the attachments found in a multipart body, which the caller
+// must close.
+func (r *SendGridRelay) addBodyContent(message *sgmail.SGMailV3, body []byte, contentType, transferEncoding string) ([]*attachment, error) {
+	mediaType, _ := parseContentType(contentType)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		// Parse multipart message, keeping signed ones verifiable
+		handle := r.handleMultipart
+		if mediaType == "multipart/signed" {
+			handle = r.handleSigned
+		}
+		attachments, err := handle(message, body, contentType)
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			// A size limit under OVERSIZE_POLICY=reject, not a parse failure
+			return nil, err
+		}
+		if err != nil {
+			logWarn("Failed to parse multipart, sending as plain text: %v", err)
+			return nil, r.addContent(message, "text/plain", string(body))
+		}
+		return attachments, nil
+	}
+
+	text := r.config.decodeText(body, contentType, transferEncoding)
+	isHTML := mediaType == "text/html" || (mediaType == "" && looksLikeHTML(body))
+	if r.config.AutoAlternative && strings.TrimSpace(text) != "" {
+		if isHTML {
+			return nil, r.addAlternatives(message, "", text)
+		}
+		return nil, r.addAlternatives(message, text, "")
+	}
+	if isHTML {
+		return nil, r.addContent(message, "text/html", text)
+	}
+
+	// Default to plain text
+	return nil, r.addContent(message, "text/plain", text)
+}
+
+// looksLikeHTML reports whether an untyped body is an HTML document. Only a
+// leading <!DOCTYPE html> or <html> counts, to avoid treating plain text that
+// merely mentions tags as HTML.
+func looksLikeHTML(body []byte) bool {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")) // UTF-8 BOM
+	body = bytes.TrimLeft(body, " \t\r\n")
+	if len(body) > 64 {
+		body = body[:64]
+	}
+	lower := bytes.ToLower(body)
+	if bytes.HasPrefix(lower, []byte("<!doctype html")) {
+		return true
+	}
+	rest, ok := bytes.CutPrefix(lower, []byte("<html"))
+	return ok && len(rest) > 0 && bytes.IndexByte([]byte("> \t\r\n"), rest[0]) >= 0
+}
+
+// errContentTooLarge rejects messages whose text or HTML content exceeds
+// MAX_TEXT_BYTES/MAX_HTML_BYTES under OVERSIZE_POLICY=reject
+var errContentTooLarge = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message content too large",
+}
+
+// errEmptyBody rejects messages without a body under EMPTY_BODY_POLICY=reject
+var errEmptyBody = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "Message has no body",
+}
+
+// fillEmptyBody handles messages whose content is empty or only whitespace,
+// which SendGrid answers with a 400. They get EMPTY_BODY_PLACEHOLDER as a
+// text body, or are rejected under EMPTY_BODY_POLICY=reject. Messages with
+// attachments always get the placeholder, SendGrid needs content anyway.
+func (r *SendGridRelay) fillEmptyBody(message *sgmail.SGMailV3, id string, attachments int) error {
+	for _, content := range message.Content {
+		if strings.TrimSpace(content.Value) != "" {
+			return nil
+		}
+	}
+	if attachments == 0 && r.config.EmptyBodyPolicy == "reject" {
+		logWarn("Rejecting message with an empty body: id=%s", id)
+		return errEmptyBody
+	}
+	logDebug("Sending placeholder body for a message with an empty body: id=%s", id)
+	message.Content = nil
+	message.AddContent(sgmail.NewContent("text/plain; charset="+contentCharset, r.config.EmptyBodyPlaceholder))
+	return nil
+}
+
+// errTooManyAttachments and errAttachmentsTooLarge reject messages over
+// MAX_ATTACHMENTS/MAX_TOTAL_ATTACHMENT_BYTES under OVERSIZE_POLICY=reject
+var (
+	errTooManyAttachments = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Too many attachments",
+	}
+	errAttachmentsTooLarge = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Attachments too large",
+	}
+)
+
+// admitAttachment enforces MAX_TOTAL_ATTACHMENT_BYTES on a read attachment.
+// It reports false when a should be dropped and returns an error when the
+// message must be rejected; either way a is closed.
+func (r *SendGridRelay) admitAttachment(attachments []*attachment, a *attachment) (bool, error) {
+	limit := int64(r.config.MaxAttachmentBytes)
+	if limit <= 0 {
+		return true, nil
+	}
+	total := a.size
+	for _, prev := range attachments {
+		total += prev.size
+	}
+	if total <= limit {
+		return true, nil
+	}
+
+	a.Close()
+	if r.config.OversizePolicy == "reject" {
+		logWarn("Rejecting message: attachments total %d bytes, limit is %d", total, limit)
+		return false, errAttachmentsTooLarge
+	}
+	logWarn("Dropping attachment %q (%d bytes): attachments would total %d bytes, limit is %d", a.Filename, a.size, total, limit)
+	return false, nil
+}
+
+// addContent adds a text or HTML content block after normalizing line
+// endings, applying the content transforms (e.g. LINK_REWRITE_BASE) and
+// wrapping long lines, each if enabled, then enforces the per-type size limit
+// by truncating or rejecting according to OVERSIZE_POLICY
+func (r *SendGridRelay) addContent(message *sgmail.SGMailV3, contentType, value string) error {
+	if r.config.NormalizeLineEndings {
+		value = normalizeLineEndings(value)
+	}
+	for _, transform := range r.transforms {
+		value = transform(contentType, value)
+	}
+	if r.config.WrapLongLines {
+		value = wrapLongLines(value, maxLineLength)
+	}
+
+	limit := r.config.MaxTextBytes
+	if contentType == "text/html" {
+		limit = r.config.MaxHTMLBytes
+	}
+
+	if limit > 0 && len(value) > limit {
+		if r.config.OversizePolicy == "reject" {
+			logWarn("Rejecting %s content: %d bytes exceeds limit of %d", contentType, len(value), limit)
+			return errContentTooLarge
+		}
+		logWarn("Truncating %s content from %d to %d bytes", contentType, len(value), limit)
+		value = truncateUTF8(value, limit)
+	}
+
+	// The value was decoded to UTF-8, say so rather than leave it implied
+	message.AddContent(sgmail.NewContent(contentType+"; charset="+contentCharset, value))
+	return nil
+}
+
+// multipartContent collects the parts of a multipart body
+type multipartContent struct {
+	text        string
+	html        string
+	attachments []*attachment
+}
+
+func (r *SendGridRelay) handleMultipart(message *sgmail.SGMailV3, body []byte, contentType string) ([]*attachment, error) {
+	var content multipartContent
+	if err := r.readMultipart(bytes.NewReader(body), contentType, &content); err != nil {
+		closeAttachments(content.attachments)
+		return nil, err
+	}
+
+	// A multipart body with only attachments has no content here,
+	// fillEmptyBody gives it the placeholder
+	return r.addMultipartContent(message, &content)
+}
+
+// signedMessageFilename names the attachment carrying a multipart/signed
+// entity exactly as received
+const signedMessageFilename = "signed-message.eml"
+
+// handleSigned sends a multipart/signed (PGP/MIME or S/MIME) body. SendGrid
+// rebuilds the MIME structure from content and attachments, which breaks
+// the signature, so the text and HTML are only extracted for display and the
+// original entity is attached byte for byte as message/rfc822, where the
+// signature still verifies.
+func (r *SendGridRelay) handleSigned(message *sgmail.SGMailV3, body []byte, contentType string) ([]*attachment, error) {
+	var content multipartContent
+	if err := r.readMultipart(bytes.NewReader(body), contentType, &content); err != nil {
+		closeAttachments(content.attachments)
+		return nil, err
+	}
+
+	// The detached signature travels inside the original, drop its copy
+	_, params := parseContentType(contentType)
+	var attachments []*attachment
+	for _, a := range content.attachments {
+		if strings.EqualFold(a.Type, params["protocol"]) {
+			a.Close()
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+
+	// The original is exempt from MAX_TOTAL_ATTACHMENT_BYTES, without it
+	// the signature is lost
+	original := append([]byte("Content-Type: "+contentType+"\r\nMIME-Version: 1.0\r\n\r\n"), body...)
+	a, err := newAttachment(signedMessageFilename, "message/rfc822", original, r.config.AttachmentSpillBytes)
+	if err != nil {
+		closeAttachments(attachments)
+		return nil, err
+	}
+	content.attachments = append(attachments, a)
+
+	if content.text == "" && content.html == "" {
+		content.text = "This message is signed, the original is attached as " + signedMessageFilename + "."
+	}
+	logDebug("Attached multipart/signed original (%s, %d bytes)", params["protocol"], len(original))
+	return r.addMultipartContent(message, &content)
+}
+
+// addMultipartContent adds the collected text and HTML, returning the
+// attachments or closing them on error
+func (r *SendGridRelay) addMultipartContent(message *sgmail.SGMailV3, content *multipartContent) ([]*attachment, error) {
+	if err := r.addAlternatives(message, content.text, content.html); err != nil {
+		closeAttachments(content.attachments)
+		return nil, err
+	}
+	return content.attachments, nil
+}
+
+// addAlternatives adds the text and HTML content, either of which may be
+// empty. With AUTO_ALTERNATIVE the missing one is generated from the other,
+// so recipients' clients can render whichever they support.
+func (r *SendGridRelay) addAlternatives(message *sgmail.SGMailV3, text, html string) error {
+	if r.config.AutoAlternative {
+		if text == "" && strings.TrimSpace(html) != "" {
+			text = htmlToText(html)
+		} else if html == "" && strings.TrimSpace(text) != "" {
+			html = textToHTML(text)
+		}
+	}
+
+	// SendGrid requires text/plain BEFORE text/html
+	if text != "" {
+		if err := r.addContent(message, "text/plain", text); err != nil {
+			return err
+		}
+	}
+	if html != "" {
+		return r.addContent(message, "text/html", html)
+	}
+	return nil
+}
+
+// readMultipart walks a multipart body, descending into nested multiparts
+// such as multipart/alternative inside multipart/mixed. Text and HTML parts
+// become the content, any other part is streamed as an attachment.
+func (r *SendGridRelay) readMultipart(body io.Reader, contentType string, content *multipartContent) error {
+	mediaType, params := parseContentType(contentType)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("not a multipart message")
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return fmt.Errorf("no boundary found")
+	}
+
+	mr := multipart.NewReader(body, boundary)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		partContentType := part.Header.Get("Content-Type")
+		partType, _ := parseContentType(partContentType)
+		if partType == "" {
+			partType = "text/plain"
+		}
+
+		switch {
+		case strings.HasPrefix(partType, "multipart/"):
+			if err := r.readMultipart(part, partContentType, content); err != nil {
+				return err
+			}
+		case (partType == "text/plain" || partType == "text/html") && !isAttachmentPart(part):
+			partBody, err := io.ReadAll(part)
+			if err != nil {
+				continue
+			}
+			// mime/multipart already undid quoted-printable
+			text := r.config.decodeText(partBody, partContentType, part.Header.Get("Content-Transfer-Encoding"))
+			if partType == "text/plain" {
+				content.text = text
+			} else {
+				content.html = text
+			}
+		default:
+			if max := r.config.MaxAttachments; max > 0 && len(content.attachments) >= max {
+				if r.config.OversizePolicy == "reject" {
+					logWarn("Rejecting message: more than %d attachments", max)
+					return errTooManyAttachments
+				}
+				logWarn("Dropping attachment %q: limit of %d attachments reached", part.FileName(), max)
+				continue
+			}
+			a, err := readAttachment(part, r.config.AttachmentSpillBytes)
+			if err != nil {
+				logWarn("Skipping attachment: %v", err)
+				continue
+			}
+			if ok, err := r.admitAttachment(content.attachments, a); !ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			content.attachments = append(content.attachments, a)
+		}
+	}
+
+	return nil
+}
+
+// isAttachmentPart reports whether a text part is a file rather than the
+// message body
+func isAttachmentPart(part *multipart.Part) bool {
+	disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	return disposition == "attachment" || part.FileName() != ""
+}
@@ -0,0 +1,1310 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sendGridRequest is a request received by a sendGridStub
+type sendGridRequest struct {
+	Path   string
+	APIKey string
+	Body   map[string]any
+}
+
+// sendGridStub is a fake SendGrid v3 API recording what it is sent. It
+// answers 202 unless reply is set.
+type sendGridStub struct {
+	*httptest.Server
+
+	// reply, when set, answers the request instead of the default 202
+	reply func(w http.ResponseWriter, r *http.Request)
+
+	mu       sync.Mutex
+	requests []sendGridRequest
+}
+
+func newSendGridStub(t *testing.T) *sendGridStub {
+	t.Helper()
+	stub := &sendGridStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		request := sendGridRequest{
+			Path:   r.URL.Path,
+			APIKey: strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		}
+		if err := json.Unmarshal(data, &request.Body); err != nil {
+			t.Errorf("SendGrid request body is not JSON: %v\n%s", err, data)
+		}
+		stub.mu.Lock()
+		stub.requests = append(stub.requests, request)
+		reply := stub.reply
+		stub.mu.Unlock()
+		if reply != nil {
+			reply(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// Requests returns the requests received so far
+func (stub *sendGridStub) Requests() []sendGridRequest {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return append([]sendGridRequest(nil), stub.requests...)
+}
+
+// Last returns the only request received, failing the test otherwise
+func (stub *sendGridStub) Last(t *testing.T) map[string]any {
+	t.Helper()
+	requests := stub.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("SendGrid got %d requests, want 1", len(requests))
+	}
+	return requests[0].Body
+}
+
+// newTestSendGridRelay returns a SendGrid relay configured from env that
+// talks to a sendGridStub
+func newTestSendGridRelay(t *testing.T, env map[string]string) (*SendGridRelay, *sendGridStub) {
+	t.Helper()
+	stub := newSendGridStub(t)
+	settings := map[string]string{"SENDGRID_HOST": stub.URL}
+	for key, value := range env {
+		settings[key] = value
+	}
+	relay, err := newRelay(testConfig(t, settings))
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	return relay.(*SendGridRelay), stub
+}
+
+// jsonPath walks decoded JSON through object keys and array indexes, e.g.
+// jsonPath(body, "personalizations", 0, "to", 0, "email")
+func jsonPath(value any, path ...any) any {
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, _ := value.(map[string]any)
+			value = object[key]
+		case int:
+			array, _ := value.([]any)
+			if key >= len(array) {
+				return nil
+			}
+			value = array[key]
+		}
+	}
+	return value
+}
+
+// jsonLen returns the length of the array at path, 0 when missing
+func jsonLen(value any, path ...any) int {
+	array, _ := jsonPath(value, path...).([]any)
+	return len(array)
+}
+
+const simpleMessage = `From: App <app@example.com>
+To: user@example.org
+Subject: Hello
+
+Hi there
+`
+
+func TestSendGridMessageID(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, nil)
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Message-Id", "sg-abc123")
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	msg := testMessage(t, simpleMessage, "app@example.com", "user@example.org")
+	result, err := relay.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if result.MessageID != "sg-abc123" || result.StatusCode != http.StatusAccepted {
+		t.Errorf("result = %+v, want message ID sg-abc123 and status 202", result)
+	}
+
+	// The success line carries it for correlation with webhook events
+	logs := captureLog(t)
+	be := &Backend{config: relay.config, relay: relay}
+	if err := be.deliver(&sendJob{ctx: context.Background(), msg: msg, subject: "Hello"}); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if !strings.Contains(logs.String(), "[INFO] Email sent successfully") || !strings.Contains(logs.String(), "message_id=sg-abc123") {
+		t.Errorf("log does not carry the message ID:\n%s", logs)
+	}
+}
+
+func TestResponseMessageIDMissing(t *testing.T) {
+	if id := responseMessageID(map[string][]string{"Content-Type": {"text/plain"}}); id != "" {
+		t.Errorf("responseMessageID = %q, want empty", id)
+	}
+	if id := responseMessageID(map[string][]string{"X-Message-Id": {"one", "two"}}); id != "one" {
+		t.Errorf("responseMessageID = %q, want the first value", id)
+	}
+}
+
+// personalizationEmails returns the "name <email>" entries of a field of a
+// personalization
+func personalizationEmails(body map[string]any, index int, field string) []string {
+	var emails []string
+	for i := 0; i < jsonLen(body, "personalizations", index, field); i++ {
+		email, _ := jsonPath(body, "personalizations", index, field, i, "email").(string)
+		name, _ := jsonPath(body, "personalizations", index, field, i, "name").(string)
+		emails = append(emails, strings.TrimSpace(name+" <"+email+">"))
+	}
+	return emails
+}
+
+func TestSendGridHeaderToNames(t *testing.T) {
+	raw := `From: app@example.com
+To: Alice <alice@example.org>, Bob <bob@example.org>
+Subject: Team update
+
+Hello team
+`
+	tests := []struct {
+		parseHeaderTo string
+		want          string
+	}{
+		// Only envelope recipients are addressed: Bob is in the header but
+		// not the envelope, the list alias is in the envelope only
+		{"true", "Alice <alice@example.org>,<team@lists.example.org>"},
+		{"false", "<alice@example.org>,<team@lists.example.org>"},
+	}
+	for _, tt := range tests {
+		t.Run("PARSE_HEADER_TO="+tt.parseHeaderTo, func(t *testing.T) {
+			relay, stub := newTestSendGridRelay(t, map[string]string{"PARSE_HEADER_TO": tt.parseHeaderTo})
+			msg := testMessage(t, raw, "app@example.com", "alice@example.org", "team@lists.example.org")
+			if _, err := relay.Send(context.Background(), msg); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			body := stub.Last(t)
+			if got := strings.Join(personalizationEmails(body, 0, "to"), ","); got != tt.want {
+				t.Errorf("personalization to = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendGridDynamicTemplate(t *testing.T) {
+	raw := `From: app@example.com
+To: user@example.org
+Subject: Welcome
+X-SMTP-Relay-Template-ID: d-123
+X-SMTP-Relay-Template-Data: {"name": "Ann", "items": 3}
+
+Rendered fallback
+`
+	relay, stub := newTestSendGridRelay(t, nil)
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if body["template_id"] != "d-123" {
+		t.Errorf("template_id = %v, want d-123", body["template_id"])
+	}
+	if jsonPath(body, "personalizations", 0, "dynamic_template_data", "name") != "Ann" ||
+		jsonPath(body, "personalizations", 0, "dynamic_template_data", "items") != float64(3) {
+		t.Errorf("dynamic_template_data = %v", jsonPath(body, "personalizations", 0, "dynamic_template_data"))
+	}
+	if jsonLen(body, "content") != 0 {
+		t.Errorf("content = %v, want none with a template", body["content"])
+	}
+}
+
+func TestSendGridDynamicTemplateInvalidData(t *testing.T) {
+	raw := `From: app@example.com
+To: user@example.org
+Subject: Welcome
+X-SMTP-Relay-Template-ID: d-123
+X-SMTP-Relay-Template-Data: {not json
+
+Rendered fallback
+`
+	logs := captureLog(t)
+	relay, stub := newTestSendGridRelay(t, nil)
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if _, ok := body["template_id"]; ok {
+		t.Errorf("template_id = %v, want the message content instead", body["template_id"])
+	}
+	if value, _ := jsonPath(body, "content", 0, "value").(string); !strings.Contains(value, "Rendered fallback") {
+		t.Errorf("content = %v, want the message body", body["content"])
+	}
+	if !strings.Contains(logs.String(), "[WARN] Invalid X-SMTP-Relay-Template-Data") {
+		t.Errorf("no warning logged:\n%s", logs)
+	}
+}
+
+func TestSendGridDryRun(t *testing.T) {
+	logs := captureLog(t)
+	currentLogLevel = LogDebug
+	t.Cleanup(func() { currentLogLevel = LogInfo })
+
+	relay, stub := newTestSendGridRelay(t, map[string]string{"DRY_RUN": "true"})
+	result, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if result == nil || result.StatusCode != 0 {
+		t.Errorf("result = %+v, want a dry-run success", result)
+	}
+	if requests := stub.Requests(); len(requests) != 0 {
+		t.Errorf("dry run made %d SendGrid requests", len(requests))
+	}
+	if !strings.Contains(logs.String(), "Dry run: would send via SendGrid: id=test-id from=app@example.com") {
+		t.Errorf("summary not logged:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), `Dry run request body: {`) || !strings.Contains(logs.String(), `"subject":"Hello"`) {
+		t.Errorf("request body not logged at debug level:\n%s", logs)
+	}
+}
+
+func TestSendGridHost(t *testing.T) {
+	stub := newSendGridStub(t)
+	config := testConfig(t, map[string]string{"SENDGRID_HOST": stub.URL + "/", "SENDGRID_API_KEY": "SG.host-test"})
+	if config.SendGridHost != stub.URL {
+		t.Errorf("SendGridHost = %q, want the trailing slash trimmed", config.SendGridHost)
+	}
+	relay, err := newRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	requests := stub.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("stub got %d requests, want 1", len(requests))
+	}
+	if requests[0].Path != "/v3/mail/send" || requests[0].APIKey != "SG.host-test" {
+		t.Errorf("request = %s with key %q", requests[0].Path, requests[0].APIKey)
+	}
+}
+
+func TestLoadConfigInvalidSendGridHost(t *testing.T) {
+	for _, host := range []string{"api.eu.sendgrid.com", "ftp://api.sendgrid.com"} {
+		if _, err := tryConfig(t, map[string]string{"SENDGRID_HOST": host}); err == nil {
+			t.Errorf("SENDGRID_HOST=%s was accepted", host)
+		}
+	}
+}
+
+func TestSendGridBccStaysBlind(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"ONE_PERSONALIZATION_PER_RECIPIENT": "true"})
+	msg := testMessage(t, simpleMessage, "app@example.com", "user@example.org", "hidden@example.org")
+	msg.Bcc = []string{"hidden@example.org"}
+	if _, err := relay.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	// Each recipient's payload is its personalization: the visible one must
+	// not name the blind recipient
+	for i := 0; i < jsonLen(body, "personalizations"); i++ {
+		p, _ := json.Marshal(jsonPath(body, "personalizations", i))
+		if strings.Contains(string(p), "user@example.org") && strings.Contains(string(p), "hidden@example.org") {
+			t.Errorf("personalization %d shows the Bcc recipient to a visible one: %s", i, p)
+		}
+	}
+	encoded, _ := json.Marshal(body)
+	if strings.Contains(strings.ToLower(string(encoded)), `"bcc:`) || strings.Contains(string(encoded), `"Bcc"`) {
+		t.Errorf("request carries a Bcc header: %s", encoded)
+	}
+}
+
+// sendGridPayload sends raw from app@example.com to user@example.org
+// through a relay configured from env and returns the SendGrid request
+// body. The body is nil when the send fails.
+func sendGridPayload(t *testing.T, env map[string]string, raw string) (map[string]any, error) {
+	t.Helper()
+	relay, stub := newTestSendGridRelay(t, env)
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "user@example.org")); err != nil {
+		if len(stub.Requests()) != 0 {
+			t.Errorf("failed send still made a SendGrid request")
+		}
+		return nil, err
+	}
+	return stub.Last(t), nil
+}
+
+func TestSendGridASMHeaders(t *testing.T) {
+	body, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: News\nX-SMTP-Relay-ASM-Group: 42\nX-SMTP-Relay-ASM-Groups-To-Display: 42, 43\n\nNews\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := jsonPath(body, "asm", "group_id"); got != float64(42) {
+		t.Errorf("asm.group_id = %v, want 42", got)
+	}
+	if got := jsonPath(body, "asm", "groups_to_display"); len(got.([]any)) != 2 || got.([]any)[1] != float64(43) {
+		t.Errorf("asm.groups_to_display = %v, want [42 43]", got)
+	}
+
+	body, err = sendGridPayload(t, nil, simpleMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["asm"]; ok {
+		t.Errorf("asm = %v without the header", body["asm"])
+	}
+}
+
+func TestSendGridASMInvalid(t *testing.T) {
+	for _, header := range []string{
+		"X-SMTP-Relay-ASM-Group: unsubscribe-me",
+		"X-SMTP-Relay-ASM-Group: -3",
+		"X-SMTP-Relay-ASM-Group: 42\nX-SMTP-Relay-ASM-Groups-To-Display: 42,x",
+	} {
+		_, err := sendGridPayload(t, nil, "From: app@example.com\n"+header+"\n\nNews\n")
+		if smtpCode(err) != 550 {
+			t.Errorf("%q: err = %v, want a 550", header, err)
+		}
+	}
+}
+
+// contentValue returns the value of the first content whose type starts
+// with mediaType, and whether there is one
+func contentValue(body map[string]any, mediaType string) (string, bool) {
+	for i := 0; i < jsonLen(body, "content"); i++ {
+		if typ, _ := jsonPath(body, "content", i, "type").(string); strings.HasPrefix(typ, mediaType) {
+			value, _ := jsonPath(body, "content", i, "value").(string)
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// multipartMessage builds a multipart/alternative message with text and
+// HTML parts
+func multipartMessage(text, html string) string {
+	return "From: app@example.com\nSubject: Report\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: text/plain; charset=utf-8\n\n" + text + "\n" +
+		"--b1\nContent-Type: text/html; charset=utf-8\n\n" + html + "\n" +
+		"--b1--\n"
+}
+
+func TestSendGridContentLimitsTruncate(t *testing.T) {
+	html := "<p>" + strings.Repeat("ñ", 300) + "</p>"
+	body, err := sendGridPayload(t, map[string]string{"MAX_HTML_BYTES": "101"}, multipartMessage("short text", html))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	gotHTML, _ := contentValue(body, "text/html")
+	if len(gotHTML) > 101 || !strings.HasPrefix(html, gotHTML) {
+		t.Errorf("html = %d bytes %q, want a prefix of at most 101 bytes", len(gotHTML), gotHTML)
+	}
+	if !utf8.ValidString(gotHTML) {
+		t.Errorf("truncated html split a UTF-8 sequence")
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "short text") {
+		t.Errorf("text = %q, want it untouched", text)
+	}
+
+	// Single-part bodies are limited too
+	body, err = sendGridPayload(t, map[string]string{"MAX_TEXT_BYTES": "10"}, "From: app@example.com\nSubject: Hi\n\n"+strings.Repeat("a", 50)+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := contentValue(body, "text/plain"); text != strings.Repeat("a", 10) {
+		t.Errorf("text = %q, want 10 bytes", text)
+	}
+}
+
+func TestSendGridContentLimitsReject(t *testing.T) {
+	env := map[string]string{"MAX_HTML_BYTES": "100", "OVERSIZE_POLICY": "reject"}
+	_, err := sendGridPayload(t, env, multipartMessage("short text", "<p>"+strings.Repeat("x", 500)+"</p>"))
+	if smtpCode(err) != 552 {
+		t.Errorf("oversized html: err = %v, want 552", err)
+	}
+	if _, err := sendGridPayload(t, env, multipartMessage("short text", "<p>small</p>")); err != nil {
+		t.Errorf("html within limits: %v", err)
+	}
+}
+
+func TestSendGridEmptyBody(t *testing.T) {
+	headersOnly := "From: app@example.com\nSubject: Ping\n\n"
+	attachmentOnly := "From: app@example.com\nSubject: Files\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+		"--b1\nContent-Type: application/pdf\nContent-Disposition: attachment; filename=\"report.pdf\"\n" +
+		"Content-Transfer-Encoding: base64\n\nJVBERi0xLjQK\n--b1--\n"
+	tests := []struct {
+		name string
+		env  map[string]string
+		raw  string
+		want string // text sent, or the error
+	}{
+		{"default placeholder", nil, headersOnly, " "},
+		{"whitespace only", nil, "From: app@example.com\nSubject: Ping\n\n  \n\t\n", " "},
+		{"custom placeholder", map[string]string{"EMPTY_BODY_PLACEHOLDER": "(sin contenido)"}, headersOnly, "(sin contenido)"},
+		{"rejected", map[string]string{"EMPTY_BODY_POLICY": "reject"}, headersOnly, errEmptyBody.Error()},
+		{"blank parts rejected", map[string]string{"EMPTY_BODY_POLICY": "reject"}, multipartMessage("", " "), errEmptyBody.Error()},
+		{"attachment only", map[string]string{"EMPTY_BODY_POLICY": "reject"}, attachmentOnly, " "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := sendGridPayload(t, tt.env, tt.raw)
+			if tt.want == errEmptyBody.Error() {
+				if smtpCode(err) != 550 || sendFailureReason(err) != reasonInvalidMessage {
+					t.Fatalf("err = %v, want a 550 5.6.0", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if jsonLen(body, "content") != 1 {
+				t.Fatalf("content = %v, want only the placeholder", jsonPath(body, "content"))
+			}
+			if text, _ := contentValue(body, "text/plain"); text != tt.want {
+				t.Errorf("text = %q, want %q", text, tt.want)
+			}
+			if tt.raw == attachmentOnly && attachmentNames(body) != "report.pdf" {
+				t.Errorf("attachments = %q, want report.pdf", attachmentNames(body))
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidEmptyBodyPolicy(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"EMPTY_BODY_POLICY": "drop"}); err == nil {
+		t.Error("unknown EMPTY_BODY_POLICY was accepted")
+	}
+}
+
+func TestSendGridProxy(t *testing.T) {
+	var proxied []string
+	var mu sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.String()+" as "+user+":"+pass)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer proxy.Close()
+
+	relay, stub := newTestSendGridRelay(t, map[string]string{
+		"SENDGRID_HOST":      "http://api.sendgrid.invalid",
+		"SENDGRID_PROXY_URL": strings.Replace(proxy.URL, "http://", "http://egress:s3cret@", 1),
+	})
+	if _, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org")); err != nil {
+		t.Fatalf("Send through the proxy: %v", err)
+	}
+	if len(stub.Requests()) != 0 {
+		t.Error("request bypassed the proxy")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 1 || proxied[0] != "POST http://api.sendgrid.invalid/v3/mail/send as egress:s3cret" {
+		t.Errorf("proxy saw %v", proxied)
+	}
+}
+
+// parseProxyAuth decodes a Basic Proxy-Authorization header
+func parseProxyAuth(value string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {value}}}
+	return r.BasicAuth()
+}
+
+func TestLoadConfigInvalidProxyURL(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"SENDGRID_PROXY_URL": "socks5://proxy:1080"}); err == nil {
+		t.Error("SENDGRID_PROXY_URL with a socks5 scheme was accepted")
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	header := mail.Header{
+		"To": {"Ann <ann@example.org>, bob@example.org"},
+		"Cc": {"BOB@example.org, carol@example.org"},
+	}
+	envelope := []string{"<Ann@Example.org>", "bob@example.org", "carol@example.org", "carol@example.org", "dave@example.org", "erin@example.org", " "}
+	tos, ccs, bccs := splitRecipients(envelope, header, []string{"Carol@example.org", "erin@example.org"})
+
+	// To wins over Cc wins over Bcc, and envelope-only recipients are To
+	if got := strings.Join(tos, ","); got != "ann@example.org,bob@example.org,dave@example.org" {
+		t.Errorf("to = %s", got)
+	}
+	if got := strings.Join(ccs, ","); got != "carol@example.org" {
+		t.Errorf("cc = %s", got)
+	}
+	if got := strings.Join(bccs, ","); got != "erin@example.org" {
+		t.Errorf("bcc = %s", got)
+	}
+}
+
+func TestSendGridRecipientsOnce(t *testing.T) {
+	raw := "From: app@example.com\nTo: user@example.org\nCc: User@Example.org, copy@example.org\nSubject: Hi\n\nHello\n"
+	relay, stub := newTestSendGridRelay(t, nil)
+	msg := testMessage(t, raw, "app@example.com", "user@example.org", "USER@example.org", "copy@example.org", "hidden@example.org", "copy@example.org")
+	msg.Bcc = []string{"hidden@example.org", "copy@example.org"}
+	if _, err := relay.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+
+	seen := map[string]int{}
+	for _, field := range []string{"to", "cc", "bcc"} {
+		for _, email := range personalizationEmails(body, 0, field) {
+			seen[field+" "+email]++
+		}
+	}
+	want := map[string]int{"to <user@example.org>": 1, "cc <copy@example.org>": 1, "bcc <hidden@example.org>": 1}
+	if len(seen) != len(want) {
+		t.Errorf("recipients = %v, want %v", seen, want)
+	}
+	for key, count := range want {
+		if seen[key] != count {
+			t.Errorf("recipients = %v, want %v", seen, want)
+			break
+		}
+	}
+}
+
+func TestSendGridOnePersonalizationPerRecipient(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"ONE_PERSONALIZATION_PER_RECIPIENT": "true"})
+	raw := "From: app@example.com\nTo: a@example.org, b@example.org\nCc: c@example.org\nSubject: Private\n\nHello\n"
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "a@example.org", "b@example.org", "c@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if n := jsonLen(body, "personalizations"); n != 3 {
+		t.Fatalf("got %d personalizations, want 3", n)
+	}
+	for i, want := range []string{"<a@example.org>", "<b@example.org>", "<c@example.org>"} {
+		to := personalizationEmails(body, i, "to")
+		if len(to) != 1 || to[0] != want {
+			t.Errorf("personalization %d to = %v, want only %s", i, to, want)
+		}
+		if n := jsonLen(body, "personalizations", i, "cc") + jsonLen(body, "personalizations", i, "bcc"); n != 0 {
+			t.Errorf("personalization %d has %d other recipients", i, n)
+		}
+	}
+}
+
+func TestSendGridTimeout(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"SENDGRID_TIMEOUT": "50ms"})
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+
+	start := time.Now()
+	_, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org"))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send took %v, the timeout did not fire", elapsed)
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 4, 1}) {
+		t.Fatalf("err = %v, want 451 4.4.1", err)
+	}
+	if !isTemporary(err) {
+		t.Error("timeout is not a temporary error")
+	}
+}
+
+func TestSendGridUTF8Recipient(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, nil)
+	raw := "From: remitente@contacloud.mx\nTo: 用户 <用户@例え.jp>\nSubject: Hola\n\nHola\n"
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "remitente@contacloud.mx", "用户@例え.jp")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if to := personalizationEmails(stub.Last(t), 0, "to"); len(to) != 1 || to[0] != "<用户@例え.jp>" {
+		t.Errorf("to = %v, want the address intact", to)
+	}
+}
+
+func TestLooksLikeHTML(t *testing.T) {
+	for body, want := range map[string]bool{
+		"<!DOCTYPE html><html><body>Hi</body></html>": true,
+		"\xef\xbb\xbf\r\n  <HTML lang=\"es\">":        true,
+		"<html>":                                      true,
+		"<htmlx>":                                     false,
+		"Use <html> tags in your template":            false,
+		"Hello\n<html>":                               false,
+		"":                                            false,
+	} {
+		if got := looksLikeHTML([]byte(body)); got != want {
+			t.Errorf("looksLikeHTML(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestSendGridSniffsUntypedBody(t *testing.T) {
+	body, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\n\n<!DOCTYPE html>\n<html><body><p>Hi</p></body></html>\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := contentValue(body, "text/html"); !ok || jsonLen(body, "content") != 1 {
+		t.Errorf("content = %v, want a single text/html", body["content"])
+	}
+
+	body, err = sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\n\nPlain text mentioning <html> tags\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := contentValue(body, "text/plain"); !ok || jsonLen(body, "content") != 1 {
+		t.Errorf("content = %v, want a single text/plain", body["content"])
+	}
+}
+
+func TestSendGridIPPool(t *testing.T) {
+	env := map[string]string{"SENDGRID_IP_POOL": "transactional", "SENDGRID_IP_POOLS": "transactional, marketing"}
+	body, err := sendGridPayload(t, env, simpleMessage)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := body["ip_pool_name"]; got != "transactional" {
+		t.Errorf("ip_pool_name = %v, want the SENDGRID_IP_POOL default", got)
+	}
+
+	body, err = sendGridPayload(t, env, "From: app@example.com\nSubject: News\nX-SMTP-Relay-IP-Pool: marketing\n\nNews\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := body["ip_pool_name"]; got != "marketing" {
+		t.Errorf("ip_pool_name = %v, want the header pool", got)
+	}
+
+	for _, pool := range []string{"bulk", "x"} {
+		_, err = sendGridPayload(t, env, "From: app@example.com\nSubject: News\nX-SMTP-Relay-IP-Pool: "+pool+"\n\nNews\n")
+		if smtpCode(err) != 550 {
+			t.Errorf("pool %q: err = %v, want a 550", pool, err)
+		}
+	}
+}
+
+func TestSendGridNoIPPool(t *testing.T) {
+	body, err := sendGridPayload(t, nil, simpleMessage)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, ok := body["ip_pool_name"]; ok {
+		t.Errorf("ip_pool_name = %v, want none by default", body["ip_pool_name"])
+	}
+}
+
+func TestLoadConfigIPPoolNotAllowed(t *testing.T) {
+	_, err := tryConfig(t, map[string]string{"SENDGRID_IP_POOL": "bulk", "SENDGRID_IP_POOLS": "transactional"})
+	if err == nil || !strings.Contains(err.Error(), "SENDGRID_IP_POOLS") {
+		t.Errorf("err = %v, want the default pool refused", err)
+	}
+}
+
+func TestSendGridCustomArgs(t *testing.T) {
+	body, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Order\nX-SMTP-Relay-Arg-OrderID: 1234\nx-smtp-relay-arg-Tenant: =?UTF-8?Q?Caf=C3=A9?=\n\nShipped\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := jsonPath(body, "custom_args", "OrderID"); got != "1234" {
+		t.Errorf("custom_args.OrderID = %v, want 1234", got)
+	}
+	if got := jsonPath(body, "custom_args", "Tenant"); got != "Café" {
+		t.Errorf("custom_args.Tenant = %v, want the decoded value", got)
+	}
+
+	_, err = sendGridPayload(t, nil, "From: app@example.com\nSubject: Order\nX-SMTP-Relay-Arg-Blob: "+strings.Repeat("x", maxCustomArgsBytes)+"\n\nShipped\n")
+	if smtpCode(err) != 550 {
+		t.Errorf("oversized custom args: err = %v, want a 550", err)
+	}
+}
+
+func TestSendGridPersonalizationHeaders(t *testing.T) {
+	raw := "From: app@example.com\nTo: a@example.org, b@example.org\nSubject: Order\nX-SMTP-Relay-PHeader-X-Route: eu\nx-smtp-relay-pheader-X-Tenant: =?UTF-8?Q?Caf=C3=A9?=\n\nShipped\n"
+	relay, stub := newTestSendGridRelay(t, map[string]string{"ONE_PERSONALIZATION_PER_RECIPIENT": "true"})
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "a@example.org", "b@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if n := jsonLen(body, "personalizations"); n != 2 {
+		t.Fatalf("got %d personalizations, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if got := jsonPath(body, "personalizations", i, "headers", "X-Route"); got != "eu" {
+			t.Errorf("personalizations[%d].headers.X-Route = %v, want eu", i, got)
+		}
+		if got := jsonPath(body, "personalizations", i, "headers", "X-Tenant"); got != "Café" {
+			t.Errorf("personalizations[%d].headers.X-Tenant = %v, want the decoded value", i, got)
+		}
+	}
+
+	_, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Order\nX-SMTP-Relay-PHeader-Subject: Hijacked\n\nShipped\n")
+	if smtpCode(err) != 550 || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("reserved personalization header: err = %v, want a 550", err)
+	}
+}
+
+func TestSendGridTrackingHeaders(t *testing.T) {
+	body, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Reset\nX-SMTP-Relay-Click-Tracking: off\nX-SMTP-Relay-Open-Tracking: on\n\nReset your password\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := jsonPath(body, "tracking_settings", "click_tracking", "enable"); got != false {
+		t.Errorf("click_tracking.enable = %v, want false", got)
+	}
+	if got := jsonPath(body, "tracking_settings", "click_tracking", "enable_text"); got != false {
+		t.Errorf("click_tracking.enable_text = %v, want false", got)
+	}
+	if got := jsonPath(body, "tracking_settings", "open_tracking", "enable"); got != true {
+		t.Errorf("open_tracking.enable = %v, want true", got)
+	}
+
+	// Without headers or defaults the account settings apply
+	body, err = sendGridPayload(t, nil, simpleMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["tracking_settings"]; ok {
+		t.Errorf("tracking_settings = %v, want none", body["tracking_settings"])
+	}
+
+	_, err = sendGridPayload(t, nil, "From: app@example.com\nSubject: Reset\nX-SMTP-Relay-Click-Tracking: maybe\n\nReset\n")
+	if smtpCode(err) != 550 {
+		t.Errorf("invalid toggle: err = %v, want a 550", err)
+	}
+}
+
+func TestSendGridTrackingDefaults(t *testing.T) {
+	env := map[string]string{"SENDGRID_CLICK_TRACKING": "off", "SENDGRID_OPEN_TRACKING": "off"}
+	body, err := sendGridPayload(t, env, simpleMessage)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if jsonPath(body, "tracking_settings", "click_tracking", "enable") != false || jsonPath(body, "tracking_settings", "open_tracking", "enable") != false {
+		t.Errorf("tracking_settings = %v, want both disabled by default", body["tracking_settings"])
+	}
+
+	// A header overrides the default
+	body, err = sendGridPayload(t, env, "From: app@example.com\nSubject: News\nX-SMTP-Relay-Click-Tracking: on\n\nNews\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonPath(body, "tracking_settings", "click_tracking", "enable") != true {
+		t.Errorf("click_tracking = %v, want the header to win", jsonPath(body, "tracking_settings", "click_tracking"))
+	}
+
+	if _, err := tryConfig(t, map[string]string{"SENDGRID_OPEN_TRACKING": "sometimes"}); err == nil {
+		t.Error("invalid SENDGRID_OPEN_TRACKING was accepted")
+	}
+}
+
+func TestSendGridMissingFromRejected(t *testing.T) {
+	for name, raw := range map[string]string{
+		"no From":    "Subject: Hi\n\nHello\n",
+		"empty From": "From: \nSubject: Hi\n\nHello\n",
+		"no address": "From: Billing\nSubject: Hi\n\nHello\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := sendGridPayload(t, nil, raw)
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || !strings.Contains(smtpErr.Message, "no usable From") {
+				t.Errorf("err = %v, want a 550 naming the From header", err)
+			}
+		})
+	}
+}
+
+func TestSendGridMissingFromDefault(t *testing.T) {
+	env := map[string]string{"DEFAULT_FROM": "Contacloud <noreply@contacloud.mx>"}
+	body, err := sendGridPayload(t, env, "Subject: Hi\n\nHello\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if jsonPath(body, "from", "email") != "noreply@contacloud.mx" || jsonPath(body, "from", "name") != "Contacloud" {
+		t.Errorf("from = %v, want DEFAULT_FROM", body["from"])
+	}
+
+	// A usable From header is kept
+	body, err = sendGridPayload(t, env, simpleMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonPath(body, "from", "email") != "app@example.com" {
+		t.Errorf("from = %v, want the header address", body["from"])
+	}
+
+	if _, err := tryConfig(t, map[string]string{"DEFAULT_FROM": "not an address"}); err == nil {
+		t.Error("invalid DEFAULT_FROM was accepted")
+	}
+}
+
+func TestSendGridSubstitutions(t *testing.T) {
+	raw := `From: app@example.com
+To: ann@example.org, bob@example.org
+Subject: Hello %name%
+X-SMTP-Relay-Substitutions: {"Ann@Example.org": {"%name%": "Ann", "%plan%": "pro"}, "bob@example.org": {"%name%": "Bob"}, "eve@example.org": {"%name%": "Eve"}}
+
+Hi %name%
+`
+	relay, stub := newTestSendGridRelay(t, nil)
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "app@example.com", "ann@example.org", "bob@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if n := jsonLen(body, "personalizations"); n != 2 {
+		t.Fatalf("got %d personalizations, want one per recipient", n)
+	}
+	want := map[string]map[string]any{
+		"ann@example.org": {"%name%": "Ann", "%plan%": "pro"},
+		"bob@example.org": {"%name%": "Bob"},
+	}
+	for i := 0; i < 2; i++ {
+		to, _ := jsonPath(body, "personalizations", i, "to", 0, "email").(string)
+		got, _ := jsonPath(body, "personalizations", i, "substitutions").(map[string]any)
+		if len(got) != len(want[to]) {
+			t.Errorf("%s substitutions = %v, want %v", to, got, want[to])
+		}
+		for key, value := range want[to] {
+			if got[key] != value {
+				t.Errorf("%s substitution %s = %v, want %v", to, key, got[key], value)
+			}
+		}
+	}
+}
+
+func TestSendGridInvalidSubstitutions(t *testing.T) {
+	_, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\nX-SMTP-Relay-Substitutions: {\"user@example.org\": [\"Ann\"]}\n\nHi\n")
+	if smtpCode(err) != 550 {
+		t.Errorf("err = %v, want a 550 for the invalid JSON", err)
+	}
+}
+
+func TestSendGridBatchAndSendAt(t *testing.T) {
+	sendAt := time.Now().Add(time.Hour).Unix()
+	body, err := sendGridPayload(t, nil, fmt.Sprintf("From: app@example.com\nSubject: News\nX-SMTP-Relay-Batch-ID: YmF0Y2gtMQ\nX-SMTP-Relay-Send-At: %d\n\nNews\n", sendAt))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := body["batch_id"]; got != "YmF0Y2gtMQ" {
+		t.Errorf("batch_id = %v", got)
+	}
+	if got := body["send_at"]; got != float64(sendAt) {
+		t.Errorf("send_at = %v, want %d", got, sendAt)
+	}
+
+	body, err = sendGridPayload(t, nil, simpleMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["send_at"]; ok {
+		t.Errorf("send_at = %v, want none", body["send_at"])
+	}
+}
+
+func TestScheduleFromHeaders(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		sendAt string
+		want   int64
+		err    string
+	}{
+		{"", 0, ""},
+		{"1700003600", 1700003600, ""},
+		{"1699999999", 0, "must be in the future"},
+		{"1700000000", 0, "must be in the future"},
+		{fmt.Sprint(now.Add(maxSendAtDelay + time.Second).Unix()), 0, "must be within"},
+		{"tomorrow", 0, "expected a unix timestamp"},
+	}
+	for _, tt := range tests {
+		header := mail.Header{"X-Smtp-Relay-Batch-Id": {"b1"}}
+		if tt.sendAt != "" {
+			header["X-Smtp-Relay-Send-At"] = []string{tt.sendAt}
+		}
+		batchID, sendAt, err := scheduleFromHeaders(header, now)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("send_at %q: err = %v, want %q", tt.sendAt, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || batchID != "b1" || sendAt != tt.want {
+			t.Errorf("send_at %q = %q, %d, %v, want b1, %d", tt.sendAt, batchID, sendAt, err, tt.want)
+		}
+	}
+}
+
+func TestSendGridDecodesEncodedDisplayNames(t *testing.T) {
+	raw := `From: =?UTF-8?B?Sm9zw6kgUMOpcmV6?= <jose@example.com>
+To: =?ISO-8859-1?Q?Mar=EDa_L=F3pez?= <maria@example.org>
+Cc: "=?UTF-8?Q?Fran=C3=A7ois?=" <francois@example.org>
+Subject: Hola
+
+Hola
+`
+	relay, stub := newTestSendGridRelay(t, map[string]string{"PARSE_HEADER_TO": "true"})
+	if _, err := relay.Send(context.Background(), testMessage(t, raw, "jose@example.com", "maria@example.org", "francois@example.org")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	body := stub.Last(t)
+	if got := jsonPath(body, "from", "name"); got != "José Pérez" {
+		t.Errorf("from name = %v, want the decoded name", got)
+	}
+	if got := strings.Join(personalizationEmails(body, 0, "to"), ","); got != "María López <maria@example.org>" {
+		t.Errorf("to = %s", got)
+	}
+	if got := strings.Join(personalizationEmails(body, 0, "cc"), ","); got != "François <francois@example.org>" {
+		t.Errorf("cc = %s", got)
+	}
+}
+
+func TestParseAddressDecodesName(t *testing.T) {
+	for in, want := range map[string]string{
+		"=?UTF-8?B?Sm9zw6kgUMOpcmV6?= <jose@example.com>": "José Pérez",
+		"=?windows-1252?Q?Ren=E9e?= <renee@example.com>":  "Renée",
+		"=?UTF-8?Q?Caf=C3=A9?= Team <team@example.com>":   "Café Team",
+		"Plain Name <plain@example.com>":                  "Plain Name",
+	} {
+		addr, err := parseAddress(in)
+		if err != nil {
+			t.Errorf("parseAddress(%q): %v", in, err)
+			continue
+		}
+		if addr.Name != want {
+			t.Errorf("parseAddress(%q).Name = %q, want %q", in, addr.Name, want)
+		}
+	}
+}
+
+func TestSendGridNormalizesLineEndings(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Hi\n\nfirst\rsecond\r" + strings.Repeat("word ", 300) + "\n"
+	body, err := sendGridPayload(t, map[string]string{"NORMALIZE_LINE_ENDINGS": "true", "WRAP_LONG_LINES": "true"}, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	text, _ := contentValue(body, "text/plain")
+	if !strings.HasPrefix(text, "first\r\nsecond\r\n") {
+		t.Errorf("text = %q, want bare CR converted to CRLF", text[:20])
+	}
+	for _, line := range strings.Split(text, "\r\n") {
+		if len(line) > maxLineLength || strings.ContainsAny(line, "\r\n") {
+			t.Errorf("line of %d octets in %q...", len(line), line[:20])
+		}
+	}
+}
+
+func TestSendGridLineEndingsUntouchedByDefault(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Hi\n\nfirst\rsecond\r" + strings.Repeat("word ", 300) + "\n"
+	body, err := sendGridPayload(t, nil, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.HasPrefix(text, "first\rsecond\r") {
+		t.Errorf("text = %q, want it untouched without NORMALIZE_LINE_ENDINGS", text[:20])
+	}
+}
+
+func TestSendGridEnvelopeFromArg(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		from   string
+		want   any
+	}{
+		{"bounce address", "", "<bounces+42@mailer.example.com>", "bounces+42@mailer.example.com"},
+		{"same as From", "", "App@Example.com", nil},
+		{"explicit custom arg", "X-SMTP-Relay-Arg-envelope_from: override@example.com\n", "bounces@mailer.example.com", "override@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, stub := newTestSendGridRelay(t, nil)
+			raw := "From: App <app@example.com>\nSubject: Hi\n" + tt.header + "\nHello\n"
+			if _, err := relay.Send(context.Background(), testMessage(t, raw, tt.from, "user@example.org")); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			body := stub.Last(t)
+			if got := jsonPath(body, "custom_args", envelopeFromArg); got != tt.want {
+				t.Errorf("custom_args.%s = %v, want %v", envelopeFromArg, got, tt.want)
+			}
+			if got := jsonPath(body, "from", "email"); got != "app@example.com" {
+				t.Errorf("from.email = %v, want the header From", got)
+			}
+		})
+	}
+}
+
+func TestSendGridSignedMessageKeptIntact(t *testing.T) {
+	contentType := `multipart/signed; micalg=pgp-sha256; protocol="application/pgp-signature"; boundary="s1"`
+	signedBody := "--s1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Signed  text with trailing spaces  \r\n" +
+		"--s1\r\n" +
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n" +
+		"\r\n" +
+		"-----BEGIN PGP SIGNATURE-----\r\n" +
+		"iQEzBAEBCAAdFiEE\r\n" +
+		"-----END PGP SIGNATURE-----\r\n" +
+		"--s1--\r\n"
+	raw := "From: app@example.com\r\nSubject: Signed\r\nMIME-Version: 1.0\r\nContent-Type: " + contentType + "\r\n\r\n" + signedBody
+
+	body, err := sendGridPayload(t, nil, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if n := jsonLen(body, "attachments"); n != 1 {
+		t.Fatalf("attachments = %v, want only the original", jsonPath(body, "attachments"))
+	}
+	if jsonPath(body, "attachments", 0, "filename") != signedMessageFilename || jsonPath(body, "attachments", 0, "type") != "message/rfc822" {
+		t.Errorf("attachment = %v", jsonPath(body, "attachments", 0))
+	}
+	encoded, _ := jsonPath(body, "attachments", 0, "content").(string)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Content-Type: " + contentType + "\r\nMIME-Version: 1.0\r\n\r\n" + signedBody
+	if string(decoded) != want {
+		t.Errorf("attached original =\n%q\nwant\n%q", decoded, want)
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "Signed  text") {
+		t.Errorf("text = %q, want the signed text for display", text)
+	}
+}
+
+func TestSendGridSignedMessagePlaceholder(t *testing.T) {
+	raw := "From: app@example.com\nSubject: Signed\nMIME-Version: 1.0\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=\"s1\"\n\n" +
+		"--s1\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"data.bin\"\n\nxyz\n" +
+		"--s1\nContent-Type: application/pkcs7-signature\n\nsig\n--s1--\n"
+	body, err := sendGridPayload(t, nil, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, signedMessageFilename) {
+		t.Errorf("text = %q, want the placeholder naming the original", text)
+	}
+	var names []any
+	for i := 0; i < jsonLen(body, "attachments"); i++ {
+		names = append(names, jsonPath(body, "attachments", i, "filename"))
+	}
+	if fmt.Sprint(names) != "[data.bin "+signedMessageFilename+"]" {
+		t.Errorf("attachments = %v, want data.bin and the original without the signature", names)
+	}
+}
+
+func TestSendGridMailSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		header string
+		want   string
+	}{
+		{"none", nil, "", "<nil>"},
+		{"footer text configured", map[string]string{"SENDGRID_FOOTER_TEXT": "Unsubscribe at example.com"}, "",
+			`{"footer":{"enable":true,"text":"Unsubscribe at example.com"}}`},
+		{"footer off by header", map[string]string{"SENDGRID_FOOTER_TEXT": "Unsubscribe"}, "X-SMTP-Relay-Footer: off\n",
+			`{"footer":{"enable":false}}`},
+		{"account footer by header", nil, "X-SMTP-Relay-Footer: on\n", `{"footer":{"enable":true}}`},
+		{"bypass by allowed domain", map[string]string{"SENDGRID_BYPASS_SENDERS": "alerts@example.net, example.com"}, "X-SMTP-Relay-Bypass-List-Management: yes\n",
+			`{"bypass_list_management":{"enable":true}}`},
+		{"bypass off for anyone", nil, "X-SMTP-Relay-Bypass-List-Management: off\n", `{"bypass_list_management":{"enable":false}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := sendGridPayload(t, tt.env, "From: app@example.com\nSubject: Hi\n"+tt.header+"\nHello\n")
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			got := "<nil>"
+			if settings, ok := body["mail_settings"]; ok {
+				data, _ := json.Marshal(settings)
+				got = string(data)
+			}
+			if got != tt.want {
+				t.Errorf("mail_settings = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendGridBypassGated(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"no allowlist":      nil,
+		"sender not listed": {"SENDGRID_BYPASS_SENDERS": "alerts@example.com, example.net"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := sendGridPayload(t, env, "From: app@example.com\nSubject: Hi\nX-SMTP-Relay-Bypass-List-Management: on\n\nHello\n")
+			if smtpCode(err) != 550 || !strings.Contains(err.Error(), "may not bypass list management") {
+				t.Errorf("err = %v, want a 550 refusing the bypass", err)
+			}
+		})
+	}
+}
+
+func TestSendGridInvalidFooterHeader(t *testing.T) {
+	_, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\nX-SMTP-Relay-Footer: maybe\n\nHello\n")
+	if smtpCode(err) != 550 || !strings.Contains(err.Error(), headerFooter) {
+		t.Errorf("err = %v, want a 550 naming the header", err)
+	}
+}
+
+func TestSendGridContentTypeDispatch(t *testing.T) {
+	tests := []struct {
+		name, contentType, boundary string
+	}{
+		{"odd casing", `Multipart/Alternative; Boundary="b1"`, "b1"},
+		{"whitespace", "  MULTIPART/alternative ;\n\tboundary = \"b1\"", "b1"},
+		{"quoted special boundary", `multipart/alternative; boundary="=_Part 1; x"`, "=_Part 1; x"},
+		{"unquoted equals boundary", "multipart/alternative; boundary==_abc=", "=_abc="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "From: app@example.com\nSubject: Hi\nMIME-Version: 1.0\nContent-Type: " + tt.contentType + "\n\n" +
+				"--" + tt.boundary + "\nContent-Type: Text/Plain; charset=utf-8\n\nPlain\n" +
+				"--" + tt.boundary + "\nContent-Type: TEXT/HTML\n\n<p>Rich</p>\n" +
+				"--" + tt.boundary + "--\n"
+			body, err := sendGridPayload(t, nil, raw)
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			text, _ := contentValue(body, "text/plain")
+			html, _ := contentValue(body, "text/html")
+			if strings.TrimSpace(text) != "Plain" || strings.TrimSpace(html) != "<p>Rich</p>" {
+				t.Errorf("content = %v, want the text and HTML parts", body["content"])
+			}
+		})
+	}
+}
+
+func TestSendGridSinglePartCasing(t *testing.T) {
+	body, err := sendGridPayload(t, nil, "From: app@example.com\nSubject: Hi\nContent-Type:  Text/HTML ; Charset=UTF-8\n\n<p>Hi</p>\n")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, ok := contentValue(body, "text/html"); !ok {
+		t.Errorf("content = %v, want HTML", body["content"])
+	}
+}
+
+func TestSendGridPartialSuccess(t *testing.T) {
+	logs := captureLog(t)
+	relay, stub := newTestSendGridRelay(t, nil)
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"errors":[`+
+			`{"message":"Recipient is suppressed","field":"personalizations.0.to.1.email"},`+
+			`{"message":"Unrelated warning","field":null},`+
+			`{"message":"Out of range","field":"personalizations.3.to.0.email"}]}`)
+	}
+	rejected := recipientsRejected.WithLabelValues("sendgrid")
+	before := testutil.ToFloat64(rejected)
+
+	result, err := relay.Send(context.Background(), testMessage(t, "From: app@example.com\nTo: a@example.org, b@example.org\nSubject: Hi\n\nHi\n",
+		"app@example.com", "a@example.org", "B@example.org"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(result.Rejected) != 1 || result.Rejected["b@example.org"] != "Recipient is suppressed" {
+		t.Errorf("Rejected = %v, want only b@example.org", result.Rejected)
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("recipients_rejected_total grew by %v, want 1", got)
+	}
+	if out := logs.String(); !strings.Contains(out, "to=b@example.org: Recipient is suppressed") || strings.Contains(out, "to=a@example.org") {
+		t.Errorf("log does not name only the suppressed recipient:\n%s", out)
+	}
+
+	// An unparsable body on success rejects nobody
+	stub.mu.Lock()
+	stub.reply = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "accepted")
+	}
+	stub.mu.Unlock()
+	if result, err := relay.Send(context.Background(), testMessage(t, simpleMessage, "app@example.com", "user@example.org")); err != nil || result.Rejected != nil {
+		t.Errorf("plain 202: result = %+v, err = %v", result, err)
+	}
+}
+
+// archiveCopies counts the personalization addresses of addr by field
+func archiveCopies(body map[string]any, addr string) map[string]int {
+	copies := map[string]int{}
+	for i := 0; i < jsonLen(body, "personalizations"); i++ {
+		for _, field := range []string{"to", "cc", "bcc"} {
+			for j := 0; j < jsonLen(body, "personalizations", i, field); j++ {
+				if jsonPath(body, "personalizations", i, field, j, "email") == addr {
+					copies[field]++
+				}
+			}
+		}
+	}
+	return copies
+}
+
+func TestSendGridArchiveBcc(t *testing.T) {
+	const archive = "archive@vault.internal"
+	tests := []struct {
+		name string
+		env  map[string]string
+		to   []string
+		want map[string]int
+	}{
+		{"single personalization", nil, []string{"a@example.org", "b@example.org"}, map[string]int{"bcc": 1}},
+		{"one per recipient", map[string]string{"ONE_PERSONALIZATION_PER_RECIPIENT": "true"}, []string{"a@example.org", "b@example.org", "c@example.org"}, map[string]int{"bcc": 1}},
+		// Its copy as a recipient is the only one
+		{"archive already a recipient", nil, []string{"a@example.org", archive}, map[string]int{"to": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"ARCHIVE_BCC": archive}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			relay, stub := newTestSendGridRelay(t, env)
+			if _, err := relay.Send(context.Background(), testMessage(t, "From: app@example.com\nTo: a@example.org\nSubject: Hi\n\nHi\n", "app@example.com", tt.to...)); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if got := archiveCopies(stub.Last(t), archive); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("archive copies = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveBccBypassesRecipientPolicy(t *testing.T) {
+	relay, stub := newTestSendGridRelay(t, map[string]string{"ARCHIVE_BCC": "archive@vault.internal", "ALLOWED_RECIPIENTS": "example.org"})
+	be := newTestBackend(t, relay.config, relay)
+	c := dialClient(t, startTestServer(t, be, nil))
+	if err := c.SendMail("app@example.com", []string{"user@example.org"}, strings.NewReader("From: app@example.com\r\nTo: user@example.org\r\nSubject: Hi\r\n\r\nHi\r\n")); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	body := stub.Last(t)
+	if got := archiveCopies(body, "archive@vault.internal"); got["bcc"] != 1 {
+		t.Errorf("archive copies = %v, want one Bcc outside ALLOWED_RECIPIENTS", got)
+	}
+	if jsonLen(body, "personalizations", 0, "to") != 1 || jsonLen(body, "personalizations", 0, "cc") != 0 {
+		t.Errorf("archive leaked into To or Cc: %v", jsonPath(body, "personalizations"))
+	}
+
+	if _, err := tryConfig(t, map[string]string{"ARCHIVE_BCC": "not an address"}); err == nil {
+		t.Error("invalid ARCHIVE_BCC was accepted")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sesMaxRecipients is the SES limit on recipients per SendEmail call
+const sesMaxRecipients = 50
+
+// errSESTooManyRecipients refuses recipients past sesMaxRecipients. Each
+// message is a single SendEmail call, so a retry never sends it twice to
+// recipients SES already accepted; SMTP clients send the rest of the
+// envelope in another transaction.
+var errSESTooManyRecipients = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+	Message:      fmt.Sprintf("Too many recipients, SES accepts %d per message", sesMaxRecipients),
+}
+
+// SESRelay delivers messages through the Amazon SES v2 SendEmail API. The
+// message is sent as raw MIME, so attachments and headers reach SES as
+// accepted (DKIM-signed if enabled).
+type SESRelay struct {
+	config   *Config
+	endpoint string // e.g. https://email.us-east-1.amazonaws.com
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newSESRelay(config *Config) *SESRelay {
+	endpoint := config.SESEndpoint
+	if endpoint == "" {
+		endpoint = "https://email." + config.SESRegion + ".amazonaws.com"
+	}
+	return &SESRelay{
+		config:   config,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{},
+		now:      time.Now,
+	}
+}
+
+func (r *SESRelay) Name() string {
+	return "ses"
+}
+
+// sesSendEmailRequest is the SES v2 SendEmail body for raw content
+type sesSendEmailRequest struct {
+	Destination          sesDestination `json:"Destination"`
+	Content              sesContent     `json:"Content"`
+	ConfigurationSetName string         `json:"ConfigurationSetName,omitempty"`
+}
+
+type sesDestination struct {
+	ToAddresses []string `json:"ToAddresses"`
+}
+
+type sesContent struct {
+	Raw struct {
+		Data []byte `json:"Data"` // base64 in JSON
+	} `json:"Raw"`
+}
+
+func (r *SESRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	ctx, span := tracer.Start(ctx, "ses.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	result, err := r.send(ctx, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+func (r *SESRelay) send(ctx context.Context, msg *Message) (*SendResult, error) {
+	to := make([]string, 0, len(msg.To))
+	for _, recipient := range msg.To {
+		to = append(to, strings.Trim(recipient, "<>"))
+	}
+
+	if r.config.DryRun {
+		logInfo("Dry run: would send via SES: id=%s from=%s to=%v size=%d", msg.ID, msg.From, to, len(msg.Raw))
+		return &SendResult{}, nil
+	}
+
+	if r.config.SESTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.SESTimeout)
+		defer cancel()
+	}
+
+	req := sesSendEmailRequest{
+		Destination:          sesDestination{ToAddresses: to},
+		ConfigurationSetName: r.config.SESConfigurationSet,
+	}
+	req.Content.Raw.Data = msg.Raw
+
+	messageID, status, err := r.sendEmail(ctx, &req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logError("SES API call timed out after %v", r.config.SESTimeout)
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+			Message:      "SES API timed out, try again later",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logDebug("SES response: status=%d message_id=%s", status, messageID)
+	return &SendResult{MessageID: messageID, StatusCode: status}, nil
+}
+
+// sendEmail makes one signed SendEmail call and returns the message ID
+func (r *SESRelay) sendEmail(ctx context.Context, req *sesSendEmailRequest) (string, int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build ses request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build ses request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	r.sign(httpReq, body)
+
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return "", 0, fmt.Errorf("ses API error: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("ses API error: %w", err)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("ses.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= 400 {
+		logError("SES returned error: status=%d body=%s", resp.StatusCode, respBody)
+		return "", resp.StatusCode, &StatusError{Service: "ses", StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var out struct {
+		MessageID string `json:"MessageId"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		logWarn("Failed to parse SES response %q: %v", respBody, err)
+	}
+	return out.MessageID, resp.StatusCode, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (r *SESRelay) sign(req *http.Request, body []byte) {
+	now := r.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if r.config.SESSessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", r.config.SESSessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := day + "/" + r.config.SESRegion + "/ses/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+r.config.SESSecretAccessKey), day)
+	key = hmacSHA256(key, r.config.SESRegion)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		r.config.SESAccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.ReplaceAll(strings.Join(pairs, "&"), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
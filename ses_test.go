@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// sesRequest is a SendEmail call received by sesStub
+type sesRequest struct {
+	Path   string
+	Header http.Header
+	Body   []byte
+	Email  sesSendEmailRequest
+}
+
+// sesStub is an SES v2 endpoint recording SendEmail calls. It answers with
+// status, or 200 and a MessageId numbered by call when status is 0.
+type sesStub struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []sesRequest
+}
+
+func newSESStub(t *testing.T) *sesStub {
+	stub := &sesStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := sesRequest{Path: r.URL.Path, Header: r.Header.Clone(), Body: body}
+		if err := json.Unmarshal(body, &req.Email); err != nil {
+			t.Errorf("SES request body: %v", err)
+		}
+		stub.mu.Lock()
+		stub.requests = append(stub.requests, req)
+		n := len(stub.requests)
+		stub.mu.Unlock()
+
+		if stub.status != 0 {
+			w.WriteHeader(stub.status)
+			w.Write([]byte(`{"message":"Email address is not verified."}`))
+			return
+		}
+		fmt.Fprintf(w, `{"MessageId":"ses-%d"}`, n)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (s *sesStub) Requests() []sesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sesRequest(nil), s.requests...)
+}
+
+// newTestSESRelay returns an SES relay sending to stub at a fixed time
+func newTestSESRelay(t *testing.T, stub *sesStub, env map[string]string) *SESRelay {
+	t.Helper()
+	settings := map[string]string{
+		"BACKEND":               "ses",
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"SES_ENDPOINT":          stub.URL,
+	}
+	for key, value := range env {
+		settings[key] = value
+	}
+	relay, err := newRelay(testConfig(t, settings))
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	ses := relay.(*SESRelay)
+	ses.now = func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) }
+	return ses
+}
+
+func TestSESRelaySend(t *testing.T) {
+	stub := newSESStub(t)
+	relay := newTestSESRelay(t, stub, map[string]string{"SES_CONFIGURATION_SET": "transactional"})
+	raw := "From: app@example.com\r\nTo: user@example.org\r\nSubject: Hi\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\nHello\r\n--b--\r\n"
+
+	result, err := relay.Send(context.Background(), &Message{
+		ID:   "test-id",
+		From: "app@example.com",
+		To:   []string{"<user@example.org>", "other@example.org"},
+		Raw:  []byte(raw),
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if result.MessageID != "ses-1" || result.StatusCode != 200 {
+		t.Errorf("result = %+v", result)
+	}
+
+	requests := stub.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d SES calls, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Path != "/v2/email/outbound-emails" {
+		t.Errorf("path = %s", req.Path)
+	}
+	if got := strings.Join(req.Email.Destination.ToAddresses, ","); got != "user@example.org,other@example.org" {
+		t.Errorf("ToAddresses = %s", got)
+	}
+	if string(req.Email.Content.Raw.Data) != raw {
+		t.Errorf("Raw.Data = %q, want the message as accepted", req.Email.Content.Raw.Data)
+	}
+	if req.Email.ConfigurationSetName != "transactional" {
+		t.Errorf("ConfigurationSetName = %q", req.Email.ConfigurationSetName)
+	}
+	if req.Header.Get("X-Amz-Date") != "20240501T123000Z" {
+		t.Errorf("X-Amz-Date = %q", req.Header.Get("X-Amz-Date"))
+	}
+}
+
+func TestSESRelaySignature(t *testing.T) {
+	stub := newSESStub(t)
+	relay := newTestSESRelay(t, stub, map[string]string{"AWS_SESSION_TOKEN": "session-token"})
+	if _, err := relay.Send(context.Background(), &Message{From: "app@example.com", To: []string{"user@example.org"}, Raw: []byte("Subject: Hi\r\n\r\nHello\r\n")}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	req := stub.Requests()[0]
+	if req.Header.Get("X-Amz-Security-Token") != "session-token" {
+		t.Errorf("X-Amz-Security-Token = %q", req.Header.Get("X-Amz-Security-Token"))
+	}
+
+	m := regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/us-east-1/ses/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`).
+		FindStringSubmatch(req.Header.Get("Authorization"))
+	if m == nil {
+		t.Fatalf("Authorization = %q", req.Header.Get("Authorization"))
+	}
+	if m[1] != "content-type;host;x-amz-date;x-amz-security-token" {
+		t.Errorf("SignedHeaders = %s", m[1])
+	}
+
+	// Recompute the signature from the request as received
+	host := strings.TrimPrefix(stub.URL, "http://")
+	canonical := strings.Join([]string{
+		"POST", "/v2/email/outbound-emails", "",
+		"content-type:application/json\nhost:" + host + "\nx-amz-date:20240501T123000Z\nx-amz-security-token:session-token\n",
+		m[1], sha256Hex(req.Body),
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n20240501T123000Z\n20240501/us-east-1/ses/aws4_request\n" + hex.EncodeToString(canonicalSum[:])
+	key := hmacSHA256([]byte("AWS4wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"), "20240501")
+	for _, part := range []string{"us-east-1", "ses", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); m[2] != want {
+		t.Errorf("Signature = %s, want %s", m[2], want)
+	}
+}
+
+func TestSESRecipientLimit(t *testing.T) {
+	stub := newSESStub(t)
+	relay := newTestSESRelay(t, stub, nil)
+	s := newTestSession(newTestBackend(t, relay.config, relay))
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var to []string
+	for i := 0; i < sesMaxRecipients; i++ {
+		to = append(to, fmt.Sprintf("user%d@example.org", i))
+		if err := s.Rcpt(to[i], &smtp.RcptOptions{}); err != nil {
+			t.Fatalf("recipient %d: %v", i+1, err)
+		}
+	}
+	// A retry of a single call never duplicates the message, so the
+	// envelope is not split into several
+	err := s.Rcpt("one-more@example.org", &smtp.RcptOptions{})
+	if smtpCode(err) != 452 || !isTemporary(err) {
+		t.Fatalf("recipient %d: err = %v, want a 452", sesMaxRecipients+1, err)
+	}
+	if err := s.Data(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	requests := stub.Requests()
+	if len(requests) != 1 || len(requests[0].Email.Destination.ToAddresses) != sesMaxRecipients {
+		t.Fatalf("SES calls = %d, want one with %d recipients", len(requests), sesMaxRecipients)
+	}
+
+	// Other backends are not limited
+	s = newTestSession(newTestBackend(t, testConfig(t, map[string]string{"BACKEND": "sendgrid"}), &fakeRelay{}))
+	if err := sendTestMessage(s, "app@example.com", append(to, "one-more@example.org"), "Subject: Hi\n\nHello\n"); err != nil {
+		t.Errorf("51 recipients with the sendgrid backend: %v", err)
+	}
+}
+
+func TestSESRelayError(t *testing.T) {
+	stub := newSESStub(t)
+	stub.status = http.StatusBadRequest
+	relay := newTestSESRelay(t, stub, nil)
+	_, err := relay.Send(context.Background(), &Message{From: "app@example.com", To: []string{"user@example.org"}, Raw: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 400 || !strings.Contains(statusErr.Body, "not verified") {
+		t.Fatalf("err = %v, want the SES 400", err)
+	}
+	if isTemporary(err) {
+		t.Error("SES 400 is treated as temporary")
+	}
+}
+
+func TestLoadConfigSESBackend(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"BACKEND": "ses", "AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"}); err == nil || !strings.Contains(err.Error(), "AWS_REGION") {
+		t.Errorf("err = %v, want the missing region refused", err)
+	}
+	if _, err := tryConfig(t, map[string]string{"BACKEND": "ses", "AWS_DEFAULT_REGION": "eu-west-1", "AWS_ACCESS_KEY_ID": ""}); err == nil || !strings.Contains(err.Error(), "AWS_ACCESS_KEY_ID") {
+		t.Errorf("err = %v, want the missing credentials refused", err)
+	}
+	config := testConfig(t, map[string]string{"BACKEND": "ses", "AWS_DEFAULT_REGION": "eu-west-1", "AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret"})
+	if relay := newSESRelay(config); relay.endpoint != "https://email.eu-west-1.amazonaws.com" {
+		t.Errorf("endpoint = %s", relay.endpoint)
+	}
+}
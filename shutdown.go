@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// watchShutdown stops the SMTP server and the client-facing HTTP servers on
+// SIGINT or SIGTERM, giving open sessions and requests up to SHUTDOWN_TIMEOUT
+// to finish before they are force-closed and logged. The returned channel is
+// closed once the servers have stopped.
+func watchShutdown(s *smtp.Server, bkd *Backend, timeout time.Duration, httpServers ...*http.Server) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		logInfo("Received %v, shutting down (timeout %v)", sig, timeout)
+
+		// Sessions waiting for MAX_INFLIGHT_BYTES would hold up the shutdown
+		bkd.inflight.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, srv := range httpServers {
+			wg.Add(1)
+			go func(srv *http.Server) {
+				defer wg.Done()
+				if err := srv.Shutdown(ctx); err != nil {
+					logWarn("HTTP server on %s not stopped gracefully (%v), closing it", srv.Addr, err)
+					srv.Close()
+				}
+			}(srv)
+		}
+		if err := s.Shutdown(ctx); err != nil {
+			remotes := bkd.closeConns()
+			logWarn("Graceful shutdown incomplete (%v), force-closed %d sessions: %s",
+				err, len(remotes), strings.Join(remotes, ", "))
+		}
+		wg.Wait()
+	}()
+	return done
+}
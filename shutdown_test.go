@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startShutdownServer serves be like startTestServer and watches for
+// SIGTERM with timeout, returning the address and the watcher's channel
+func startShutdownServer(t *testing.T, be *Backend, timeout time.Duration) (string, <-chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := newSMTPServer(be.config, be, nil)
+	go s.Serve(wrapListener(l, be.config, be))
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String(), watchShutdown(s, be, timeout)
+}
+
+// sigterm sends SIGTERM to the test process, which watchShutdown handles
+func sigterm(t *testing.T) {
+	t.Helper()
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitShutdown waits for the watcher to report the server stopped
+func waitShutdown(t *testing.T, done <-chan struct{}) time.Duration {
+	t.Helper()
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	return time.Since(start)
+}
+
+// waitConnsForgotten waits for be to see every session closed
+func waitConnsForgotten(t *testing.T, be *Backend) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		be.mu.Lock()
+		open := len(be.connRecipients)
+		be.mu.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still open", open)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShutdownForceClosesSlowSession(t *testing.T) {
+	logs := captureLog(t)
+	relay := newBlockingRelay()
+	t.Cleanup(func() { close(relay.release) })
+	be := newTestBackend(t, testConfig(t, nil), relay)
+	addr, done := startShutdownServer(t, be, 200*time.Millisecond)
+
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	c.expect(250, "MAIL FROM:<app@example.com>")
+	c.expect(250, "RCPT TO:<user@example.org>")
+	c.expect(354, "DATA")
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := c.text.ReadResponse(250)
+		replied <- err
+	}()
+	if err := c.text.PrintfLine("Subject: Slow\r\n\r\nHello\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	relay.waitStarted(t)
+
+	sigterm(t)
+	if elapsed := waitShutdown(t, done); elapsed < 150*time.Millisecond {
+		t.Errorf("server stopped after %v, before the 200ms timeout", elapsed)
+	}
+	select {
+	case err := <-replied:
+		if err == nil {
+			t.Error("cut-off DATA got a success reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection not closed")
+	}
+	if remote := c.conn.LocalAddr().String(); !strings.Contains(logs.String(), "force-closed 1 sessions: "+remote) {
+		t.Errorf("log does not name the cut-off session %s:\n%s", remote, logs)
+	}
+	waitConnsForgotten(t, be)
+}
+
+func TestShutdownWithoutSessions(t *testing.T) {
+	logs := captureLog(t)
+	be := newTestBackend(t, testConfig(t, nil), &fakeRelay{})
+	addr, done := startShutdownServer(t, be, 5*time.Second)
+
+	// A session closed before the signal does not hold up the shutdown
+	c := dialClient(t, addr)
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	waitConnsForgotten(t, be)
+
+	sigterm(t)
+	if elapsed := waitShutdown(t, done); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %v without open sessions", elapsed)
+	}
+	if strings.Contains(logs.String(), "force-closed") {
+		t.Errorf("sessions force-closed on a clean shutdown:\n%s", logs)
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("listener still accepting after shutdown")
+	}
+}
+
+func TestShutdownStopsHTTPServers(t *testing.T) {
+	be := newTestBackend(t, testConfig(t, nil), &fakeRelay{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest := newIngestServer(l.Addr().String(), be)
+	served := make(chan error, 1)
+	go func() { served <- ingest.Serve(l) }()
+	t.Cleanup(func() { ingest.Close() })
+	s := newSMTPServer(be.config, be, nil)
+	done := watchShutdown(s, be, 5*time.Second, ingest)
+
+	sigterm(t)
+	waitShutdown(t, done)
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Serve = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HTTP server still serving after shutdown")
+	}
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Error("HTTP listener still accepting after shutdown")
+	}
+}
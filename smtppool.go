@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// smtpConnPool keeps authenticated upstream connections open between sends.
+// Idle connections are checked with NOOP before reuse and dropped once idle
+// for longer than idleTimeout; a failed check dials a fresh one instead.
+type smtpConnPool struct {
+	dial        func(ctx context.Context) (*relayClient, error)
+	idle        chan *idleClient
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mu     sync.Mutex
+	closed bool // set by Close, after which Put quits connections
+}
+
+type idleClient struct {
+	client *relayClient
+	since  time.Time
+}
+
+// newSMTPConnPool returns nil when size is 0, which dials per message
+func newSMTPConnPool(size int, idleTimeout time.Duration, dial func(ctx context.Context) (*relayClient, error)) *smtpConnPool {
+	if size <= 0 {
+		return nil
+	}
+	return &smtpConnPool{
+		dial:        dial,
+		idle:        make(chan *idleClient, size),
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+	}
+}
+
+// Get returns a healthy idle connection, or dials a new one. The health
+// check and the dial are bounded by ctx.
+func (p *smtpConnPool) Get(ctx context.Context) (*relayClient, error) {
+	for {
+		select {
+		case ic := <-p.idle:
+			if p.idleTimeout > 0 && p.now().Sub(ic.since) > p.idleTimeout {
+				logDebug("SMTP relay connection idle for %v, closing", p.now().Sub(ic.since).Round(time.Second))
+				ic.client.Quit()
+				continue
+			}
+			unbind := ic.client.bind(ctx)
+			err := ic.client.Noop()
+			unbind()
+			if err != nil {
+				logDebug("SMTP relay connection failed health check, redialing: %v", err)
+				ic.client.Close()
+				continue
+			}
+			smtpPoolReused.Inc()
+			return ic.client, nil
+		default:
+			return p.dial(ctx)
+		}
+	}
+}
+
+// Put returns a connection after a completed transaction. It is closed
+// instead when the pool is full or closed.
+func (p *smtpConnPool) Put(c *relayClient) {
+	// Checked under the lock so a Put racing Close cannot leave a
+	// connection idle after Close drained the pool
+	p.mu.Lock()
+	if !p.closed {
+		select {
+		case p.idle <- &idleClient{client: c, since: p.now()}:
+			p.mu.Unlock()
+			return
+		default:
+		}
+	}
+	p.mu.Unlock()
+	c.Quit()
+}
+
+// Close quits every idle connection. Sends still in progress quit theirs
+// when they put them back.
+func (p *smtpConnPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case ic := <-p.idle:
+			ic.client.Quit()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SMTPRelay delivers messages to a downstream SMTP server (e.g. Amazon SES SMTP)
+type SMTPRelay struct {
+	addr     string
+	username string
+	password string
+	tlsMode  string // "starttls", "tls" or "none"
+	helo     string
+
+	// pool reuses upstream connections across sends, nil to dial per message
+	pool *smtpConnPool
+}
+
+func (r *SMTPRelay) Name() string {
+	return "smtp"
+}
+
+func (r *SMTPRelay) Send(ctx context.Context, msg *Message) (*SendResult, error) {
+	ctx, span := tracer.Start(ctx, "smtp.relay.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	result, err := r.send(ctx, msg, nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+// SendStream relays msg.Raw followed by body, copying the body to the
+// upstream DATA as it is read. If the body fails the upstream connection is
+// dropped before the final dot, so the upstream discards the partial message.
+func (r *SMTPRelay) SendStream(ctx context.Context, msg *Message, body io.Reader) (*SendResult, error) {
+	ctx, span := tracer.Start(ctx, "smtp.relay.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	result, err := r.send(ctx, msg, body)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+func (r *SMTPRelay) send(ctx context.Context, msg *Message, body io.Reader) (*SendResult, error) {
+	var c *relayClient
+	var err error
+	if r.pool != nil {
+		c, err = r.pool.Get(ctx)
+	} else {
+		c, err = r.connect(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Only a connection that completed the transaction goes back to the
+	// pool, any other is closed
+	done := false
+	defer func() {
+		if !done {
+			c.Close()
+		}
+	}()
+	unbind := c.bind(ctx)
+	defer unbind()
+
+	from := strings.Trim(msg.From, "<>")
+	to := make([]string, 0, len(msg.To))
+	for _, recipient := range msg.To {
+		to = append(to, strings.Trim(recipient, "<>"))
+	}
+
+	// Internationalized addresses need SMTPUTF8 on the upstream hop too.
+	// DSN parameters are passed on, go-smtp drops them when the upstream
+	// does not advertise DSN.
+	mailOpts := &smtp.MailOptions{UTF8: msg.UTF8}
+	if msg.DSN != nil {
+		mailOpts.EnvelopeID = msg.DSN.EnvelopeID
+		mailOpts.Return = msg.DSN.Return
+	}
+	if err := c.Mail(from, mailOpts); err != nil {
+		return nil, fmt.Errorf("smtp relay send error: %w", err)
+	}
+	for i, addr := range to {
+		var rcptOpts *smtp.RcptOptions
+		if msg.DSN != nil && msg.DSN.Notify[msg.To[i]] != nil {
+			rcptOpts = &smtp.RcptOptions{Notify: msg.DSN.Notify[msg.To[i]]}
+		}
+		if err := c.Rcpt(addr, rcptOpts); err != nil {
+			return nil, fmt.Errorf("smtp relay send error: %w", err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return nil, fmt.Errorf("smtp relay send error: %w", err)
+	}
+	if _, err := w.Write(msg.Raw); err != nil {
+		return nil, fmt.Errorf("smtp relay send error: %w", err)
+	}
+	if body != nil {
+		if _, err := io.Copy(w, body); err != nil {
+			return nil, fmt.Errorf("smtp relay send error: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("smtp relay send error: %w", err)
+	}
+
+	done = true
+	unbind()
+	if r.pool != nil {
+		r.pool.Put(c)
+	} else if err := c.Quit(); err != nil {
+		logDebug("SMTP relay QUIT failed: %v", err)
+	}
+
+	logDebug("SMTP relay accepted message: addr=%s recipients=%d", r.addr, len(to))
+	return &SendResult{StatusCode: 250}, nil
+}
+
+// connect dials the upstream and authenticates
+func (r *SMTPRelay) connect(ctx context.Context) (*relayClient, error) {
+	c, err := r.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("smtp relay connect error: %w", err)
+	}
+	if r.username != "" {
+		unbind := c.bind(ctx)
+		err := c.Auth(sasl.NewPlainClient("", r.username, r.password))
+		unbind()
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("smtp relay auth error: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (r *SMTPRelay) dial(ctx context.Context) (*relayClient, error) {
+	host, _, err := net.SplitHostPort(r.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := net.Dialer{Timeout: smtpDialTimeout}
+	raw, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &ctxConn{Conn: raw}
+	unbind := conn.bind(ctx)
+	defer unbind()
+
+	switch r.tlsMode {
+	case "tls":
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return r.hello(&relayClient{Client: smtp.NewClient(tlsConn), conn: conn})
+	case "none":
+		return r.hello(&relayClient{Client: smtp.NewClient(conn), conn: conn})
+	default:
+		// go-smtp greets the server itself before upgrading, so the
+		// EHLO name can't be customized on the STARTTLS path
+		c, err := smtp.NewClientStartTLS(conn, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &relayClient{Client: c, conn: conn}, nil
+	}
+}
+
+func (r *SMTPRelay) hello(c *relayClient) (*relayClient, error) {
+	if err := c.Hello(r.helo); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// smtpDialTimeout bounds connecting to the upstream when the send itself has
+// no deadline, as go-smtp's own Dial does
+const smtpDialTimeout = 30 * time.Second
+
+// relayClient is an upstream connection along with the conn under it, whose
+// deadlines follow the send using it
+type relayClient struct {
+	*smtp.Client
+	conn *ctxConn
+}
+
+// bind ties c to ctx until the returned func is called
+func (c *relayClient) bind(ctx context.Context) func() {
+	return c.conn.bind(ctx)
+}
+
+// ctxConn caps the deadlines go-smtp sets before each command at the
+// deadline of the bound context, and is closed if that context is canceled,
+// so a stalled upstream cannot outlast the send
+type ctxConn struct {
+	net.Conn
+
+	mu    sync.Mutex
+	limit time.Time
+}
+
+// bind applies ctx's deadline and cancellation to c until the returned func
+// is called
+func (c *ctxConn) bind(ctx context.Context) func() {
+	deadline, _ := ctx.Deadline()
+	c.mu.Lock()
+	c.limit = deadline
+	c.mu.Unlock()
+	c.Conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() { c.Conn.Close() })
+	return func() {
+		stop()
+		c.mu.Lock()
+		c.limit = time.Time{}
+		c.mu.Unlock()
+	}
+}
+
+func (c *ctxConn) capped(t time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.limit.IsZero() && (t.IsZero() || t.After(c.limit)) {
+		return c.limit
+	}
+	return t
+}
+
+func (c *ctxConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.capped(t))
+}
+
+func (c *ctxConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.capped(t))
+}
+
+func (c *ctxConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.capped(t))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSMTPRelaySend(t *testing.T) {
+	sink := newSMTPSink(t)
+	relay := &SMTPRelay{addr: sink.addr, tlsMode: "none", helo: "relay.test"}
+
+	raw := "From: app@example.com\r\nTo: user@example.org\r\nSubject: Hi\r\n\r\nHello\r\n"
+	result, err := relay.Send(context.Background(), &Message{
+		From: "app@example.com",
+		To:   []string{"<user@example.org>", "other@example.org"},
+		Raw:  []byte(raw),
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if result.StatusCode != 250 {
+		t.Errorf("StatusCode = %d, want 250", result.StatusCode)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.From != "app@example.com" {
+		t.Errorf("MAIL FROM = %q", got.From)
+	}
+	if strings.Join(got.To, ",") != "user@example.org,other@example.org" {
+		t.Errorf("RCPT TO = %v", got.To)
+	}
+	if string(got.Data) != raw {
+		t.Errorf("DATA = %q, want %q", got.Data, raw)
+	}
+}
+
+func TestSMTPRelayAuth(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	msg := &Message{From: "app@example.com", To: []string{"user@example.org"}, Raw: []byte("Subject: Hi\r\n\r\nHello\r\n")}
+
+	relay := &SMTPRelay{addr: sink.addr, tlsMode: "none", helo: "relay.test", username: "relay", password: "secret"}
+	if _, err := relay.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send with valid credentials: %v", err)
+	}
+	if got := sink.Messages(); len(got) != 1 || got[0].AuthUser != "relay" {
+		t.Fatalf("sink messages = %+v, want one authenticated as relay", got)
+	}
+
+	relay.password = "wrong"
+	if _, err := relay.Send(context.Background(), msg); err == nil || !strings.Contains(err.Error(), "auth") {
+		t.Errorf("Send with wrong password: err = %v, want an auth error", err)
+	}
+}
+
+func TestSMTPRelayUnreachable(t *testing.T) {
+	relay := &SMTPRelay{addr: "127.0.0.1:1", tlsMode: "none"}
+	_, err := relay.Send(context.Background(), &Message{From: "a@example.com", To: []string{"b@example.com"}})
+	if err == nil {
+		t.Fatal("Send to a closed port succeeded")
+	}
+	if !isTemporary(err) {
+		t.Errorf("connect error %v is not temporary", err)
+	}
+}
+
+// stalledUpstream accepts connections and never greets
+func stalledUpstream(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSMTPRelayStalledUpstream(t *testing.T) {
+	relay := &SMTPRelay{addr: stalledUpstream(t), tlsMode: "none", helo: "relay.test"}
+	msg := &Message{From: "a@example.com", To: []string{"b@example.com"}, Raw: []byte("Subject: Hi\r\n\r\nHello\r\n")}
+
+	// The send's deadline bounds the upstream conversation
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := relay.Send(ctx, msg); err == nil {
+		t.Fatal("Send to a silent upstream succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send returned after %v, past its 100ms deadline", elapsed)
+	}
+
+	// So does canceling it
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := relay.Send(ctx, msg); err == nil {
+		t.Fatal("canceled Send succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Send returned %v after it was canceled", elapsed)
+	}
+}
+
+func TestNewRelayBackend(t *testing.T) {
+	config := testConfig(t, map[string]string{"BACKEND": "smtp", "SMTP_RELAY_ADDR": "mail.example.com:587"})
+	relay, err := newRelay(config)
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	smtpRelay, ok := relay.(*SMTPRelay)
+	if !ok {
+		t.Fatalf("newRelay returned %T, want *SMTPRelay", relay)
+	}
+	if smtpRelay.addr != "mail.example.com:587" || smtpRelay.Name() != "smtp" {
+		t.Errorf("relay = %+v", smtpRelay)
+	}
+
+	if relay, err := newRelay(testConfig(t, map[string]string{"BACKEND": "sendgrid"})); err != nil || relay.Name() != "sendgrid" {
+		t.Errorf("sendgrid backend: relay=%v err=%v", relay, err)
+	}
+}
+
+func TestLoadConfigSMTPBackendRequiresAddr(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"BACKEND": "smtp"}); err == nil {
+		t.Error("BACKEND=smtp without SMTP_RELAY_ADDR was accepted")
+	}
+	if _, err := tryConfig(t, map[string]string{"BACKEND": "carrier-pigeon"}); err == nil {
+		t.Error("unknown BACKEND was accepted")
+	}
+}
+
+func TestSMTPRelayForwardsSMTPUTF8(t *testing.T) {
+	sink := newSMTPSink(t)
+	relay := &SMTPRelay{addr: sink.addr, tlsMode: "none", helo: "relay.test"}
+	_, err := relay.Send(context.Background(), &Message{
+		From: "remitente@contacloud.mx",
+		To:   []string{"用户@例え.jp"},
+		Raw:  []byte("Subject: Hola\r\n\r\nHola\r\n"),
+		UTF8: true,
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got := sink.Messages()
+	if len(got) != 1 || got[0].To[0] != "用户@例え.jp" || !got[0].Mail.UTF8 {
+		t.Errorf("sink got %+v, want the address with SMTPUTF8", got)
+	}
+}
+
+// newPooledRelay returns the smtp backend for sink with a connection pool
+func newPooledRelay(t *testing.T, sink *smtpSink, idleTimeout string) *SMTPRelay {
+	t.Helper()
+	relay, err := newRelay(testConfig(t, map[string]string{
+		"BACKEND": "smtp", "SMTP_RELAY_ADDR": sink.addr, "SMTP_RELAY_TLS": "none",
+		"SMTP_RELAY_USERNAME": "relay", "SMTP_RELAY_PASSWORD": "secret",
+		"SMTP_RELAY_POOL_SIZE": "2", "SMTP_RELAY_POOL_IDLE_TIMEOUT": idleTimeout,
+	}))
+	if err != nil {
+		t.Fatalf("newRelay: %v", err)
+	}
+	smtpRelay := relay.(*SMTPRelay)
+	t.Cleanup(smtpRelay.pool.Close)
+	return smtpRelay
+}
+
+func pooledSend(t *testing.T, relay *SMTPRelay, to string) error {
+	t.Helper()
+	_, err := relay.Send(context.Background(), &Message{
+		From: "app@example.com",
+		To:   []string{to},
+		Raw:  []byte("Subject: Hi\r\n\r\nHello\r\n"),
+	})
+	return err
+}
+
+func TestSMTPRelayPoolReusesConnection(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	relay := newPooledRelay(t, sink, "30s")
+
+	reused := testutil.ToFloat64(smtpPoolReused)
+	for i := 0; i < 3; i++ {
+		if err := pooledSend(t, relay, "user@example.org"); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if got := len(sink.Messages()); got != 3 {
+		t.Fatalf("sink got %d messages, want 3", got)
+	}
+	if got := sink.Sessions(); got != 1 {
+		t.Errorf("upstream saw %d connections for 3 sends, want 1", got)
+	}
+	if got := testutil.ToFloat64(smtpPoolReused) - reused; got != 2 {
+		t.Errorf("upstream_connections_reused_total grew by %v, want 2", got)
+	}
+	for _, msg := range sink.Messages() {
+		if msg.AuthUser != "relay" {
+			t.Errorf("message sent on a connection authenticated as %q", msg.AuthUser)
+		}
+	}
+}
+
+func TestSMTPRelayPoolRedialsAfterClose(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	sink.rejectRcpt = "gone@example.org"
+	relay := newPooledRelay(t, sink, "30s")
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+
+	// The pooled connection fails its health check and a new one is dialed
+	sink.CloseConns()
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatalf("send after the upstream closed the connection: %v", err)
+	}
+	if got := sink.Sessions(); got != 2 {
+		t.Errorf("upstream saw %d connections, want a redial", got)
+	}
+
+	// A connection whose transaction failed is not kept
+	if err := pooledSend(t, relay, "gone@example.org"); smtpCode(err) != 550 {
+		t.Fatalf("send to a rejected recipient: err = %v, want a 550", err)
+	}
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatalf("send after a failed one: %v", err)
+	}
+	if got := sink.Sessions(); got != 3 {
+		t.Errorf("upstream saw %d connections, want the failed one replaced", got)
+	}
+	if got := len(sink.Messages()); got != 3 {
+		t.Errorf("sink got %d messages, want 3", got)
+	}
+}
+
+func TestSMTPRelayPoolOutlivesSendDeadline(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	relay := newPooledRelay(t, sink, "30s")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := relay.Send(ctx, &Message{From: "app@example.com", To: []string{"user@example.org"}, Raw: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	if err != nil {
+		t.Fatalf("send with a deadline: %v", err)
+	}
+	<-ctx.Done()
+
+	// The pooled connection is not bound to the finished send
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatalf("send after the first one's context ended: %v", err)
+	}
+	if got := sink.Sessions(); got != 1 {
+		t.Errorf("upstream saw %d connections, want the first one reused", got)
+	}
+}
+
+func TestSMTPRelayPoolIdleTimeout(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	relay := newPooledRelay(t, sink, "30s")
+	now := time.Now()
+	relay.pool.now = func() time.Time { return now }
+
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(31 * time.Second)
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.Sessions(); got != 2 {
+		t.Errorf("upstream saw %d connections, want the idle one replaced", got)
+	}
+
+	if newSMTPConnPool(0, time.Second, nil) != nil {
+		t.Error("SMTP_RELAY_POOL_SIZE=0 did not disable the pool")
+	}
+}
+
+func TestSMTPRelayPoolClosed(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.username, sink.password = "relay", "secret"
+	relay := newPooledRelay(t, sink, "30s")
+	if err := pooledSend(t, relay, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A send in progress at Close quits its connection when done instead
+	// of leaving it idle
+	c, err := relay.pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.pool.Close()
+	relay.pool.Put(c)
+	if got := len(relay.pool.idle); got != 0 {
+		t.Errorf("%d idle connections after Close, want 0", got)
+	}
+	if err := c.Noop(); err == nil {
+		t.Error("connection put back after Close is still open")
+	}
+}
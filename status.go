@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deliveryStatus tracks the outcome of the most recent deliveries so
+// operators can tell whether mail is flowing
+type deliveryStatus struct {
+	mu          sync.Mutex
+	lastSuccess *statusEvent
+	lastError   *statusEvent
+}
+
+type statusEvent struct {
+	Time      time.Time `json:"time"`
+	MessageID string    `json:"message_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var relayStatus = &deliveryStatus{}
+
+func (s *deliveryStatus) RecordSuccess(messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = &statusEvent{Time: time.Now().UTC(), MessageID: messageID}
+}
+
+func (s *deliveryStatus) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = &statusEvent{Time: time.Now().UTC(), Error: err.Error()}
+}
+
+// statusHandler renders the delivery status as JSON
+func statusHandler(backend string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relayStatus.mu.Lock()
+		body := struct {
+			Backend     string       `json:"backend"`
+			LastSuccess *statusEvent `json:"last_success"`
+			LastError   *statusEvent `json:"last_error"`
+		}{backend, relayStatus.lastSuccess, relayStatus.lastError}
+		relayStatus.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// getStatus renders /status
+func getStatus(t *testing.T) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statusHandler("fake").ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status is not JSON: %v\n%s", err, rec.Body)
+	}
+	return body
+}
+
+func TestStatusReflectsDeliveries(t *testing.T) {
+	saved := relayStatus
+	relayStatus = &deliveryStatus{}
+	t.Cleanup(func() { relayStatus = saved })
+
+	body := getStatus(t)
+	if body["backend"] != "fake" || body["last_success"] != nil || body["last_error"] != nil {
+		t.Errorf("initial status = %v", body)
+	}
+
+	relay := &fakeRelay{result: &SendResult{MessageID: "msg-1"}}
+	be := newTestBackend(t, testConfig(t, nil), relay)
+	msg := &Message{ID: "id-1", From: "app@example.com", To: []string{"user@example.org"}}
+	if err := be.deliver(&sendJob{ctx: context.Background(), msg: msg}); err != nil {
+		t.Fatal(err)
+	}
+	body = getStatus(t)
+	if jsonPath(body, "last_success", "message_id") != "msg-1" || jsonPath(body, "last_success", "time") == nil {
+		t.Errorf("after a success: %v", body)
+	}
+	if body["last_error"] != nil {
+		t.Errorf("last_error = %v before any failure", body["last_error"])
+	}
+
+	relay.err = &StatusError{Service: "fake", StatusCode: 400, Body: "bad request"}
+	if err := be.deliver(&sendJob{ctx: context.Background(), msg: msg}); err == nil {
+		t.Fatal("deliver succeeded")
+	}
+	body = getStatus(t)
+	if jsonPath(body, "last_error", "error") != "fake returned status 400: bad request" {
+		t.Errorf("after a failure: %v", body)
+	}
+	if jsonPath(body, "last_success", "message_id") != "msg-1" {
+		t.Errorf("the failure replaced the last success: %v", body)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// streamRelay reports whether the body of the current message can be passed
+// to the backend while it is still being received instead of buffered. That
+// needs a StreamRelay and nothing that must see the whole message first: a
+// DKIM signature, the send queue, retries or a dead-letter copy.
+func (s *Session) streamRelay() bool {
+	if _, ok := s.backend.relay.(StreamRelay); !ok {
+		return false
+	}
+	return s.backend.dkim == nil && s.backend.pool == nil &&
+		s.config.SendRetries == 0 && s.config.DeadLetterDir == ""
+}
+
+// readHeaderBlock reads the header block of a message, including the blank
+// line ending it, and returns a reader for the rest. Reading stops once the
+// block exceeds max bytes (when max > 0) so checkHeaderLimits can reject it
+// without the body being read. body is nil when r ended within the header,
+// in which case header is the whole message.
+func readHeaderBlock(r io.Reader, max int) (header []byte, body io.Reader, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		header = append(header, line...)
+		if errors.Is(err, io.EOF) {
+			return header, nil, nil
+		}
+		if err != nil {
+			return header, nil, err
+		}
+		if bytes.Equal(line, []byte("\r\n")) || bytes.Equal(line, []byte("\n")) {
+			return header, br, nil
+		}
+		if max > 0 && len(header) > max {
+			return header, br, nil
+		}
+	}
+}
+
+// countingReader counts the bytes streamed through it and keeps the read
+// error, telling a client failure apart from a backend one
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
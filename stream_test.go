@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// lineReader yields n identical lines without holding them in memory
+type lineReader struct {
+	n, pos int
+}
+
+const streamTestLine = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcd\r\n"
+
+func (r *lineReader) Read(b []byte) (int, error) {
+	total := r.n * len(streamTestLine)
+	if r.pos >= total {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(b) && r.pos < total {
+		c := copy(b[n:], streamTestLine[r.pos%len(streamTestLine):])
+		if r.pos+c > total {
+			c = total - r.pos
+		}
+		n += c
+		r.pos += c
+	}
+	return n, nil
+}
+
+// hashingSink is an upstream SMTP server that hashes each message instead
+// of keeping it
+type hashingSink struct {
+	addr string
+
+	mu    sync.Mutex
+	sums  [][]byte
+	sizes []int64
+}
+
+func newHashingSink(t *testing.T) *hashingSink {
+	t.Helper()
+	sink := &hashingSink{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(sink)
+	s.Domain = "sink.test"
+	sink.addr = l.Addr().String()
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return sink
+}
+
+func (sink *hashingSink) NewSession(*smtp.Conn) (smtp.Session, error) {
+	return &hashingSession{sink: sink}, nil
+}
+
+type hashingSession struct{ sink *hashingSink }
+
+func (s *hashingSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (s *hashingSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (s *hashingSession) Reset()                               {}
+func (s *hashingSession) Logout() error                        { return nil }
+
+func (s *hashingSession) Data(r io.Reader) error {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	s.sink.mu.Lock()
+	s.sink.sums = append(s.sink.sums, h.Sum(nil))
+	s.sink.sizes = append(s.sink.sizes, n)
+	s.sink.mu.Unlock()
+	return nil
+}
+
+func TestSMTPBackendStreamsLargeMessage(t *testing.T) {
+	sink := newHashingSink(t)
+	config := testConfig(t, map[string]string{
+		"BACKEND": "smtp", "SMTP_RELAY_ADDR": sink.addr, "SMTP_RELAY_TLS": "none",
+		"MAX_MESSAGE_BYTES": "67108864",
+	})
+	relay, err := newRelay(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := newTestBackend(t, config, relay)
+	s := newTestSession(be)
+	if !s.streamRelay() {
+		t.Fatal("SMTP backend does not stream")
+	}
+
+	// A 32 MB body, generated and hashed on the fly
+	const lines = 32 << 20 / len(streamTestLine)
+	header := "From: app@example.com\r\nTo: user@example.org\r\nSubject: Big\r\n\r\n"
+	want := sha256.New()
+	io.Copy(want, io.MultiReader(strings.NewReader(header), &lineReader{n: lines}))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("user@example.org", &smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Data(io.MultiReader(strings.NewReader(header), &lineReader{n: lines})); err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.sums) != 1 || !bytes.Equal(sink.sums[0], want.Sum(nil)) {
+		t.Fatalf("upstream got %d messages (sizes %v), want the exact 32 MB message", len(sink.sums), sink.sizes)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+		t.Errorf("relaying 32 MB allocated %d MB, want it streamed", allocated>>20)
+	}
+}
+
+func TestStreamRelayConditions(t *testing.T) {
+	smtpRelay := &SMTPRelay{}
+	tests := []struct {
+		name  string
+		relay Relay
+		env   map[string]string
+		want  bool
+	}{
+		{"smtp backend", smtpRelay, nil, true},
+		{"no stream support", &fakeRelay{}, nil, false},
+		{"send queue", smtpRelay, map[string]string{"SEND_WORKERS": "1"}, false},
+		{"retries", smtpRelay, map[string]string{"SEND_RETRIES": "1"}, false},
+		{"dead letters", smtpRelay, map[string]string{"DEAD_LETTER_DIR": "/tmp"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			be := newTestBackend(t, testConfig(t, tt.env), tt.relay)
+			if got := newTestSession(be).streamRelay(); got != tt.want {
+				t.Errorf("streamRelay = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHeaderBlock(t *testing.T) {
+	header, body, err := readHeaderBlock(strings.NewReader("Subject: Hi\r\nFrom: a@example.com\r\n\r\nBody\r\n"), 0)
+	if err != nil || string(header) != "Subject: Hi\r\nFrom: a@example.com\r\n\r\n" {
+		t.Fatalf("header = %q, %v", header, err)
+	}
+	if rest, _ := io.ReadAll(body); string(rest) != "Body\r\n" {
+		t.Errorf("body = %q", rest)
+	}
+
+	// A message without a body
+	header, body, err = readHeaderBlock(strings.NewReader("Subject: Hi\r\n"), 0)
+	if err != nil || body != nil || string(header) != "Subject: Hi\r\n" {
+		t.Errorf("header-only = %q, %v, %v", header, body, err)
+	}
+
+	// Reading stops past max, leaving the rest unread
+	long := "X-Long: " + strings.Repeat("a", 100) + "\r\n"
+	header, body, _ = readHeaderBlock(strings.NewReader(long+long+long+"\r\nBody\r\n"), 150)
+	if len(header) != 2*len(long) || body == nil {
+		t.Errorf("bounded header = %d bytes, want %d", len(header), 2*len(long))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// headerStripRule removes headers from mail sent by a sender address or
+// domain, before it is signed or relayed
+type headerStripRule struct {
+	sender  string // lowercase address or domain
+	headers []string
+}
+
+// parseHeaderStripRules parses SENDER_STRIP_HEADERS, a comma-separated list
+// of sender=headers entries with space-separated header names, e.g.
+// "legal.example.com=List-Unsubscribe List-Unsubscribe-Post X-Campaign"
+func parseHeaderStripRules(value string) ([]headerStripRule, error) {
+	var rules []headerStripRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		sender, names, ok := strings.Cut(entry, "=")
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		headers := strings.Fields(names)
+		if !ok || sender == "" || len(headers) == 0 {
+			return nil, fmt.Errorf("invalid SENDER_STRIP_HEADERS entry %q (expected sender=Header Header...)", entry)
+		}
+		for i, name := range headers {
+			if strings.ContainsAny(name, ":=") {
+				return nil, fmt.Errorf("invalid SENDER_STRIP_HEADERS header %q for %s", name, sender)
+			}
+			headers[i] = textproto.CanonicalMIMEHeaderKey(name)
+		}
+		rules = append(rules, headerStripRule{sender: sender, headers: headers})
+	}
+	return rules, nil
+}
+
+// strippedHeaders returns the headers to remove from mail sent by from, the
+// union of every rule matching its address or domain
+func (c *Config) strippedHeaders(from string) []string {
+	from = strings.ToLower(strings.Trim(from, "<>"))
+	domain := addressDomain(from)
+	var headers []string
+	for _, rule := range c.SenderStripHeaders {
+		if rule.sender == from || rule.sender == domain {
+			headers = append(headers, rule.headers...)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const stripHeadersMessage = "From: app@example.com\n" +
+	"Subject: News\n" +
+	"List-Unsubscribe: <https://example.com/unsubscribe>,\n <mailto:unsubscribe@example.com>\n" +
+	"list-unsubscribe-post: List-Unsubscribe=One-Click\n" +
+	"X-Campaign: spring\n" +
+	"\n" +
+	"Hello\n"
+
+func TestSenderStripHeaders(t *testing.T) {
+	relay := &fakeRelay{}
+	config := testConfig(t, map[string]string{
+		"SENDER_STRIP_HEADERS": "legal.example.com=List-Unsubscribe list-unsubscribe-post, counsel@example.com=X-Campaign",
+	})
+	s := newTestSession(newTestBackend(t, config, relay))
+	to := []string{"user@example.org"}
+	for _, from := range []string{"notices@legal.example.com", "Counsel@example.com", "app@example.com"} {
+		if err := sendTestMessage(s, from, to, stripHeadersMessage); err != nil {
+			t.Fatalf("send from %s: %v", from, err)
+		}
+	}
+
+	messages := relay.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("relayed %d messages, want 3", len(messages))
+	}
+	tests := []struct {
+		name     string
+		stripped []string
+		kept     []string
+	}{
+		{"domain rule", []string{"List-Unsubscribe", "List-Unsubscribe-Post"}, []string{"X-Campaign"}},
+		{"address rule", []string{"X-Campaign"}, []string{"List-Unsubscribe", "List-Unsubscribe-Post"}},
+		{"no rule", nil, []string{"List-Unsubscribe", "List-Unsubscribe-Post", "X-Campaign"}},
+	}
+	for i, tt := range tests {
+		msg := messages[i]
+		raw := strings.ToLower(string(msg.Raw))
+		for _, name := range tt.stripped {
+			if msg.Header.Get(name) != "" || strings.Contains(raw, strings.ToLower(name)+":") {
+				t.Errorf("%s: %s was not stripped:\n%s", tt.name, name, msg.Raw)
+			}
+		}
+		for _, name := range tt.kept {
+			if msg.Header.Get(name) == "" || !strings.Contains(raw, strings.ToLower(name)+":") {
+				t.Errorf("%s: %s was stripped:\n%s", tt.name, name, msg.Raw)
+			}
+		}
+		// Folded continuation lines go with their header
+		if strings.Contains(raw, "mailto:unsubscribe") != (tt.name != "domain rule") {
+			t.Errorf("%s: List-Unsubscribe continuation line handled wrong:\n%s", tt.name, msg.Raw)
+		}
+		if !strings.Contains(raw, "subject: news") || !strings.HasSuffix(raw, "\r\n\r\nhello\r\n") {
+			t.Errorf("%s: rest of the message changed:\n%s", tt.name, msg.Raw)
+		}
+	}
+}
+
+func TestStrippedHeadersUnion(t *testing.T) {
+	config := testConfig(t, map[string]string{
+		"CONFIG_FILE": writeConfigFile(t, `{"SENDER_STRIP_HEADERS": {"example.com": "X-Campaign", "app@example.com": "list-unsubscribe"}}`),
+	})
+	if got := strings.Join(config.strippedHeaders("<App@Example.com>"), " "); got != "List-Unsubscribe X-Campaign" && got != "X-Campaign List-Unsubscribe" {
+		t.Errorf("strippedHeaders = %q, want both rules", got)
+	}
+	// A domain rule does not cover subdomains
+	if got := config.strippedHeaders("app@mail.example.com"); got != nil {
+		t.Errorf("subdomain sender strips %v", got)
+	}
+}
+
+func TestParseHeaderStripRulesErrors(t *testing.T) {
+	for _, value := range []string{"legal.example.com", "legal.example.com=", "=X-Campaign", "legal.example.com=X-Campaign:"} {
+		if _, err := parseHeaderStripRules(value); err == nil || !strings.Contains(err.Error(), "SENDER_STRIP_HEADERS") {
+			t.Errorf("parseHeaderStripRules(%q) err = %v", value, err)
+		}
+	}
+}
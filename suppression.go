@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// suppression records why an address stopped receiving mail
+type suppression struct {
+	Event     string    `json:"event"` // bounce, spamreport or dropped
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// suppressionList holds recipients that bounced or complained. With a path
+// it is persisted as JSON, rewritten on every change, so it survives
+// restarts.
+type suppressionList struct {
+	mu      sync.RWMutex
+	path    string
+	entries map[string]suppression
+}
+
+// newSuppressionList loads path if it exists; an empty path keeps the list
+// in memory only
+func newSuppressionList(path string) (*suppressionList, error) {
+	l := &suppressionList{path: path, entries: make(map[string]suppression)}
+	if path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SUPPRESSION_FILE: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, fmt.Errorf("invalid SUPPRESSION_FILE %s: %w", path, err)
+	}
+	// A file holding null unmarshals to a nil map
+	if l.entries == nil {
+		l.entries = make(map[string]suppression)
+	}
+	return l, nil
+}
+
+// Lookup reports whether addr is suppressed
+func (l *suppressionList) Lookup(addr string) (suppression, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[normalizeSuppressed(addr)]
+	return entry, ok
+}
+
+// Add suppresses each address in entries and persists the list. Addresses
+// already present keep their original entry. The new entries only take
+// effect once saved, so a failed save leaves the list as it was on disk and
+// the caller can retry.
+func (l *suppressionList) Add(entries map[string]suppression) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := maps.Clone(l.entries)
+	var added []string
+	for addr, entry := range entries {
+		addr = normalizeSuppressed(addr)
+		if _, ok := next[addr]; ok || addr == "" {
+			continue
+		}
+		next[addr] = entry
+		added = append(added, addr)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if l.path != "" {
+		if err := saveSuppressions(l.path, next); err != nil {
+			return err
+		}
+	}
+	l.entries = next
+	for _, addr := range added {
+		logInfo("Suppressed %s after %s event", addr, next[addr].Event)
+	}
+	return nil
+}
+
+// Len returns the number of suppressed addresses
+func (l *suppressionList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// saveSuppressions writes entries to a temp file and renames it over path,
+// so a crash never leaves a truncated file
+func saveSuppressions(path string, entries map[string]suppression) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".suppressions-*")
+	if err != nil {
+		return fmt.Errorf("failed to write suppression file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write suppression file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write suppression file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write suppression file: %w", err)
+	}
+	return nil
+}
+
+func normalizeSuppressed(addr string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuppressionListPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressions.json")
+	list, err := newSuppressionList(path)
+	if err != nil {
+		t.Fatalf("newSuppressionList: %v", err)
+	}
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := list.Add(map[string]suppression{"<User@Example.org>": {Event: "bounce", Reason: "no such user", CreatedAt: created}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// Later events for the same address keep the first entry
+	if err := list.Add(map[string]suppression{"user@example.org": {Event: "spamreport", CreatedAt: created.Add(time.Hour)}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	reloaded, err := newSuppressionList(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	entry, ok := reloaded.Lookup("user@EXAMPLE.org")
+	if !ok || entry.Event != "bounce" || entry.Reason != "no such user" || !entry.CreatedAt.Equal(created) {
+		t.Errorf("reloaded entry = %+v, %v", entry, ok)
+	}
+	if reloaded.Len() != 1 {
+		t.Errorf("reloaded %d entries, want 1", reloaded.Len())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".suppressions-*")); len(matches) != 0 {
+		t.Errorf("temp files left: %v", matches)
+	}
+}
+
+func TestSuppressionListMissingFile(t *testing.T) {
+	list, err := newSuppressionList(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil || list.Len() != 0 {
+		t.Errorf("missing file = %v, %v, want an empty list", list, err)
+	}
+}
+
+func TestSuppressionListNullFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressions.json")
+	if err := os.WriteFile(path, []byte("null\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := newSuppressionList(path)
+	if err != nil {
+		t.Fatalf("newSuppressionList: %v", err)
+	}
+	if err := list.Add(map[string]suppression{"user@example.org": {Event: "bounce"}}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, ok := list.Lookup("user@example.org"); !ok {
+		t.Error("address not suppressed")
+	}
+}
+
+func TestSuppressionListFailedSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gone")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	list, err := newSuppressionList(filepath.Join(dir, "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is suppressed until it is on disk
+	if err := list.Add(map[string]suppression{"user@example.org": {Event: "bounce"}}); err == nil {
+		t.Fatal("Add succeeded without a directory to save to")
+	}
+	if _, ok := list.Lookup("user@example.org"); ok || list.Len() != 0 {
+		t.Error("entry kept after a failed save")
+	}
+
+	// A retry once the file can be written saves the entry
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Add(map[string]suppression{"user@example.org": {Event: "bounce"}}); err != nil {
+		t.Fatalf("retried Add: %v", err)
+	}
+	reloaded, err := newSuppressionList(filepath.Join(dir, "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Lookup("user@example.org"); !ok {
+		t.Error("retried entry not saved")
+	}
+}
+
+func TestSuppressionListInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressions.json")
+	if err := os.WriteFile(path, []byte("[not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSuppressionList(path); err == nil || !strings.Contains(err.Error(), "invalid SUPPRESSION_FILE") {
+		t.Errorf("err = %v, want an invalid SUPPRESSION_FILE error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadTLSConfig builds the STARTTLS configuration from config.
+// It returns nil when TLS is not configured.
+func loadTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		if config.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   config.TLSMinVersion,
+		CipherSuites: config.TLSCipherSuites,
+	}
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE %s", config.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// logTLSConnection logs the negotiated TLS version and cipher suite of an
+// encrypted connection, to audit clients still on old protocol versions
+func logTLSConnection(remoteAddr string, state tls.ConnectionState) {
+	if len(state.VerifiedChains) > 0 {
+		logInfo("TLS connection from %s: version=%s cipher=%s client_cn=%q",
+			remoteAddr, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.PeerCertificates[0].Subject.CommonName)
+		return
+	}
+	logInfo("TLS connection from %s: version=%s cipher=%s",
+		remoteAddr, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+// tlsVersions maps TLS_MIN_VERSION values to the tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses TLS_MIN_VERSION, e.g. "1.2" or "TLS1.2"
+func parseTLSVersion(value string) (uint16, error) {
+	v := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "TLS")
+	version, ok := tlsVersions[strings.TrimSpace(v)]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS_MIN_VERSION %q (expected 1.0, 1.1, 1.2 or 1.3)", value)
+	}
+	return version, nil
+}
+
+// parseCipherSuites parses TLS_CIPHERS, a comma-separated list of Go cipher
+// suite names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites Go
+// considers insecure are refused, and TLS 1.3 suites are not configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	secure := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		suite, ok := secure[strings.ToUpper(name)]
+		switch {
+		case insecure[strings.ToUpper(name)]:
+			return nil, fmt.Errorf("invalid TLS_CIPHERS %q: cipher suite is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("invalid TLS_CIPHERS %q: unknown cipher suite", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("invalid TLS_CIPHERS %q: TLS 1.3 cipher suites are not configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
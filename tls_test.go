@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestLogTLSConnection(t *testing.T) {
+	logs := captureLog(t)
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, newTestBackend(t, config, &fakeRelay{}), tlsConfig)
+
+	c, err := smtp.DialStartTLS(addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	defer c.Close()
+	// The session after the handshake is started by the first command
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := c.TLSConnectionState()
+	want := "version=TLS 1.2 cipher=" + tls.CipherSuiteName(state.CipherSuite)
+	if !strings.Contains(logs.String(), "[INFO] TLS connection from 127.0.0.1:") || !strings.Contains(logs.String(), want) {
+		t.Errorf("log does not mention the TLS connection with %q:\n%s", want, logs)
+	}
+}
+
+// startMTLSServer serves SMTP with STARTTLS requiring client certificates
+// signed by ca, and returns its address
+func startMTLSServer(t *testing.T, ca *testCA, allowedCNs string) string {
+	t.Helper()
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t, map[string]string{
+		"TLS_CERT_FILE":          certFile,
+		"TLS_KEY_FILE":           keyFile,
+		"TLS_CLIENT_CA_FILE":     caFile,
+		"TLS_CLIENT_ALLOWED_CNS": allowedCNs,
+	})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("ClientAuth = %v, want RequireAndVerifyClientCert", tlsConfig.ClientAuth)
+	}
+	return startTestServer(t, newTestBackend(t, config, &fakeRelay{}), tlsConfig)
+}
+
+// dialMTLS runs STARTTLS presenting cert and then MAIL FROM, returning the
+// first error
+func dialMTLS(t *testing.T, addr string, ca *testCA, cert *tls.Certificate) error {
+	t.Helper()
+	tlsConfig := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	c, err := smtp.DialStartTLS(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Mail("app@example.com", nil)
+}
+
+func TestClientCertificateAccepted(t *testing.T) {
+	logs := captureLog(t)
+	ca := newTestCA(t)
+	addr := startMTLSServer(t, ca, "app1, app2")
+	cert := ca.issue(t, "app2")
+	if err := dialMTLS(t, addr, ca, &cert); err != nil {
+		t.Fatalf("MAIL with a trusted certificate: %v", err)
+	}
+	if !strings.Contains(logs.String(), `client_cn="app2"`) {
+		t.Errorf("log does not carry the client CN:\n%s", logs)
+	}
+}
+
+func TestClientCertificateRejected(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startMTLSServer(t, ca, "app1")
+
+	untrusted := newTestCA(t).issue(t, "app1")
+	if err := dialMTLS(t, addr, ca, &untrusted); err == nil {
+		t.Error("certificate from another CA accepted")
+	}
+	if err := dialMTLS(t, addr, ca, nil); err == nil {
+		t.Error("STARTTLS without a certificate accepted")
+	}
+
+	other := ca.issue(t, "intruder")
+	if err := dialMTLS(t, addr, ca, &other); smtpCode(err) != 550 {
+		t.Errorf("MAIL with a CN not in TLS_CLIENT_ALLOWED_CNS: err = %v, want a 550", err)
+	}
+
+	// Clients must STARTTLS before MAIL
+	c := dialSMTP(t, addr)
+	c.reply()
+	c.expect(250, "EHLO client.test")
+	if code, msg := c.cmd("MAIL FROM:<app@example.com>"); code != 530 {
+		t.Errorf("MAIL without STARTTLS got %d %s, want 530", code, msg)
+	}
+}
+
+func TestClientCAConfigErrors(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates here\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"without server certificate", Config{TLSClientCAFile: empty}, "requires TLS_CERT_FILE"},
+		{"missing file", Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: filepath.Join(t.TempDir(), "none.pem")}, "failed to read TLS_CLIENT_CA_FILE"},
+		{"no certificates", Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: empty}, "no certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadTLSConfig(&tt.config); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for value, want := range map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "TLS1.2": tls.VersionTLS12, " tls 1.3 ": tls.VersionTLS13} {
+		if got, err := parseTLSVersion(value); err != nil || got != want {
+			t.Errorf("parseTLSVersion(%q) = %x, %v, want %x", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"1.4", "SSL3", "", "12"} {
+		if _, err := parseTLSVersion(value); err == nil {
+			t.Errorf("parseTLSVersion(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256"})
+	if err != nil {
+		t.Fatalf("parseCipherSuites: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || ids[1] != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Errorf("ids = %x", ids)
+	}
+	for name, want := range map[string]string{
+		"TLS_RSA_WITH_RC4_128_SHA": "insecure",
+		"TLS_MADE_UP":              "unknown",
+		"TLS_AES_128_GCM_SHA256":   "TLS 1.3",
+	} {
+		if _, err := parseCipherSuites([]string{name}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCipherSuites(%s) = %v, want an error mentioning %q", name, err, want)
+		}
+	}
+}
+
+func TestTLSConfigVersionAndCiphers(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+
+	// The default is TLS 1.2
+	config := testConfig(t, map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_MIN_VERSION": "", "TLS_CIPHERS": ""})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.CipherSuites != nil {
+		t.Errorf("defaults: MinVersion = %x, CipherSuites = %x", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+
+	config = testConfig(t, map[string]string{"TLS_MIN_VERSION": "1.3", "TLS_CIPHERS": "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+	if tlsConfig, err = loadTLSConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("configured: MinVersion = %x, CipherSuites = %x", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+}
+
+func TestTLSConfigRejectsUnknownValues(t *testing.T) {
+	for key, value := range map[string]string{"TLS_MIN_VERSION": "1.4", "TLS_CIPHERS": "TLS_RSA_WITH_RC4_128_SHA"} {
+		t.Run(key, func(t *testing.T) {
+			if _, err := tryConfig(t, map[string]string{key: value}); err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("%s=%s: err = %v", key, value, err)
+			}
+		})
+	}
+}
+
+func TestOldTLSClientRefused(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	config := testConfig(t, map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_MIN_VERSION": "1.3"})
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, newTestBackend(t, config, &fakeRelay{}), tlsConfig)
+
+	if c, err := smtp.DialStartTLS(addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12}); err == nil {
+		c.Close()
+		t.Error("TLS 1.2 client accepted with TLS_MIN_VERSION=1.3")
+	}
+	c, err := smtp.DialStartTLS(addr, &tls.Config{RootCAs: ca.pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("TLS 1.3 client: %v", err)
+	}
+	defer c.Close()
+	if state, _ := c.TLSConnectionState(); state.Version != tls.VersionTLS13 {
+		t.Errorf("negotiated %s, want TLS 1.3", tls.VersionName(state.Version))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testSpans forwards spans to the recorder of the running test. The global
+// tracer provider can only be installed once, tracer keeps delegating to it.
+var (
+	testSpans        atomic.Pointer[tracetest.SpanRecorder]
+	testSpansInstall sync.Once
+)
+
+type testSpanProcessor struct{}
+
+func (testSpanProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if r := testSpans.Load(); r != nil {
+		r.OnStart(ctx, s)
+	}
+}
+
+func (testSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if r := testSpans.Load(); r != nil {
+		r.OnEnd(s)
+	}
+}
+
+func (testSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (testSpanProcessor) ForceFlush(context.Context) error { return nil }
+
+// recordSpans records the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	testSpansInstall.Do(func() {
+		if _, err := setupTracing(context.Background()); err != nil {
+			t.Fatalf("setupTracing: %v", err)
+		}
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpanProcessor{})))
+	})
+	recorder := tracetest.NewSpanRecorder()
+	testSpans.Store(recorder)
+	t.Cleanup(func() { testSpans.Store(nil) })
+	return recorder
+}
+
+// endedSpan returns the ended span called name, failing the test if there
+// is none
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	var names []string
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	t.Fatalf("no %s span, got %v", name, names)
+	return nil
+}
+
+// spanAttribute returns the value of the attribute key of span
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingSpanTree(t *testing.T) {
+	recorder := recordSpans(t)
+	relay, _ := newTestSendGridRelay(t, nil)
+	be := newTestBackend(t, relay.config, relay)
+	s := newTestSession(be)
+
+	raw := "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\n" +
+		"From: app@example.com\nTo: a@example.org, b@example.org\nSubject: Traced\n\nHello\n"
+	if err := sendTestMessage(s, "app@example.com", []string{"a@example.org", "b@example.org"}, raw); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	data := endedSpan(t, recorder, "smtp.data")
+	parse := endedSpan(t, recorder, "smtp.parse")
+	send := endedSpan(t, recorder, "sendgrid.send")
+
+	// The message's traceparent is the parent of the whole tree
+	if got := data.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("smtp.data trace ID = %s, want the traceparent's", got)
+	}
+	if got := data.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !data.Parent().IsRemote() {
+		t.Errorf("smtp.data parent = %s, want the remote traceparent span", got)
+	}
+	if data.SpanKind() != trace.SpanKindServer || send.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span kinds = %v/%v, want server/client", data.SpanKind(), send.SpanKind())
+	}
+	for _, child := range []sdktrace.ReadOnlySpan{parse, send} {
+		if child.Parent().SpanID() != data.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of smtp.data", child.Name())
+		}
+	}
+
+	if got := spanAttribute(data, "smtp.recipients").AsInt64(); got != 2 {
+		t.Errorf("smtp.recipients = %d, want 2", got)
+	}
+	size := int64(len(raw) + strings.Count(raw, "\n")) // sent with CRLF
+	if got := spanAttribute(data, "smtp.message.size").AsInt64(); got != size {
+		t.Errorf("smtp.message.size = %d, want %d", got, size)
+	}
+	if got := spanAttribute(send, "sendgrid.status_code").AsInt64(); got != 202 {
+		t.Errorf("sendgrid.status_code = %d, want 202", got)
+	}
+}
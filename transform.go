@@ -0,0 +1,64 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// contentTransform rewrites a text or HTML content block before it is sent
+type contentTransform func(contentType, value string) string
+
+// contentTransforms returns the transforms enabled in config, in the order
+// they are applied
+func contentTransforms(config *Config) []contentTransform {
+	var transforms []contentTransform
+	if config.LinkRewriteBase != "" {
+		transforms = append(transforms, linkRewriter(config.LinkRewriteBase))
+	}
+	return transforms
+}
+
+// linkPlaceholder marks where the original URL goes in LINK_REWRITE_BASE
+const linkPlaceholder = "{url}"
+
+// hrefPattern matches the href of <a> and <area> tags, double- or
+// single-quoted
+var hrefPattern = regexp.MustCompile(`(?is)(<(?:a|area)\b[^>]*?\bhref\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// linkRewriter sends HTML links through base, a click-tracking redirect. The
+// escaped URL replaces {url} in base, or is appended to it. Only http(s)
+// links are rewritten, so mailto:, tel:, #anchors and template tags are
+// left alone, as are links already pointing at base.
+func linkRewriter(base string) contentTransform {
+	return func(contentType, value string) string {
+		if contentType != "text/html" {
+			return value
+		}
+		return hrefPattern.ReplaceAllStringFunc(value, func(match string) string {
+			m := hrefPattern.FindStringSubmatch(match)
+			quote, link := `"`, m[2]
+			if strings.HasSuffix(match, "'") {
+				quote, link = "'", m[3]
+			}
+
+			target := html.UnescapeString(strings.TrimSpace(link))
+			lower := strings.ToLower(target)
+			if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+				return match
+			}
+			if prefix, _, _ := strings.Cut(base, linkPlaceholder); prefix != "" && strings.HasPrefix(target, prefix) {
+				return match
+			}
+
+			var rewritten string
+			if strings.Contains(base, linkPlaceholder) {
+				rewritten = strings.ReplaceAll(base, linkPlaceholder, url.QueryEscape(target))
+			} else {
+				rewritten = base + url.QueryEscape(target)
+			}
+			return m[1] + quote + html.EscapeString(rewritten) + quote
+		})
+	}
+}
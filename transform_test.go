@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinkRewriter(t *testing.T) {
+	rewrite := linkRewriter("https://click.example.com/r?u={url}&src=relay")
+	tests := []struct {
+		name, html, want string
+	}{
+		{"double-quoted", `<a href="https://shop.example.com/item?id=1&amp;ref=mail">Buy</a>`,
+			`<a href="https://click.example.com/r?u=https%3A%2F%2Fshop.example.com%2Fitem%3Fid%3D1%26ref%3Dmail&amp;src=relay">Buy</a>`},
+		{"single-quoted with attributes", `<a class='btn' HREF = 'http://example.com/'>Go</a>`,
+			`<a class='btn' HREF = 'https://click.example.com/r?u=http%3A%2F%2Fexample.com%2F&amp;src=relay'>Go</a>`},
+		{"area", `<area shape="rect" href="https://example.com/map">`,
+			`<area shape="rect" href="https://click.example.com/r?u=https%3A%2F%2Fexample.com%2Fmap&amp;src=relay">`},
+		{"mailto", `<a href="mailto:help@example.com">Help</a>`, `<a href="mailto:help@example.com">Help</a>`},
+		{"tel", `<a href="tel:+525555555555">Call</a>`, `<a href="tel:+525555555555">Call</a>`},
+		{"anchor", `<a href="#top">Top</a>`, `<a href="#top">Top</a>`},
+		{"template tag", `<a href="{{unsubscribe}}">Unsubscribe</a>`, `<a href="{{unsubscribe}}">Unsubscribe</a>`},
+		{"already rewritten", `<a href="https://click.example.com/r?u=x">Go</a>`, `<a href="https://click.example.com/r?u=x">Go</a>`},
+		{"link element", `<link href="https://example.com/style.css">`, `<link href="https://example.com/style.css">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewrite("text/html", tt.html); got != tt.want {
+				t.Errorf("rewrite =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	text := "Visit https://example.com/"
+	if got := rewrite("text/plain", text); got != text {
+		t.Errorf("text content rewritten to %q", got)
+	}
+}
+
+func TestLinkRewriterAppendsURL(t *testing.T) {
+	got := linkRewriter("https://click.example.com/?to=")("text/html", `<a href="https://example.com/a b">x</a>`)
+	if want := `<a href="https://click.example.com/?to=https%3A%2F%2Fexample.com%2Fa+b">x</a>`; got != want {
+		t.Errorf("rewrite = %s, want %s", got, want)
+	}
+}
+
+func TestSendGridRewritesLinks(t *testing.T) {
+	raw := multipartMessage("Visit https://example.com/", `<p><a href="https://example.com/">Visit</a> or <a href="mailto:help@example.com">write</a></p>`)
+	body, err := sendGridPayload(t, map[string]string{"LINK_REWRITE_BASE": "https://click.example.com/r?u={url}"}, raw)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	html, _ := contentValue(body, "text/html")
+	if !strings.Contains(html, `href="https://click.example.com/r?u=https%3A%2F%2Fexample.com%2F"`) || !strings.Contains(html, `href="mailto:help@example.com"`) {
+		t.Errorf("html = %s", html)
+	}
+	if text, _ := contentValue(body, "text/plain"); !strings.Contains(text, "Visit https://example.com/") {
+		t.Errorf("text = %q, want it untouched", text)
+	}
+}
+
+func TestLinkRewriteBaseValidated(t *testing.T) {
+	if _, err := tryConfig(t, map[string]string{"LINK_REWRITE_BASE": "ftp://click.example.com/{url}"}); err == nil {
+		t.Error("non-http LINK_REWRITE_BASE accepted")
+	}
+	if len(contentTransforms(&Config{})) != 0 {
+		t.Error("transforms enabled without LINK_REWRITE_BASE")
+	}
+}
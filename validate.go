@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validateConfig loads the configuration and every file it references, as
+// startup would, without opening any listener. It returns all problems found.
+func validateConfig() []error {
+	config, err := loadConfig()
+	if err != nil {
+		return []error{err}
+	}
+	warnUnknownSettings()
+
+	var problems []error
+	check := func(prefix string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", prefix, err))
+		}
+	}
+
+	if config.Backend == "sendgrid" {
+		check("SENDGRID_API_KEY", validateSendGridAPIKey(config.SendGridAPIKey))
+		for _, route := range config.SendGridKeyRoutes {
+			check("SENDGRID_KEY_ROUTES "+route.domain, validateSendGridAPIKey(route.key))
+		}
+	}
+	if _, isUnix := strings.CutPrefix(config.ListenAddr, "unix:"); !isUnix {
+		_, _, err := net.SplitHostPort(config.ListenAddr)
+		check("SMTP_LISTEN_ADDR", err)
+	}
+	for _, addr := range []struct{ key, value string }{
+		{"HTTP_ADDR", config.HTTPAddr},
+		{"HTTP_INGEST_ADDR", config.HTTPIngestAddr},
+		{"SENDGRID_WEBHOOK_ADDR", config.SendGridWebhookAddr},
+	} {
+		if addr.value != "" {
+			_, _, err := net.SplitHostPort(addr.value)
+			check(addr.key, err)
+		}
+	}
+
+	_, err = loadDKIMOptions(config)
+	check("DKIM", err)
+	_, err = loadTLSConfig(config)
+	check("TLS", err)
+	_, err = parseSenderQuota(config.SenderDailyQuota)
+	check("SENDER_DAILY_QUOTA", err)
+	if config.SendGridWebhookAddr != "" {
+		_, err = parseWebhookKey(config.SendGridWebhookPublicKey)
+		check("SENDGRID_WEBHOOK_PUBLIC_KEY", err)
+	}
+
+	// The directory is created at startup, so only its parent must exist
+	if config.DeadLetterDir != "" {
+		dir := config.DeadLetterDir
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			dir = filepath.Dir(dir)
+		}
+		if info, err := os.Stat(dir); err != nil {
+			check("DEAD_LETTER_DIR", err)
+		} else if !info.IsDir() {
+			check("DEAD_LETTER_DIR", fmt.Errorf("%s is not a directory", dir))
+		}
+	}
+
+	return problems
+}
+
+// validateSendGridAPIKey checks the "SG.<id>.<secret>" format of SendGrid
+// API keys. It does not call the API.
+func validateSendGridAPIKey(key string) error {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || parts[0] != "SG" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("not a SendGrid API key (expected SG.<id>.<secret>)")
+	}
+	return nil
+}
+
+// runValidate reports the result of validateConfig to w and returns the
+// process exit code
+func runValidate(w io.Writer) int {
+	problems := validateConfig()
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "Configuration OK")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(w, "Configuration error: %v\n", problem)
+	}
+	return 1
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validateWith runs runValidate with env set
+func validateWith(t *testing.T, env map[string]string) (int, string) {
+	t.Helper()
+	fileSettings = nil
+	t.Cleanup(func() { fileSettings = nil })
+	t.Setenv("SENDGRID_API_KEY", "SG.abc123.def456")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	var out bytes.Buffer
+	code := runValidate(&out)
+	return code, out.String()
+}
+
+func TestValidateGoodConfig(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writeCertFiles(t, ca.issue(t, "localhost"))
+	code, out := validateWith(t, map[string]string{
+		"SMTP_LISTEN_ADDR": "127.0.0.1:2525",
+		"TLS_CERT_FILE":    certFile,
+		"TLS_KEY_FILE":     keyFile,
+		"DEAD_LETTER_DIR":  filepath.Join(t.TempDir(), "dead"),
+	})
+	if code != 0 || out != "Configuration OK\n" {
+		t.Errorf("validate = %d %q, want 0 and OK", code, out)
+	}
+}
+
+func TestValidateBadConfigs(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"API key format", map[string]string{"SENDGRID_API_KEY": "not-a-key"}, "SENDGRID_API_KEY: not a SendGrid API key"},
+		{"listen address", map[string]string{"SMTP_LISTEN_ADDR": "2525"}, "SMTP_LISTEN_ADDR:"},
+		{"ingest address", map[string]string{"HTTP_INGEST_ADDR": "localhost", "HTTP_INGEST_TOKEN": "x"}, "HTTP_INGEST_ADDR:"},
+		{"certificate", map[string]string{"TLS_CERT_FILE": "/nonexistent/cert.pem", "TLS_KEY_FILE": "/nonexistent/key.pem"}, "TLS: failed to load TLS certificate"},
+		{"DKIM", map[string]string{"DKIM_PRIVATE_KEY_FILE": "/nonexistent/dkim.pem", "DKIM_DOMAIN": "example.com"}, "DKIM:"},
+		{"dead letter dir", map[string]string{"DEAD_LETTER_DIR": "/nonexistent/parent/dead"}, "DEAD_LETTER_DIR:"},
+		{"load error", map[string]string{"MAX_MESSAGE_BYTES": "lots"}, "invalid MAX_MESSAGE_BYTES"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out := validateWith(t, tt.env)
+			if code != 1 || !strings.Contains(out, "Configuration error: "+tt.want) {
+				t.Errorf("validate = %d %q, want 1 and %q", code, out, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	code, out := validateWith(t, map[string]string{"SENDGRID_API_KEY": "bad", "SMTP_LISTEN_ADDR": "2525"})
+	if code != 1 || strings.Count(out, "Configuration error:") != 2 {
+		t.Errorf("validate = %d %q, want both problems", code, out)
+	}
+}
+
+func TestValidateSendGridAPIKey(t *testing.T) {
+	for key, ok := range map[string]bool{
+		"SG.abc.def": true,
+		"SG.abc":     false,
+		"XX.abc.def": false,
+		"SG..def":    false,
+		"":           false,
+	} {
+		if err := validateSendGridAPIKey(key); (err == nil) != ok {
+			t.Errorf("validateSendGridAPIKey(%q) = %v", key, err)
+		}
+	}
+}
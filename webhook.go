@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SendGrid signs event webhooks with ECDSA over the timestamp header
+// followed by the raw body
+const (
+	webhookSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	webhookTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// maxWebhookBody bounds one batch of events. SendGrid posts batches well
+// under this.
+const maxWebhookBody = 10 << 20
+
+// parseWebhookKey parses SENDGRID_WEBHOOK_PUBLIC_KEY, the base64 public key
+// shown in SendGrid's Signed Event Webhook settings
+func parseWebhookKey(value string) (*ecdsa.PublicKey, error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(value, "-----BEGIN PUBLIC KEY-----")
+	value = strings.TrimSuffix(value, "-----END PUBLIC KEY-----")
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENDGRID_WEBHOOK_PUBLIC_KEY: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENDGRID_WEBHOOK_PUBLIC_KEY: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid SENDGRID_WEBHOOK_PUBLIC_KEY: not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// webhookEvent is the part of a SendGrid event the relay uses
+type webhookEvent struct {
+	Email     string `json:"email"`
+	Event     string `json:"event"`
+	Type      string `json:"type"` // bounce or blocked, for bounce events
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// suppresses reports whether the event should stop mail to its address.
+// Blocked bounces are usually temporary (e.g. reputation), so only hard
+// bounces count.
+func (e *webhookEvent) suppresses() bool {
+	switch e.Event {
+	case "bounce":
+		return e.Type != "blocked"
+	case "spamreport", "dropped":
+		return true
+	}
+	return false
+}
+
+// newWebhookServer returns the server for the SendGrid event webhook
+func newWebhookServer(addr string, key *ecdsa.PublicKey, list *suppressionList) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/webhooks/sendgrid", webhookHandler(key, list))
+
+	return newHTTPServer(addr, mux)
+}
+
+// webhookHandler accepts SendGrid event webhooks and adds bounced, dropped
+// and complaining recipients to the suppression list. Replayed batches are
+// harmless, since adding an address twice keeps the first entry.
+func webhookHandler(key *ecdsa.PublicKey, list *suppressionList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		if !verifyWebhook(key, r.Header.Get(webhookTimestampHeader), r.Header.Get(webhookSignatureHeader), body) {
+			logWarn("Rejected SendGrid webhook from %s: invalid signature", r.RemoteAddr)
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var events []webhookEvent
+		if err := json.Unmarshal(body, &events); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		entries := make(map[string]suppression)
+		for _, event := range events {
+			if !event.suppresses() || event.Email == "" {
+				continue
+			}
+			createdAt := time.Now().UTC()
+			if event.Timestamp > 0 {
+				createdAt = time.Unix(event.Timestamp, 0).UTC()
+			}
+			entries[event.Email] = suppression{Event: event.Event, Reason: event.Reason, CreatedAt: createdAt}
+		}
+		logDebug("SendGrid webhook: %d events, %d suppressions", len(events), len(entries))
+
+		// A 5xx makes SendGrid retry the batch later
+		if err := list.Add(entries); err != nil {
+			logError("Failed to store suppressions: %v", err)
+			http.Error(w, "failed to store suppressions", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// verifyWebhook checks the ECDSA signature SendGrid puts on each request
+func verifyWebhook(key *ecdsa.PublicKey, timestamp, signature string, body []byte) bool {
+	if timestamp == "" || signature == "" {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	return ecdsa.VerifyASN1(key, digest[:], sig)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// webhookSigner signs event webhooks as SendGrid does
+type webhookSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func newWebhookSigner(t *testing.T) *webhookSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &webhookSigner{key: key}
+}
+
+// PublicKey returns the key in the form SendGrid shows it
+func (s *webhookSigner) PublicKey(t *testing.T) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// post sends body to handler signed over timestamp and returns the status
+func (s *webhookSigner) post(t *testing.T, handler http.Handler, timestamp, body string) int {
+	t.Helper()
+	digest := sha256.Sum256([]byte(timestamp + body))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/sendgrid", strings.NewReader(body))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+const webhookTestEvents = `[
+	{"email": "Bounced@Example.org", "event": "bounce", "type": "bounce", "reason": "550 no such user", "timestamp": 1700000000},
+	{"email": "blocked@example.org", "event": "bounce", "type": "blocked", "reason": "IP blocklisted"},
+	{"email": "complainer@example.org", "event": "spamreport"},
+	{"email": "dropped@example.org", "event": "dropped", "reason": "Invalid"},
+	{"email": "reader@example.org", "event": "open"}
+]`
+
+func TestWebhookSuppressesRecipients(t *testing.T) {
+	signer := newWebhookSigner(t)
+	key, err := parseWebhookKey(signer.PublicKey(t))
+	if err != nil {
+		t.Fatalf("parseWebhookKey: %v", err)
+	}
+	list, _ := newSuppressionList("")
+	if code := signer.post(t, webhookHandler(key, list), "1700000001", webhookTestEvents); code != http.StatusNoContent {
+		t.Fatalf("webhook status = %d, want 204", code)
+	}
+	if list.Len() != 3 {
+		t.Errorf("suppressed %d addresses, want 3", list.Len())
+	}
+	entry, ok := list.Lookup("<bounced@example.org>")
+	if !ok || entry.Event != "bounce" || entry.Reason != "550 no such user" || entry.CreatedAt.Unix() != 1700000000 {
+		t.Errorf("bounced entry = %+v, %v", entry, ok)
+	}
+	for _, addr := range []string{"blocked@example.org", "reader@example.org"} {
+		if _, ok := list.Lookup(addr); ok {
+			t.Errorf("%s suppressed", addr)
+		}
+	}
+
+	// The recipients are then refused at RCPT
+	be := newTestBackend(t, testConfig(t, nil), &fakeRelay{})
+	be.suppressions = list
+	s := newTestSession(be)
+	if err := s.Mail("app@example.com", &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = s.Rcpt("complainer@example.org", &smtp.RcptOptions{})
+	if smtpCode(err) != 550 || !strings.Contains(err.Error(), "(spamreport)") {
+		t.Errorf("Rcpt suppressed = %v, want a 550 naming the event", err)
+	}
+	if err := s.Rcpt("blocked@example.org", &smtp.RcptOptions{}); err != nil {
+		t.Errorf("Rcpt not suppressed = %v", err)
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	signer := newWebhookSigner(t)
+	key, _ := parseWebhookKey(signer.PublicKey(t))
+	list, _ := newSuppressionList("")
+	handler := webhookHandler(key, list)
+
+	// Signed by another key
+	if code := newWebhookSigner(t).post(t, handler, "1700000001", webhookTestEvents); code != http.StatusUnauthorized {
+		t.Errorf("foreign signature status = %d, want 401", code)
+	}
+
+	// Signed over a different timestamp than the header says
+	digest := sha256.Sum256([]byte("1700000001" + webhookTestEvents))
+	sig, _ := ecdsa.SignASN1(rand.Reader, signer.key, digest[:])
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/sendgrid", strings.NewReader(webhookTestEvents))
+	req.Header.Set(webhookTimestampHeader, "1700000002")
+	req.Header.Set(webhookSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("replayed timestamp status = %d, want 401", rec.Code)
+	}
+
+	// Unsigned
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhooks/sendgrid", strings.NewReader(webhookTestEvents)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned status = %d, want 401", rec.Code)
+	}
+
+	if list.Len() != 0 {
+		t.Errorf("rejected requests suppressed %d addresses", list.Len())
+	}
+}
+
+func TestWebhookRequestErrors(t *testing.T) {
+	signer := newWebhookSigner(t)
+	key, _ := parseWebhookKey(signer.PublicKey(t))
+	list, _ := newSuppressionList("")
+	handler := webhookHandler(key, list)
+
+	if code := signer.post(t, handler, "1700000001", `{"not": "an array"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid JSON status = %d, want 400", code)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/webhooks/sendgrid", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", rec.Code)
+	}
+}
+
+func TestWebhookRetriesFailedSave(t *testing.T) {
+	signer := newWebhookSigner(t)
+	key, _ := parseWebhookKey(signer.PublicKey(t))
+	dir := filepath.Join(t.TempDir(), "gone")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	list, err := newSuppressionList(filepath.Join(dir, "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := webhookHandler(key, list)
+	os.Remove(dir)
+
+	// SendGrid retries a batch answered with a 5xx, which must then still
+	// be stored
+	if code := signer.post(t, handler, "1700000001", webhookTestEvents); code != http.StatusInternalServerError {
+		t.Fatalf("unsaved batch status = %d, want 500", code)
+	}
+	if list.Len() != 0 {
+		t.Fatalf("unsaved batch suppressed %d addresses", list.Len())
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if code := signer.post(t, handler, "1700000001", webhookTestEvents); code != http.StatusNoContent {
+		t.Fatalf("retried batch status = %d, want 204", code)
+	}
+	if list.Len() == 0 {
+		t.Error("retried batch suppressed nothing")
+	}
+}
+
+func TestWebhookServerTimeouts(t *testing.T) {
+	list, _ := newSuppressionList("")
+	srv := newWebhookServer("127.0.0.1:0", nil, list)
+	if srv.ReadHeaderTimeout <= 0 || srv.ReadTimeout <= 0 || srv.WriteTimeout <= 0 {
+		t.Errorf("webhook server timeouts: header %v, read %v, write %v, want all set",
+			srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout)
+	}
+}
+
+func TestParseWebhookKey(t *testing.T) {
+	signer := newWebhookSigner(t)
+	pem := "-----BEGIN PUBLIC KEY-----\n" + signer.PublicKey(t) + "\n-----END PUBLIC KEY-----\n"
+	if _, err := parseWebhookKey(pem); err != nil {
+		t.Errorf("PEM key: %v", err)
+	}
+	for _, value := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("not a key"))} {
+		if _, err := parseWebhookKey(value); err == nil {
+			t.Errorf("parseWebhookKey(%q) succeeded", value)
+		}
+	}
+}